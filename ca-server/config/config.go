@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 )
 
 // Config holds application configuration
@@ -16,14 +17,94 @@ type Config struct {
 	TLSEnabled  bool
 	TLSCertPath string
 	TLSKeyPath  string
+	// Serving certificate source: file (reloaded on change) or ca (issued from the managed CA)
+	TLSCertSource    string
+	TLSCertNames     []string
+	TLSCertValidDays int
+	TLSReloadSeconds int
 	// mTLS configuration
 	MTLSEnabled      bool
 	ClientCACertPath string
+	// Client certificate roles, rules written as role=field:pattern, granted only to certificates
+	// chaining to the CA at MTLSRoleRulesCACertPath
+	MTLSRoleRules           []string
+	MTLSRoleRulesCACertPath string
+	// AuthRequired enforces roles and role bindings on the certificate, profile and user endpoints,
+	// always on unless InsecureSkipAuth is set
+	AuthRequired bool
+	// InsecureSkipAuth lets anyone reaching the server issue, revoke and create CAs, for local development only
+	InsecureSkipAuth bool
+	// Issuing CA
+	CACertPath  string
+	CAKeyPath   string
+	CADir       string
+	CABootstrap bool
+	// Key encryption passphrase (KEK) for the CA keys, taken from the first source set
+	CAKEK       string
+	CAKEKFile   string
+	CAKEKPrompt bool
+	// Backend holding the CA keys: file, pkcs11 or remote
+	CAKeyBackend     string
+	PKCS11Module     string
+	PKCS11TokenLabel string
+	PKCS11PIN        string
+	KMSURL           string
+	KMSToken         string
+	// AdminToken guards the admin API, which is disabled when it is empty
+	AdminToken string
+	// Store backend: memory (lost on restart), sqlite or bolt, the latter two also hold the audit log
+	StoreBackend string
+	SQLitePath   string
+	BoltPath     string
+	// AuditLogPath is the hash-chained audit log of the memory backend, JSON lines appended to forever
+	AuditLogPath string
+	// Bearer JWTs, verified with an HMAC secret and/or JWKS keys, the JWKS file wins over the URL
+	JWTHMACSecret    string
+	JWTJWKSURL       string
+	JWTJWKSFile      string
+	JWTIssuer        string
+	JWTAudience      string
+	JWTLeewaySeconds int
+	// Email verification of pending users, the tokens are signed with the secret, a random one per process when empty
+	UserVerificationSecret string
+	UserVerificationHours  int
+	// Issuance policy
+	MaxCertValidDays int
+	// Key specs in short form, e.g. rsa-3072, ecdsa-P384 or ed25519
+	KeyAllowedSpecs []string
+	KeyDefaultSpec  string
+	// CSR signing policy
+	CSRAllowedDomains      []string
+	CSRAllowIPAddresses    bool
+	CSRAllowedExtKeyUsages []string
+	CSRMinRSABits          int
+	// Revocation
+	PublicURL        string
+	CRLValidityHours int
+	// OCSP responder, the signer is optional and defaults to the CA key
+	OCSPNextUpdateMinutes int
+	OCSPSignerCertPath    string
+	OCSPSignerKeyPath     string
+	// ACME server, off by default and limited to the domains of ACMEAllowedDomains
+	ACMEEnabled        bool
+	ACMEAllowedDomains []string
+	ACMECertValidDays  int
+	ACMEHTTP01Port     int
+	ACMEDNSResolver    string
+	// Expiry notifications, sent once per threshold crossed, always logged
+	ExpiryThresholdDays []int
+	ExpiryCheckMinutes  int
+	ExpiryWebhookURL    string
+	ExpirySMTPAddr      string
+	ExpirySMTPFrom      string
+	ExpirySMTPTo        []string
+	ExpirySMTPUsername  string
+	ExpirySMTPPassword  string
 }
 
 // New creates a new Config with values from environment
 func New() *Config {
-	return &Config{
+	cfg := &Config{
 		ServerPort:     getEnvAsInt("SERVER_PORT", 8080),
 		TLSServerPort:  getEnvAsInt("TLS_SERVER_PORT", 8080),
 		MTLSServerPort: getEnvAsInt("MTLS_SERVER_PORT", 8443),
@@ -33,10 +114,82 @@ func New() *Config {
 		TLSEnabled:  getEnvAsBool("TLS_ENABLED", false),
 		TLSCertPath: getEnv("TLS_CERT_PATH", "server/certs/cert.pem"),
 		TLSKeyPath:  getEnv("TLS_KEY_PATH", "server/certs/key.pem"),
+		// Serving certificate rotation
+		TLSCertSource:    getEnv("TLS_CERT_SOURCE", "file"),
+		TLSCertNames:     getEnvAsSlice("TLS_CERT_NAMES", []string{"localhost", "127.0.0.1"}),
+		TLSCertValidDays: getEnvAsInt("TLS_CERT_VALID_DAYS", 30),
+		TLSReloadSeconds: getEnvAsInt("TLS_RELOAD_SECONDS", 60),
 		// mTLS configuration
-		MTLSEnabled:      getEnvAsBool("MTLS_ENABLED", false),
-		ClientCACertPath: getEnv("CLIENT_CA_CERT_PATH", "cert.pem"),
+		MTLSEnabled:             getEnvAsBool("MTLS_ENABLED", false),
+		ClientCACertPath:        getEnv("CLIENT_CA_CERT_PATH", "cert.pem"),
+		MTLSRoleRules:           getEnvAsSlice("MTLS_ROLE_RULES", nil),
+		MTLSRoleRulesCACertPath: getEnv("MTLS_ROLE_RULES_CA_CERT_PATH", ""),
+		InsecureSkipAuth:        getEnvAsBool("INSECURE_SKIP_AUTH", false),
+		// Issuing CA
+		CACertPath:  getEnv("CA_CERT_PATH", "caCert.pem"),
+		CAKeyPath:   getEnv("CA_KEY_PATH", "caKey.pem"),
+		CADir:       getEnv("CA_DIR", "cas"),
+		CABootstrap: getEnvAsBool("CA_BOOTSTRAP", false),
+		CAKEK:       getEnv("CA_KEK", ""),
+		CAKEKFile:   getEnv("CA_KEK_FILE", ""),
+		CAKEKPrompt: getEnvAsBool("CA_KEK_PROMPT", false),
+		AdminToken:  getEnv("ADMIN_TOKEN", ""),
+
+		StoreBackend: getEnv("STORE_BACKEND", "memory"),
+		SQLitePath:   getEnv("SQLITE_PATH", "ca-server.db"),
+		BoltPath:     getEnv("BOLT_PATH", "ca-server.bolt"),
+		AuditLogPath: getEnv("AUDIT_LOG_PATH", "audit.log"),
+
+		JWTHMACSecret:    getEnv("JWT_HMAC_SECRET", ""),
+		JWTJWKSURL:       getEnv("JWT_JWKS_URL", ""),
+		JWTJWKSFile:      getEnv("JWT_JWKS_FILE", ""),
+		JWTIssuer:        getEnv("JWT_ISSUER", ""),
+		JWTAudience:      getEnv("JWT_AUDIENCE", ""),
+		JWTLeewaySeconds: getEnvAsInt("JWT_LEEWAY_SECONDS", 60),
+		// Email verification
+		UserVerificationSecret: getEnv("USER_VERIFICATION_SECRET", ""),
+		UserVerificationHours:  getEnvAsInt("USER_VERIFICATION_HOURS", 72),
+		// CA key backend
+		CAKeyBackend:     getEnv("CA_KEY_BACKEND", "file"),
+		PKCS11Module:     getEnv("PKCS11_MODULE", ""),
+		PKCS11TokenLabel: getEnv("PKCS11_TOKEN_LABEL", ""),
+		PKCS11PIN:        getEnv("PKCS11_PIN", ""),
+		KMSURL:           getEnv("KMS_URL", ""),
+		KMSToken:         getEnv("KMS_TOKEN", ""),
+		// Issuance policy
+		MaxCertValidDays: getEnvAsInt("MAX_CERT_VALID_DAYS", 825),
+		KeyAllowedSpecs:  getEnvAsSlice("KEY_ALLOWED_SPECS", []string{"rsa-2048", "rsa-3072", "rsa-4096", "ecdsa-P256", "ecdsa-P384", "ecdsa-P521", "ed25519"}),
+		KeyDefaultSpec:   getEnv("KEY_DEFAULT_SPEC", "ecdsa-P256"),
+		// CSR signing policy
+		CSRAllowedDomains:      getEnvAsSlice("CSR_ALLOWED_DOMAINS", nil),
+		CSRAllowIPAddresses:    getEnvAsBool("CSR_ALLOW_IP_ADDRESSES", true),
+		CSRAllowedExtKeyUsages: getEnvAsSlice("CSR_ALLOWED_EXT_KEY_USAGES", []string{"serverAuth", "clientAuth"}),
+		CSRMinRSABits:          getEnvAsInt("CSR_MIN_RSA_BITS", 2048),
+		// Revocation
+		PublicURL:        getEnv("PUBLIC_URL", "http://localhost:8080"),
+		CRLValidityHours: getEnvAsInt("CRL_VALIDITY_HOURS", 24),
+		// OCSP responder
+		OCSPNextUpdateMinutes: getEnvAsInt("OCSP_NEXT_UPDATE_MINUTES", 60),
+		OCSPSignerCertPath:    getEnv("OCSP_SIGNER_CERT_PATH", ""),
+		OCSPSignerKeyPath:     getEnv("OCSP_SIGNER_KEY_PATH", ""),
+		// ACME server
+		ACMEEnabled:        getEnvAsBool("ACME_ENABLED", false),
+		ACMEAllowedDomains: getEnvAsSlice("ACME_ALLOWED_DOMAINS", nil),
+		ACMECertValidDays:  getEnvAsInt("ACME_CERT_VALID_DAYS", 90),
+		ACMEHTTP01Port:     getEnvAsInt("ACME_HTTP01_PORT", 80),
+		ACMEDNSResolver:    getEnv("ACME_DNS_RESOLVER", ""),
+		// Expiry notifications
+		ExpiryThresholdDays: getEnvAsIntSlice("EXPIRY_THRESHOLD_DAYS", []int{30, 7, 1}),
+		ExpiryCheckMinutes:  getEnvAsInt("EXPIRY_CHECK_MINUTES", 60),
+		ExpiryWebhookURL:    getEnv("EXPIRY_WEBHOOK_URL", ""),
+		ExpirySMTPAddr:      getEnv("EXPIRY_SMTP_ADDR", ""),
+		ExpirySMTPFrom:      getEnv("EXPIRY_SMTP_FROM", "ca-server@localhost"),
+		ExpirySMTPTo:        getEnvAsSlice("EXPIRY_SMTP_TO", nil),
+		ExpirySMTPUsername:  getEnv("EXPIRY_SMTP_USERNAME", ""),
+		ExpirySMTPPassword:  getEnv("EXPIRY_SMTP_PASSWORD", ""),
 	}
+	cfg.AuthRequired = !cfg.InsecureSkipAuth
+	return cfg
 }
 
 // Helper to get env with fallback
@@ -66,3 +219,34 @@ func getEnvAsBool(key string, fallback bool) bool {
 	}
 	return fallback
 }
+
+// Helper to get env as comma separated list with fallback
+func getEnvAsSlice(key string, fallback []string) []string {
+	if value, exists := os.LookupEnv(key); exists {
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items
+	}
+	return fallback
+}
+
+// Helper to get env as comma separated list of integers with fallback
+func getEnvAsIntSlice(key string, fallback []int) []int {
+	items := getEnvAsSlice(key, nil)
+	if items == nil {
+		return fallback
+	}
+	values := make([]int, 0, len(items))
+	for _, item := range items {
+		intVal, err := strconv.Atoi(item)
+		if err != nil {
+			return fallback
+		}
+		values = append(values, intVal)
+	}
+	return values
+}
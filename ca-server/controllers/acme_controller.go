@@ -0,0 +1,504 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"ca-server/middleware"
+	"ca-server/models"
+	"ca-server/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxACMERequestSize bounds JWS bodies, finalize requests carrying a CSR are the largest
+const maxACMERequestSize = 64 * 1024
+
+// acmeAlgorithms are the JWS algorithms accepted on ACME requests
+var acmeAlgorithms = []string{"RS256", "ES256", "ES384", "ES512", "EdDSA"}
+
+// ACMEController serves the RFC 8555 ACME protocol under /acme
+type ACMEController struct {
+	acme      *services.ACMEService
+	publicURL string
+	baseURL   string
+}
+
+// NewACMEController creates a new ACME controller, publicURL is the URL clients reach the server on
+func NewACMEController(acme *services.ACMEService, publicURL string) *ACMEController {
+	publicURL = strings.TrimSuffix(publicURL, "/")
+	return &ACMEController{
+		acme:      acme,
+		publicURL: publicURL,
+		baseURL:   publicURL + "/acme",
+	}
+}
+
+// acmeRequest is an authenticated ACME request
+type acmeRequest struct {
+	header  *services.JWSHeader
+	payload []byte
+	account *models.ACMEAccount
+}
+
+// postAsGet reports whether the request carries an empty payload (RFC 8555 section 6.3)
+func (r *acmeRequest) postAsGet() bool {
+	return len(r.payload) == 0
+}
+
+// Directory lists the ACME endpoints
+func (c *ACMEController) Directory(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"newNonce":   c.baseURL + "/new-nonce",
+		"newAccount": c.baseURL + "/new-account",
+		"newOrder":   c.baseURL + "/new-order",
+		"meta": gin.H{
+			"externalAccountRequired": false,
+		},
+	})
+}
+
+// NewNonce hands out a fresh anti-replay nonce
+func (c *ACMEController) NewNonce(ctx *gin.Context) {
+	c.setHeaders(ctx)
+	ctx.Header("Cache-Control", "no-store")
+	if ctx.Request.Method == http.MethodHead {
+		ctx.Status(http.StatusOK)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// NewAccount registers an account key or looks up the existing account
+func (c *ACMEController) NewAccount(ctx *gin.Context) {
+	c.setHeaders(ctx)
+	req, ok := c.authenticate(ctx, true)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		Contact              []string `json:"contact"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
+	}
+	if !c.decodePayload(ctx, req, &payload) {
+		return
+	}
+
+	account, created, err := c.acme.NewAccount(req.header.JWK, payload.Contact, payload.TermsOfServiceAgreed, payload.OnlyReturnExisting)
+	if err != nil {
+		c.problem(ctx, err)
+		return
+	}
+
+	ctx.Header("Location", c.accountURL(account.ID))
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	ctx.JSON(status, c.accountJSON(account))
+}
+
+// Account returns, updates or deactivates the requesting account
+func (c *ACMEController) Account(ctx *gin.Context) {
+	c.setHeaders(ctx)
+	req, ok := c.authenticate(ctx, false)
+	if !ok {
+		return
+	}
+	if req.account.ID != ctx.Param("id") {
+		c.problem(ctx, services.NewACMEError("unauthorized", http.StatusUnauthorized, "account URL does not match the request key"))
+		return
+	}
+
+	account := req.account
+	if !req.postAsGet() {
+		var payload struct {
+			Contact []string `json:"contact"`
+			Status  string   `json:"status"`
+		}
+		if !c.decodePayload(ctx, req, &payload) {
+			return
+		}
+
+		var err error
+		account, err = c.acme.UpdateAccount(account, payload.Contact, payload.Status)
+		if err != nil {
+			c.problem(ctx, err)
+			return
+		}
+	}
+
+	ctx.Header("Location", c.accountURL(account.ID))
+	ctx.JSON(http.StatusOK, c.accountJSON(account))
+}
+
+// AccountOrders lists the order URLs of the requesting account
+func (c *ACMEController) AccountOrders(ctx *gin.Context) {
+	c.setHeaders(ctx)
+	req, ok := c.authenticate(ctx, false)
+	if !ok {
+		return
+	}
+	if req.account.ID != ctx.Param("id") {
+		c.problem(ctx, services.NewACMEError("unauthorized", http.StatusUnauthorized, "account URL does not match the request key"))
+		return
+	}
+
+	orders, err := c.acme.Orders(req.account)
+	if err != nil {
+		c.problem(ctx, err)
+		return
+	}
+
+	urls := make([]string, 0, len(orders))
+	for _, order := range orders {
+		urls = append(urls, c.orderURL(order.ID))
+	}
+	ctx.JSON(http.StatusOK, gin.H{"orders": urls})
+}
+
+// NewOrder creates an order for a set of identifiers
+func (c *ACMEController) NewOrder(ctx *gin.Context) {
+	c.setHeaders(ctx)
+	req, ok := c.authenticate(ctx, false)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		Identifiers []models.ACMEIdentifier `json:"identifiers"`
+		NotBefore   string                  `json:"notBefore"`
+		NotAfter    string                  `json:"notAfter"`
+	}
+	if !c.decodePayload(ctx, req, &payload) {
+		return
+	}
+
+	notBefore, errBefore := parseOptionalTime(payload.NotBefore)
+	notAfter, errAfter := parseOptionalTime(payload.NotAfter)
+	if errBefore != nil || errAfter != nil {
+		c.problem(ctx, services.NewACMEError("malformed", http.StatusBadRequest, "notBefore and notAfter must be RFC 3339 timestamps"))
+		return
+	}
+
+	order, err := c.acme.NewOrder(req.account, payload.Identifiers, notBefore, notAfter)
+	if err != nil {
+		c.problem(ctx, err)
+		return
+	}
+
+	ctx.Header("Location", c.orderURL(order.ID))
+	ctx.JSON(http.StatusCreated, c.orderJSON(order))
+}
+
+// Order returns the current state of an order
+func (c *ACMEController) Order(ctx *gin.Context) {
+	c.setHeaders(ctx)
+	req, ok := c.authenticate(ctx, false)
+	if !ok {
+		return
+	}
+
+	order, err := c.acme.Order(req.account, ctx.Param("id"))
+	if err != nil {
+		c.problem(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, c.orderJSON(order))
+}
+
+// Finalize submits the CSR of a ready order and issues the certificate
+func (c *ACMEController) Finalize(ctx *gin.Context) {
+	c.setHeaders(ctx)
+	req, ok := c.authenticate(ctx, false)
+	if !ok {
+		return
+	}
+	middleware.AddAuditDetail(ctx, "account", req.account.ID)
+
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if !c.decodePayload(ctx, req, &payload) {
+		return
+	}
+	csrDER, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		c.problem(ctx, services.NewACMEError("badCSR", http.StatusBadRequest, "csr must be base64url encoded DER"))
+		return
+	}
+
+	order, err := c.acme.Finalize(ctx.Request.Context(), req.account, ctx.Param("id"), csrDER)
+	if err != nil {
+		c.problem(ctx, err)
+		return
+	}
+	middleware.AddAuditDetail(ctx, "identifiers", order.Identifiers)
+	middleware.AddAuditDetail(ctx, "serialNumber", order.CertSerial)
+
+	ctx.Header("Location", c.orderURL(order.ID))
+	ctx.JSON(http.StatusOK, c.orderJSON(order))
+}
+
+// Authorization returns an authorization, or deactivates it
+func (c *ACMEController) Authorization(ctx *gin.Context) {
+	c.setHeaders(ctx)
+	req, ok := c.authenticate(ctx, false)
+	if !ok {
+		return
+	}
+
+	if !req.postAsGet() {
+		var payload struct {
+			Status string `json:"status"`
+		}
+		if !c.decodePayload(ctx, req, &payload) {
+			return
+		}
+		if payload.Status != models.ACMEStatusDeactivated {
+			c.problem(ctx, services.NewACMEError("malformed", http.StatusBadRequest, "authorization status can only be set to deactivated"))
+			return
+		}
+		if err := c.acme.DeactivateAuthorization(req.account, ctx.Param("id")); err != nil {
+			c.problem(ctx, err)
+			return
+		}
+	}
+
+	authz, challenges, err := c.acme.Authorization(req.account, ctx.Param("id"))
+	if err != nil {
+		c.problem(ctx, err)
+		return
+	}
+
+	challengesJSON := make([]gin.H, 0, len(challenges))
+	for _, challenge := range challenges {
+		challengesJSON = append(challengesJSON, c.challengeJSON(challenge))
+	}
+	resp := gin.H{
+		"status":     authz.Status,
+		"expires":    authz.Expires.Format(time.RFC3339),
+		"identifier": authz.Identifier,
+		"challenges": challengesJSON,
+	}
+	if authz.Wildcard {
+		resp["wildcard"] = true
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// Challenge returns a challenge, a non-empty payload tells the server to validate it
+func (c *ACMEController) Challenge(ctx *gin.Context) {
+	c.setHeaders(ctx)
+	req, ok := c.authenticate(ctx, false)
+	if !ok {
+		return
+	}
+
+	var challenge *models.ACMEChallenge
+	var authz *models.ACMEAuthorization
+	var err error
+	if req.postAsGet() {
+		challenge, authz, err = c.acme.Challenge(req.account, ctx.Param("id"))
+	} else {
+		challenge, authz, err = c.acme.RespondChallenge(req.account, ctx.Param("id"))
+	}
+	if err != nil {
+		c.problem(ctx, err)
+		return
+	}
+
+	ctx.Header("Link", "<"+c.baseURL+"/authz/"+authz.ID+`>;rel="up"`)
+	ctx.JSON(http.StatusOK, c.challengeJSON(challenge))
+}
+
+// Certificate downloads the issued certificate chain of an order
+func (c *ACMEController) Certificate(ctx *gin.Context) {
+	c.setHeaders(ctx)
+	req, ok := c.authenticate(ctx, false)
+	if !ok {
+		return
+	}
+
+	order, err := c.acme.Order(req.account, ctx.Param("id"))
+	if err != nil {
+		c.problem(ctx, err)
+		return
+	}
+	if order.Status != models.ACMEStatusValid {
+		c.problem(ctx, services.NewACMEError("malformed", http.StatusNotFound, "no certificate has been issued for this order"))
+		return
+	}
+
+	ctx.Data(http.StatusOK, "application/pem-certificate-chain", order.CertChainPEM)
+}
+
+// authenticate verifies the JWS of a request: its nonce, URL and signature.
+// newAccount requests are signed with an embedded jwk, all others reference an account by kid.
+func (c *ACMEController) authenticate(ctx *gin.Context, withJWK bool) (*acmeRequest, bool) {
+	body, err := io.ReadAll(io.LimitReader(ctx.Request.Body, maxACMERequestSize))
+	if err != nil {
+		c.problem(ctx, services.NewACMEError("malformed", http.StatusBadRequest, "failed to read request"))
+		return nil, false
+	}
+
+	jws, header, payload, err := services.ParseJWS(body)
+	if err != nil {
+		c.problem(ctx, services.NewACMEError("malformed", http.StatusBadRequest, "%v", err))
+		return nil, false
+	}
+	if !c.acme.Nonces().Consume(header.Nonce) {
+		c.problem(ctx, services.NewACMEError("badNonce", http.StatusBadRequest, "invalid or reused nonce"))
+		return nil, false
+	}
+	if header.URL != c.publicURL+ctx.Request.URL.Path {
+		c.problem(ctx, services.NewACMEError("unauthorized", http.StatusUnauthorized, "JWS url does not match the request URL"))
+		return nil, false
+	}
+	if !slices.Contains(acmeAlgorithms, header.Alg) {
+		c.problem(ctx, services.NewACMEError("badSignatureAlgorithm", http.StatusBadRequest, "algorithm %q is not supported", header.Alg))
+		return nil, false
+	}
+
+	req := &acmeRequest{header: header, payload: payload}
+	var key json.RawMessage
+	switch {
+	case withJWK && len(header.JWK) > 0 && header.KID == "":
+		key = header.JWK
+	case !withJWK && len(header.JWK) == 0 && strings.HasPrefix(header.KID, c.baseURL+"/acct/"):
+		account, err := c.acme.Account(strings.TrimPrefix(header.KID, c.baseURL+"/acct/"))
+		if err != nil {
+			c.problem(ctx, err)
+			return nil, false
+		}
+		req.account = account
+		key = account.Key
+	default:
+		c.problem(ctx, services.NewACMEError("malformed", http.StatusBadRequest, "request must be signed with exactly one of jwk or a known account kid"))
+		return nil, false
+	}
+
+	pub, err := services.ParseJWK(key)
+	if err == nil {
+		err = services.CheckAccountKey(pub)
+	}
+	if err != nil {
+		c.problem(ctx, services.NewACMEError("badPublicKey", http.StatusBadRequest, "%v", err))
+		return nil, false
+	}
+	if err := services.VerifyJWS(jws, header.Alg, pub); err != nil {
+		c.problem(ctx, services.NewACMEError("malformed", http.StatusBadRequest, "JWS verification failed: %v", err))
+		return nil, false
+	}
+
+	return req, true
+}
+
+// decodePayload unmarshals the JWS payload, an empty payload leaves v untouched
+func (c *ACMEController) decodePayload(ctx *gin.Context, req *acmeRequest, v any) bool {
+	if req.postAsGet() {
+		return true
+	}
+	if err := json.Unmarshal(req.payload, v); err != nil {
+		c.problem(ctx, services.NewACMEError("malformed", http.StatusBadRequest, "invalid payload: %v", err))
+		return false
+	}
+	return true
+}
+
+// setHeaders adds the headers every ACME response carries
+func (c *ACMEController) setHeaders(ctx *gin.Context) {
+	ctx.Header("Replay-Nonce", c.acme.Nonces().New())
+	ctx.Header("Link", "<"+c.baseURL+`/directory>;rel="index"`)
+}
+
+// problem writes an RFC 7807 problem document
+func (c *ACMEController) problem(ctx *gin.Context, err error) {
+	var acmeErr *services.ACMEError
+	if !errors.As(err, &acmeErr) {
+		log.Printf("ACME internal error: %v", err)
+		acmeErr = services.NewACMEError("serverInternal", http.StatusInternalServerError, "internal error")
+	}
+
+	body, _ := json.Marshal(acmeErr.Problem())
+	ctx.Data(acmeErr.Status, "application/problem+json", body)
+}
+
+func (c *ACMEController) accountURL(id string) string {
+	return c.baseURL + "/acct/" + id
+}
+
+func (c *ACMEController) orderURL(id string) string {
+	return c.baseURL + "/order/" + id
+}
+
+func (c *ACMEController) accountJSON(account *models.ACMEAccount) gin.H {
+	return gin.H{
+		"status":               account.Status,
+		"contact":              account.Contact,
+		"termsOfServiceAgreed": account.TermsOfServiceAgreed,
+		"orders":               c.accountURL(account.ID) + "/orders",
+	}
+}
+
+func (c *ACMEController) orderJSON(order *models.ACMEOrder) gin.H {
+	authorizations := make([]string, 0, len(order.AuthorizationIDs))
+	for _, id := range order.AuthorizationIDs {
+		authorizations = append(authorizations, c.baseURL+"/authz/"+id)
+	}
+
+	resp := gin.H{
+		"status":         order.Status,
+		"expires":        order.Expires.Format(time.RFC3339),
+		"identifiers":    order.Identifiers,
+		"authorizations": authorizations,
+		"finalize":       c.orderURL(order.ID) + "/finalize",
+	}
+	if !order.NotBefore.IsZero() {
+		resp["notBefore"] = order.NotBefore.Format(time.RFC3339)
+	}
+	if !order.NotAfter.IsZero() {
+		resp["notAfter"] = order.NotAfter.Format(time.RFC3339)
+	}
+	if order.Status == models.ACMEStatusValid {
+		resp["certificate"] = c.baseURL + "/cert/" + order.ID
+	}
+	if order.Error != nil {
+		resp["error"] = order.Error
+	}
+	return resp
+}
+
+func (c *ACMEController) challengeJSON(challenge *models.ACMEChallenge) gin.H {
+	resp := gin.H{
+		"type":   challenge.Type,
+		"url":    c.baseURL + "/chall/" + challenge.ID,
+		"token":  challenge.Token,
+		"status": challenge.Status,
+	}
+	if challenge.Validated != nil {
+		resp["validated"] = challenge.Validated.Format(time.RFC3339)
+	}
+	if challenge.Error != nil {
+		resp["error"] = challenge.Error
+	}
+	return resp
+}
+
+// parseOptionalTime parses an RFC 3339 timestamp, the empty string yields the zero time
+func parseOptionalTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"ca-server/middleware"
+	"ca-server/models"
+	"ca-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APIKeyController manages the API keys of users
+type APIKeyController struct {
+	store models.Store
+}
+
+// NewAPIKeyController creates a new API key controller with the given store
+func NewAPIKeyController(store models.Store) *APIKeyController {
+	return &APIKeyController{
+		store: store,
+	}
+}
+
+// apiKeyRequest is the optional body of a create request
+type apiKeyRequest struct {
+	Name string `json:"name"`
+	// ExpiresInDays of 0 creates a key that does not expire
+	ExpiresInDays int `json:"expiresInDays"`
+}
+
+// CreateAPIKey creates an API key for the user, the token is only returned by this call
+func (c *APIKeyController) CreateAPIKey(ctx *gin.Context) {
+	user, ok := c.authorizedUser(ctx)
+	if !ok {
+		return
+	}
+
+	var req apiKeyRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		utils.BadRequest(ctx, "Invalid API key request", err.Error())
+		return
+	}
+	if req.ExpiresInDays < 0 {
+		utils.BadRequest(ctx, "Invalid API key request", "expiresInDays must not be negative")
+		return
+	}
+	var expiresAt *time.Time
+	if req.ExpiresInDays > 0 {
+		at := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		expiresAt = &at
+	}
+
+	key, token, err := models.NewAPIKey(user.ID, req.Name, expiresAt)
+	if err != nil {
+		utils.InternalServerError(ctx, "Failed to generate API key")
+		return
+	}
+	if err := c.store.CreateAPIKey(ctx.Request.Context(), key); err != nil {
+		respondStoreError(ctx, err, "API key")
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, gin.H{
+		"apiKey": key,
+		"token":  token,
+	})
+}
+
+// ListAPIKeys returns the API keys of the user without their secrets
+func (c *APIKeyController) ListAPIKeys(ctx *gin.Context) {
+	user, ok := c.authorizedUser(ctx)
+	if !ok {
+		return
+	}
+
+	keys, err := c.store.ListAPIKeys(ctx.Request.Context(), user.ID)
+	if err != nil {
+		respondStoreError(ctx, err, "API key")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, keys)
+}
+
+// RevokeAPIKey revokes an API key of the user
+func (c *APIKeyController) RevokeAPIKey(ctx *gin.Context) {
+	user, ok := c.authorizedUser(ctx)
+	if !ok {
+		return
+	}
+
+	key, err := c.store.GetAPIKey(ctx.Request.Context(), ctx.Param("keyId"))
+	if err == nil && key.UserID != user.ID {
+		err = models.ErrAPIKeyNotFound
+	}
+	if err != nil {
+		respondStoreError(ctx, err, "API key")
+		return
+	}
+	key, err = c.store.RevokeAPIKey(ctx.Request.Context(), key.ID, time.Now())
+	if err != nil {
+		respondStoreError(ctx, err, "API key")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, key)
+}
+
+// authorizedUser returns the user of the path, callers manage their own keys and admins everyone's
+func (c *APIKeyController) authorizedUser(ctx *gin.Context) (*models.User, bool) {
+	user, err := c.store.GetUser(ctx.Request.Context(), ctx.Param("id"))
+	if err != nil {
+		respondStoreError(ctx, err, "User")
+		return nil, false
+	}
+
+	principal, ok := middleware.GetPrincipal(ctx)
+	if !ok {
+		utils.Unauthorized(ctx, "Authentication required")
+		return nil, false
+	}
+	if !principal.HasRole(models.RoleAdmin) && (principal.User == nil || principal.User.ID != user.ID) {
+		utils.Forbidden(ctx, "Only the user or an admin can manage these API keys")
+		return nil, false
+	}
+	return user, true
+}
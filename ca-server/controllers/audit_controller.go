@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"ca-server/models"
+	"ca-server/services"
+	"ca-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AuditController exposes the audit log
+type AuditController struct {
+	audit *services.AuditLog
+}
+
+// NewAuditController creates a new audit controller
+func NewAuditController(audit *services.AuditLog) *AuditController {
+	return &AuditController{
+		audit: audit,
+	}
+}
+
+// ListRecords returns audit records, newest first.
+// Supports action (exact, or a prefix ending in a dot), actor, result, since, until (RFC 3339) and limit query params.
+func (c *AuditController) ListRecords(ctx *gin.Context) {
+	filter, err := parseAuditFilter(ctx)
+	if err != nil {
+		utils.BadRequest(ctx, "Invalid query", err.Error())
+		return
+	}
+
+	records, err := c.audit.Query(filter)
+	if err != nil {
+		utils.InternalServerError(ctx, err.Error())
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"items": records,
+		"count": len(records),
+	})
+}
+
+// VerifyChain checks the hash chain of the audit log, a broken chain answers 409 with the first bad record
+func (c *AuditController) VerifyChain(ctx *gin.Context) {
+	result, err := c.audit.Verify()
+	var chainErr *services.AuditChainError
+	if errors.As(err, &chainErr) {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"valid": false,
+			"seq":   chainErr.Seq,
+			"error": chainErr.Error(),
+		})
+		return
+	}
+	if err != nil {
+		utils.InternalServerError(ctx, err.Error())
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"valid":   true,
+		"records": result.Records,
+		"head":    result.Head,
+	})
+}
+
+// parseAuditFilter reads the audit query params, limit defaults to 100
+func parseAuditFilter(ctx *gin.Context) (models.AuditFilter, error) {
+	filter := models.AuditFilter{
+		Action: ctx.Query("action"),
+		Actor:  ctx.Query("actor"),
+		Result: ctx.Query("result"),
+		Limit:  100,
+	}
+
+	var err error
+	if value := ctx.Query("since"); value != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, value); err != nil {
+			return filter, fmt.Errorf("since must be an RFC 3339 timestamp")
+		}
+	}
+	if value := ctx.Query("until"); value != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, value); err != nil {
+			return filter, fmt.Errorf("until must be an RFC 3339 timestamp")
+		}
+	}
+	if value := ctx.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > 1000 {
+			return filter, fmt.Errorf("limit must be between 1 and 1000")
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
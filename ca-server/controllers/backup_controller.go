@@ -0,0 +1,78 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"ca-server/middleware"
+	"ca-server/models"
+	"ca-server/services"
+	"ca-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BackupController takes and restores snapshots of the whole CA state
+type BackupController struct {
+	store   models.Store
+	caStore models.CAStore
+}
+
+// NewBackupController creates a new backup controller
+func NewBackupController(store models.Store, caStore models.CAStore) *BackupController {
+	return &BackupController{
+		store:   store,
+		caStore: caStore,
+	}
+}
+
+// Snapshot streams a snapshot of the CAs, certificates, users, profiles and API keys as gzip compressed JSON
+func (c *BackupController) Snapshot(ctx *gin.Context) {
+	snap, err := services.TakeSnapshot(ctx.Request.Context(), c.store, c.caStore)
+	if err != nil {
+		utils.InternalServerError(ctx, err.Error())
+		return
+	}
+	summary := snap.Summary()
+	middleware.AddAuditDetail(ctx, "snapshot", summary)
+
+	filename := "ca-server-" + snap.CreatedAt.Format("20060102-150405") + ".json.gz"
+	ctx.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	ctx.Header("Content-Type", "application/gzip")
+	ctx.Status(http.StatusOK)
+	// the status is sent, a failure now only shows as a truncated download
+	if err := services.WriteSnapshot(ctx.Writer, snap); err != nil {
+		log.Printf("Failed to write snapshot: %v", err)
+	}
+}
+
+// Restore imports a snapshot taken by Snapshot. The instance must be fresh unless the force query param is true,
+// then the CAs of the snapshot are added and everything else is replaced.
+func (c *BackupController) Restore(ctx *gin.Context) {
+	snap, err := services.ReadSnapshot(ctx.Request.Body)
+	if err != nil {
+		utils.BadRequest(ctx, "Invalid snapshot", err.Error())
+		return
+	}
+	summary := snap.Summary()
+	middleware.AddAuditDetail(ctx, "snapshot", summary)
+	middleware.AddAuditDetail(ctx, "createdAt", snap.CreatedAt.Format(time.RFC3339))
+
+	err = services.RestoreSnapshot(ctx.Request.Context(), snap, c.store, c.caStore, ctx.Query("force") == "true")
+	if errors.Is(err, services.ErrNotFresh) {
+		utils.Conflict(ctx, "Instance is not empty, restore with force=true to replace it")
+		return
+	}
+	if err != nil {
+		utils.InternalServerError(ctx, err.Error())
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"restored":  summary,
+		"createdAt": snap.CreatedAt,
+		"sealed":    c.caStore.Sealed(),
+	})
+}
@@ -0,0 +1,281 @@
+package controllers
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"ca-server/middleware"
+	"ca-server/models"
+	"ca-server/services"
+	"ca-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CAController manages the CA hierarchy: roots, intermediates and which CA issues leaf certificates
+type CAController struct {
+	caStore    models.CAStore
+	issuer     *services.Issuer
+	keyPolicy  *services.KeyPolicy
+	keyBackend services.KeyBackend
+}
+
+// NewCAController creates a new CA controller, keys of stored CAs are generated in keyBackend
+func NewCAController(caStore models.CAStore, issuer *services.Issuer, keyPolicy *services.KeyPolicy, keyBackend services.KeyBackend) *CAController {
+	return &CAController{
+		caStore:    caStore,
+		issuer:     issuer,
+		keyPolicy:  keyPolicy,
+		keyBackend: keyBackend,
+	}
+}
+
+// caResponse describes a stored CA
+type caResponse struct {
+	ID                  string    `json:"id"`
+	IssuerID            string    `json:"issuerId"`
+	Subject             string    `json:"subject"`
+	SerialNumber        string    `json:"serialNumber"`
+	NotBefore           time.Time `json:"notBefore"`
+	NotAfter            time.Time `json:"notAfter"`
+	MaxPathLen          *int      `json:"maxPathLen,omitempty"`
+	PermittedDNSDomains []string  `json:"permittedDNSDomains,omitempty"`
+	ExcludedDNSDomains  []string  `json:"excludedDNSDomains,omitempty"`
+	Root                bool      `json:"root"`
+	Issuing             bool      `json:"issuing"`
+	ChainPEM            []byte    `json:"chainPEM"`
+}
+
+// newCAResponse describes ca, issuing reports whether it signs leaf certificates
+func newCAResponse(ca *models.CA, issuing bool) caResponse {
+	resp := caResponse{
+		ID:                  ca.ID(),
+		IssuerID:            hex.EncodeToString(ca.Cert.AuthorityKeyId),
+		Subject:             ca.Cert.Subject.String(),
+		SerialNumber:        ca.Cert.SerialNumber.String(),
+		NotBefore:           ca.Cert.NotBefore,
+		NotAfter:            ca.Cert.NotAfter,
+		PermittedDNSDomains: ca.Cert.PermittedDNSDomains,
+		ExcludedDNSDomains:  ca.Cert.ExcludedDNSDomains,
+		Root:                ca.IsRoot(),
+		Issuing:             issuing,
+		ChainPEM:            utils.EncodeCertsPEM(ca.FullChain()...),
+	}
+	if ca.IsRoot() {
+		resp.IssuerID = resp.ID
+	}
+	if ca.Cert.MaxPathLen >= 0 {
+		maxPathLen := ca.Cert.MaxPathLen
+		resp.MaxPathLen = &maxPathLen
+	}
+	return resp
+}
+
+// ListCAs returns every stored CA
+func (c *CAController) ListCAs(ctx *gin.Context) {
+	issuing, _ := c.caStore.Get()
+
+	items := make([]caResponse, 0)
+	for _, ca := range c.caStore.List() {
+		items = append(items, newCAResponse(ca, ca == issuing))
+	}
+	ctx.JSON(http.StatusOK, gin.H{"items": items})
+}
+
+// GetCA returns a stored CA with its chain
+func (c *CAController) GetCA(ctx *gin.Context) {
+	ca, err := c.caStore.GetByID(ctx.Param("id"))
+	if err != nil {
+		utils.NotFound(ctx, "CA not found")
+		return
+	}
+
+	issuing, _ := c.caStore.Get()
+	ctx.JSON(http.StatusOK, newCAResponse(ca, ca == issuing))
+}
+
+// CreateCA create a certificate authority
+// a CA should include a private key and a certificate (public key) which is self-signed
+// with ?persist=true the CA is saved to the CA store and becomes the issuing CA
+func (c *CAController) CreateCA(ctx *gin.Context) {
+	persist := ctx.Query("persist") == "true"
+	force := ctx.Query("force") == "true"
+	// saves the key generation when the store already has a CA, Create below decides
+	if persist && !force && c.caStore.Loaded() {
+		utils.Conflict(ctx, "An issuing CA already exists, use force=true to replace it")
+		return
+	}
+
+	// the body is optional, an empty one creates the default root
+	var req caRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		utils.BadRequest(ctx, "Invalid CA request", err.Error())
+		return
+	}
+	caTmpl, err := req.template(defaultCACommonName, defaultRootValidDays)
+	if err != nil {
+		utils.BadRequest(ctx, "Invalid CA request", err.Error())
+		return
+	}
+
+	keySpec, err := c.keyPolicy.Resolve(req.Key)
+	if err != nil {
+		utils.BadRequest(ctx, "Invalid key spec", err.Error())
+		return
+	}
+	// a stored CA keeps its key in the backend, otherwise the key is handed to the caller
+	var caPriv crypto.Signer
+	if persist {
+		caPriv, err = c.keyBackend.Generate(keySpec, caTmpl.Subject.CommonName)
+	} else {
+		caPriv, err = keySpec.Generate()
+	}
+	if err != nil {
+		ctx.JSON(500, gin.H{"error": "Failed to generate CA key: " + err.Error()})
+		return
+	}
+
+	// generate a self-signed certificate
+	caTmpl.SignatureAlgorithm = services.SignatureAlgorithm(caPriv.Public())
+	caCertDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, caPriv.Public(), caPriv)
+	if err != nil {
+		ctx.JSON(500, gin.H{"error": "Failed to marshal CA cert"})
+		return
+	}
+	caCert, err := x509.ParseCertificate(caCertDER)
+	if err != nil {
+		ctx.JSON(500, gin.H{"error": "Failed to parse CA cert: " + err.Error()})
+		return
+	}
+
+	// Encode the certificate to PEM format for easy storage and transfer
+	caCertPEM := pem.EncodeToMemory(&pem.Block{Bytes: caCertDER, Type: "CERTIFICATE"})
+
+	if persist {
+		ca, err := models.NewCA(caPriv, caCert, nil)
+		if err != nil {
+			ctx.JSON(500, gin.H{"error": "Invalid CA: " + err.Error()})
+			return
+		}
+		// without force the store checks for an issuing CA and saves under one lock,
+		// so of two concurrent requests only one creates a CA
+		save := c.caStore.Create
+		if force {
+			save = func(ca *models.CA) error { return c.caStore.Save(ca, true) }
+		}
+		if err := save(ca); err != nil {
+			if errors.Is(err, models.ErrCAExists) {
+				utils.Conflict(ctx, "An issuing CA already exists, use force=true to replace it")
+				return
+			}
+			ctx.JSON(500, gin.H{"error": "Failed to persist CA: " + err.Error()})
+			return
+		}
+		// only a CA that was saved makes it into the inventory
+		if err := c.issuer.Record(ctx.Request.Context(), caCert); err != nil {
+			ctx.JSON(500, gin.H{"error": "CA persisted but recording it in the inventory failed: " + err.Error()})
+			return
+		}
+		// the private key stays in the CA store
+		middleware.AddAuditDetail(ctx, "caId", ca.ID())
+		ctx.JSON(200, gin.H{
+			"id":        ca.ID(),
+			"certPEM":   caCertPEM,
+			"persisted": true,
+		})
+		return
+	}
+
+	caPrivDER, err := x509.MarshalPKCS8PrivateKey(caPriv)
+	if err != nil {
+		ctx.JSON(500, gin.H{"error": "Failed to marshal CA private key"})
+		return
+	}
+
+	// Encode the private key to PEM format to ensure compatibility with other tools and systems
+	caPrivPEM := pem.EncodeToMemory(&pem.Block{Bytes: caPrivDER, Type: "PRIVATE KEY"})
+	// recorded last, a CA that is not handed out is not in the inventory
+	if err := c.issuer.Record(ctx.Request.Context(), caCert); err != nil {
+		ctx.JSON(500, gin.H{"error": "Failed to record CA cert: " + err.Error()})
+		return
+	}
+	middleware.AddAuditDetail(ctx, "keyExported", true)
+	ctx.JSON(200, gin.H{
+		"certPEM": caCertPEM,
+		"keyPEM":  caPrivPEM,
+	}) // the client can then use base64 decode to view the PEM files
+}
+
+// CreateIntermediate issues a subordinate CA signed by a stored CA.
+// The key is kept in the CA store, ?activate or "activate": true makes it the issuing CA.
+func (c *CAController) CreateIntermediate(ctx *gin.Context) {
+	var req caRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		utils.BadRequest(ctx, "Invalid CA request", err.Error())
+		return
+	}
+	tmpl, err := req.template(defaultCACommonName+" Intermediate CA", defaultIntermediateValidDays)
+	if err != nil {
+		utils.BadRequest(ctx, "Invalid CA request", err.Error())
+		return
+	}
+
+	keySpec, err := c.keyPolicy.Resolve(req.Key)
+	if err != nil {
+		utils.BadRequest(ctx, "Invalid key spec", err.Error())
+		return
+	}
+	priv, err := c.keyBackend.Generate(keySpec, tmpl.Subject.CommonName)
+	if err != nil {
+		ctx.JSON(500, gin.H{"error": "Failed to generate CA key: " + err.Error()})
+		return
+	}
+
+	cert, chain, err := c.issuer.SignCA(req.IssuerID, tmpl, priv.Public())
+	if err != nil {
+		respondIssueError(ctx, err)
+		return
+	}
+
+	ca, err := models.NewCA(priv, cert, chain)
+	if err != nil {
+		ctx.JSON(500, gin.H{"error": "Invalid CA: " + err.Error()})
+		return
+	}
+	activate := req.Activate || ctx.Query("activate") == "true"
+	if err := c.caStore.Save(ca, activate); err != nil {
+		ctx.JSON(500, gin.H{"error": "Failed to persist CA: " + err.Error()})
+		return
+	}
+	// only a CA that was saved makes it into the inventory
+	if err := c.issuer.Record(ctx.Request.Context(), cert); err != nil {
+		ctx.JSON(500, gin.H{"error": "CA persisted but recording it in the inventory failed: " + err.Error()})
+		return
+	}
+
+	middleware.AddAuditDetail(ctx, "caId", ca.ID())
+	ctx.JSON(http.StatusCreated, newCAResponse(ca, activate))
+}
+
+// ActivateCA makes a stored CA the one that issues leaf certificates
+func (c *CAController) ActivateCA(ctx *gin.Context) {
+	err := c.caStore.Activate(ctx.Param("id"))
+	if errors.Is(err, models.ErrCANotFound) {
+		utils.NotFound(ctx, "CA not found")
+		return
+	}
+	if err != nil {
+		utils.InternalServerError(ctx, "Failed to activate CA: "+err.Error())
+		return
+	}
+
+	ca, _ := c.caStore.Get()
+	ctx.JSON(http.StatusOK, newCAResponse(ca, true))
+}
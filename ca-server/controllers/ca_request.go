@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"ca-server/services"
+	"ca-server/utils"
+)
+
+const (
+	defaultRootValidDays         = 3650
+	defaultIntermediateValidDays = 1825
+	defaultCACommonName          = "My Homelab"
+	defaultCAOrganization        = "Private Homelab"
+)
+
+// caRequest is the request body accepted by the CA endpoints, all fields are optional
+type caRequest struct {
+	CommonName   string `json:"commonName"`
+	Organization string `json:"organization"`
+	ValidDays    int    `json:"validDays"`
+	// MaxPathLen limits how many CAs may follow this one, unset derives it from the parent
+	MaxPathLen *int `json:"maxPathLen"`
+	// IssuerID picks the parent of an intermediate, the issuing CA when empty
+	IssuerID string `json:"issuerId"`
+	// Key selects the CA key pair, the configured default when unset
+	Key *services.KeySpec `json:"key"`
+	// Activate makes an intermediate the CA that issues leaf certificates
+	Activate            bool     `json:"activate"`
+	PermittedDNSDomains []string `json:"permittedDNSDomains"`
+	ExcludedDNSDomains  []string `json:"excludedDNSDomains"`
+	PermittedIPRanges   []string `json:"permittedIPRanges"`
+	ExcludedIPRanges    []string `json:"excludedIPRanges"`
+}
+
+// template validates the request and builds the CA certificate template
+func (r *caRequest) template(defaultCommonName string, defaultValidDays int) (*x509.Certificate, error) {
+	commonName := strings.TrimSpace(r.CommonName)
+	if commonName == "" {
+		commonName = defaultCommonName
+	}
+	if len(commonName) > maxCommonNameLength {
+		return nil, fmt.Errorf("commonName must be at most %d characters", maxCommonNameLength)
+	}
+	organization := strings.TrimSpace(r.Organization)
+	if organization == "" {
+		organization = defaultCAOrganization
+	}
+
+	validDays := r.ValidDays
+	if validDays < 0 {
+		return nil, fmt.Errorf("validDays must be positive")
+	}
+	if validDays == 0 {
+		validDays = defaultValidDays
+	}
+
+	maxPathLen := -1
+	if r.MaxPathLen != nil {
+		if *r.MaxPathLen < 0 {
+			return nil, fmt.Errorf("maxPathLen must not be negative")
+		}
+		maxPathLen = *r.MaxPathLen
+	}
+
+	permittedDNS, err := parseConstraintDomains(r.PermittedDNSDomains)
+	if err != nil {
+		return nil, err
+	}
+	excludedDNS, err := parseConstraintDomains(r.ExcludedDNSDomains)
+	if err != nil {
+		return nil, err
+	}
+	permittedIPs, err := parseIPRanges(r.PermittedIPRanges)
+	if err != nil {
+		return nil, err
+	}
+	excludedIPs, err := parseIPRanges(r.ExcludedIPRanges)
+	if err != nil {
+		return nil, err
+	}
+
+	notBefore := time.Now()
+	return &x509.Certificate{
+		Subject:               pkix.Name{Country: []string{"VN"}, Organization: []string{organization}, CommonName: commonName},
+		SerialNumber:          utils.NewSerialNum(),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            maxPathLen,
+		MaxPathLenZero:        maxPathLen == 0,
+		NotBefore:             notBefore,
+		NotAfter:              certNotAfter(notBefore, validDays),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		PermittedDNSDomains:   permittedDNS,
+		ExcludedDNSDomains:    excludedDNS,
+		PermittedIPRanges:     permittedIPs,
+		ExcludedIPRanges:      excludedIPs,
+	}, nil
+}
+
+// parseConstraintDomains validates DNS name constraints, a leading dot restricts to subdomains only
+func parseConstraintDomains(domains []string) ([]string, error) {
+	parsed := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if !utils.IsValidDNSName(strings.TrimPrefix(domain, ".")) || strings.HasPrefix(domain, "*.") {
+			return nil, fmt.Errorf("invalid DNS name constraint: %q", domain)
+		}
+		parsed = append(parsed, domain)
+	}
+	return parsed, nil
+}
+
+// parseIPRanges parses CIDR name constraints
+func parseIPRanges(ranges []string) ([]*net.IPNet, error) {
+	parsed := make([]*net.IPNet, 0, len(ranges))
+	for _, r := range ranges {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(r))
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP range constraint: %q", r)
+		}
+		parsed = append(parsed, ipNet)
+	}
+	return parsed, nil
+}
@@ -1,396 +1,522 @@
 package controllers
 
 import (
+	"ca-server/config"
+	"ca-server/middleware"
+	"ca-server/models"
+	"ca-server/services"
 	"ca-server/utils"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
-	"crypto/rsa"
+	"context"
+	"crypto"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"log"
+	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-const defaultValidDays = 365
-
-type CertController struct{}
+type CertController struct {
+	store        models.CertStore
+	users        models.UserStore
+	profiles     models.ProfileStore
+	issuer       *services.Issuer
+	keyPolicy    *services.KeyPolicy
+	revoker      *services.RevocationService
+	maxValidDays int
+	csrPolicy    services.CSRPolicy
+	// authRequired applies the role bindings of the caller to what it issues and revokes
+	authRequired bool
+}
 
+// GetCert returns an issued certificate by serial number
 func (c *CertController) GetCert(ctx *gin.Context) {
-	// Logic to get certificate
+	cert, err := c.store.GetCert(ctx.Request.Context(), ctx.Param("serial"))
+	if err != nil {
+		respondStoreError(ctx, err, "Certificate")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, cert)
 }
 
+// ListCerts returns a page of issued certificates.
+// Supports subject, issuer, expiresAfter, expiresBefore (RFC 3339), isCA, sort, cursor, page and pageSize query params.
 func (c *CertController) ListCerts(ctx *gin.Context) {
-	// Logic to list certificates
-}
+	filter, page, pageSize, err := parseCertFilter(ctx)
+	if err != nil {
+		utils.BadRequest(ctx, "Invalid query", err.Error())
+		return
+	}
 
-func (c *CertController) SignCSR(ctx *gin.Context) {
+	certs, err := c.store.ListCerts(ctx.Request.Context(), filter)
+	if err != nil {
+		respondStoreError(ctx, err, "Certificate")
+		return
+	}
+
+	resp := gin.H{
+		"items":    certs.Items,
+		"total":    certs.Total,
+		"pageSize": pageSize,
+	}
+	if page > 0 {
+		resp["page"] = page
+	}
+	if certs.NextCursor != "" {
+		resp["nextCursor"] = certs.NextCursor
+	}
+	ctx.JSON(http.StatusOK, resp)
 }
 
-func (c *CertController) CreateClientCert(ctx *gin.Context) {
-	// Parse request body
-	var req struct {
-		CommonName  string   `json:"commonName"`
-		DNSNames    []string `json:"dnsNames"`
-		IPAddresses []string `json:"ipAddresses,omitempty"`
-		ValidDays   int      `json:"validDays"`
-	}
-
-	// if err := ctx.ShouldBindJSON(&req); err != nil {
-	// 	ctx.JSON(400, gin.H{
-	// 		"error": "Invalid request: " + err.Error(),
-	// 		"expected": gin.H{
-	// 			"commonName":  "string (required)",
-	// 			"dnsNames":    "array of strings (required)",
-	// 			"ipAddresses": "array of strings (optional)",
-	// 			"validDays":   "integer (required)",
-	// 		},
-	// 	})
-	// 	return
-	// }
-
-	// Read CA key from file
-	caKeyData, err := os.ReadFile("caKey.pem")
-	if err != nil {
-		ctx.JSON(500, gin.H{"error": "Failed to read CA key: " + err.Error()})
+// RevokeCert revokes an issued certificate and republishes the CRL. A CRL that fails to publish
+// does not undo the revocation, the response carries a warning and the CRL is retried in the background.
+func (c *CertController) RevokeCert(ctx *gin.Context) {
+	var req revokeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(ctx, "Invalid revocation request", err.Error())
+		return
+	}
+	if err := req.validate(); err != nil {
+		utils.BadRequest(ctx, "Invalid revocation request", err.Error())
 		return
 	}
 
-	// Parse CA key
-	block, _ := pem.Decode(caKeyData)
-	if block == nil || block.Type != "EC Private Key" || block.Bytes == nil {
-		ctx.JSON(500, gin.H{"error": "Failed to decode CA key PEM or invalid block bytes"})
+	if !c.authorizeCert(ctx, models.RoleRevoker, ctx.Param("serial")) {
 		return
 	}
 
-	caPriv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	cert, err := c.revoker.Revoke(ctx.Request.Context(), ctx.Param("serial"), req.Reason, time.Now())
+	var publishErr *services.CRLPublishError
+	if errors.As(err, &publishErr) {
+		// the revocation is committed and OCSP already answers revoked, only the CRL lags behind
+		middleware.AddAuditDetail(ctx, "crlError", publishErr.Error())
+		ctx.JSON(http.StatusOK, revokeResponse{Certificate: cert, Warning: publishErr.Error() + ", retrying in the background"})
+		return
+	}
+	if errors.Is(err, models.ErrAlreadyRevoked) {
+		utils.Conflict(ctx, "Certificate already revoked")
+		return
+	}
 	if err != nil {
-		ctx.JSON(500, gin.H{"error": "Failed to parse CA private key: " + err.Error()})
+		respondStoreError(ctx, err, "Certificate")
 		return
 	}
 
-	// Read CA cert from file
-	caCertData, err := os.ReadFile("caCert.pem")
-	if err != nil {
-		ctx.JSON(500, gin.H{"error": "Failed to read CA certificate: " + err.Error()})
+	ctx.JSON(http.StatusOK, cert)
+}
+
+// revokeResponse is a revoked certificate with a warning when its CRL is not published yet
+type revokeResponse struct {
+	*models.Certificate
+	Warning string `json:"warning,omitempty"`
+}
+
+// respondIssueError maps an issuance failure to a response, a missing CA is a temporary condition
+func respondIssueError(ctx *gin.Context, err error) {
+	if errors.Is(err, models.ErrCANotLoaded) || errors.Is(err, models.ErrCASealed) {
+		utils.ServiceUnavailable(ctx, "Issuing CA is not available", err.Error())
 		return
 	}
+	if errors.Is(err, models.ErrCANotFound) {
+		utils.BadRequest(ctx, "Unknown CA", err.Error())
+		return
+	}
+	if errors.Is(err, services.ErrCAConstraint) {
+		utils.BadRequest(ctx, "Certificate rejected by CA constraints", err.Error())
+		return
+	}
+	if errors.Is(err, services.ErrForbidden) {
+		utils.Forbidden(ctx, "Certificate is outside your role bindings")
+		return
+	}
+	if errors.Is(err, services.ErrOtherUser) {
+		utils.Forbidden(ctx, "Certificate is bound to another user")
+		return
+	}
+	if errors.Is(err, services.ErrAmbiguousUser) {
+		utils.BadRequest(ctx, "Invalid certificate request", err.Error())
+		return
+	}
+	ctx.JSON(500, gin.H{"error": err.Error()})
+}
 
-	// Parse CA certificate
-	block, _ = pem.Decode(caCertData)
-	if block == nil || block.Type != "CERTIFICATE" || block.Bytes == nil {
-		ctx.JSON(500, gin.H{"error": "Failed to decode CA certificate PEM or invalid block bytes"})
+// SignCSR issues a certificate for a PEM encoded PKCS#10 request.
+// The key pair stays with the caller, only the public key in the CSR is certified.
+func (c *CertController) SignCSR(ctx *gin.Context) {
+	var req csrRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(ctx, "Invalid CSR request", err.Error())
 		return
 	}
 
-	caCert, err := x509.ParseCertificate(block.Bytes)
+	csr, err := parseCSR(req.CSR)
 	if err != nil {
-		ctx.JSON(500, gin.H{"error": "Failed to parse CA certificate: " + err.Error()})
-		return
-	}
-
-	// Generate server private key with configurable curve
-	curve := elliptic.P256() // Default curve
-	if curveName := ctx.Query("curve"); curveName != "" {
-		switch curveName {
-		case "P384":
-			curve = elliptic.P384()
-		case "P521":
-			curve = elliptic.P521()
-		case "P256": // Explicitly handle P256
-			curve = elliptic.P256()
-		default:
-			ctx.JSON(400, gin.H{"error": "Unsupported curve: " + curveName})
-			return
-		}
+		utils.BadRequest(ctx, "Invalid CSR", err.Error())
+		return
 	}
-
-	serverPriv, err := ecdsa.GenerateKey(curve, rand.Reader)
+	export, err := parseExportOptions(ctx, req.exportRequest, false)
 	if err != nil {
-		ctx.JSON(500, gin.H{"error": "Failed to generate server key: " + err.Error()})
-		return
-	}
-
-	// Parse IP addresses if provided
-	// var ips []net.IP
-	// for _, ip := range req.IPAddresses {
-	// 	parsedIP := net.ParseIP(ip)
-	// 	if parsedIP == nil {
-	// 		ctx.JSON(400, gin.H{"error": fmt.Sprintf("Invalid IP address: %s", ip)})
-	// 		return
-	// 	}
-	// 	ips = append(ips, parsedIP)
-	// }
-
-	// Create certificate template
-	validDays := defaultValidDays
-	if req.ValidDays > 0 {
-		validDays = req.ValidDays
-	}
-
-	certTemplate := &x509.Certificate{
-		Subject:      pkix.Name{CommonName: "My Homelab"},
-		SerialNumber: utils.NewSerialNum(),
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().Add(time.Hour * 24 * time.Duration(validDays)),
-		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, // NOTE: find same usage in openssl
-		DNSNames:     []string{"localhost"},
-	}
-
-	// Sign the certificate
-	certDER, err := x509.CreateCertificate(
-		rand.Reader,
-		certTemplate,
-		caCert,
-		serverPriv.Public(),
-		caPriv,
-	)
+		utils.BadRequest(ctx, "Invalid export format", err.Error())
+		return
+	}
+
+	var certTemplate *x509.Certificate
+	if req.Profile != "" {
+		certTemplate, err = c.csrProfileTemplate(ctx.Request.Context(), csr, req)
+	} else {
+		certTemplate, err = c.csrPolicyTemplate(csr, req)
+	}
 	if err != nil {
-		ctx.JSON(500, gin.H{"error": "Failed to create certificate: " + err.Error()})
+		utils.BadRequest(ctx, "CSR rejected by policy", err.Error())
 		return
 	}
 
-	// Encode server private key to PEM
-	serverPrivDER, err := x509.MarshalPKCS8PrivateKey(serverPriv)
+	opts, err := c.issueOptions(ctx, certTemplate, services.IssueOptions{CAID: req.CAID, Profile: req.Profile})
 	if err != nil {
-		if err == x509.IncorrectPasswordError || err == x509.ErrUnsupportedAlgorithm {
-			ctx.JSON(500, gin.H{"error": "Unsupported key type for server private key: " + err.Error()})
-		} else {
-			ctx.JSON(500, gin.H{"error": "Failed to marshal server private key: " + err.Error()})
-		}
+		respondIssueError(ctx, err)
+		return
+	}
+	cert, chain, err := c.issuer.Issue(ctx.Request.Context(), opts, certTemplate, csr.PublicKey)
+	if err != nil {
+		respondIssueError(ctx, err)
 		return
 	}
 
-	// Create PEM blocks
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: serverPrivDER})
+	respondCredentials(ctx, export, credentials{cert: cert, chain: chain})
+}
 
-	ctx.JSON(200, gin.H{
-		"certPEM": certPEM,
-		"keyPEM":  keyPEM,
-	})
+// IssueCert generates a key pair and issues a certificate for it from a named profile.
+// A non-empty profile fixes the profile for the route, otherwise it is taken from the request body.
+func (c *CertController) IssueCert(profile string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req certRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			utils.BadRequest(ctx, "Invalid certificate request", err.Error())
+			return
+		}
+		if profile != "" {
+			if req.Profile != "" && req.Profile != profile {
+				utils.BadRequest(ctx, "Invalid certificate request", "this endpoint only issues "+profile+" certificates, use /api/certs/issue")
+				return
+			}
+			req.Profile = profile
+		}
+		if req.Profile == "" {
+			utils.BadRequest(ctx, "Invalid certificate request", "profile is required")
+			return
+		}
+
+		ips, err := req.validate()
+		if err != nil {
+			utils.BadRequest(ctx, "Invalid certificate request", err.Error())
+			return
+		}
+		export, err := parseExportOptions(ctx, req.exportRequest, true)
+		if err != nil {
+			utils.BadRequest(ctx, "Invalid export format", err.Error())
+			return
+		}
+
+		p, err := c.profiles.GetProfile(ctx.Request.Context(), req.Profile)
+		if errors.Is(err, models.ErrNotFound) {
+			utils.BadRequest(ctx, "Unknown profile", req.Profile)
+			return
+		}
+		if err != nil {
+			utils.InternalServerError(ctx, err.Error())
+			return
+		}
+		certTemplate, err := services.ApplyProfile(p, services.ProfileRequest{
+			Subject:        pkix.Name{CommonName: req.CommonName},
+			DNSNames:       req.DNSNames,
+			IPAddresses:    ips,
+			EmailAddresses: req.EmailAddresses,
+			ValidDays:      req.ValidDays,
+		})
+		if err != nil {
+			utils.BadRequest(ctx, "Certificate rejected by profile", err.Error())
+			return
+		}
+
+		opts, err := c.issueOptions(ctx, certTemplate, services.IssueOptions{CAID: req.CAID, Profile: p.Name})
+		if err != nil {
+			respondIssueError(ctx, err)
+			return
+		}
+
+		// Generate the private key from the requested key spec
+		keySpec, err := c.keyPolicy.Resolve(req.Key)
+		if err != nil {
+			utils.BadRequest(ctx, "Invalid key spec", err.Error())
+			return
+		}
+		priv, err := keySpec.Generate()
+		if err != nil {
+			ctx.JSON(500, gin.H{"error": "Failed to generate key: " + err.Error()})
+			return
+		}
+
+		// Sign the certificate
+		cert, chain, err := c.issuer.Issue(ctx.Request.Context(), opts, certTemplate, priv.Public())
+		if err != nil {
+			respondIssueError(ctx, err)
+			return
+		}
+
+		respondCredentials(ctx, export, credentials{cert: cert, chain: chain, key: priv, extra: gin.H{"profile": p.Name}})
+	}
 }
 
-func (c *CertController) CreateServerCert(ctx *gin.Context) {
-	// Parse request body
-	var req struct {
-		CommonName  string   `json:"commonName"`
-		DNSNames    []string `json:"dnsNames"`
-		IPAddresses []string `json:"ipAddresses,omitempty"`
-		ValidDays   int      `json:"validDays"`
-	}
-
-	// if err := ctx.ShouldBindJSON(&req); err != nil {
-	// 	ctx.JSON(400, gin.H{
-	// 		"error": "Invalid request: " + err.Error(),
-	// 		"expected": gin.H{
-	// 			"commonName":  "string (required)",
-	// 			"dnsNames":    "array of strings (required)",
-	// 			"ipAddresses": "array of strings (optional)",
-	// 			"validDays":   "integer (required)",
-	// 		},
-	// 	})
-	// 	return
-	// }
-
-	// Read CA key from file
-	caKeyData, err := os.ReadFile("caKey.pem")
+// RenewCert issues a replacement for an inventory certificate with the same subject, SANs and profile.
+// The existing public key is certified again unless rekey is set, the original may be revoked after a grace period.
+func (c *CertController) RenewCert(ctx *gin.Context) {
+	var req renewRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		utils.BadRequest(ctx, "Invalid renewal request", err.Error())
+		return
+	}
+	if err := req.validate(); err != nil {
+		utils.BadRequest(ctx, "Invalid renewal request", err.Error())
+		return
+	}
+	export, err := parseExportOptions(ctx, req.exportRequest, req.Rekey)
 	if err != nil {
-		ctx.JSON(500, gin.H{"error": "Failed to read CA key: " + err.Error()})
+		utils.BadRequest(ctx, "Invalid export format", err.Error())
 		return
 	}
 
-	// Parse CA key
-	block, _ := pem.Decode(caKeyData)
-	if block == nil || block.Type != "EC Private Key" || block.Bytes == nil {
-		ctx.JSON(500, gin.H{"error": "Failed to decode CA key PEM or invalid block bytes"})
+	old, err := c.store.GetCert(ctx.Request.Context(), ctx.Param("serial"))
+	if err != nil {
+		respondStoreError(ctx, err, "Certificate")
 		return
 	}
-
-	caPriv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	switch {
+	case old.IsCA:
+		utils.BadRequest(ctx, "Invalid renewal request", "CA certificates are replaced through /api/certs/ca")
+		return
+	case old.IsRevoked():
+		utils.Conflict(ctx, "Certificate is revoked")
+		return
+	case old.RenewedBy != "":
+		utils.Conflict(ctx, "Certificate was already renewed by "+old.RenewedBy)
+		return
+	}
+	// revoking the original, now or after the grace period, takes the revoker role over it,
+	// checked before anything is issued
+	if req.RevokeOld && !c.authorizeCert(ctx, models.RoleRevoker, old.SerialNumber) {
+		return
+	}
+	oldCert, err := x509.ParseCertificate(old.RawCertificate)
 	if err != nil {
-		ctx.JSON(500, gin.H{"error": "Failed to parse CA private key: " + err.Error()})
+		utils.InternalServerError(ctx, "Failed to parse stored certificate: "+err.Error())
 		return
 	}
 
-	// Read CA cert from file
-	caCertData, err := os.ReadFile("caCert.pem")
+	profileName := req.Profile
+	if profileName == "" {
+		profileName = old.Profile
+	}
+	if profileName == "" {
+		utils.BadRequest(ctx, "Invalid renewal request", "certificate was issued without a profile, pass one")
+		return
+	}
+	p, err := c.profiles.GetProfile(ctx.Request.Context(), profileName)
+	if errors.Is(err, models.ErrNotFound) {
+		utils.BadRequest(ctx, "Unknown profile", profileName)
+		return
+	}
 	if err != nil {
-		ctx.JSON(500, gin.H{"error": "Failed to read CA certificate: " + err.Error()})
+		utils.InternalServerError(ctx, err.Error())
 		return
 	}
-
-	// Parse CA certificate
-	block, _ = pem.Decode(caCertData)
-	if block == nil || block.Type != "CERTIFICATE" || block.Bytes == nil {
-		ctx.JSON(500, gin.H{"error": "Failed to decode CA certificate PEM or invalid block bytes"})
+	certTemplate, err := services.ApplyProfile(p, services.ProfileRequest{
+		Subject:        oldCert.Subject,
+		DNSNames:       oldCert.DNSNames,
+		IPAddresses:    oldCert.IPAddresses,
+		EmailAddresses: oldCert.EmailAddresses,
+		ValidDays:      req.ValidDays,
+	})
+	if err != nil {
+		utils.BadRequest(ctx, "Certificate rejected by profile", err.Error())
 		return
 	}
 
-	caCert, err := x509.ParseCertificate(block.Bytes)
-	if err != nil {
-		ctx.JSON(500, gin.H{"error": "Failed to parse CA certificate: " + err.Error()})
-		return
-	}
-
-	// Generate server private key with configurable curve
-	curve := elliptic.P256() // Default curve
-	if curveName := ctx.Query("curve"); curveName != "" {
-		switch curveName {
-		case "P384":
-			curve = elliptic.P384()
-		case "P521":
-			curve = elliptic.P521()
-		case "P256": // Explicitly handle P256
-			curve = elliptic.P256()
-		default:
-			ctx.JSON(400, gin.H{"error": "Unsupported curve: " + curveName})
+	pub, priv := oldCert.PublicKey, crypto.Signer(nil)
+	if req.Rekey {
+		keySpec, err := c.keyPolicy.Resolve(req.Key)
+		if err != nil {
+			utils.BadRequest(ctx, "Invalid key spec", err.Error())
+			return
+		}
+		if priv, err = keySpec.Generate(); err != nil {
+			ctx.JSON(500, gin.H{"error": "Failed to generate key: " + err.Error()})
 			return
 		}
+		pub = priv.Public()
+	} else if err := c.csrPolicy.CheckPublicKey(pub); err != nil {
+		utils.BadRequest(ctx, "Existing key rejected by policy, renew with rekey", err.Error())
+		return
 	}
 
-	serverPriv, err := ecdsa.GenerateKey(curve, rand.Reader)
-	if err != nil {
-		ctx.JSON(500, gin.H{"error": "Failed to generate server key: " + err.Error()})
-		return
-	}
-
-	// Parse IP addresses if provided
-	// var ips []net.IP
-	// for _, ip := range req.IPAddresses {
-	// 	parsedIP := net.ParseIP(ip)
-	// 	if parsedIP == nil {
-	// 		ctx.JSON(400, gin.H{"error": fmt.Sprintf("Invalid IP address: %s", ip)})
-	// 		return
-	// 	}
-	// 	ips = append(ips, parsedIP)
-	// }
-
-	// Create certificate template
-	validDays := defaultValidDays
-	if req.ValidDays > 0 {
-		validDays = req.ValidDays
-	}
-
-	certTemplate := &x509.Certificate{
-		Subject:      pkix.Name{CommonName: "My Homelab"},
-		SerialNumber: utils.NewSerialNum(),
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().Add(time.Hour * 24 * time.Duration(validDays)),
-		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		DNSNames:     []string{"localhost"},
-	}
-
-	// Sign the certificate
-	certDER, err := x509.CreateCertificate(
-		rand.Reader,
-		certTemplate,
-		caCert,
-		serverPriv.Public(),
-		caPriv,
-	)
+	// the CA that issued the original signs again unless another one is picked
+	caID := req.CAID
+	if caID == "" {
+		caID = old.AuthorityKeyID
+	}
+	opts, err := c.issueOptions(ctx, certTemplate, services.IssueOptions{CAID: caID, Profile: p.Name, RenewedFrom: old.SerialNumber})
 	if err != nil {
-		ctx.JSON(500, gin.H{"error": "Failed to create certificate: " + err.Error()})
+		respondIssueError(ctx, err)
 		return
 	}
-
-	// Encode server private key to PEM
-	serverPrivDER, err := x509.MarshalPKCS8PrivateKey(serverPriv)
+	cert, chain, err := c.issuer.Issue(ctx.Request.Context(), opts, certTemplate, pub)
 	if err != nil {
-		if err == x509.IncorrectPasswordError || err == x509.ErrUnsupportedAlgorithm {
-			ctx.JSON(500, gin.H{"error": "Unsupported key type for server private key: " + err.Error()})
-		} else {
-			ctx.JSON(500, gin.H{"error": "Failed to marshal server private key: " + err.Error()})
-		}
+		respondIssueError(ctx, err)
 		return
 	}
 
-	// Create PEM blocks
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: serverPrivDER})
+	var revokeAt *time.Time
+	if req.RevokeOld && req.GraceHours > 0 {
+		at := time.Now().Add(time.Duration(req.GraceHours) * time.Hour)
+		revokeAt = &at
+	}
+	if old, err = c.store.MarkRenewed(ctx.Request.Context(), old.SerialNumber, cert.SerialNumber.String(), revokeAt); err != nil {
+		utils.InternalServerError(ctx, "Failed to link renewed certificate: "+err.Error())
+		return
+	}
+	if req.RevokeOld && req.GraceHours == 0 {
+		// the new certificate is already issued, a failed revocation must not withhold it
+		revoked, err := c.revoker.Revoke(ctx.Request.Context(), old.SerialNumber, services.ReasonSuperseded, time.Now())
+		if revoked != nil {
+			old = revoked
+		}
+		if err != nil {
+			log.Printf("Failed to revoke renewed certificate %s: %v", old.SerialNumber, err)
+		}
+	}
 
-	ctx.JSON(200, gin.H{
-		"certPEM": certPEM,
-		"keyPEM":  keyPEM,
-	})
+	respondCredentials(ctx, export, credentials{cert: cert, chain: chain, key: priv, extra: gin.H{
+		"profile":      p.Name,
+		"serialNumber": cert.SerialNumber.String(),
+		"renewedFrom":  old.SerialNumber,
+		"oldCert":      old,
+	}})
 }
 
-// CreateCA create a certificate authority
-// a CA should include a private key and a certificate (public key) which is self-signed
-func (c *CertController) CreateCA(ctx *gin.Context) {
-	caPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		ctx.JSON(500, gin.H{"error": "Failed to generate CA key"})
+// CreateKey generates a private key from the optional {"key": {...}} spec
+func (c *CertController) CreateKey(ctx *gin.Context) {
+	var req struct {
+		Key *services.KeySpec `json:"key"`
+	}
+	if err := ctx.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		utils.BadRequest(ctx, "Invalid key request", err.Error())
 		return
 	}
-
-	// generate a self-signed certificate
-	caTmpl := &x509.Certificate{
-		Subject:               pkix.Name{Country: []string{"VN"}, Organization: []string{"Private Homelab"}, CommonName: "My Homelab"},
-		SerialNumber:          utils.NewSerialNum(), // random serial number
-		BasicConstraintsValid: true,
-		IsCA:                  true,
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(time.Hour * 24 * 365 * 10), // valid for 10 year
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	keySpec, err := c.keyPolicy.Resolve(req.Key)
+	if err != nil {
+		utils.BadRequest(ctx, "Invalid key spec", err.Error())
+		return
 	}
 
-	if caPriv == nil {
-		ctx.JSON(500, gin.H{"error": "CA private key is nil"})
+	privatekey, err := keySpec.Generate()
+	if err != nil {
+		ctx.JSON(500, gin.H{"error": "Failed to generate key"})
 		return
 	}
-	caCertDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, caPriv.Public(), caPriv)
+
+	// convert to PEM format, PKCS#8 holds every key algorithm
+	privatekeyDER, err := x509.MarshalPKCS8PrivateKey(privatekey)
 	if err != nil {
-		ctx.JSON(500, gin.H{"error": "Failed to marshal CA cert"})
+		ctx.JSON(500, gin.H{"error": "Failed to marshal key: " + err.Error()})
 		return
 	}
-	caPrivDER, err := x509.MarshalPKCS8PrivateKey(caPriv)
+	privakeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privatekeyDER})
+	base64PEM := base64.StdEncoding.EncodeToString(privakeyPEM)
+
+	ctx.JSON(200, gin.H{"pem": string(base64PEM), "base64_encoded": true, "key": keySpec})
+}
+
+// csrPolicyTemplate builds the certificate for a CSR without a profile.
+// Only the subject and SANs are taken from the CSR, usages and lifetime come from policy.
+func (c *CertController) csrPolicyTemplate(csr *x509.CertificateRequest, req csrRequest) (*x509.Certificate, error) {
+	if err := c.csrPolicy.Check(csr, false); err != nil {
+		return nil, err
+	}
+	extKeyUsage, err := c.csrPolicy.ExtKeyUsages(req.ExtKeyUsages)
 	if err != nil {
-		ctx.JSON(500, gin.H{"error": "Failed to marshal CA private key"})
-		return
+		return nil, err
 	}
 
-	// Encode the certificate to PEM format for easy storage and transfer
-	caCertPEM := pem.EncodeToMemory(&pem.Block{Bytes: caCertDER, Type: "CERTIFICATE"})
-	// Encode the private key to PEM format to ensure compatibility with other tools and systems
-	caPrivPEM := pem.EncodeToMemory(&pem.Block{Bytes: caPrivDER, Type: "EC PRIVATE KEY"})
-	ctx.JSON(200, gin.H{
-		"certPEM": caCertPEM,
-		"keyPEM":  caPrivPEM,
-	}) // the client can then use base64 decode to view the PEM files
+	validDays, err := resolveValidDays(req.ValidDays, c.maxValidDays)
+	if err != nil {
+		return nil, err
+	}
+
+	notBefore := time.Now()
+	return &x509.Certificate{
+		Subject:     services.CSRSubject(csr.Subject),
+		NotBefore:   notBefore,
+		NotAfter:    certNotAfter(notBefore, validDays),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: extKeyUsage,
+		DNSNames:    csr.DNSNames,
+		IPAddresses: csr.IPAddresses,
+	}, nil
 }
 
-func (c *CertController) CreateKey(ctx *gin.Context) {
-	// Logic to create a key
-	// use RSA for now
-	privatekey, err := rsa.GenerateKey(rand.Reader, 2048)
+// csrProfileTemplate builds the certificate for a CSR from a named profile.
+// The CSR policy applies as without a profile, except that the profile vets email SANs, usages come from the profile.
+func (c *CertController) csrProfileTemplate(ctx context.Context, csr *x509.CertificateRequest, req csrRequest) (*x509.Certificate, error) {
+	if len(req.ExtKeyUsages) > 0 {
+		return nil, fmt.Errorf("extKeyUsages cannot be combined with a profile")
+	}
+	profile, err := c.profiles.GetProfile(ctx, req.Profile)
 	if err != nil {
-		ctx.JSON(500, gin.H{"error": "Failed to generate key"})
-		return
+		return nil, fmt.Errorf("unknown profile %q", req.Profile)
 	}
 
-	// convert to PEM format
-	privatekeyDER := x509.MarshalPKCS1PrivateKey(privatekey)
-	privatekeyBlock := pem.Block{
-		Type: "RSA PRIVATE KEY",
-		// WARN: why doesn't openssl RSA understand the headers?
-		Bytes: privatekeyDER,
+	if err := c.csrPolicy.Check(csr, true); err != nil {
+		return nil, err
 	}
 
-	privakeyPEM := pem.EncodeToMemory(&privatekeyBlock)
-	base64PEM := base64.StdEncoding.EncodeToString(privakeyPEM)
+	return services.ApplyProfile(profile, services.ProfileRequest{
+		Subject:        services.CSRSubject(csr.Subject),
+		DNSNames:       csr.DNSNames,
+		IPAddresses:    csr.IPAddresses,
+		EmailAddresses: csr.EmailAddresses,
+		ValidDays:      req.ValidDays,
+	})
+}
 
-	fmt.Printf("Generated PEM successfully\n")
-	ctx.JSON(200, gin.H{"pem": string(base64PEM), "base64_encoded": true})
+// NewCertController creates a new cert controller signing through issuer
+// and recording every issued certificate in store, client certificates are bound to users of users
+func NewCertController(cfg *config.Config, store models.CertStore, users models.UserStore, profiles models.ProfileStore, issuer *services.Issuer, keyPolicy *services.KeyPolicy, revoker *services.RevocationService) *CertController {
+	return &CertController{
+		store:        store,
+		users:        users,
+		profiles:     profiles,
+		issuer:       issuer,
+		keyPolicy:    keyPolicy,
+		revoker:      revoker,
+		maxValidDays: cfg.MaxCertValidDays,
+		csrPolicy:    newCSRPolicy(cfg, keyPolicy),
+		authRequired: cfg.AuthRequired,
+	}
 }
 
-func NewCertController() *CertController {
-	return &CertController{}
+// newCSRPolicy builds the CSR signing policy from configuration
+func newCSRPolicy(cfg *config.Config, keyPolicy *services.KeyPolicy) services.CSRPolicy {
+	return services.CSRPolicy{
+		AllowedDomains:      cfg.CSRAllowedDomains,
+		AllowIPAddresses:    cfg.CSRAllowIPAddresses,
+		AllowedExtKeyUsages: cfg.CSRAllowedExtKeyUsages,
+		MinRSABits:          cfg.CSRMinRSABits,
+		Keys:                keyPolicy,
+	}
 }
@@ -0,0 +1,253 @@
+package controllers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"ca-server/middleware"
+	"ca-server/utils"
+
+	"github.com/gin-gonic/gin"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Export formats of the issuance endpoints
+const (
+	formatJSON       = "json"
+	formatPEM        = "pem"
+	formatDER        = "der"
+	formatPKCS12     = "p12"
+	formatTrustStore = "truststore"
+	formatTar        = "tar"
+	formatZip        = "zip"
+)
+
+// formatMediaTypes maps the Accept media types to export formats
+var formatMediaTypes = map[string]string{
+	"application/json":                  formatJSON,
+	"application/x-pem-file":            formatPEM,
+	"application/pem-certificate-chain": formatPEM,
+	"application/pkix-cert":             formatDER,
+	"application/x-pkcs12":              formatPKCS12,
+	"application/x-tar":                 formatTar,
+	"application/zip":                   formatZip,
+}
+
+// fileNameUnsafe matches characters not kept in download file names
+var fileNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// exportRequest holds the export fields shared by the issuance request bodies
+type exportRequest struct {
+	// Format is json, pem, der, p12, truststore, tar or zip, taken from ?format= or Accept when empty
+	Format string `json:"format"`
+	// Password encrypts p12 and truststore downloads
+	Password string `json:"password"`
+}
+
+// exportOptions selects how issued credentials are returned
+type exportOptions struct {
+	format   string
+	password string
+	// legacy selects 3DES encryption for PKCS#12 files, for Windows before Server 2019 and Java before 8u301
+	legacy bool
+}
+
+// credentials are the issued certificate with its issuers and, when generated by the server, its key
+type credentials struct {
+	cert  *x509.Certificate
+	chain []*x509.Certificate
+	key   crypto.Signer
+	extra gin.H
+}
+
+// parseExportOptions picks the format from the request body, the format query parameter or
+// the Accept header, in that order. It is checked before issuing so a bad format issues nothing.
+func parseExportOptions(ctx *gin.Context, req exportRequest, hasKey bool) (exportOptions, error) {
+	opts := exportOptions{
+		format:   strings.ToLower(req.Format),
+		password: req.Password,
+		legacy:   ctx.Query("p12Encryption") == "legacy",
+	}
+	if opts.format == "" {
+		opts.format = strings.ToLower(ctx.Query("format"))
+	}
+	if opts.format == "" {
+		opts.format = formatFromAccept(ctx.GetHeader("Accept"))
+	}
+
+	switch opts.format {
+	case formatJSON, formatPEM, formatTar, formatZip:
+	case formatDER, formatTrustStore:
+		if hasKey {
+			return opts, fmt.Errorf("%s carries no private key, use json, pem, p12, tar or zip for a key generated by the server", opts.format)
+		}
+	case formatPKCS12:
+		if !hasKey {
+			return opts, fmt.Errorf("p12 needs a private key generated by the server, CSR keys stay with the caller")
+		}
+		if opts.password == "" {
+			return opts, fmt.Errorf("password is required for p12")
+		}
+	default:
+		return opts, fmt.Errorf("unsupported format %q, use json, pem, der, p12, truststore, tar or zip", opts.format)
+	}
+	return opts, nil
+}
+
+// formatFromAccept returns the format of the first supported media type in an Accept header
+func formatFromAccept(accept string) string {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if format, ok := formatMediaTypes[mediaType]; ok {
+			return format
+		}
+	}
+	return formatJSON
+}
+
+// respondCredentials writes issued credentials in the requested format
+func respondCredentials(ctx *gin.Context, opts exportOptions, creds credentials) {
+	var keyPEM []byte
+	if creds.key != nil {
+		keyDER, err := x509.MarshalPKCS8PrivateKey(creds.key)
+		if err != nil {
+			ctx.JSON(500, gin.H{"error": "Failed to marshal private key: " + err.Error()})
+			return
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	}
+	middleware.AddAuditDetail(ctx, "serialNumber", creds.cert.SerialNumber.String())
+	middleware.AddAuditDetail(ctx, "subject", creds.cert.Subject.String())
+	middleware.AddAuditDetail(ctx, "format", opts.format)
+	middleware.AddAuditDetail(ctx, "keyExported", creds.key != nil && opts.format != formatDER && opts.format != formatTrustStore)
+	certPEM := utils.EncodeCertsPEM(creds.cert)
+	caPEM := utils.EncodeCertsPEM(creds.chain...)
+	name := fileNameUnsafe.ReplaceAllString(creds.cert.Subject.CommonName, "_")
+	if name == "" {
+		name = creds.cert.SerialNumber.String()
+	}
+
+	switch opts.format {
+	case formatPEM:
+		// leaf, issuers, then the key, the layout nginx and haproxy accept
+		bundle := append(append(certPEM, caPEM...), keyPEM...)
+		sendFile(ctx, name+".pem", "application/x-pem-file", bundle)
+	case formatDER:
+		sendFile(ctx, name+".der", "application/pkix-cert", creds.cert.Raw)
+	case formatPKCS12:
+		encoder := pkcs12.Modern
+		if opts.legacy {
+			encoder = pkcs12.LegacyDES
+		}
+		pfx, err := encoder.WithRand(rand.Reader).Encode(creds.key, creds.cert, creds.chain, opts.password)
+		if err != nil {
+			ctx.JSON(500, gin.H{"error": "Failed to encode PKCS#12: " + err.Error()})
+			return
+		}
+		sendFile(ctx, name+".p12", "application/x-pkcs12", pfx)
+	case formatTrustStore:
+		// a Java trust store holding the issuers, for clients verifying the certificate
+		pfx, err := pkcs12.Modern.WithRand(rand.Reader).EncodeTrustStore(creds.chain, opts.password)
+		if err != nil {
+			ctx.JSON(500, gin.H{"error": "Failed to encode trust store: " + err.Error()})
+			return
+		}
+		sendFile(ctx, name+"-truststore.p12", "application/x-pkcs12", pfx)
+	case formatTar, formatZip:
+		files := []archiveFile{{"cert.pem", certPEM, 0644}, {"ca.pem", caPEM, 0644}}
+		if keyPEM != nil {
+			files = append(files, archiveFile{"key.pem", keyPEM, 0600})
+		}
+		writeArchive := writeTar
+		contentType := "application/x-tar"
+		if opts.format == formatZip {
+			writeArchive, contentType = writeZip, "application/zip"
+		}
+		archive, err := writeArchive(files)
+		if err != nil {
+			ctx.JSON(500, gin.H{"error": "Failed to write archive: " + err.Error()})
+			return
+		}
+		sendFile(ctx, name+"."+opts.format, contentType, archive)
+	default:
+		resp := gin.H{
+			"certPEM":  certPEM,
+			"chainPEM": append(certPEM, caPEM...),
+		}
+		if keyPEM != nil {
+			resp["keyPEM"] = keyPEM
+		}
+		for k, v := range creds.extra {
+			resp[k] = v
+		}
+		ctx.JSON(200, resp)
+	}
+}
+
+// sendFile answers with data as a download named fileName
+func sendFile(ctx *gin.Context, fileName, contentType string, data []byte) {
+	ctx.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	ctx.Data(http.StatusOK, contentType, data)
+}
+
+// archiveFile is a file written to a tar or zip download
+type archiveFile struct {
+	name string
+	data []byte
+	mode int64
+}
+
+// writeTar packs files into a tar archive
+func writeTar(files []archiveFile) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: f.mode, Size: int64(len(f.data)), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeZip packs files into a zip archive
+func writeZip(files []archiveFile) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: time.Now()}
+		hdr.SetMode(fs.FileMode(f.mode))
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(f.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
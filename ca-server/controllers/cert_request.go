@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"ca-server/models"
+	"ca-server/services"
+	"ca-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultValidDays = 365
+	// maxCommonNameLength is ub-common-name from RFC 5280
+	maxCommonNameLength = 64
+)
+
+// certRequest is the request body accepted by the leaf issuing endpoints
+type certRequest struct {
+	CommonName     string   `json:"commonName" binding:"required"`
+	DNSNames       []string `json:"dnsNames"`
+	IPAddresses    []string `json:"ipAddresses,omitempty"`
+	EmailAddresses []string `json:"emailAddresses,omitempty"`
+	// ValidDays of 0 selects the profile default
+	ValidDays int `json:"validDays"`
+	// Profile names the issuance profile, e.g. server, client or peer
+	Profile string `json:"profile"`
+	// CAID picks the signing CA, the issuing CA when empty
+	CAID string `json:"caId"`
+	// Key selects the generated key pair, the configured default when unset
+	Key *services.KeySpec `json:"key"`
+	exportRequest
+}
+
+// validate normalizes the request and returns the parsed IP SANs.
+// Which SANs are allowed and the lifetime are checked against the profile.
+func (r *certRequest) validate() ([]net.IP, error) {
+	r.CommonName = strings.TrimSpace(r.CommonName)
+	if r.CommonName == "" {
+		return nil, fmt.Errorf("commonName must not be empty")
+	}
+	if len(r.CommonName) > maxCommonNameLength {
+		return nil, fmt.Errorf("commonName must be at most %d characters", maxCommonNameLength)
+	}
+
+	for i, name := range r.DNSNames {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !utils.IsValidDNSName(name) {
+			return nil, fmt.Errorf("invalid DNS name: %q", r.DNSNames[i])
+		}
+		r.DNSNames[i] = name
+	}
+	for i, email := range r.EmailAddresses {
+		r.EmailAddresses[i] = strings.TrimSpace(email)
+	}
+
+	ips := make([]net.IP, 0, len(r.IPAddresses))
+	for _, ip := range r.IPAddresses {
+		parsedIP := net.ParseIP(strings.TrimSpace(ip))
+		if parsedIP == nil {
+			return nil, fmt.Errorf("invalid IP address: %q", ip)
+		}
+		ips = append(ips, parsedIP)
+	}
+
+	return ips, nil
+}
+
+// resolveValidDays applies the default lifetime and the server-side maximum
+func resolveValidDays(validDays, maxValidDays int) (int, error) {
+	if validDays < 0 {
+		return 0, fmt.Errorf("validDays must be positive")
+	}
+	if validDays == 0 {
+		validDays = defaultValidDays
+	}
+	if validDays > maxValidDays {
+		return 0, fmt.Errorf("validDays must not exceed %d", maxValidDays)
+	}
+	return validDays, nil
+}
+
+// certNotAfter computes the expiry of a certificate, the issuer caps it to the CA's lifetime
+func certNotAfter(notBefore time.Time, validDays int) time.Time {
+	return notBefore.Add(time.Hour * 24 * time.Duration(validDays))
+}
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// parseCertFilter builds a certificate listing filter from the query string.
+// Pages are picked by number or, for listings that change while they are read, by the cursor
+// of the previous page, the page number is 0 then.
+func parseCertFilter(ctx *gin.Context) (models.CertFilter, int, int, error) {
+	filter := models.CertFilter{
+		Subject: ctx.Query("subject"),
+		Issuer:  ctx.Query("issuer"),
+		Sort:    ctx.Query("sort"),
+		Cursor:  ctx.Query("cursor"),
+	}
+
+	var err error
+	if value := ctx.Query("expiresAfter"); value != "" {
+		if filter.ExpiresAfter, err = time.Parse(time.RFC3339, value); err != nil {
+			return filter, 0, 0, fmt.Errorf("expiresAfter must be an RFC 3339 timestamp")
+		}
+	}
+	if value := ctx.Query("expiresBefore"); value != "" {
+		if filter.ExpiresBefore, err = time.Parse(time.RFC3339, value); err != nil {
+			return filter, 0, 0, fmt.Errorf("expiresBefore must be an RFC 3339 timestamp")
+		}
+	}
+	if value := ctx.Query("isCA"); value != "" {
+		isCA, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, 0, 0, fmt.Errorf("isCA must be true or false")
+		}
+		filter.IsCA = &isCA
+	}
+
+	pageSize, err := parsePageSize(ctx)
+	if err != nil {
+		return filter, 0, 0, err
+	}
+	filter.Limit = pageSize
+	if filter.Cursor != "" {
+		if ctx.Query("page") != "" {
+			return filter, 0, 0, fmt.Errorf("page cannot be combined with cursor")
+		}
+		return filter, 0, pageSize, nil
+	}
+
+	page, err := strconv.Atoi(ctx.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		return filter, 0, 0, fmt.Errorf("page must be a positive integer")
+	}
+	filter.Offset = (page - 1) * pageSize
+	return filter, page, pageSize, nil
+}
+
+// parsePageSize reads the pageSize query param
+func parsePageSize(ctx *gin.Context) (int, error) {
+	pageSize, err := strconv.Atoi(ctx.DefaultQuery("pageSize", strconv.Itoa(defaultPageSize)))
+	if err != nil || pageSize < 1 || pageSize > maxPageSize {
+		return 0, fmt.Errorf("pageSize must be between 1 and %d", maxPageSize)
+	}
+	return pageSize, nil
+}
+
+// renewRequest is the optional request body accepted by the renewal endpoint
+type renewRequest struct {
+	// Rekey generates a new key pair from Key, otherwise the existing public key is certified again
+	Rekey bool              `json:"rekey"`
+	Key   *services.KeySpec `json:"key"`
+	// Profile replaces the recorded profile, required for certificates issued without one
+	Profile string `json:"profile"`
+	// ValidDays of 0 selects the profile default
+	ValidDays int `json:"validDays"`
+	// CAID picks the signing CA, the CA of the original certificate when empty
+	CAID string `json:"caId"`
+	// RevokeOld revokes the original as superseded once GraceHours have passed, right away when 0
+	RevokeOld  bool `json:"revokeOld"`
+	GraceHours int  `json:"graceHours"`
+	exportRequest
+}
+
+// validate checks the renewal options that do not depend on the original certificate
+func (r *renewRequest) validate() error {
+	if r.Key != nil && !r.Rekey {
+		return fmt.Errorf("key is only used with rekey")
+	}
+	if r.GraceHours < 0 {
+		return fmt.Errorf("graceHours must not be negative")
+	}
+	if r.GraceHours > 0 && !r.RevokeOld {
+		return fmt.Errorf("graceHours is only used with revokeOld")
+	}
+	return nil
+}
+
+// revokeRequest is the request body accepted by the revocation endpoint
+type revokeRequest struct {
+	// Reason is an RFC 5280 CRLReason code
+	Reason int `json:"reason"`
+}
+
+// validate rejects reason codes that are unassigned or only valid in delta CRLs
+func (r *revokeRequest) validate() error {
+	if r.Reason < 0 || r.Reason > 10 || r.Reason == 7 || r.Reason == 8 {
+		return fmt.Errorf("reason must be an RFC 5280 CRLReason code: 0-6, 9 or 10")
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"strings"
+
+	"ca-server/models"
+	"ca-server/services"
+	"ca-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CRLController serves the certificate revocation list
+type CRLController struct {
+	crlService *services.CRLService
+}
+
+// NewCRLController creates a new CRL controller
+func NewCRLController(crlService *services.CRLService) *CRLController {
+	return &CRLController{
+		crlService: crlService,
+	}
+}
+
+// GetCRL returns the CRL of the CA in the id path param, or of the issuing CA without one.
+// It is DER encoded, or PEM with ?format=pem or an Accept header asking for PEM.
+func (c *CRLController) GetCRL(ctx *gin.Context) {
+	der, err := c.crlService.Get(ctx.Request.Context(), ctx.Param("id"))
+	if errors.Is(err, models.ErrCANotFound) {
+		utils.NotFound(ctx, "CA not found")
+		return
+	}
+	if err != nil {
+		utils.ServiceUnavailable(ctx, "CRL is not available", err.Error())
+		return
+	}
+
+	if ctx.Query("format") == "pem" || strings.Contains(ctx.GetHeader("Accept"), "application/x-pem-file") {
+		ctx.Data(http.StatusOK, "application/x-pem-file", pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}))
+		return
+	}
+
+	ctx.Data(http.StatusOK, "application/pkix-crl", der)
+}
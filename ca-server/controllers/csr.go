@@ -0,0 +1,44 @@
+package controllers
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// csrRequest is the request body accepted by the CSR signing endpoint
+type csrRequest struct {
+	CSR          string   `json:"csr" binding:"required"`
+	ExtKeyUsages []string `json:"extKeyUsages"`
+	ValidDays    int      `json:"validDays"`
+	// CAID picks the signing CA, the issuing CA when empty
+	CAID string `json:"caId"`
+	// Profile selects usages, lifetime and allowed SANs instead of the CSR policy
+	Profile string `json:"profile"`
+	exportRequest
+}
+
+// parseCSR decodes a PEM encoded PKCS#10 request and verifies its self-signature.
+// Private keys are refused outright so they never end up in the server's logs or memory.
+func parseCSR(pemData string) (*x509.CertificateRequest, error) {
+	if strings.Contains(pemData, "PRIVATE KEY") {
+		return nil, fmt.Errorf("request contains a private key, submit only the CSR")
+	}
+
+	block, _ := pem.Decode([]byte(pemData))
+	if block == nil || (block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST") {
+		return nil, fmt.Errorf("csr must be a PEM encoded CERTIFICATE REQUEST")
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse csr: %w", err)
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid csr signature: %w", err)
+	}
+
+	return csr, nil
+}
@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"net/http"
+
+	"ca-server/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ExpiryController serves the alert state of the expiry watcher
+type ExpiryController struct {
+	watcher *services.ExpiryWatcher
+}
+
+// NewExpiryController creates a new expiry controller
+func NewExpiryController(watcher *services.ExpiryWatcher) *ExpiryController {
+	return &ExpiryController{
+		watcher: watcher,
+	}
+}
+
+// ListExpiring returns the certificates inside an expiry threshold as of the last scan
+func (c *ExpiryController) ListExpiring(ctx *gin.Context) {
+	alerts, lastScan := c.watcher.Alerts()
+
+	resp := gin.H{
+		"items":         alerts,
+		"thresholdDays": c.watcher.Thresholds(),
+	}
+	if !lastScan.IsZero() {
+		resp["lastScan"] = lastScan
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
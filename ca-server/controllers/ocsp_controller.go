@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"ca-server/services"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ocsp"
+)
+
+// maxOCSPRequestSize bounds POST bodies, real requests are a few hundred bytes
+const maxOCSPRequestSize = 10 * 1024
+
+// ocspErrorResponses are the unsigned responses to requests that were not answered, never cached
+var ocspErrorResponses = [][]byte{
+	ocsp.MalformedRequestErrorResponse,
+	ocsp.InternalErrorErrorResponse,
+	ocsp.TryLaterErrorResponse,
+	ocsp.SigRequredErrorResponse,
+	ocsp.UnauthorizedErrorResponse,
+}
+
+// OCSPController serves the OCSP responder over HTTP as described in RFC 6960 appendix A
+type OCSPController struct {
+	ocspService *services.OCSPService
+}
+
+// NewOCSPController creates a new OCSP controller
+func NewOCSPController(ocspService *services.OCSPService) *OCSPController {
+	return &OCSPController{
+		ocspService: ocspService,
+	}
+}
+
+// Get answers a base64 encoded request carried in the URL path
+func (c *OCSPController) Get(ctx *gin.Context) {
+	encoded := strings.TrimPrefix(ctx.Param("request"), "/")
+	reqDER, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		c.write(ctx, ocsp.MalformedRequestErrorResponse, false)
+		return
+	}
+
+	c.respond(ctx, reqDER, true)
+}
+
+// Post answers a DER encoded request in the body
+func (c *OCSPController) Post(ctx *gin.Context) {
+	reqDER, err := io.ReadAll(io.LimitReader(ctx.Request.Body, maxOCSPRequestSize))
+	if err != nil {
+		c.write(ctx, ocsp.MalformedRequestErrorResponse, false)
+		return
+	}
+
+	c.respond(ctx, reqDER, false)
+}
+
+func (c *OCSPController) respond(ctx *gin.Context, reqDER []byte, cacheable bool) {
+	resp, err := c.ocspService.Respond(ctx.Request.Context(), reqDER)
+	if err != nil {
+		log.Printf("OCSP responder error: %v", err)
+		cacheable = false
+	}
+
+	c.write(ctx, resp, cacheable)
+}
+
+func (c *OCSPController) write(ctx *gin.Context, resp []byte, cacheable bool) {
+	if cacheable && !slices.ContainsFunc(ocspErrorResponses, func(e []byte) bool { return bytes.Equal(resp, e) }) {
+		ctx.Header("Cache-Control", fmt.Sprintf("max-age=%d, public, no-transform, must-revalidate", int(c.ocspService.MaxAge().Seconds())))
+	}
+	ctx.Data(http.StatusOK, "application/ocsp-response", resp)
+}
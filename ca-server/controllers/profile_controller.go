@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"net/http"
+
+	"ca-server/models"
+	"ca-server/services"
+	"ca-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ProfileController manages the named issuance profiles
+type ProfileController struct {
+	store        models.ProfileStore
+	maxValidDays int
+}
+
+// NewProfileController creates a new profile controller, maxValidDays caps every profile's lifetime
+func NewProfileController(store models.ProfileStore, maxValidDays int) *ProfileController {
+	return &ProfileController{
+		store:        store,
+		maxValidDays: maxValidDays,
+	}
+}
+
+// ListProfiles returns every profile
+func (c *ProfileController) ListProfiles(ctx *gin.Context) {
+	profiles, err := c.store.ListProfiles(ctx.Request.Context())
+	if err != nil {
+		respondStoreError(ctx, err, "Profile")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"items": profiles})
+}
+
+// GetProfile returns a profile by name
+func (c *ProfileController) GetProfile(ctx *gin.Context) {
+	profile, err := c.store.GetProfile(ctx.Request.Context(), ctx.Param("name"))
+	if err != nil {
+		respondStoreError(ctx, err, "Profile")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, profile)
+}
+
+// CreateProfile adds a new profile
+func (c *ProfileController) CreateProfile(ctx *gin.Context) {
+	var profile models.Profile
+	if err := ctx.ShouldBindJSON(&profile); err != nil {
+		utils.BadRequest(ctx, "Invalid profile", err.Error())
+		return
+	}
+	if err := services.ValidateProfile(&profile, c.maxValidDays); err != nil {
+		utils.BadRequest(ctx, "Invalid profile", err.Error())
+		return
+	}
+
+	if err := c.store.CreateProfile(ctx.Request.Context(), &profile); err != nil {
+		respondStoreError(ctx, err, "Profile")
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, profile)
+}
+
+// UpdateProfile replaces an existing profile
+func (c *ProfileController) UpdateProfile(ctx *gin.Context) {
+	var profile models.Profile
+	if err := ctx.ShouldBindJSON(&profile); err != nil {
+		utils.BadRequest(ctx, "Invalid profile", err.Error())
+		return
+	}
+
+	// Ensure the name in the path matches the body
+	profile.Name = ctx.Param("name")
+	if err := services.ValidateProfile(&profile, c.maxValidDays); err != nil {
+		utils.BadRequest(ctx, "Invalid profile", err.Error())
+		return
+	}
+
+	if err := c.store.UpdateProfile(ctx.Request.Context(), &profile); err != nil {
+		respondStoreError(ctx, err, "Profile")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, profile)
+}
+
+// DeleteProfile removes a profile, certificates issued from it are not affected
+func (c *ProfileController) DeleteProfile(ctx *gin.Context) {
+	name := ctx.Param("name")
+
+	if err := c.store.DeleteProfile(ctx.Request.Context(), name); err != nil {
+		respondStoreError(ctx, err, "Profile")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "Profile deleted successfully",
+		"name":    name,
+	})
+}
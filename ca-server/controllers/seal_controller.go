@@ -0,0 +1,73 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"ca-server/models"
+	"ca-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SealController locks and unlocks the CA keys
+type SealController struct {
+	caStore models.CAStore
+}
+
+// NewSealController creates a new seal controller
+func NewSealController(caStore models.CAStore) *SealController {
+	return &SealController{
+		caStore: caStore,
+	}
+}
+
+// unsealRequest carries the key encryption passphrase
+type unsealRequest struct {
+	Passphrase string `json:"passphrase" binding:"required"`
+}
+
+// SealStatus reports whether the CA keys are sealed
+func (c *SealController) SealStatus(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"sealed": c.caStore.Sealed()})
+}
+
+// Unseal decrypts the CA keys so signing endpoints become available
+func (c *SealController) Unseal(ctx *gin.Context) {
+	var req unsealRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(ctx, "Invalid unseal request", err.Error())
+		return
+	}
+
+	err := c.caStore.Unseal([]byte(req.Passphrase))
+	if errors.Is(err, models.ErrCANotSealed) {
+		utils.Conflict(ctx, "CA keys are not sealed")
+		return
+	}
+	if errors.Is(err, utils.ErrIncorrectPassphrase) {
+		utils.Forbidden(ctx, "Incorrect passphrase")
+		return
+	}
+	if err != nil {
+		utils.InternalServerError(ctx, "Failed to unseal CA keys: "+err.Error())
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"sealed": false})
+}
+
+// Seal drops the decrypted CA keys, signing endpoints return 503 until the next unseal
+func (c *SealController) Seal(ctx *gin.Context) {
+	err := c.caStore.Seal()
+	if errors.Is(err, models.ErrNoKEK) {
+		utils.Conflict(ctx, err.Error())
+		return
+	}
+	if err != nil {
+		utils.InternalServerError(ctx, "Failed to seal CA keys: "+err.Error())
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"sealed": true})
+}
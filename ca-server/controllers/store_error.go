@@ -0,0 +1,26 @@
+package controllers
+
+import (
+	"errors"
+
+	"ca-server/models"
+	"ca-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// respondStoreError maps a store error to a response, record names the kind of record, e.g. "User"
+func respondStoreError(ctx *gin.Context, err error, record string) {
+	switch {
+	case errors.Is(err, models.ErrNotFound):
+		utils.NotFound(ctx, record+" not found")
+	case errors.Is(err, models.ErrConflict):
+		utils.Conflict(ctx, record+" already exists")
+	case errors.Is(err, models.ErrVersionMismatch):
+		utils.PreconditionFailed(ctx, record+" was changed, fetch it again")
+	case errors.Is(err, models.ErrInvalidFilter):
+		utils.BadRequest(ctx, "Invalid query", err.Error())
+	default:
+		utils.InternalServerError(ctx, err.Error())
+	}
+}
@@ -1,75 +1,184 @@
 package controllers
 
 import (
+	"bytes"
+	"ca-server/middleware"
 	"ca-server/models"
+	"ca-server/services"
 	"ca-server/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 // UserController handles user-related API endpoints
 type UserController struct {
-	store models.Store
+	store     models.Store
+	lifecycle *services.UserLifecycle
+	verifier  *services.UserVerifier
 }
 
-// NewUserController creates a new user controller with the given store
-func NewUserController(store models.Store) *UserController {
+// NewUserController creates a new user controller with the given store, lifecycle revokes the
+// credentials of disabled users and verifier activates pending users with a token sent to their email
+func NewUserController(store models.Store, lifecycle *services.UserLifecycle, verifier *services.UserVerifier) *UserController {
 	return &UserController{
-		store: store,
+		store:     store,
+		lifecycle: lifecycle,
+		verifier:  verifier,
 	}
 }
 
-// GetUser returns a user by ID
+// verificationResponse is a pending user with the token that activates it, shown only once
+type verificationResponse struct {
+	*models.User
+	VerificationToken   string    `json:"verificationToken"`
+	VerificationExpires time.Time `json:"verificationExpires"`
+}
+
+// GetUser returns a user by ID with its version as ETag, 304 when If-None-Match lists it
 func (c *UserController) GetUser(ctx *gin.Context) {
 	userID := ctx.Param("id")
 
-	user, err := c.store.GetUser(userID)
+	user, err := c.store.GetUser(ctx.Request.Context(), userID)
 	if err != nil {
-		utils.NotFound(ctx, "User not found")
+		respondStoreError(ctx, err, "User")
 		return
 	}
 
-	ctx.JSON(http.StatusOK, user)
+	if header := ctx.GetHeader("If-None-Match"); header != "" && etagListed(header, userETag(user), true) {
+		ctx.Header("ETag", userETag(user))
+		ctx.Status(http.StatusNotModified)
+		return
+	}
+	respondUser(ctx, http.StatusOK, user)
 }
 
-// ListUsers returns a list of users
+// ListUsers returns a page of users.
+// Supports name, email, role, sort, cursor and pageSize query params.
 func (c *UserController) ListUsers(ctx *gin.Context) {
-	users, err := c.store.ListUsers()
+	filter, err := parseUserFilter(ctx)
 	if err != nil {
-		utils.InternalServerError(ctx, err.Error())
+		utils.BadRequest(ctx, "Invalid query", err.Error())
+		return
+	}
+
+	users, err := c.store.ListUsers(ctx.Request.Context(), filter)
+	if err != nil {
+		respondStoreError(ctx, err, "User")
 		return
 	}
 
 	ctx.JSON(http.StatusOK, users)
 }
 
-// CreateUser creates a new user
+// CreateUser creates a new user, the server assigns its ID and it starts active unless the body says pending.
+// A pending user comes with the verification token to send to its email.
 func (c *UserController) CreateUser(ctx *gin.Context) {
 	var user models.User
 
-	// Bind JSON request body to user model
-	if err := ctx.ShouldBindJSON(&user); err != nil {
+	if err := decodeUser(ctx.Request.Body, &user); err != nil {
 		utils.BadRequest(ctx, "Invalid user data", err.Error())
 		return
 	}
+	if user.ID != "" {
+		utils.BadRequest(ctx, "Invalid user data", "id is assigned by the server")
+		return
+	}
+	if err := validateUser(&user); err != nil {
+		utils.BadRequest(ctx, "Invalid user data", err.Error())
+		return
+	}
+	if user.Status == models.UserDisabled {
+		utils.BadRequest(ctx, "Invalid user data", "new users are pending or active")
+		return
+	}
 
 	// Create the user
-	if err := c.store.CreateUser(&user); err != nil {
+	if err := c.store.CreateUser(ctx.Request.Context(), &user); err != nil {
+		respondUserError(ctx, err)
+		return
+	}
+
+	if user.Status == models.UserPending {
+		c.respondVerification(ctx, http.StatusCreated, &user)
+		return
+	}
+	respondUser(ctx, http.StatusCreated, &user)
+}
+
+// IssueVerification issues a new verification token for a pending user, e.g. after the last one expired
+func (c *UserController) IssueVerification(ctx *gin.Context) {
+	user, err := c.store.GetUser(ctx.Request.Context(), ctx.Param("id"))
+	if err != nil {
+		respondStoreError(ctx, err, "User")
+		return
+	}
+	c.respondVerification(ctx, http.StatusOK, user)
+}
+
+// VerifyUser activates the pending user a verification token was issued for. It takes no
+// credentials, the token is the proof, and it is void once used or once the user changed.
+func (c *UserController) VerifyUser(ctx *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(ctx, "Invalid verification request", err.Error())
+		return
+	}
+
+	user, err := c.verifier.Verify(ctx.Request.Context(), req.Token, time.Now())
+	if errors.Is(err, services.ErrInvalidVerification) {
+		utils.BadRequest(ctx, "Invalid verification token", err.Error())
+		return
+	}
+	if err != nil {
+		utils.InternalServerError(ctx, err.Error())
+		return
+	}
+	middleware.AddAuditDetail(ctx, "userId", user.ID)
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"id":     user.ID,
+		"status": user.Status,
+	})
+}
+
+// respondVerification sends a pending user with a fresh verification token
+func (c *UserController) respondVerification(ctx *gin.Context, status int, user *models.User) {
+	token, expires, err := c.verifier.Token(user, time.Now())
+	if errors.Is(err, services.ErrNotPending) {
+		utils.Conflict(ctx, "Only pending users are verified")
+		return
+	}
+	if err != nil {
 		utils.InternalServerError(ctx, err.Error())
 		return
 	}
 
-	ctx.JSON(http.StatusCreated, user)
+	ctx.Header("ETag", userETag(user))
+	ctx.JSON(status, verificationResponse{User: user, VerificationToken: token, VerificationExpires: expires})
 }
 
-// UpdateUser updates an existing user
+// UpdateUser replaces an existing user. With If-Match, or a version in the body, the
+// update only goes through on that version of the user and fails with 412 otherwise.
 func (c *UserController) UpdateUser(ctx *gin.Context) {
 	userID := ctx.Param("id")
 	var user models.User
 
-	// Bind JSON request to user model
-	if err := ctx.ShouldBindJSON(&user); err != nil {
+	if err := decodeUser(ctx.Request.Body, &user); err != nil {
+		utils.BadRequest(ctx, "Invalid user data", err.Error())
+		return
+	}
+	if err := validateUser(&user); err != nil {
 		utils.BadRequest(ctx, "Invalid user data", err.Error())
 		return
 	}
@@ -77,21 +186,144 @@ func (c *UserController) UpdateUser(ctx *gin.Context) {
 	// Ensure ID in path matches ID in body
 	user.ID = userID
 
-	// Update the user
-	if err := c.store.UpdateUser(&user); err != nil {
-		utils.NotFound(ctx, "User not found")
+	current, err := c.store.GetUser(ctx.Request.Context(), userID)
+	if err != nil {
+		respondStoreError(ctx, err, "User")
 		return
 	}
+	if header := ctx.GetHeader("If-Match"); header != "" {
+		if !etagListed(header, userETag(current), false) {
+			utils.PreconditionFailed(ctx, "User was changed, fetch it again")
+			return
+		}
+		user.Version = current.Version
+	}
 
-	ctx.JSON(http.StatusOK, user)
+	c.replaceUser(ctx, current, &user)
 }
 
-// DeleteUser deletes a user
+// PatchUser applies a JSON Merge Patch (RFC 7396) to a user. The patch applies to the version
+// read here, a concurrent update in between fails with 412 like a stale If-Match.
+func (c *UserController) PatchUser(ctx *gin.Context) {
+	userID := ctx.Param("id")
+
+	if contentType := ctx.ContentType(); contentType != "application/merge-patch+json" && contentType != "application/json" {
+		utils.RespondWithError(ctx, http.StatusUnsupportedMediaType, "Unsupported patch format", "use application/merge-patch+json")
+		return
+	}
+	patch, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		utils.BadRequest(ctx, "Invalid patch", err.Error())
+		return
+	}
+
+	current, err := c.store.GetUser(ctx.Request.Context(), userID)
+	if err != nil {
+		respondStoreError(ctx, err, "User")
+		return
+	}
+	if header := ctx.GetHeader("If-Match"); header != "" && !etagListed(header, userETag(current), false) {
+		utils.PreconditionFailed(ctx, "User was changed, fetch it again")
+		return
+	}
+
+	doc, err := json.Marshal(current)
+	if err != nil {
+		utils.InternalServerError(ctx, err.Error())
+		return
+	}
+	merged, err := utils.MergePatch(doc, patch)
+	if err != nil {
+		utils.BadRequest(ctx, "Invalid patch", err.Error())
+		return
+	}
+	var user models.User
+	if err := decodeUser(bytes.NewReader(merged), &user); err != nil {
+		utils.BadRequest(ctx, "Invalid user data", err.Error())
+		return
+	}
+	if user.ID != current.ID {
+		utils.BadRequest(ctx, "Invalid user data", "id cannot be changed")
+		return
+	}
+	if err := validateUser(&user); err != nil {
+		utils.BadRequest(ctx, "Invalid user data", err.Error())
+		return
+	}
+
+	// timestamps and version are the store's, whatever the patch says
+	user.Version = current.Version
+	c.replaceUser(ctx, current, &user)
+}
+
+// replaceUser stores user in place of current, as of the version it was checked against.
+// A user without status keeps that of current, a disabled one loses its API keys and client certificates.
+func (c *UserController) replaceUser(ctx *gin.Context, current, user *models.User) {
+	if user.Status == "" {
+		user.Status = current.CurrentStatus()
+	}
+	if !current.CurrentStatus().CanBecome(user.Status) {
+		utils.Conflict(ctx, fmt.Sprintf("A user that is %s cannot become %s", current.CurrentStatus(), user.Status))
+		return
+	}
+	// the status change was checked against current, so the update must find it unchanged
+	if user.Version == 0 {
+		user.Version = current.Version
+	}
+
+	if err := c.store.UpdateUser(ctx.Request.Context(), user); err != nil {
+		respondUserError(ctx, err)
+		return
+	}
+
+	if user.Status == models.UserDisabled {
+		revoked, err := c.lifecycle.Disabled(ctx.Request.Context(), user)
+		middleware.AddAuditDetail(ctx, "revokedAPIKeys", revoked.APIKeys)
+		middleware.AddAuditDetail(ctx, "revokedCerts", revoked.Certs)
+		var publishErr *services.CRLPublishError
+		if errors.As(err, &publishErr) {
+			// the certificates are revoked and the update is saved, only the CRL lags behind
+			middleware.AddAuditDetail(ctx, "crlError", publishErr.Error())
+			ctx.Header("ETag", userETag(user))
+			ctx.JSON(http.StatusOK, userResponse{User: user, Warning: publishErr.Error() + ", retrying in the background"})
+			return
+		}
+		if err != nil {
+			utils.InternalServerError(ctx, "user is disabled but revoking its credentials failed, retry the update: "+err.Error())
+			return
+		}
+	}
+
+	respondUser(ctx, http.StatusOK, user)
+}
+
+// userResponse is an updated user with a warning when the CRL of its revoked certificates is not published yet
+type userResponse struct {
+	*models.User
+	Warning string `json:"warning,omitempty"`
+}
+
+// DeleteUser deletes a user after revoking its API keys and client certificates like disabling it does.
+// If revoking fails the user stays, so a retry finds its credentials and finishes the job.
 func (c *UserController) DeleteUser(ctx *gin.Context) {
 	userID := ctx.Param("id")
 
-	if err := c.store.DeleteUser(userID); err != nil {
-		utils.NotFound(ctx, "User not found")
+	user, err := c.store.GetUser(ctx.Request.Context(), userID)
+	if err != nil {
+		respondStoreError(ctx, err, "User")
+		return
+	}
+	revoked, err := c.lifecycle.Disabled(ctx.Request.Context(), user)
+	middleware.AddAuditDetail(ctx, "revokedAPIKeys", revoked.APIKeys)
+	middleware.AddAuditDetail(ctx, "revokedCerts", revoked.Certs)
+	var publishErr *services.CRLPublishError
+	if err != nil && !errors.As(err, &publishErr) {
+		utils.InternalServerError(ctx, "revoking the credentials of the user failed, it was not deleted: "+err.Error())
+		return
+	}
+
+	if err := c.store.DeleteUser(ctx.Request.Context(), userID); err != nil {
+		respondStoreError(ctx, err, "User")
 		return
 	}
 
@@ -100,3 +332,144 @@ func (c *UserController) DeleteUser(ctx *gin.Context) {
 		"id":      userID,
 	})
 }
+
+// respondUserError maps a store error of a user write to a response
+func respondUserError(ctx *gin.Context, err error) {
+	if errors.Is(err, models.ErrEmailTaken) {
+		utils.Conflict(ctx, "Email already in use")
+		return
+	}
+	respondStoreError(ctx, err, "User")
+}
+
+// respondUser sends user with its version as ETag
+func respondUser(ctx *gin.Context, status int, user *models.User) {
+	ctx.Header("ETag", userETag(user))
+	ctx.JSON(status, user)
+}
+
+// userETag is the entity tag of a version of a user
+func userETag(user *models.User) string {
+	return `"` + strconv.FormatInt(user.Version, 10) + `"`
+}
+
+// etagListed reports whether header, an If-Match or If-None-Match list, holds etag or is *.
+// Weak tags only match when weak is set, If-Match compares strongly.
+func etagListed(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseUserFilter builds a user listing filter from the query string
+func parseUserFilter(ctx *gin.Context) (models.UserFilter, error) {
+	filter := models.UserFilter{
+		Name:   ctx.Query("name"),
+		Email:  ctx.Query("email"),
+		Sort:   ctx.Query("sort"),
+		Cursor: ctx.Query("cursor"),
+	}
+	if value := ctx.Query("role"); value != "" {
+		role, err := models.ParseRole(value)
+		if err != nil {
+			return filter, err
+		}
+		filter.Role = role
+	}
+
+	pageSize, err := parsePageSize(ctx)
+	if err != nil {
+		return filter, err
+	}
+	filter.Limit = pageSize
+	return filter, nil
+}
+
+// maxUserNameLength bounds user names, in characters
+const maxUserNameLength = 200
+
+// decodeUser decodes a user from body, refusing members the user schema does not have
+func decodeUser(body io.Reader, user *models.User) error {
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(user); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return fmt.Errorf("unexpected data after the user")
+	}
+	return nil
+}
+
+// validateUser checks a user from a request and normalizes its name, email, status, roles and bindings
+func validateUser(user *models.User) error {
+	user.Name = strings.TrimSpace(user.Name)
+	if user.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if len([]rune(user.Name)) > maxUserNameLength {
+		return fmt.Errorf("name is longer than %d characters", maxUserNameLength)
+	}
+
+	user.Email = strings.TrimSpace(user.Email)
+	if user.Email == "" {
+		return fmt.Errorf("email is required")
+	}
+	if address, err := mail.ParseAddress(user.Email); err != nil || address.Address != user.Email {
+		return fmt.Errorf("invalid email %q, use a plain address such as alice@example.com", user.Email)
+	}
+
+	if user.Status != "" {
+		status, err := models.ParseUserStatus(string(user.Status))
+		if err != nil {
+			return err
+		}
+		user.Status = status
+	}
+	if err := validateRoles(user.Roles); err != nil {
+		return err
+	}
+	return validateBindings(user.Bindings)
+}
+
+// validateRoles normalizes role names and rejects unknown ones
+func validateRoles(roles []models.Role) error {
+	for i, role := range roles {
+		parsed, err := models.ParseRole(string(role))
+		if err != nil {
+			return err
+		}
+		roles[i] = parsed
+	}
+	return nil
+}
+
+// validateBindings normalizes role bindings, admin is never scoped and domains are lower case suffixes
+func validateBindings(bindings []models.RoleBinding) error {
+	for i := range bindings {
+		binding := &bindings[i]
+		role, err := models.ParseRole(string(binding.Role))
+		if err != nil {
+			return err
+		}
+		if role == models.RoleAdmin {
+			return fmt.Errorf("the admin role cannot be scoped, grant it through roles")
+		}
+		binding.Role = role
+		for j, domain := range binding.Domains {
+			domain = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(domain), "."), "."))
+			if domain == "" || strings.ContainsAny(domain, "*@ /") {
+				return fmt.Errorf("invalid domain suffix %q in %s binding", binding.Domains[j], role)
+			}
+			binding.Domains[j] = domain
+		}
+	}
+	return nil
+}
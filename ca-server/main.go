@@ -1,15 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -18,6 +22,7 @@ import (
 	"ca-server/middleware"
 	"ca-server/models"
 	"ca-server/routes"
+	"ca-server/services"
 
 	"github.com/gin-gonic/gin"
 )
@@ -26,6 +31,11 @@ func main() {
 	// Load configuration
 	cfg := config.New()
 
+	// verify-audit [path] checks the audit log chain and exits
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit" {
+		os.Exit(verifyAudit(cfg, os.Args[2:]))
+	}
+
 	// Set gin mode
 	gin.SetMode(cfg.Mode)
 
@@ -37,10 +47,68 @@ func main() {
 	r.Use(middleware.Logger())
 
 	// Initialize store
-	store := models.NewMemoryStore()
+	store, auditStore, err := newStore(cfg)
+	if err != nil {
+		log.Fatalf("Failed to open store: %v", err)
+	}
+	if closer, ok := auditStore.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	// Load the issuing CA once, issuance handlers use the cached key pair
+	kek, err := readKEK(cfg)
+	if err != nil {
+		log.Fatalf("Failed to read CA key encryption key: %v", err)
+	}
+	keyBackend, err := newKeyBackend(cfg)
+	if err != nil {
+		log.Fatalf("Failed to set up CA key backend: %v", err)
+	}
+	caStore, err := models.NewFileCAStore(cfg.CACertPath, cfg.CAKeyPath, cfg.CADir, kek, cfg.CABootstrap, keyBackend)
+	if err != nil {
+		log.Fatalf("Failed to load CA: %v", err)
+	}
+	if !caStore.Loaded() {
+		log.Println("No issuing CA loaded, create one with POST /api/certs/ca?persist=true")
+	}
+	if caStore.Sealed() {
+		log.Println("CA keys are sealed, unlock them with POST /api/admin/ca/unseal")
+	} else if kek == nil {
+		log.Println("No CA key encryption key configured, CA keys are stored in plaintext")
+	}
+
+	auditLog, err := services.NewAuditLog(auditStore)
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
+
+	if !cfg.AuthRequired {
+		log.Println("**************************************************************************")
+		log.Println("WARNING: INSECURE_SKIP_AUTH is set, roles and role bindings are NOT checked")
+		log.Println("WARNING: anyone reaching the server can issue and revoke certificates and create CAs")
+		log.Println("WARNING: never run this configuration outside local development")
+		log.Println("**************************************************************************")
+	} else if cfg.AdminToken == "" && !cfg.MTLSEnabled && cfg.JWTHMACSecret == "" && cfg.JWTJWKSURL == "" && cfg.JWTJWKSFile == "" {
+		log.Println("No ADMIN_TOKEN, mTLS or JWTs configured, every protected endpoint answers 401")
+	}
+	if cfg.UserVerificationSecret == "" {
+		log.Println("No USER_VERIFICATION_SECRET configured, email verification tokens are void after a restart")
+	}
 
 	// Setup routes
-	routes.SetupRoutes(r, store)
+	if err := routes.SetupRoutes(r, cfg, store, caStore, keyBackend, auditLog); err != nil {
+		log.Fatalf("Failed to setup routes: %v", err)
+	}
+
+	// The TLS and mTLS servers share one serving certificate, replaced in the background without a restart
+	var servingCert *services.ServingCert
+	if cfg.TLSEnabled || cfg.MTLSEnabled {
+		servingCert, err = newServingCert(cfg, store, caStore)
+		if err != nil {
+			log.Fatalf("Failed to load serving certificate: %v", err)
+		}
+		servingCert.Start(time.Duration(cfg.TLSReloadSeconds) * time.Second)
+	}
 
 	// WaitGroup to track active servers
 	var wg sync.WaitGroup
@@ -56,14 +124,14 @@ func main() {
 	if cfg.TLSEnabled {
 		tlsAddr := fmt.Sprintf(":%d", cfg.TLSServerPort)
 		wg.Add(1)
-		go startTLSServer(r, tlsAddr, cfg.TLSCertPath, cfg.TLSKeyPath, &wg)
+		go startTLSServer(r, tlsAddr, servingCert, &wg)
 	}
 
 	// Start mTLS server
 	if cfg.MTLSEnabled {
 		mtlsAddr := fmt.Sprintf(":%d", cfg.MTLSServerPort)
 		wg.Add(1)
-		go startMTLSServer(r, mtlsAddr, cfg.TLSCertPath, cfg.TLSKeyPath, cfg.ClientCACertPath, &wg)
+		go startMTLSServer(r, mtlsAddr, servingCert, cfg.ClientCACertPath, &wg)
 	}
 
 	// Set up signal handling for graceful shutdown
@@ -78,6 +146,138 @@ func main() {
 	log.Println("All servers shutdown complete")
 }
 
+// verifyAudit checks the chain of the audit log file at args[0], or else of the configured store, and returns the exit code
+func verifyAudit(cfg *config.Config, args []string) int {
+	path := cfg.AuditLogPath
+	var result *services.AuditVerification
+	var err error
+	switch {
+	case len(args) > 0:
+		path = args[0]
+		result, err = services.VerifyAuditLog(path)
+	case cfg.StoreBackend == models.StoreSQLite:
+		path = cfg.SQLitePath
+		result, err = verifyStoreAudit(path, func() (models.AuditStore, error) { return models.NewSQLiteStore(path) })
+	case cfg.StoreBackend == models.StoreBolt:
+		path = cfg.BoltPath
+		result, err = verifyStoreAudit(path, func() (models.AuditStore, error) { return models.NewBoltStore(path) })
+	default:
+		result, err = services.VerifyAuditLog(path)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Audit log %s is NOT intact: %v\n", path, err)
+		return 1
+	}
+	fmt.Printf("Audit log %s is intact: %d records, head %s\n", path, result.Records, result.Head)
+	return 0
+}
+
+// verifyStoreAudit checks the audit log kept in the database at path, opened with open
+func verifyStoreAudit(path string, open func() (models.AuditStore, error)) (*services.AuditVerification, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	store, err := open()
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := store.(io.Closer); ok {
+		defer closer.Close()
+	}
+	return services.VerifyAuditStore(store)
+}
+
+// newStore opens the store selected by STORE_BACKEND along with the audit log kept with it,
+// a file at AUDIT_LOG_PATH for the memory store and part of the database for SQLite and bolt
+func newStore(cfg *config.Config) (models.Store, models.AuditStore, error) {
+	switch cfg.StoreBackend {
+	case models.StoreMemory:
+		return models.NewMemoryStore(), models.NewFileAuditStore(cfg.AuditLogPath), nil
+	case models.StoreSQLite:
+		store, err := models.NewSQLiteStore(cfg.SQLitePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, store, nil
+	case models.StoreBolt:
+		store, err := models.NewBoltStore(cfg.BoltPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, store, nil
+	}
+	return nil, nil, fmt.Errorf("unknown store backend %q, use memory, sqlite or bolt", cfg.StoreBackend)
+}
+
+// readKEK returns the CA key encryption passphrase from CA_KEK, CA_KEK_FILE or a prompt on stdin,
+// nil when none is configured
+func readKEK(cfg *config.Config) ([]byte, error) {
+	var kek []byte
+	switch {
+	case cfg.CAKEK != "":
+		// keep the passphrase out of the environment of anything started later
+		os.Unsetenv("CA_KEK")
+		kek = []byte(cfg.CAKEK)
+	case cfg.CAKEKFile != "":
+		data, err := os.ReadFile(cfg.CAKEKFile)
+		if err != nil {
+			return nil, err
+		}
+		kek = bytes.TrimRight(data, "\r\n")
+	case cfg.CAKEKPrompt:
+		fmt.Fprint(os.Stderr, "CA key passphrase: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return nil, err
+		}
+		kek = []byte(strings.TrimRight(line, "\r\n"))
+	default:
+		return nil, nil
+	}
+
+	if len(kek) == 0 {
+		return nil, fmt.Errorf("passphrase is empty")
+	}
+	return kek, nil
+}
+
+// newKeyBackend creates the backend new CA keys are generated in, see CA_KEY_BACKEND
+func newKeyBackend(cfg *config.Config) (services.KeyBackend, error) {
+	switch cfg.CAKeyBackend {
+	case services.KeyBackendFile:
+		return services.FileKeyBackend{}, nil
+	case services.KeyBackendPKCS11:
+		return services.NewPKCS11Backend(cfg.PKCS11Module, cfg.PKCS11TokenLabel, cfg.PKCS11PIN)
+	case services.KeyBackendRemote:
+		return services.NewRemoteKeyBackend(cfg.KMSURL, cfg.KMSToken)
+	}
+	return nil, fmt.Errorf("unknown CA key backend %q, use file, pkcs11 or remote", cfg.CAKeyBackend)
+}
+
+// newServingCert loads the TLS serving certificate from TLS_CERT_PATH and TLS_KEY_PATH,
+// or issues it from the managed CA, see TLS_CERT_SOURCE
+func newServingCert(cfg *config.Config, store models.CertStore, caStore models.CAStore) (*services.ServingCert, error) {
+	if cfg.TLSReloadSeconds <= 0 {
+		return nil, fmt.Errorf("TLS_RELOAD_SECONDS must be positive")
+	}
+	switch cfg.TLSCertSource {
+	case services.ServingCertFile:
+		return services.NewServingCert(services.NewFileCertSource(cfg.TLSCertPath, cfg.TLSKeyPath))
+	case services.ServingCertCA:
+		keySpec, err := services.ParseKeySpec(cfg.KeyDefaultSpec)
+		if err != nil {
+			return nil, err
+		}
+		issuer := services.NewIssuer(store, caStore, cfg.PublicURL)
+		source, err := services.NewCACertSource(issuer, keySpec, cfg.TLSCertNames, cfg.TLSCertValidDays)
+		if err != nil {
+			return nil, err
+		}
+		return services.NewServingCert(source)
+	}
+	return nil, fmt.Errorf("unknown serving certificate source %q, use file or ca", cfg.TLSCertSource)
+}
+
 // startHTTPServer starts a regular HTTP server
 func startHTTPServer(handler http.Handler, addr string, wg *sync.WaitGroup) {
 	defer wg.Done()
@@ -111,18 +311,19 @@ func startHTTPServer(handler http.Handler, addr string, wg *sync.WaitGroup) {
 }
 
 // startTLSServer starts a TLS server without client certificate validation
-func startTLSServer(handler http.Handler, addr, certPath, keyPath string, wg *sync.WaitGroup) {
+func startTLSServer(handler http.Handler, addr string, servingCert *services.ServingCert, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	server := &http.Server{
-		Addr:    addr,
-		Handler: handler,
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: &tls.Config{GetCertificate: servingCert.GetCertificate},
 	}
 
 	// Startup server in a goroutine
 	go func() {
 		log.Printf("Starting TLS server on %s", addr)
-		if err := server.ListenAndServeTLS(certPath, keyPath); err != nil && err != http.ErrServerClosed {
+		if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("TLS server error: %v", err)
 		}
 	}()
@@ -143,7 +344,7 @@ func startTLSServer(handler http.Handler, addr, certPath, keyPath string, wg *sy
 }
 
 // startMTLSServer starts a server with mutual TLS (client certificate validation)
-func startMTLSServer(handler http.Handler, addr, certPath, keyPath, clientCACertPath string, wg *sync.WaitGroup) {
+func startMTLSServer(handler http.Handler, addr string, servingCert *services.ServingCert, clientCACertPath string, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	// Load CA cert for client certificate validation
@@ -159,8 +360,9 @@ func startMTLSServer(handler http.Handler, addr, certPath, keyPath, clientCACert
 
 	// Configure TLS with client certificate verification
 	tlsConfig := &tls.Config{
-		ClientCAs:  caCertPool,
-		ClientAuth: tls.RequireAndVerifyClientCert,
+		GetCertificate: servingCert.GetCertificate,
+		ClientCAs:      caCertPool,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
 	}
 
 	server := &http.Server{
@@ -172,7 +374,7 @@ func startMTLSServer(handler http.Handler, addr, certPath, keyPath, clientCACert
 	// Startup server in a goroutine
 	go func() {
 		log.Printf("Starting mTLS server on %s", addr)
-		if err := server.ListenAndServeTLS(certPath, keyPath); err != nil && err != http.ErrServerClosed {
+		if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("mTLS server error: %v", err)
 		}
 	}()
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"ca-server/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminRequired checks the bearer token against the configured admin token.
+// A principal with the admin role, e.g. from a client certificate, passes without a token.
+// Otherwise an empty admin token disables every route behind this middleware.
+func AdminRequired(adminToken string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if principal, ok := GetPrincipal(c); ok && principal.HasRole(models.RoleAdmin) {
+			c.Next()
+			return
+		}
+
+		if adminToken == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "Forbidden: admin API is disabled, set ADMIN_TOKEN",
+			})
+			return
+		}
+
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Unauthorized: invalid admin token",
+			})
+			return
+		}
+
+		c.Set("userID", "admin")
+		c.Next()
+	}
+}
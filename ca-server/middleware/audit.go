@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"ca-server/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Context keys of the audit middleware
+const (
+	auditActionKey  = "auditAction"
+	auditDetailsKey = "auditDetails"
+)
+
+// Request parameters whose values never reach the audit log
+var auditRedacted = map[string]bool{
+	"password":   true,
+	"passphrase": true,
+	"secret":     true,
+	"token":      true,
+	"pin":        true,
+}
+
+// auditMaxValue is the longest parameter value kept verbatim, longer ones such as CSRs are kept as a hash
+const auditMaxValue = 256
+
+// AuditAction marks a route as audited under action, e.g. cert.issue
+func AuditAction(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(auditActionKey, action)
+		c.Next()
+	}
+}
+
+// AddAuditDetail attaches a detail of the outcome to the audit record of the request
+func AddAuditDetail(c *gin.Context, key string, value interface{}) {
+	details, _ := c.Get(auditDetailsKey)
+	m, ok := details.(map[string]interface{})
+	if !ok {
+		m = make(map[string]interface{})
+		c.Set(auditDetailsKey, m)
+	}
+	m[key] = value
+}
+
+// auditWriter keeps the start of error responses for the audit record
+type auditWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *auditWriter) Write(data []byte) (int, error) {
+	w.capture(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *auditWriter) WriteString(s string) (int, error) {
+	w.capture([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *auditWriter) capture(data []byte) {
+	if w.Status() >= http.StatusBadRequest && w.body.Len() < 4096 {
+		w.body.Write(data)
+	}
+}
+
+// Audit records every request to a route marked with AuditAction, and every request rejected
+// with 401 or 403 as auth.failure, with the caller, its source, the parameters and the result.
+// It must run before the authentication middleware so their rejections are seen.
+func Audit(recorder models.AuditRecorder) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body []byte
+		if c.Request.Body != nil && c.Request.Method != http.MethodGet {
+			body, _ = io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+			c.Request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), c.Request.Body))
+		}
+		writer := &auditWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+
+		c.Next()
+
+		status := writer.Status()
+		action := c.GetString(auditActionKey)
+		if action == "" {
+			if status != http.StatusUnauthorized && status != http.StatusForbidden {
+				return
+			}
+			action = "auth.failure"
+		}
+
+		rec := &models.AuditRecord{
+			Action:  action,
+			Actor:   "anonymous",
+			Source:  models.AuditSource{IP: c.ClientIP()},
+			Request: c.Request.Method + " " + c.Request.URL.Path,
+			Params:  auditParams(c, body),
+			Status:  status,
+		}
+		if principal, ok := GetPrincipal(c); ok {
+			rec.Actor = c.GetString("userID")
+			rec.AuthMethod = principal.Method
+		}
+		if state := c.Request.TLS; state != nil && len(state.PeerCertificates) > 0 {
+			cert := state.PeerCertificates[0]
+			rec.Source.ClientCert = cert.Subject.String() + " serial " + cert.SerialNumber.String()
+		}
+		switch {
+		case status == http.StatusUnauthorized || status == http.StatusForbidden:
+			rec.Result = models.AuditDenied
+		case status >= http.StatusBadRequest:
+			rec.Result = models.AuditFailure
+		default:
+			rec.Result = models.AuditSuccess
+		}
+		if rec.Result != models.AuditSuccess {
+			rec.Error = errorMessage(writer.body.Bytes())
+		}
+		if details, ok := c.Get(auditDetailsKey); ok {
+			rec.Details, _ = details.(map[string]interface{})
+		}
+
+		if err := recorder.Record(rec); err != nil {
+			log.Printf("Failed to write audit record for %s: %v", rec.Request, err)
+		}
+	}
+}
+
+// auditParams collects the path and query parameters and the JSON body of a request, secrets redacted
+func auditParams(c *gin.Context, body []byte) map[string]interface{} {
+	params := make(map[string]interface{})
+	for _, p := range c.Params {
+		params[p.Key] = p.Value
+	}
+	for key, values := range c.Request.URL.Query() {
+		params[key] = auditValue(key, strings.Join(values, ","))
+	}
+	var fields map[string]interface{}
+	if len(body) > 0 && json.Unmarshal(body, &fields) == nil {
+		for key, value := range fields {
+			params[key] = auditValue(key, value)
+		}
+	}
+	if len(params) == 0 {
+		return nil
+	}
+	return params
+}
+
+// auditValue redacts secrets and replaces long strings by their SHA-256
+func auditValue(key string, value interface{}) interface{} {
+	if auditRedacted[strings.ToLower(key)] {
+		return "[redacted]"
+	}
+	switch v := value.(type) {
+	case string:
+		if len(v) > auditMaxValue {
+			sum := sha256.Sum256([]byte(v))
+			return "sha256:" + hex.EncodeToString(sum[:])
+		}
+	case map[string]interface{}:
+		for k, nested := range v {
+			v[k] = auditValue(k, nested)
+		}
+	}
+	return value
+}
+
+// errorMessage extracts the message of a JSON error response
+func errorMessage(body []byte) string {
+	var resp struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+	if json.Unmarshal(body, &resp) != nil {
+		return strings.TrimSpace(string(body))
+	}
+	if resp.Message != "" && resp.Error != "" {
+		return resp.Message + ": " + resp.Error
+	}
+	return resp.Message + resp.Error
+}
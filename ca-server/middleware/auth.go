@@ -1,40 +1,64 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
 	"strings"
 
+	"ca-server/models"
+
 	"github.com/gin-gonic/gin"
 )
 
-// AuthRequired checks for valid authentication
-func AuthRequired() gin.HandlerFunc {
+// TokenAuthenticator turns a bearer token into a principal
+type TokenAuthenticator interface {
+	Authenticate(ctx context.Context, token string) (*models.Principal, error)
+}
+
+// TokenAuth authenticates requests carrying a bearer token, unless a client certificate already did.
+// Requests without a token pass through unauthenticated, those with an invalid token are rejected.
+func TokenAuth(auth TokenAuthenticator) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Get authorization header
-		authHeader := c.GetHeader("Authorization")
+		if _, ok := GetPrincipal(c); ok {
+			c.Next()
+			return
+		}
 
-		// Check if authorization header exists and has valid format
-		if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
+		authHeader := c.GetHeader("Authorization")
+		if authHeader == "" {
+			c.Next()
+			return
+		}
+		token, ok := strings.CutPrefix(authHeader, "Bearer ")
+		if !ok || token == "" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 				"error": "Unauthorized: missing or invalid authorization token",
 			})
 			return
 		}
 
-		// Extract token (in production, validate JWT/OAuth token here)
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if token == "" {
+		principal, err := auth.Authenticate(c.Request.Context(), token)
+		if err != nil {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-				"error": "Unauthorized: empty token",
+				"error": "Unauthorized: " + err.Error(),
 			})
 			return
 		}
 
-		// For demonstration purposes, accept any non-empty token
-		// In production, validate against a real auth system
+		setPrincipal(c, principal)
+		c.Next()
+	}
+}
 
-		// Set user ID in context (extracted from token in production)
-		c.Set("userID", "sample-user-id")
+// AuthRequired rejects requests that were not authenticated by a client certificate or bearer token
+func AuthRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := GetPrincipal(c); !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Unauthorized: missing or invalid authorization token",
+			})
+			return
+		}
 
 		c.Next()
 	}
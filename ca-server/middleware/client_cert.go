@@ -0,0 +1,188 @@
+package middleware
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"ca-server/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Client certificate fields a role rule can match
+const (
+	certFieldCN    = "CN"
+	certFieldOU    = "OU"
+	certFieldDNS   = "DNS"
+	certFieldEmail = "EMAIL"
+	certFieldURI   = "URI"
+)
+
+// CertRoleRule grants Role to client certificates with a Field value matching the shell pattern Pattern
+type CertRoleRule struct {
+	Role    models.Role
+	Field   string
+	Pattern string
+}
+
+// ParseCertRoleRules parses rules written as role=field:pattern, e.g. admin=CN:ops-* or issuer=DNS:*.ci.home.lab.
+// The field is CN, OU, DNS, EMAIL or URI.
+func ParseCertRoleRules(specs []string) ([]CertRoleRule, error) {
+	rules := make([]CertRoleRule, 0, len(specs))
+	for _, spec := range specs {
+		roleName, match, ok := strings.Cut(spec, "=")
+		field, pattern, ok2 := strings.Cut(match, ":")
+		if !ok || !ok2 || pattern == "" {
+			return nil, fmt.Errorf("invalid client certificate role rule %q, use role=field:pattern", spec)
+		}
+		role, err := models.ParseRole(roleName)
+		if err != nil {
+			return nil, err
+		}
+		field = strings.ToUpper(strings.TrimSpace(field))
+		switch field {
+		case certFieldCN, certFieldOU, certFieldDNS, certFieldEmail, certFieldURI:
+		default:
+			return nil, fmt.Errorf("invalid field %q in role rule %q, use CN, OU, DNS, EMAIL or URI", field, spec)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern in role rule %q: %w", spec, err)
+		}
+		rules = append(rules, CertRoleRule{Role: role, Field: field, Pattern: pattern})
+	}
+	return rules, nil
+}
+
+// Match reports whether a value of the rule's field in cert matches its pattern
+func (r CertRoleRule) Match(cert *x509.Certificate) bool {
+	for _, value := range certFieldValues(cert, r.Field) {
+		if ok, _ := path.Match(r.Pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// certFieldValues returns the values of a rule field in cert
+func certFieldValues(cert *x509.Certificate, field string) []string {
+	switch field {
+	case certFieldCN:
+		return []string{cert.Subject.CommonName}
+	case certFieldOU:
+		return cert.Subject.OrganizationalUnit
+	case certFieldDNS:
+		return cert.DNSNames
+	case certFieldEmail:
+		return cert.EmailAddresses
+	case certFieldURI:
+		uris := make([]string, 0, len(cert.URIs))
+		for _, uri := range cert.URIs {
+			uris = append(uris, uri.String())
+		}
+		return uris
+	}
+	return nil
+}
+
+// ClientCertAuth turns the verified client certificate of a TLS request into the request principal.
+// The certificate maps to the user the CA bound it to when it was issued, see models.Certificate.UserID,
+// and gets that user's roles. Rules only grant roles to certificates chaining to rulesCA, see rulesApply.
+// Requests without a verified certificate pass through unauthenticated, certificates revoked in the
+// inventory or of a user that is not active are rejected.
+func ClientCertAuth(store models.Store, caStore models.CAStore, rules []CertRoleRule, rulesCA *x509.Certificate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		state := c.Request.TLS
+		if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+			c.Next()
+			return
+		}
+		cert := state.PeerCertificates[0]
+
+		// a certificate whose revocation or user cannot be looked up is refused rather than let in on its rules
+		record, err := store.GetCert(c.Request.Context(), cert.SerialNumber.String())
+		if err != nil && !errors.Is(err, models.ErrNotFound) {
+			abortStoreUnavailable(c)
+			return
+		}
+		if err == nil && record.IsRevoked() {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Unauthorized: client certificate is revoked",
+			})
+			return
+		}
+
+		principal := &models.Principal{Subject: cert.Subject.String(), Method: "mtls"}
+		user, err := userForCert(c.Request.Context(), store, record)
+		if err != nil {
+			abortStoreUnavailable(c)
+			return
+		}
+		if user != nil {
+			if !user.Active() {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+					"error": "Unauthorized: client certificate belongs to a " + string(user.CurrentStatus()) + " user",
+				})
+				return
+			}
+			principal.User = user
+			principal.Roles = append(principal.Roles, user.Roles...)
+		}
+		if rulesApply(state.VerifiedChains, rulesCA, caStore) {
+			for _, rule := range rules {
+				if rule.Match(cert) {
+					principal.Roles = append(principal.Roles, rule.Role)
+				}
+			}
+		}
+
+		setPrincipal(c, principal)
+		c.Next()
+	}
+}
+
+// rulesApply reports whether role rules may match a client certificate: one of its verified chains must
+// lead to rulesCA without passing a CA this server manages. Callers able to issue from a managed CA pick
+// the subject and SANs of their certificates, the rules would let them grant themselves any role.
+func rulesApply(chains [][]*x509.Certificate, rulesCA *x509.Certificate, caStore models.CAStore) bool {
+	if rulesCA == nil {
+		return false
+	}
+	managed := func(cert *x509.Certificate) bool {
+		_, err := caStore.GetByID(hex.EncodeToString(cert.SubjectKeyId))
+		return len(cert.SubjectKeyId) > 0 && err == nil
+	}
+	for _, chain := range chains {
+		if len(chain) > 1 && slices.ContainsFunc(chain[1:], rulesCA.Equal) && !slices.ContainsFunc(chain[1:], managed) {
+			return true
+		}
+	}
+	return false
+}
+
+// userForCert finds the user the inventory record of a client certificate binds it to, nil when there is
+// none or the user was deleted
+func userForCert(ctx context.Context, store models.Store, record *models.Certificate) (*models.User, error) {
+	if record == nil || record.UserID == "" {
+		return nil, nil
+	}
+	user, err := store.GetUser(ctx, record.UserID)
+	if errors.Is(err, models.ErrNotFound) {
+		return nil, nil
+	}
+	return user, err
+}
+
+// abortStoreUnavailable rejects a client certificate that could not be checked against the store
+func abortStoreUnavailable(c *gin.Context) {
+	c.Header("Retry-After", "60")
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+		"error": "Service unavailable: failed to check the client certificate",
+	})
+}
@@ -0,0 +1,337 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ca-server/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestWithCert sends a GET to router as if it arrived over mTLS with cert verified up to the parents
+func requestWithCert(router *gin.Engine, target string, cert *x509.Certificate, parents ...*x509.Certificate) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if cert != nil {
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{append([]*x509.Certificate{cert}, parents...)},
+		}
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// newTestCA creates a self-signed CA
+func newTestCA(t *testing.T, name string) *models.CA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse CA certificate: %v", err)
+	}
+	ca, err := models.NewCA(key, cert, nil)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	return ca
+}
+
+// newTestCAStore returns a CA store holding ca as the issuing CA
+func newTestCAStore(t *testing.T, ca *models.CA) models.CAStore {
+	t.Helper()
+	dir := t.TempDir()
+	caStore, err := models.NewFileCAStore(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"), filepath.Join(dir, "cas"), nil, true)
+	if err != nil {
+		t.Fatalf("Failed to create CA store: %v", err)
+	}
+	if err := caStore.Save(ca, true); err != nil {
+		t.Fatalf("Failed to save CA: %v", err)
+	}
+	return caStore
+}
+
+func TestClientCertAuthRoles(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	ctx := context.Background()
+	store := models.NewMemoryStore()
+	alice := models.NewUser("alice", "Alice", "alice@home.lab")
+	alice.Roles = []models.Role{models.RoleRevoker}
+	if err := store.CreateUser(ctx, alice); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	rules, err := ParseCertRoleRules([]string{"issuer=DNS:*.ci.home.lab", "admin=OU:ops"})
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	rulesCA := newTestCA(t, "Client CA")
+	router := gin.New()
+	router.Use(ClientCertAuth(store, newTestCAStore(t, newTestCA(t, "Issuing CA")), rules, rulesCA.Cert))
+	for _, role := range []models.Role{models.RoleViewer, models.RoleIssuer, models.RoleRevoker, models.RoleAdmin} {
+		router.GET("/"+string(role), RoleRequired(role), func(c *gin.Context) {
+			c.String(http.StatusOK, c.GetString("userID"))
+		})
+	}
+
+	certs := map[string]*x509.Certificate{
+		"alice":  {Subject: pkix.Name{CommonName: "laptop"}, EmailAddresses: []string{"Alice@home.lab"}, SerialNumber: big.NewInt(1)},
+		"runner": {Subject: pkix.Name{CommonName: "runner"}, DNSNames: []string{"build.ci.home.lab"}, SerialNumber: big.NewInt(2)},
+		"ops":    {Subject: pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"ops"}}, SerialNumber: big.NewInt(3)},
+		"nobody": {Subject: pkix.Name{CommonName: "nobody"}, SerialNumber: big.NewInt(4)},
+	}
+	// the CA bound the alice certificate to alice when it issued it
+	if err := store.SaveCert(ctx, &models.Certificate{SerialNumber: "1", NotAfter: time.Now().Add(time.Hour), UserID: alice.ID}); err != nil {
+		t.Fatalf("Failed to save certificate: %v", err)
+	}
+	expected := map[string]map[models.Role]int{
+		"alice":  {models.RoleViewer: 200, models.RoleIssuer: 403, models.RoleRevoker: 200, models.RoleAdmin: 403},
+		"runner": {models.RoleViewer: 200, models.RoleIssuer: 200, models.RoleRevoker: 403, models.RoleAdmin: 403},
+		"ops":    {models.RoleViewer: 200, models.RoleIssuer: 200, models.RoleRevoker: 200, models.RoleAdmin: 200},
+		"nobody": {models.RoleViewer: 403},
+		"":       {models.RoleViewer: 401},
+	}
+	for name, codes := range expected {
+		for role, code := range codes {
+			if w := requestWithCert(router, "/"+string(role), certs[name], rulesCA.Cert); w.Code != code {
+				t.Errorf("%s as %s: expected %d, got %d", name, role, code, w.Code)
+			}
+		}
+	}
+	if w := requestWithCert(router, "/viewer", certs["alice"]); w.Body.String() != "alice" {
+		t.Errorf("Expected the bound certificate to map to user alice, got %q", w.Body.String())
+	}
+
+	// a certificate revoked in the inventory no longer authenticates
+	cert := certs["runner"]
+	if err := store.SaveCert(ctx, &models.Certificate{SerialNumber: cert.SerialNumber.String(), NotAfter: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("Failed to save certificate: %v", err)
+	}
+	if _, err := store.RevokeCert(ctx, cert.SerialNumber.String(), 1, time.Now()); err != nil {
+		t.Fatalf("Failed to revoke: %v", err)
+	}
+	if w := requestWithCert(router, "/viewer", cert); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a revoked certificate, got %d", w.Code)
+	}
+
+	// so does the certificate of a user that is not active
+	disabled := *alice
+	disabled.Status = models.UserDisabled
+	if err := store.UpdateUser(ctx, &disabled); err != nil {
+		t.Fatalf("Failed to disable alice: %v", err)
+	}
+	if w := requestWithCert(router, "/viewer", certs["alice"]); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for the certificate of a disabled user, got %d", w.Code)
+	}
+}
+
+func TestClientCertAuthImpersonation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	ctx := context.Background()
+	store := models.NewMemoryStore()
+	root := models.NewUser("root", "Root", "root@home.lab")
+	root.Roles = []models.Role{models.RoleAdmin}
+	mallory := models.NewUser("mallory", "Mallory", "mallory@home.lab")
+	mallory.Roles = []models.Role{models.RoleViewer}
+	for _, user := range []*models.User{root, mallory} {
+		if err := store.CreateUser(ctx, user); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	router := gin.New()
+	router.Use(ClientCertAuth(store, newTestCAStore(t, newTestCA(t, "Issuing CA")), nil, nil))
+	router.GET("/admin", RoleRequired(models.RoleAdmin), func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("userID"))
+	})
+	router.GET("/viewer", RoleRequired(models.RoleViewer), func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("userID"))
+	})
+
+	// certificates naming the admin by email SAN or common name, none of them issued for root
+	claimsRoot := func(serial int64) *x509.Certificate {
+		return &x509.Certificate{
+			Subject:        pkix.Name{CommonName: root.ID},
+			EmailAddresses: []string{root.Email},
+			SerialNumber:   big.NewInt(serial),
+		}
+	}
+	cases := []struct {
+		name   string
+		record *models.Certificate
+		viewer int
+		user   string
+	}{
+		{"not in the inventory", nil, http.StatusForbidden, ""},
+		{"issued without a user", &models.Certificate{SerialNumber: "2"}, http.StatusForbidden, ""},
+		{"issued for mallory", &models.Certificate{SerialNumber: "3", UserID: mallory.ID}, http.StatusOK, mallory.ID},
+		{"issued for a deleted user", &models.Certificate{SerialNumber: "4", UserID: "gone"}, http.StatusForbidden, ""},
+	}
+	for i, tc := range cases {
+		if tc.record != nil {
+			tc.record.NotAfter = time.Now().Add(time.Hour)
+			if err := store.SaveCert(ctx, tc.record); err != nil {
+				t.Fatalf("Failed to save certificate: %v", err)
+			}
+		}
+		cert := claimsRoot(int64(i + 1))
+		if w := requestWithCert(router, "/admin", cert); w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403 for the admin route, got %d", tc.name, w.Code)
+		}
+		w := requestWithCert(router, "/viewer", cert)
+		if w.Code != tc.viewer {
+			t.Errorf("%s: expected %d for the viewer route, got %d", tc.name, tc.viewer, w.Code)
+		}
+		if w.Code == http.StatusOK && w.Body.String() != tc.user {
+			t.Errorf("%s: expected to authenticate as %q, got %q", tc.name, tc.user, w.Body.String())
+		}
+	}
+}
+
+// TestClientCertAuthSelfIssued checks that certificates of the managed CAs, whose subject and SANs an
+// issuer picks, never match the role rules
+func TestClientCertAuthSelfIssued(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	store := models.NewMemoryStore()
+	rules, err := ParseCertRoleRules([]string{"admin=OU:ops", "admin=CN:alice"})
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	issuing := newTestCA(t, "Issuing CA")
+	rulesCA := newTestCA(t, "Client CA")
+	router := gin.New()
+	router.Use(ClientCertAuth(store, newTestCAStore(t, issuing), rules, rulesCA.Cert))
+	router.GET("/admin", RoleRequired(models.RoleAdmin), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"ops"}}, SerialNumber: big.NewInt(1)}
+	cases := []struct {
+		name    string
+		parents []*x509.Certificate
+		code    int
+	}{
+		{"client CA", []*x509.Certificate{rulesCA.Cert}, http.StatusOK},
+		{"issuing CA", []*x509.Certificate{issuing.Cert}, http.StatusForbidden},
+		{"issuing CA under the client CA", []*x509.Certificate{issuing.Cert, rulesCA.Cert}, http.StatusForbidden},
+		{"no parent", nil, http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		if w := requestWithCert(router, "/admin", cert, tc.parents...); w.Code != tc.code {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.code, w.Code)
+		}
+	}
+
+	// without a client CA the rules never apply
+	router = gin.New()
+	router.Use(ClientCertAuth(store, newTestCAStore(t, issuing), rules, nil))
+	router.GET("/admin", RoleRequired(models.RoleAdmin), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	if w := requestWithCert(router, "/admin", cert, rulesCA.Cert); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without a client CA, got %d", w.Code)
+	}
+}
+
+// failingStore fails the certificate or user lookups of the store it wraps
+type failingStore struct {
+	models.Store
+	certs, users bool
+}
+
+func (s failingStore) GetCert(ctx context.Context, serial string) (*models.Certificate, error) {
+	if s.certs {
+		return nil, errors.New("database is locked")
+	}
+	return s.Store.GetCert(ctx, serial)
+}
+
+func (s failingStore) GetUser(ctx context.Context, id string) (*models.User, error) {
+	if s.users {
+		return nil, errors.New("database is locked")
+	}
+	return s.Store.GetUser(ctx, id)
+}
+
+// TestClientCertAuthStoreErrors checks that a certificate is refused, not authenticated on its rules alone,
+// when the store cannot tell whether it is revoked or whose it is
+func TestClientCertAuthStoreErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	ctx := context.Background()
+	store := models.NewMemoryStore()
+	alice := models.NewUser("alice", "Alice", "alice@home.lab")
+	if err := store.CreateUser(ctx, alice); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if err := store.SaveCert(ctx, &models.Certificate{SerialNumber: "1", NotAfter: time.Now().Add(time.Hour), UserID: alice.ID}); err != nil {
+		t.Fatalf("Failed to save certificate: %v", err)
+	}
+	rules, err := ParseCertRoleRules([]string{"viewer=CN:*"})
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	rulesCA := newTestCA(t, "Client CA")
+	caStore := newTestCAStore(t, newTestCA(t, "Issuing CA"))
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "laptop"}, SerialNumber: big.NewInt(1)}
+
+	cases := []struct {
+		name  string
+		store models.Store
+		code  int
+	}{
+		{"store available", failingStore{Store: store}, http.StatusOK},
+		{"certificate lookup fails", failingStore{Store: store, certs: true}, http.StatusServiceUnavailable},
+		{"user lookup fails", failingStore{Store: store, users: true}, http.StatusServiceUnavailable},
+	}
+	for _, tc := range cases {
+		router := gin.New()
+		router.Use(ClientCertAuth(tc.store, caStore, rules, rulesCA.Cert))
+		router.GET("/viewer", RoleRequired(models.RoleViewer), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+		if w := requestWithCert(router, "/viewer", cert, rulesCA.Cert); w.Code != tc.code {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.code, w.Code)
+		}
+	}
+}
+
+func TestParseCertRoleRulesErrors(t *testing.T) {
+	for _, spec := range []string{"admin", "admin=CN", "root=CN:x", "admin=SERIAL:1", "admin=CN:["} {
+		if _, err := ParseCertRoleRules([]string{spec}); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
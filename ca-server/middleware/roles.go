@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"net/http"
+
+	"ca-server/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PrincipalKey is the context key of the *models.Principal of an authenticated request
+const PrincipalKey = "principal"
+
+// GetPrincipal returns the principal of an authenticated request
+func GetPrincipal(c *gin.Context) (*models.Principal, bool) {
+	value, ok := c.Get(PrincipalKey)
+	if !ok {
+		return nil, false
+	}
+	principal, ok := value.(*models.Principal)
+	return principal, ok
+}
+
+// setPrincipal stores the principal and its user ID in the request context
+func setPrincipal(c *gin.Context, principal *models.Principal) {
+	c.Set(PrincipalKey, principal)
+	if principal.User != nil {
+		c.Set("userID", principal.User.ID)
+	} else {
+		c.Set("userID", principal.Subject)
+	}
+}
+
+// RoleRequired rejects requests without a principal with 401 and those whose roles do not grant role with 403
+func RoleRequired(role models.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, ok := GetPrincipal(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Unauthorized: authentication required",
+			})
+			return
+		}
+		if !principal.HasRole(role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "Forbidden: requires the " + string(role) + " role",
+			})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Unsealed rejects requests with 503 while the CA keys are sealed, so nothing
+// is recorded for a request that cannot be signed
+func Unsealed(store interface{ Sealed() bool }) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if store.Sealed() {
+			c.Header("Retry-After", "60")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"error": "Service unavailable: CA keys are sealed",
+			})
+			return
+		}
+		c.Next()
+	}
+}
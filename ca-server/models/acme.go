@@ -0,0 +1,78 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ACME object states from RFC 8555 section 7.1.6
+const (
+	ACMEStatusPending     = "pending"
+	ACMEStatusReady       = "ready"
+	ACMEStatusProcessing  = "processing"
+	ACMEStatusValid       = "valid"
+	ACMEStatusInvalid     = "invalid"
+	ACMEStatusDeactivated = "deactivated"
+	ACMEStatusExpired     = "expired"
+)
+
+// ACMEAccount is a registered ACME client, identified by its account key
+type ACMEAccount struct {
+	ID                   string          `json:"id"`
+	Status               string          `json:"status"`
+	Contact              []string        `json:"contact,omitempty"`
+	TermsOfServiceAgreed bool            `json:"termsOfServiceAgreed"`
+	Key                  json.RawMessage `json:"key"`
+	KeyThumbprint        string          `json:"keyThumbprint"`
+	CreatedAt            time.Time       `json:"createdAt"`
+}
+
+// ACMEIdentifier names the subject of an order, only "dns" is supported
+type ACMEIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// ACMEProblem is an RFC 7807 problem document as used by ACME
+type ACMEProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+// ACMEOrder is a request for a certificate covering a set of identifiers
+type ACMEOrder struct {
+	ID               string           `json:"id"`
+	AccountID        string           `json:"accountId"`
+	Status           string           `json:"status"`
+	Expires          time.Time        `json:"expires"`
+	Identifiers      []ACMEIdentifier `json:"identifiers"`
+	NotBefore        time.Time        `json:"notBefore,omitempty"`
+	NotAfter         time.Time        `json:"notAfter,omitempty"`
+	AuthorizationIDs []string         `json:"authorizationIds"`
+	CertSerial       string           `json:"certSerial,omitempty"`
+	CertChainPEM     []byte           `json:"certChainPEM,omitempty"`
+	Error            *ACMEProblem     `json:"error,omitempty"`
+}
+
+// ACMEAuthorization is the proof of control over one identifier
+type ACMEAuthorization struct {
+	ID           string         `json:"id"`
+	AccountID    string         `json:"accountId"`
+	Status       string         `json:"status"`
+	Expires      time.Time      `json:"expires"`
+	Identifier   ACMEIdentifier `json:"identifier"`
+	Wildcard     bool           `json:"wildcard,omitempty"`
+	ChallengeIDs []string       `json:"challengeIds"`
+}
+
+// ACMEChallenge is one way of proving control over an authorization's identifier
+type ACMEChallenge struct {
+	ID              string       `json:"id"`
+	AuthorizationID string       `json:"authorizationId"`
+	Type            string       `json:"type"`
+	Token           string       `json:"token"`
+	Status          string       `json:"status"`
+	Validated       *time.Time   `json:"validated,omitempty"`
+	Error           *ACMEProblem `json:"error,omitempty"`
+}
@@ -0,0 +1,288 @@
+package models
+
+import (
+	"sync"
+)
+
+var (
+	// ErrACMEAccountNotFound is returned for an unknown ACME account ID or key
+	ErrACMEAccountNotFound error = &storeError{"account not found", ErrNotFound}
+	// ErrACMEOrderNotFound is returned for an unknown ACME order ID
+	ErrACMEOrderNotFound error = &storeError{"order not found", ErrNotFound}
+	// ErrACMEAuthorizationNotFound is returned for an unknown ACME authorization ID
+	ErrACMEAuthorizationNotFound error = &storeError{"authorization not found", ErrNotFound}
+	// ErrACMEChallengeNotFound is returned for an unknown ACME challenge ID
+	ErrACMEChallengeNotFound error = &storeError{"challenge not found", ErrNotFound}
+	// ErrACMEOrderChanged is returned by TransitionOrder when the order is no longer in the expected status
+	ErrACMEOrderChanged error = &storeError{"order status changed", ErrConflict}
+)
+
+// ACMEStore defines the data access interface for ACME server state.
+// Every Store implements it, so ACME accounts and orders live as long as the rest of the store.
+type ACMEStore interface {
+	CreateAccount(account *ACMEAccount) error
+	GetAccount(id string) (*ACMEAccount, error)
+	GetAccountByThumbprint(thumbprint string) (*ACMEAccount, error)
+	UpdateAccount(account *ACMEAccount) error
+	CreateOrder(order *ACMEOrder) error
+	GetOrder(id string) (*ACMEOrder, error)
+	ListOrders(accountID string) ([]*ACMEOrder, error)
+	UpdateOrder(order *ACMEOrder) error
+	// TransitionOrder atomically moves an order in status from to status to, or fails with ErrACMEOrderChanged
+	TransitionOrder(id, from, to string) error
+	CreateAuthorization(authz *ACMEAuthorization) error
+	GetAuthorization(id string) (*ACMEAuthorization, error)
+	UpdateAuthorization(authz *ACMEAuthorization) error
+	CreateChallenge(challenge *ACMEChallenge) error
+	GetChallenge(id string) (*ACMEChallenge, error)
+	UpdateChallenge(challenge *ACMEChallenge) error
+}
+
+// MemoryACMEStore provides an in-memory implementation of ACMEStore.
+// Objects are copied in and out since challenge validation updates them concurrently.
+type MemoryACMEStore struct {
+	accounts       map[string]ACMEAccount
+	orders         map[string]ACMEOrder
+	authorizations map[string]ACMEAuthorization
+	challenges     map[string]ACMEChallenge
+	mutex          sync.RWMutex
+}
+
+// NewMemoryACMEStore creates a new in-memory ACME store
+func NewMemoryACMEStore() *MemoryACMEStore {
+	return &MemoryACMEStore{
+		accounts:       make(map[string]ACMEAccount),
+		orders:         make(map[string]ACMEOrder),
+		authorizations: make(map[string]ACMEAuthorization),
+		challenges:     make(map[string]ACMEChallenge),
+	}
+}
+
+// CreateAccount adds a new account
+func (s *MemoryACMEStore) CreateAccount(account *ACMEAccount) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.accounts[account.ID] = *account
+	return nil
+}
+
+// GetAccount retrieves an account by ID
+func (s *MemoryACMEStore) GetAccount(id string) (*ACMEAccount, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	account, exists := s.accounts[id]
+	if !exists {
+		return nil, ErrACMEAccountNotFound
+	}
+	return &account, nil
+}
+
+// GetAccountByThumbprint retrieves an account by the thumbprint of its key
+func (s *MemoryACMEStore) GetAccountByThumbprint(thumbprint string) (*ACMEAccount, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, account := range s.accounts {
+		if account.KeyThumbprint == thumbprint {
+			return &account, nil
+		}
+	}
+	return nil, ErrACMEAccountNotFound
+}
+
+// UpdateAccount updates an existing account
+func (s *MemoryACMEStore) UpdateAccount(account *ACMEAccount) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.accounts[account.ID]; !exists {
+		return ErrACMEAccountNotFound
+	}
+	s.accounts[account.ID] = *account
+	return nil
+}
+
+// CreateOrder adds a new order
+func (s *MemoryACMEStore) CreateOrder(order *ACMEOrder) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.orders[order.ID] = *order
+	return nil
+}
+
+// GetOrder retrieves an order by ID
+func (s *MemoryACMEStore) GetOrder(id string) (*ACMEOrder, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	order, exists := s.orders[id]
+	if !exists {
+		return nil, ErrACMEOrderNotFound
+	}
+	return &order, nil
+}
+
+// ListOrders returns the orders of an account
+func (s *MemoryACMEStore) ListOrders(accountID string) ([]*ACMEOrder, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	orders := make([]*ACMEOrder, 0)
+	for _, order := range s.orders {
+		if order.AccountID == accountID {
+			order := order
+			orders = append(orders, &order)
+		}
+	}
+	return orders, nil
+}
+
+// UpdateOrder updates an existing order
+func (s *MemoryACMEStore) UpdateOrder(order *ACMEOrder) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.orders[order.ID]; !exists {
+		return ErrACMEOrderNotFound
+	}
+	s.orders[order.ID] = *order
+	return nil
+}
+
+// TransitionOrder moves an order from one status to another
+func (s *MemoryACMEStore) TransitionOrder(id, from, to string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	order, exists := s.orders[id]
+	if !exists {
+		return ErrACMEOrderNotFound
+	}
+	if order.Status != from {
+		return ErrACMEOrderChanged
+	}
+	order.Status = to
+	s.orders[id] = order
+	return nil
+}
+
+// CreateAuthorization adds a new authorization
+func (s *MemoryACMEStore) CreateAuthorization(authz *ACMEAuthorization) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.authorizations[authz.ID] = *authz
+	return nil
+}
+
+// GetAuthorization retrieves an authorization by ID
+func (s *MemoryACMEStore) GetAuthorization(id string) (*ACMEAuthorization, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	authz, exists := s.authorizations[id]
+	if !exists {
+		return nil, ErrACMEAuthorizationNotFound
+	}
+	return &authz, nil
+}
+
+// UpdateAuthorization updates an existing authorization
+func (s *MemoryACMEStore) UpdateAuthorization(authz *ACMEAuthorization) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.authorizations[authz.ID]; !exists {
+		return ErrACMEAuthorizationNotFound
+	}
+	s.authorizations[authz.ID] = *authz
+	return nil
+}
+
+// CreateChallenge adds a new challenge
+func (s *MemoryACMEStore) CreateChallenge(challenge *ACMEChallenge) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.challenges[challenge.ID] = *challenge
+	return nil
+}
+
+// GetChallenge retrieves a challenge by ID
+func (s *MemoryACMEStore) GetChallenge(id string) (*ACMEChallenge, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	challenge, exists := s.challenges[id]
+	if !exists {
+		return nil, ErrACMEChallengeNotFound
+	}
+	return &challenge, nil
+}
+
+// UpdateChallenge updates an existing challenge
+func (s *MemoryACMEStore) UpdateChallenge(challenge *ACMEChallenge) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.challenges[challenge.ID]; !exists {
+		return ErrACMEChallengeNotFound
+	}
+	s.challenges[challenge.ID] = *challenge
+	return nil
+}
+
+// snapshot copies every ACME object
+func (s *MemoryACMEStore) snapshot() *ACMESnapshot {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	snap := newACMESnapshot()
+	for _, account := range s.accounts {
+		account := account
+		snap.Accounts = append(snap.Accounts, &account)
+	}
+	for _, order := range s.orders {
+		order := order
+		snap.Orders = append(snap.Orders, &order)
+	}
+	for _, authz := range s.authorizations {
+		authz := authz
+		snap.Authorizations = append(snap.Authorizations, &authz)
+	}
+	for _, challenge := range s.challenges {
+		challenge := challenge
+		snap.Challenges = append(snap.Challenges, &challenge)
+	}
+	return snap
+}
+
+// restore replaces every ACME object with those of snap, nil clears them
+func (s *MemoryACMEStore) restore(snap *ACMESnapshot) {
+	restored := NewMemoryACMEStore()
+	if snap != nil {
+		for _, account := range snap.Accounts {
+			restored.accounts[account.ID] = *account
+		}
+		for _, order := range snap.Orders {
+			restored.orders[order.ID] = *order
+		}
+		for _, authz := range snap.Authorizations {
+			restored.authorizations[authz.ID] = *authz
+		}
+		for _, challenge := range snap.Challenges {
+			restored.challenges[challenge.ID] = *challenge
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.accounts = restored.accounts
+	s.orders = restored.orders
+	s.authorizations = restored.authorizations
+	s.challenges = restored.challenges
+}
@@ -0,0 +1,79 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// APIKeyPrefix starts every API key token, tokens are written as cak_<id>_<secret>
+const APIKeyPrefix = "cak_"
+
+// APIKey is a long-lived bearer credential of a user. Only the SHA-256 of its secret is stored,
+// the token itself is shown once when the key is created.
+type APIKey struct {
+	ID     string `json:"id"`
+	UserID string `json:"userId"`
+	Name   string `json:"name"`
+	// Prefix is the start of the token, enough to recognise it in a list
+	Prefix     string     `json:"prefix"`
+	Hash       []byte     `json:"-"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+}
+
+// NewAPIKey creates a key for userID and returns it with its token
+func NewAPIKey(userID, name string, expiresAt *time.Time) (*APIKey, string, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+
+	key := &APIKey{
+		ID:        hex.EncodeToString(id),
+		UserID:    userID,
+		Name:      name,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	hash := sha256.Sum256([]byte(encoded))
+	key.Hash = hash[:]
+	token := APIKeyPrefix + key.ID + "_" + encoded
+	key.Prefix = token[:len(APIKeyPrefix)+len(key.ID)+5]
+	return key, token, nil
+}
+
+// ParseAPIKeyToken splits a token into the key ID and its secret
+func ParseAPIKeyToken(token string) (id, secret string, err error) {
+	rest, ok := strings.CutPrefix(token, APIKeyPrefix)
+	if ok {
+		id, secret, ok = strings.Cut(rest, "_")
+	}
+	if !ok || id == "" || secret == "" {
+		return "", "", fmt.Errorf("malformed API key")
+	}
+	return id, secret, nil
+}
+
+// Matches reports whether secret hashes to the stored hash, in constant time
+func (k *APIKey) Matches(secret string) bool {
+	hash := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(hash[:], k.Hash) == 1
+}
+
+// Active reports whether the key is neither revoked nor expired at now
+func (k *APIKey) Active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
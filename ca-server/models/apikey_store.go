@@ -0,0 +1,99 @@
+package models
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrAPIKeyNotFound is returned for an unknown key ID
+	ErrAPIKeyNotFound error = &storeError{"API key not found", ErrNotFound}
+	// ErrAPIKeyExists is returned when creating a key under an ID already in use
+	ErrAPIKeyExists error = &storeError{"API key already exists", ErrConflict}
+)
+
+// APIKeyStore defines the data access interface for API keys, indexed by key ID
+type APIKeyStore interface {
+	GetAPIKey(ctx context.Context, id string) (*APIKey, error)
+	ListAPIKeys(ctx context.Context, userID string) ([]*APIKey, error)
+	CreateAPIKey(ctx context.Context, key *APIKey) error
+	// RevokeAPIKey marks the key revoked at the given time, revoking twice keeps the first time
+	RevokeAPIKey(ctx context.Context, id string, at time.Time) (*APIKey, error)
+	// TouchAPIKey records the last use of the key
+	TouchAPIKey(ctx context.Context, id string, at time.Time) error
+}
+
+// GetAPIKey retrieves an API key by ID
+func (s *MemoryStore) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	key, exists := s.apiKeys[id]
+	if !exists {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	return key, nil
+}
+
+// ListAPIKeys returns the API keys of a user, oldest first
+func (s *MemoryStore) ListAPIKeys(ctx context.Context, userID string) ([]*APIKey, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	keys := make([]*APIKey, 0)
+	for _, key := range s.apiKeys {
+		if key.UserID == userID {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	return keys, nil
+}
+
+// CreateAPIKey adds a new API key
+func (s *MemoryStore) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.apiKeys[key.ID]; exists {
+		return ErrAPIKeyExists
+	}
+
+	s.apiKeys[key.ID] = key
+	return nil
+}
+
+// RevokeAPIKey marks an API key revoked
+func (s *MemoryStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) (*APIKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key, exists := s.apiKeys[id]
+	if !exists {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	if key.RevokedAt == nil {
+		key.RevokedAt = &at
+	}
+	return key, nil
+}
+
+// TouchAPIKey records the last use of an API key
+func (s *MemoryStore) TouchAPIKey(ctx context.Context, id string, at time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key, exists := s.apiKeys[id]
+	if !exists {
+		return ErrAPIKeyNotFound
+	}
+
+	key.LastUsedAt = &at
+	return nil
+}
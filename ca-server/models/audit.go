@@ -0,0 +1,62 @@
+package models
+
+import "time"
+
+// Audit results
+const (
+	AuditSuccess = "success"
+	// AuditDenied is the result of requests rejected with 401 or 403
+	AuditDenied  = "denied"
+	AuditFailure = "failure"
+)
+
+// AuditSource is where an audited request came from
+type AuditSource struct {
+	IP string `json:"ip,omitempty"`
+	// ClientCert is the subject and serial number of a verified client certificate
+	ClientCert string `json:"clientCert,omitempty"`
+}
+
+// AuditRecord is one entry of the audit log. Hash is the SHA-256 of the record encoded as JSON
+// with an empty hash, PrevHash is the hash of the record before it, chaining the log.
+type AuditRecord struct {
+	Seq        int64       `json:"seq"`
+	Time       time.Time   `json:"time"`
+	Action     string      `json:"action"`
+	Actor      string      `json:"actor"`
+	AuthMethod string      `json:"authMethod,omitempty"`
+	Source     AuditSource `json:"source"`
+	// Request is the method and path, e.g. POST /api/certs/issue
+	Request string                 `json:"request,omitempty"`
+	Params  map[string]interface{} `json:"params,omitempty"`
+	Result  string                 `json:"result"`
+	Status  int                    `json:"status,omitempty"`
+	Error   string                 `json:"error,omitempty"`
+	// Details are set by the handler, e.g. the serial number of an issued certificate
+	Details  map[string]interface{} `json:"details,omitempty"`
+	PrevHash string                 `json:"prevHash"`
+	Hash     string                 `json:"hash"`
+}
+
+// AuditRecorder appends records to the audit log
+type AuditRecorder interface {
+	Record(rec *AuditRecord) error
+}
+
+// AuditFilter selects audit records, empty fields match everything.
+// Action matches exactly or, ending in a dot, as a prefix, e.g. "cert.".
+type AuditFilter struct {
+	Action string
+	Actor  string
+	Result string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// AuditStore keeps the records of the audit log in order, records are only ever appended
+type AuditStore interface {
+	AppendAudit(rec *AuditRecord) error
+	// ScanAudit calls fn with every record, oldest first
+	ScanAudit(fn func(rec *AuditRecord) error) error
+}
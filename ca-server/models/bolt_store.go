@@ -0,0 +1,766 @@
+package models
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the bolt store, every record is kept as JSON under its ID
+var (
+	boltUsers    = []byte("users")
+	boltCerts    = []byte("certs")
+	boltProfiles = []byte("profiles")
+	boltAPIKeys  = []byte("api_keys")
+	// ACME objects
+	boltACMEAccounts       = []byte("acme_accounts")
+	boltACMEOrders         = []byte("acme_orders")
+	boltACMEAuthorizations = []byte("acme_authorizations")
+	boltACMEChallenges     = []byte("acme_challenges")
+	// audit records are keyed by their sequence number in big endian, so they iterate in order
+	boltAudit = []byte("audit")
+)
+
+// boltACMEBuckets hold the ACME state
+var boltACMEBuckets = [][]byte{boltACMEAccounts, boltACMEOrders, boltACMEAuthorizations, boltACMEChallenges}
+
+// BoltStore is a Store kept in a single bbolt file, which also holds the audit log.
+// Listings scan a whole bucket, which is fine for the few thousand certificates of a small CA.
+// Records returned are copies, changes are saved through the store methods.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens or creates the database at path, another process holding it makes this fail
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range append([][]byte{boltUsers, boltCerts, boltProfiles, boltAPIKeys, boltAudit}, boltACMEBuckets...) {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create buckets: %w", err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// Close closes the database
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// GetUser retrieves a user by ID
+func (s *BoltStore) GetUser(ctx context.Context, id string) (*User, error) {
+	user := &User{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx, boltUsers, id, user, ErrUserNotFound)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// ListUsers returns one page of the users matching filter
+func (s *BoltStore) ListUsers(ctx context.Context, filter UserFilter) (*Page[User], error) {
+	l, err := userListing(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]*User, 0)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsers).ForEach(func(_, data []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			user := &User{}
+			if err := json.Unmarshal(data, user); err != nil {
+				return err
+			}
+			if filter.Match(user) {
+				users = append(users, user)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l.page(users, 0, filter.Limit), nil
+}
+
+// CreateUser adds a new user
+func (s *BoltStore) CreateUser(ctx context.Context, user *User) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if user.ID == "" {
+			user.ID = uuid.NewString()
+		} else if tx.Bucket(boltUsers).Get([]byte(user.ID)) != nil {
+			return ErrUserExists
+		}
+		if err := boltEmailTaken(tx, user); err != nil {
+			return err
+		}
+		user.created()
+		return boltPut(tx, boltUsers, user.ID, user)
+	})
+}
+
+// UpdateUser updates an existing user
+func (s *BoltStore) UpdateUser(ctx context.Context, user *User) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		existing := &User{}
+		if err := boltGet(tx, boltUsers, user.ID, existing, ErrUserNotFound); err != nil {
+			return err
+		}
+		if err := boltEmailTaken(tx, user); err != nil {
+			return err
+		}
+		if err := user.replaces(existing); err != nil {
+			return err
+		}
+		return boltPut(tx, boltUsers, user.ID, user)
+	})
+}
+
+// boltEmailTaken fails with ErrEmailTaken when another user has the email of user
+func boltEmailTaken(tx *bolt.Tx, user *User) error {
+	if user.Email == "" {
+		return nil
+	}
+	return tx.Bucket(boltUsers).ForEach(func(_, data []byte) error {
+		other := &User{}
+		if err := json.Unmarshal(data, other); err != nil {
+			return err
+		}
+		if other.ID != user.ID && other.sameEmail(user.Email) {
+			return ErrEmailTaken
+		}
+		return nil
+	})
+}
+
+// DeleteUser removes a user
+func (s *BoltStore) DeleteUser(ctx context.Context, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltDelete(tx, boltUsers, id, ErrUserNotFound)
+	})
+}
+
+// SaveCert records an issued certificate
+func (s *BoltStore) SaveCert(ctx context.Context, cert *Certificate) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltCerts).Get([]byte(cert.SerialNumber)) != nil {
+			return ErrCertExists
+		}
+		return boltPut(tx, boltCerts, cert.SerialNumber, NewCertRecord(cert))
+	})
+}
+
+// GetCert retrieves a certificate by serial number
+func (s *BoltStore) GetCert(ctx context.Context, serial string) (*Certificate, error) {
+	var cert *Certificate
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		cert, err = boltGetCert(tx, serial)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// ListCerts returns one page of the certificates matching filter, newest first unless it sorts otherwise
+func (s *BoltStore) ListCerts(ctx context.Context, filter CertFilter) (*Page[Certificate], error) {
+	l, err := certListing(filter)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := s.selectCerts(ctx, filter.Match)
+	if err != nil {
+		return nil, err
+	}
+	return l.page(certs, filter.Offset, filter.Limit), nil
+}
+
+// RevokeCert marks a certificate as revoked with an RFC 5280 reason code
+func (s *BoltStore) RevokeCert(ctx context.Context, serial string, reason int, revokedAt time.Time) (*Certificate, error) {
+	var cert *Certificate
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if cert, err = boltGetCert(tx, serial); err != nil {
+			return err
+		}
+		if cert.IsRevoked() {
+			return ErrAlreadyRevoked
+		}
+
+		cert.RevokedAt = &revokedAt
+		cert.RevocationCode = reason
+		cert.RevokeAt = nil
+		return boltPut(tx, boltCerts, serial, NewCertRecord(cert))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// ListRevoked returns the revoked certificates issued by the CA with authorityKeyID
+func (s *BoltStore) ListRevoked(ctx context.Context, authorityKeyID string) ([]*Certificate, error) {
+	return s.selectCerts(ctx, func(cert *Certificate) bool {
+		return cert.IsRevoked() && cert.AuthorityKeyID == authorityKeyID
+	})
+}
+
+// MarkRenewed links a certificate to its replacement and optionally schedules its revocation
+func (s *BoltStore) MarkRenewed(ctx context.Context, serial, renewedBy string, revokeAt *time.Time) (*Certificate, error) {
+	var cert *Certificate
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if cert, err = boltGetCert(tx, serial); err != nil {
+			return err
+		}
+
+		cert.RenewedBy = renewedBy
+		if revokeAt != nil && !cert.IsRevoked() {
+			cert.RevokeAt = revokeAt
+		}
+		return boltPut(tx, boltCerts, serial, NewCertRecord(cert))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// ListRevocationsDue returns the unrevoked certificates whose scheduled revocation is at or before now
+func (s *BoltStore) ListRevocationsDue(ctx context.Context, now time.Time) ([]*Certificate, error) {
+	return s.selectCerts(ctx, func(cert *Certificate) bool {
+		return !cert.IsRevoked() && cert.RevokeAt != nil && !cert.RevokeAt.After(now)
+	})
+}
+
+// selectCerts scans the certificates and returns those match accepts
+func (s *BoltStore) selectCerts(ctx context.Context, match func(cert *Certificate) bool) ([]*Certificate, error) {
+	certs := make([]*Certificate, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltCerts).ForEach(func(_, data []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var record CertRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			if !match(record.Certificate) {
+				return nil
+			}
+			cert, err := record.Cert()
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+func boltGetCert(tx *bolt.Tx, serial string) (*Certificate, error) {
+	var record CertRecord
+	if err := boltGet(tx, boltCerts, serial, &record, ErrCertNotFound); err != nil {
+		return nil, err
+	}
+	return record.Cert()
+}
+
+// GetProfile retrieves a profile by name
+func (s *BoltStore) GetProfile(ctx context.Context, name string) (*Profile, error) {
+	profile := &Profile{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx, boltProfiles, name, profile, ErrProfileNotFound)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// ListProfiles returns all profiles sorted by name
+func (s *BoltStore) ListProfiles(ctx context.Context) ([]*Profile, error) {
+	profiles := make([]*Profile, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltProfiles).ForEach(func(_, data []byte) error {
+			profile := &Profile{}
+			if err := json.Unmarshal(data, profile); err != nil {
+				return err
+			}
+			profiles = append(profiles, profile)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// CreateProfile adds a new profile
+func (s *BoltStore) CreateProfile(ctx context.Context, profile *Profile) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltProfiles).Get([]byte(profile.Name)) != nil {
+			return ErrProfileExists
+		}
+
+		now := time.Now()
+		profile.CreatedAt = now
+		profile.UpdatedAt = now
+		return boltPut(tx, boltProfiles, profile.Name, profile)
+	})
+}
+
+// UpdateProfile replaces an existing profile
+func (s *BoltStore) UpdateProfile(ctx context.Context, profile *Profile) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		existing := &Profile{}
+		if err := boltGet(tx, boltProfiles, profile.Name, existing, ErrProfileNotFound); err != nil {
+			return err
+		}
+
+		profile.CreatedAt = existing.CreatedAt
+		profile.UpdatedAt = time.Now()
+		return boltPut(tx, boltProfiles, profile.Name, profile)
+	})
+}
+
+// DeleteProfile removes a profile
+func (s *BoltStore) DeleteProfile(ctx context.Context, name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltDelete(tx, boltProfiles, name, ErrProfileNotFound)
+	})
+}
+
+// GetAPIKey retrieves an API key by ID
+func (s *BoltStore) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	var key *APIKey
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		key, err = boltGetAPIKey(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ListAPIKeys returns the API keys of a user, oldest first
+func (s *BoltStore) ListAPIKeys(ctx context.Context, userID string) ([]*APIKey, error) {
+	keys := make([]*APIKey, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAPIKeys).ForEach(func(_, data []byte) error {
+			var record APIKeyRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			if record.UserID == userID {
+				keys = append(keys, record.Key())
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+// CreateAPIKey adds a new API key
+func (s *BoltStore) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltAPIKeys).Get([]byte(key.ID)) != nil {
+			return ErrAPIKeyExists
+		}
+		return boltPut(tx, boltAPIKeys, key.ID, NewAPIKeyRecord(key))
+	})
+}
+
+// RevokeAPIKey marks an API key revoked
+func (s *BoltStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) (*APIKey, error) {
+	var key *APIKey
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if key, err = boltGetAPIKey(tx, id); err != nil {
+			return err
+		}
+		if key.RevokedAt != nil {
+			return nil
+		}
+		key.RevokedAt = &at
+		return boltPut(tx, boltAPIKeys, id, NewAPIKeyRecord(key))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// TouchAPIKey records the last use of an API key
+func (s *BoltStore) TouchAPIKey(ctx context.Context, id string, at time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		key, err := boltGetAPIKey(tx, id)
+		if err != nil {
+			return err
+		}
+		key.LastUsedAt = &at
+		return boltPut(tx, boltAPIKeys, id, NewAPIKeyRecord(key))
+	})
+}
+
+func boltGetAPIKey(tx *bolt.Tx, id string) (*APIKey, error) {
+	var record APIKeyRecord
+	if err := boltGet(tx, boltAPIKeys, id, &record, ErrAPIKeyNotFound); err != nil {
+		return nil, err
+	}
+	return record.Key(), nil
+}
+
+// CreateAccount adds a new ACME account
+func (s *BoltStore) CreateAccount(account *ACMEAccount) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, boltACMEAccounts, account.ID, account)
+	})
+}
+
+// GetAccount retrieves an ACME account by ID
+func (s *BoltStore) GetAccount(id string) (*ACMEAccount, error) {
+	return boltGetACME[ACMEAccount](s.db, boltACMEAccounts, id, ErrACMEAccountNotFound)
+}
+
+// GetAccountByThumbprint retrieves an ACME account by the thumbprint of its key
+func (s *BoltStore) GetAccountByThumbprint(thumbprint string) (*ACMEAccount, error) {
+	accounts, err := boltSelectACME(s.db, boltACMEAccounts, func(account *ACMEAccount) bool {
+		return account.KeyThumbprint == thumbprint
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		return nil, ErrACMEAccountNotFound
+	}
+	return accounts[0], nil
+}
+
+// UpdateAccount updates an existing ACME account
+func (s *BoltStore) UpdateAccount(account *ACMEAccount) error {
+	return boltUpdateACME(s.db, boltACMEAccounts, account.ID, account, ErrACMEAccountNotFound)
+}
+
+// CreateOrder adds a new ACME order
+func (s *BoltStore) CreateOrder(order *ACMEOrder) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, boltACMEOrders, order.ID, order)
+	})
+}
+
+// GetOrder retrieves an ACME order by ID
+func (s *BoltStore) GetOrder(id string) (*ACMEOrder, error) {
+	return boltGetACME[ACMEOrder](s.db, boltACMEOrders, id, ErrACMEOrderNotFound)
+}
+
+// ListOrders returns the orders of an ACME account
+func (s *BoltStore) ListOrders(accountID string) ([]*ACMEOrder, error) {
+	return boltSelectACME(s.db, boltACMEOrders, func(order *ACMEOrder) bool {
+		return order.AccountID == accountID
+	})
+}
+
+// UpdateOrder updates an existing ACME order
+func (s *BoltStore) UpdateOrder(order *ACMEOrder) error {
+	return boltUpdateACME(s.db, boltACMEOrders, order.ID, order, ErrACMEOrderNotFound)
+}
+
+// TransitionOrder moves an ACME order from one status to another in one write transaction
+func (s *BoltStore) TransitionOrder(id, from, to string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		order := &ACMEOrder{}
+		if err := boltGet(tx, boltACMEOrders, id, order, ErrACMEOrderNotFound); err != nil {
+			return err
+		}
+		if order.Status != from {
+			return ErrACMEOrderChanged
+		}
+		order.Status = to
+		return boltPut(tx, boltACMEOrders, id, order)
+	})
+}
+
+// CreateAuthorization adds a new ACME authorization
+func (s *BoltStore) CreateAuthorization(authz *ACMEAuthorization) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, boltACMEAuthorizations, authz.ID, authz)
+	})
+}
+
+// GetAuthorization retrieves an ACME authorization by ID
+func (s *BoltStore) GetAuthorization(id string) (*ACMEAuthorization, error) {
+	return boltGetACME[ACMEAuthorization](s.db, boltACMEAuthorizations, id, ErrACMEAuthorizationNotFound)
+}
+
+// UpdateAuthorization updates an existing ACME authorization
+func (s *BoltStore) UpdateAuthorization(authz *ACMEAuthorization) error {
+	return boltUpdateACME(s.db, boltACMEAuthorizations, authz.ID, authz, ErrACMEAuthorizationNotFound)
+}
+
+// CreateChallenge adds a new ACME challenge
+func (s *BoltStore) CreateChallenge(challenge *ACMEChallenge) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, boltACMEChallenges, challenge.ID, challenge)
+	})
+}
+
+// GetChallenge retrieves an ACME challenge by ID
+func (s *BoltStore) GetChallenge(id string) (*ACMEChallenge, error) {
+	return boltGetACME[ACMEChallenge](s.db, boltACMEChallenges, id, ErrACMEChallengeNotFound)
+}
+
+// UpdateChallenge updates an existing ACME challenge
+func (s *BoltStore) UpdateChallenge(challenge *ACMEChallenge) error {
+	return boltUpdateACME(s.db, boltACMEChallenges, challenge.ID, challenge, ErrACMEChallengeNotFound)
+}
+
+// boltGetACME reads the ACME object under id, notFound is the error for a missing one
+func boltGetACME[T any](db *bolt.DB, bucket []byte, id string, notFound error) (*T, error) {
+	record := new(T)
+	err := db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx, bucket, id, record, notFound)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// boltSelectACME returns the ACME objects of a bucket that match
+func boltSelectACME[T any](db *bolt.DB, bucket []byte, match func(record *T) bool) ([]*T, error) {
+	records := make([]*T, 0)
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(_, data []byte) error {
+			record := new(T)
+			if err := json.Unmarshal(data, record); err != nil {
+				return err
+			}
+			if match(record) {
+				records = append(records, record)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// boltUpdateACME replaces the existing ACME object under id, notFound is the error for a missing one
+func boltUpdateACME(db *bolt.DB, bucket []byte, id string, v interface{}, notFound error) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucket).Get([]byte(id)) == nil {
+			return notFound
+		}
+		return boltPut(tx, bucket, id, v)
+	})
+}
+
+// Snapshot reads every record in one read transaction
+func (s *BoltStore) Snapshot(ctx context.Context) (*StoreSnapshot, error) {
+	snap := &StoreSnapshot{
+		Users:    make([]*User, 0),
+		Certs:    make([]*CertRecord, 0),
+		Profiles: make([]*Profile, 0),
+		APIKeys:  make([]*APIKeyRecord, 0),
+		ACME:     newACMESnapshot(),
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		buckets := []struct {
+			name   []byte
+			decode func(data []byte) error
+		}{
+			{boltUsers, func(data []byte) error { return appendJSON(data, &snap.Users) }},
+			{boltCerts, func(data []byte) error { return appendJSON(data, &snap.Certs) }},
+			{boltProfiles, func(data []byte) error { return appendJSON(data, &snap.Profiles) }},
+			{boltAPIKeys, func(data []byte) error { return appendJSON(data, &snap.APIKeys) }},
+			{boltACMEAccounts, func(data []byte) error { return appendJSON(data, &snap.ACME.Accounts) }},
+			{boltACMEOrders, func(data []byte) error { return appendJSON(data, &snap.ACME.Orders) }},
+			{boltACMEAuthorizations, func(data []byte) error { return appendJSON(data, &snap.ACME.Authorizations) }},
+			{boltACMEChallenges, func(data []byte) error { return appendJSON(data, &snap.ACME.Challenges) }},
+		}
+		for _, bucket := range buckets {
+			err := tx.Bucket(bucket.name).ForEach(func(_, data []byte) error {
+				return bucket.decode(data)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// Restore replaces every record but the audit log in one write transaction
+func (s *BoltStore) Restore(ctx context.Context, snap *StoreSnapshot) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range append([][]byte{boltUsers, boltCerts, boltProfiles, boltAPIKeys}, boltACMEBuckets...) {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+
+		for _, user := range snap.Users {
+			if err := boltPut(tx, boltUsers, user.ID, user); err != nil {
+				return err
+			}
+		}
+		for _, record := range snap.Certs {
+			if err := boltPut(tx, boltCerts, record.SerialNumber, record); err != nil {
+				return err
+			}
+		}
+		for _, profile := range snap.Profiles {
+			if err := boltPut(tx, boltProfiles, profile.Name, profile); err != nil {
+				return err
+			}
+		}
+		for _, record := range snap.APIKeys {
+			if err := boltPut(tx, boltAPIKeys, record.ID, record); err != nil {
+				return err
+			}
+		}
+		if snap.ACME == nil {
+			return nil
+		}
+		for _, account := range snap.ACME.Accounts {
+			if err := boltPut(tx, boltACMEAccounts, account.ID, account); err != nil {
+				return err
+			}
+		}
+		for _, order := range snap.ACME.Orders {
+			if err := boltPut(tx, boltACMEOrders, order.ID, order); err != nil {
+				return err
+			}
+		}
+		for _, authz := range snap.ACME.Authorizations {
+			if err := boltPut(tx, boltACMEAuthorizations, authz.ID, authz); err != nil {
+				return err
+			}
+		}
+		for _, challenge := range snap.ACME.Challenges {
+			if err := boltPut(tx, boltACMEChallenges, challenge.ID, challenge); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AppendAudit stores an audit record, a sequence number already in use fails
+func (s *BoltStore) AppendAudit(rec *AuditRecord) error {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(rec.Seq))
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltAudit)
+		if bucket.Get(key) != nil {
+			return fmt.Errorf("record %d already exists", rec.Seq)
+		}
+		return bucket.Put(key, data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+	return nil
+}
+
+// ScanAudit reads the audit records in sequence order
+func (s *BoltStore) ScanAudit(fn func(rec *AuditRecord) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAudit).ForEach(func(_, data []byte) error {
+			var rec AuditRecord
+			if err := json.Unmarshal(data, &rec); err != nil {
+				return fmt.Errorf("audit record is not valid: %w", err)
+			}
+			return fn(&rec)
+		})
+	})
+}
+
+// boltGet decodes the record under key, notFound is the error for a missing one
+func boltGet(tx *bolt.Tx, bucket []byte, key string, v interface{}, notFound error) error {
+	data := tx.Bucket(bucket).Get([]byte(key))
+	if data == nil {
+		return notFound
+	}
+	return json.Unmarshal(data, v)
+}
+
+// boltPut stores v as JSON under key
+func boltPut(tx *bolt.Tx, bucket []byte, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucket).Put([]byte(key), data)
+}
+
+// boltDelete removes the record under key, notFound is the error for a missing one
+func boltDelete(tx *bolt.Tx, bucket []byte, key string, notFound error) error {
+	b := tx.Bucket(bucket)
+	if b.Get([]byte(key)) == nil {
+		return notFound
+	}
+	return b.Delete([]byte(key))
+}
+
+// appendJSON decodes data as one more element of the slice list points to
+func appendJSON[T any](data []byte, list *[]*T) error {
+	record := new(T)
+	if err := json.Unmarshal(data, record); err != nil {
+		return err
+	}
+	*list = append(*list, record)
+	return nil
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// caIDPattern matches CA IDs, the hex subject key IDs also used as file names
+var caIDPattern = regexp.MustCompile(`^[0-9a-f]+$`)
+
+// CAArchive is a CA as the CA store keeps it: the certificate with its chain and the key,
+// sealed with the KEK when there is one, or only the reference of an external key
+type CAArchive struct {
+	ID      string `json:"id"`
+	CertPEM string `json:"certPem"`
+	KeyPEM  string `json:"keyPem"`
+	Issuing bool   `json:"issuing,omitempty"`
+}
+
+// Export reads the files of every CA, sealed stores export their sealed keys
+func (s *FileCAStore) Export() ([]CAArchive, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	cas := make([]CAArchive, 0, len(s.cas))
+	for id, ca := range s.cas {
+		// the issuing CA may predate the CA directory
+		certPath, keyPath := filepath.Join(s.dir, id+".pem"), filepath.Join(s.dir, id+".key")
+		issuing := ca == s.issuing
+		if issuing {
+			certPath, keyPath = s.certPath, s.keyPath
+		}
+
+		certPEM, err := os.ReadFile(certPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+		keyPEM, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA key: %w", err)
+		}
+		cas = append(cas, CAArchive{ID: id, CertPEM: string(certPEM), KeyPEM: string(keyPEM), Issuing: issuing})
+	}
+	return cas, nil
+}
+
+// Import writes the CAs next to the stored ones and reloads the store. The CAs are first loaded
+// from a staging directory, so a key sealed with another KEK or a missing key backend fails
+// before anything is replaced. Plaintext keys are sealed when the store has a KEK.
+func (s *FileCAStore) Import(cas []CAArchive) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create CA directory: %w", err)
+	}
+	staging, err := os.MkdirTemp(s.dir, ".import-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	issuing := ""
+	for _, ca := range cas {
+		if !caIDPattern.MatchString(ca.ID) {
+			return fmt.Errorf("invalid CA ID %q", ca.ID)
+		}
+		if ca.Issuing {
+			if issuing != "" {
+				return fmt.Errorf("CAs %s and %s are both issuing", issuing, ca.ID)
+			}
+			issuing = ca.ID
+		}
+		if err := os.WriteFile(filepath.Join(staging, ca.ID+".pem"), []byte(ca.CertPEM), 0644); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(staging, ca.ID+".key"), []byte(ca.KeyPEM), 0600); err != nil {
+			return err
+		}
+	}
+
+	backends := make([]SignerBackend, 0, len(s.backends))
+	for _, backend := range s.backends {
+		backends = append(backends, backend)
+	}
+	// no issuing CA paths in staging, the directory holds every CA
+	staged, err := NewFileCAStore(filepath.Join(staging, "issuing.pem"), filepath.Join(staging, "issuing.key"), staging, s.kek, true, backends...)
+	if err != nil {
+		return err
+	}
+	for _, ca := range cas {
+		if _, ok := staged.cas[ca.ID]; !ok {
+			return fmt.Errorf("CA %s does not match the subject key ID of its certificate", ca.ID)
+		}
+	}
+
+	// the staged files now hold the keys as this store writes them
+	for _, ca := range cas {
+		targets := [][2]string{{filepath.Join(s.dir, ca.ID+".pem"), filepath.Join(s.dir, ca.ID+".key")}}
+		if ca.ID == issuing {
+			targets = append(targets, [2]string{s.certPath, s.keyPath})
+		}
+		certPEM, err := os.ReadFile(filepath.Join(staging, ca.ID+".pem"))
+		if err != nil {
+			return err
+		}
+		keyPEM, err := os.ReadFile(filepath.Join(staging, ca.ID+".key"))
+		if err != nil {
+			return err
+		}
+		for _, target := range targets {
+			if err := writePair(target[0], target[1], certPEM, keyPEM); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.load()
+}
@@ -0,0 +1,594 @@
+package models
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"ca-server/utils"
+)
+
+// ErrCANotLoaded is returned when no issuing CA has been loaded or created yet
+var ErrCANotLoaded = errors.New("CA not loaded")
+
+// ErrCANotFound is returned when a CA is looked up by an unknown ID
+var ErrCANotFound = errors.New("CA not found")
+
+// ErrCASealed is returned when signing with, or storing, a CA whose key is still encrypted
+var ErrCASealed = errors.New("CA keys are sealed")
+
+// ErrCANotSealed is returned when unsealing a store whose keys are already available
+var ErrCANotSealed = errors.New("CA keys are not sealed")
+
+// ErrNoKEK is returned when sealing a store that keeps its keys in plaintext
+var ErrNoKEK = errors.New("CA keys are not encrypted, configure a key encryption key")
+
+// ErrCAExists is returned when creating an issuing CA while there is one
+var ErrCAExists = errors.New("an issuing CA already exists")
+
+// CA is a certificate authority key pair with the certificates above it
+type CA struct {
+	Signer crypto.Signer
+	Cert   *x509.Certificate
+	// Chain holds the issuers of Cert up to and including the root, empty for a root CA
+	Chain []*x509.Certificate
+}
+
+// NewCA checks that the signer matches the certificate and that each certificate
+// of the chain signed the one before it
+func NewCA(signer crypto.Signer, cert *x509.Certificate, chain []*x509.Certificate) (*CA, error) {
+	if !cert.IsCA {
+		return nil, errors.New("certificate is not a CA")
+	}
+	if len(cert.SubjectKeyId) == 0 {
+		return nil, errors.New("CA certificate has no subject key identifier")
+	}
+	if !utils.PublicKeysEqual(signer.Public(), cert.PublicKey) {
+		return nil, errors.New("CA key does not match certificate")
+	}
+
+	child := cert
+	for _, parent := range chain {
+		if err := child.CheckSignatureFrom(parent); err != nil {
+			return nil, fmt.Errorf("chain is broken at %q: %w", child.Subject.CommonName, err)
+		}
+		child = parent
+	}
+	return &CA{Signer: signer, Cert: cert, Chain: chain}, nil
+}
+
+// ID identifies the CA by its hex subject key ID, the AuthorityKeyID of what it issues
+func (ca *CA) ID() string {
+	return hex.EncodeToString(ca.Cert.SubjectKeyId)
+}
+
+// FullChain returns the CA certificate followed by its issuers
+func (ca *CA) FullChain() []*x509.Certificate {
+	return append([]*x509.Certificate{ca.Cert}, ca.Chain...)
+}
+
+// IsRoot reports whether the CA is self-signed
+func (ca *CA) IsRoot() bool {
+	return len(ca.Chain) == 0
+}
+
+// sealedSigner stands in for a CA key that has not been decrypted yet, so the CA
+// can still be listed and looked up while every signature fails with ErrCASealed
+type sealedSigner struct {
+	pub crypto.PublicKey
+}
+
+func (s sealedSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s sealedSigner) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	return nil, ErrCASealed
+}
+
+// CAStore holds the certificate authorities and which of them issues leaf certificates
+type CAStore interface {
+	// Get returns the issuing CA
+	Get() (*CA, error)
+	// GetByID returns any stored CA
+	GetByID(id string) (*CA, error)
+	// List returns all stored CAs
+	List() []*CA
+	// Save persists a CA, making it the issuing CA when activate is set
+	Save(ca *CA, activate bool) error
+	// Create persists a CA as the issuing CA unless there is one, see ErrCAExists
+	Create(ca *CA) error
+	// Activate makes a stored CA the issuing CA
+	Activate(id string) error
+	// Loaded reports whether an issuing CA is available
+	Loaded() bool
+	// Sealed reports whether the CA keys are still encrypted
+	Sealed() bool
+	// Unseal decrypts the CA keys with the key encryption passphrase
+	Unseal(passphrase []byte) error
+	// Seal drops the decrypted CA keys from memory
+	Seal() error
+	// Export returns every CA as stored, for backups
+	Export() ([]CAArchive, error)
+	// Import adds the exported CAs, replacing the issuing CA when one of them was issuing
+	Import(cas []CAArchive) error
+}
+
+// FileCAStore keeps CAs as PEM files on disk and caches the parsed key pairs in memory.
+// The issuing CA lives at certPath and keyPath, every CA is also kept in dir as <id>.pem
+// (certificate and chain) and <id>.key.
+// Once a key encryption passphrase (KEK) is known every key is written sealed, see utils.EncryptPrivateKeyPEM.
+// Sealed keys found without the KEK leave the store sealed until Unseal is called.
+type FileCAStore struct {
+	certPath string
+	keyPath  string
+	dir      string
+	kek      []byte
+	sealed   bool
+	backends map[string]SignerBackend
+	cas      map[string]*CA
+	issuing  *CA
+	mutex    sync.RWMutex
+}
+
+// NewFileCAStore loads the issuing CA from certPath and keyPath and the other CAs from dir.
+// kek decrypts sealed keys and seals plaintext ones, nil keeps plaintext keys as they are.
+// When allowEmpty is set a missing issuing CA is not an error, so one can be created through the API later.
+// backends open the CA keys that are only referenced from their key file.
+func NewFileCAStore(certPath, keyPath, dir string, kek []byte, allowEmpty bool, backends ...SignerBackend) (*FileCAStore, error) {
+	s := &FileCAStore{
+		certPath: certPath,
+		keyPath:  keyPath,
+		dir:      dir,
+		kek:      kek,
+		backends: make(map[string]SignerBackend),
+	}
+	for _, backend := range backends {
+		s.backends[backend.Name()] = backend
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if s.issuing == nil && !allowEmpty {
+		return nil, fmt.Errorf("no CA found at %s and %s, create one or set CA_BOOTSTRAP=true", certPath, keyPath)
+	}
+	return s, nil
+}
+
+// plaintextKey is a CA key found unsealed on disk, sealed once every key loaded with the KEK
+type plaintextKey struct {
+	ca   *CA
+	path string
+}
+
+// load reads every CA from disk with the current KEK, replacing the cached ones.
+// Plaintext keys are only sealed after every key loaded, so a KEK that fails to open one
+// of the sealed keys never seals others under it.
+// The caller must hold the write lock or own the store.
+func (s *FileCAStore) load() error {
+	s.cas = make(map[string]*CA)
+	s.issuing = nil
+	s.sealed = false
+
+	plaintext, err := s.loadDir()
+	if err != nil {
+		return err
+	}
+	issuingKey, err := s.loadIssuing()
+	if err != nil {
+		return err
+	}
+	if issuingKey != nil {
+		plaintext = append(plaintext, *issuingKey)
+	}
+
+	if s.kek == nil {
+		return nil
+	}
+	for _, key := range plaintext {
+		if err := writeKey(key.ca.Signer, key.path, s.kek); err != nil {
+			return err
+		}
+		log.Printf("Sealed plaintext CA key %s", key.path)
+	}
+	return nil
+}
+
+// loadIssuing reads the issuing CA and returns its key when it is kept in plaintext
+func (s *FileCAStore) loadIssuing() (*plaintextKey, error) {
+	if err := recoverPair(s.certPath, s.keyPath); err != nil {
+		return nil, err
+	}
+	_, certErr := os.Stat(s.certPath)
+	_, keyErr := os.Stat(s.keyPath)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		return nil, nil
+	}
+
+	ca, isPlaintext, err := s.loadCA(s.certPath, s.keyPath)
+	if err != nil {
+		return nil, err
+	}
+	var key *plaintextKey
+	if isPlaintext {
+		key = &plaintextKey{ca: ca, path: s.keyPath}
+	}
+	if stored, ok := s.cas[ca.ID()]; ok && len(stored.Chain) > len(ca.Chain) {
+		ca = stored
+	}
+	s.cas[ca.ID()] = ca
+	s.issuing = ca
+	return key, nil
+}
+
+// loadDir reads every CA kept in dir and returns those with plaintext keys, a missing directory holds no CAs
+func (s *FileCAStore) loadDir() ([]plaintextKey, error) {
+	pending, err := filepath.Glob(filepath.Join(s.dir, "*"+pendingSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range pending {
+		base := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(file, pendingSuffix), ".key"), ".pem")
+		if err := recoverPair(base+".pem", base+".key"); err != nil {
+			return nil, err
+		}
+	}
+
+	keyFiles, err := filepath.Glob(filepath.Join(s.dir, "*.key"))
+	if err != nil {
+		return nil, err
+	}
+
+	var plaintext []plaintextKey
+	for _, keyFile := range keyFiles {
+		ca, isPlaintext, err := s.loadCA(strings.TrimSuffix(keyFile, ".key")+".pem", keyFile)
+		if err != nil {
+			return nil, err
+		}
+		if isPlaintext {
+			plaintext = append(plaintext, plaintextKey{ca: ca, path: keyFile})
+		}
+		s.cas[ca.ID()] = ca
+	}
+	return plaintext, nil
+}
+
+// loadCA reads and validates a CA key pair, the certificate file may carry the chain after the CA certificate.
+// A sealed key without the KEK yields a CA that cannot sign. plaintext reports a key kept unsealed on disk
+// that is to be sealed once the KEK is known, see load.
+func (s *FileCAStore) loadCA(certPath, keyPath string) (ca *CA, plaintext bool, err error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read CA key: %w", err)
+	}
+
+	certs, err := utils.ParseCertsPEM(certPEM)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to parse CA certificate %s: %w", certPath, err)
+	}
+
+	var signer crypto.Signer
+	sealed := utils.IsSealedKeyPEM(keyPEM)
+	backend, ref, external := decodeKeyRef(keyPEM)
+	switch {
+	case external:
+		signer, err = openKeyRef(s.backends, backend, ref)
+	case sealed && s.kek == nil:
+		signer = sealedSigner{pub: certs[0].PublicKey}
+		s.sealed = true
+	case sealed:
+		signer, err = utils.DecryptPrivateKeyPEM(keyPEM, s.kek)
+	default:
+		signer, err = utils.ParsePrivateKeyPEM(keyPEM)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to parse CA key %s: %w", keyPath, err)
+	}
+
+	ca, err = NewCA(signer, certs[0], certs[1:])
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid CA in %s: %w", certPath, err)
+	}
+	return ca, !sealed && !external, nil
+}
+
+// Get returns the issuing CA
+func (s *FileCAStore) Get() (*CA, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.issuing == nil {
+		return nil, ErrCANotLoaded
+	}
+	return s.issuing, nil
+}
+
+// GetByID returns a stored CA by its subject key ID
+func (s *FileCAStore) GetByID(id string) (*CA, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	ca, ok := s.cas[strings.ToLower(id)]
+	if !ok {
+		return nil, ErrCANotFound
+	}
+	return ca, nil
+}
+
+// List returns all stored CAs, oldest first
+func (s *FileCAStore) List() []*CA {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	cas := make([]*CA, 0, len(s.cas))
+	for _, ca := range s.cas {
+		cas = append(cas, ca)
+	}
+	slices.SortFunc(cas, func(a, b *CA) int {
+		return a.Cert.NotBefore.Compare(b.Cert.NotBefore)
+	})
+	return cas
+}
+
+// Loaded reports whether an issuing CA is available
+func (s *FileCAStore) Loaded() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.issuing != nil
+}
+
+// Sealed reports whether the CA keys are still encrypted
+func (s *FileCAStore) Sealed() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.sealed
+}
+
+// Unseal decrypts the CA keys with passphrase, a wrong passphrase leaves the store sealed
+func (s *FileCAStore) Unseal(passphrase []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.sealed {
+		return ErrCANotSealed
+	}
+
+	cas, issuing := s.cas, s.issuing
+	s.kek = passphrase
+	if err := s.load(); err != nil {
+		s.kek = nil
+		s.cas, s.issuing, s.sealed = cas, issuing, true
+		return err
+	}
+	return nil
+}
+
+// Seal forgets the KEK and the decrypted keys, signing fails with ErrCASealed until the next Unseal
+func (s *FileCAStore) Seal() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.sealed {
+		return nil
+	}
+	if s.kek == nil {
+		return ErrNoKEK
+	}
+
+	s.kek = nil
+	return s.load()
+}
+
+// Save writes the CA to dir, and to the issuing CA paths when activate is set
+func (s *FileCAStore) Save(ca *CA, activate bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.save(ca, activate)
+}
+
+// Create saves ca as the issuing CA unless there is one already, which fails with ErrCAExists.
+// The check and the save happen under the store lock, of concurrent calls only one creates a CA.
+func (s *FileCAStore) Create(ca *CA) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.issuing != nil {
+		return ErrCAExists
+	}
+	return s.save(ca, true)
+}
+
+// Activate writes a stored CA to the issuing CA paths and signs with it from now on
+func (s *FileCAStore) Activate(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ca, ok := s.cas[strings.ToLower(id)]
+	if !ok {
+		return ErrCANotFound
+	}
+	return s.activate(ca)
+}
+
+// save is Save for callers holding the write lock
+func (s *FileCAStore) save(ca *CA, activate bool) error {
+	if s.sealed {
+		return ErrCASealed
+	}
+
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create CA directory: %w", err)
+	}
+	if err := writeCA(ca, filepath.Join(s.dir, ca.ID()+".pem"), filepath.Join(s.dir, ca.ID()+".key"), s.kek); err != nil {
+		return err
+	}
+	s.cas[ca.ID()] = ca
+
+	if activate {
+		return s.activate(ca)
+	}
+	return nil
+}
+
+// activate is Activate for callers holding the write lock
+func (s *FileCAStore) activate(ca *CA) error {
+	if s.sealed {
+		return ErrCASealed
+	}
+
+	// keep a copy of the current issuing CA before its files are replaced,
+	// it may predate the CA directory
+	if current := s.issuing; current != nil && current != ca {
+		keyPath := filepath.Join(s.dir, current.ID()+".key")
+		if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+			if err := os.MkdirAll(s.dir, 0700); err != nil {
+				return fmt.Errorf("failed to create CA directory: %w", err)
+			}
+			if err := writeCA(current, filepath.Join(s.dir, current.ID()+".pem"), keyPath, s.kek); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := writeCA(ca, s.certPath, s.keyPath, s.kek); err != nil {
+		return err
+	}
+	s.issuing = ca
+	return nil
+}
+
+// pendingSuffix marks the files of a CA pair written but not yet renamed into place, see writePair
+const pendingSuffix = ".new"
+
+// writeCA writes the certificate chain and the private key of a CA, sealing the key when kek is set
+func writeCA(ca *CA, certPath, keyPath string, kek []byte) error {
+	keyPEM, err := encodeKey(ca.Signer, kek)
+	if err != nil {
+		return err
+	}
+	return writePair(certPath, keyPath, utils.EncodeCertsPEM(ca.FullChain()...), keyPEM)
+}
+
+// writePair replaces the certificate and key files of a CA. Both are written in full next to their
+// paths first, then renamed into place key first, so recoverPair can finish or undo a pair left
+// half replaced by a crash and the certificate never ends up next to the key of another CA.
+func writePair(certPath, keyPath string, certPEM, keyPEM []byte) error {
+	if err := writeFileAtomic(keyPath+pendingSuffix, keyPEM, 0600); err != nil {
+		return fmt.Errorf("failed to write CA key: %w", err)
+	}
+	if err := writeFileAtomic(certPath+pendingSuffix, certPEM, 0644); err != nil {
+		os.Remove(keyPath + pendingSuffix)
+		return fmt.Errorf("failed to write CA certificate: %w", err)
+	}
+	// from here on both files are complete and recoverPair rolls forward
+	if err := os.Rename(keyPath+pendingSuffix, keyPath); err != nil {
+		return fmt.Errorf("failed to write CA key: %w", err)
+	}
+	if err := os.Rename(certPath+pendingSuffix, certPath); err != nil {
+		return fmt.Errorf("failed to write CA certificate: %w", err)
+	}
+	return nil
+}
+
+// recoverPair completes an interrupted writePair. A pending certificate means both files were
+// written and the pair is renamed into place, a pending key alone was written without its
+// certificate and is dropped, leaving the previous pair as it was.
+func recoverPair(certPath, keyPath string) error {
+	_, certErr := os.Stat(certPath + pendingSuffix)
+	_, keyErr := os.Stat(keyPath + pendingSuffix)
+	switch {
+	case certErr == nil:
+		if keyErr == nil {
+			if err := os.Rename(keyPath+pendingSuffix, keyPath); err != nil {
+				return fmt.Errorf("failed to recover CA key %s: %w", keyPath, err)
+			}
+		}
+		if err := os.Rename(certPath+pendingSuffix, certPath); err != nil {
+			return fmt.Errorf("failed to recover CA certificate %s: %w", certPath, err)
+		}
+		log.Printf("Completed the interrupted write of CA %s", certPath)
+	case keyErr == nil:
+		if err := os.Remove(keyPath + pendingSuffix); err != nil {
+			return fmt.Errorf("failed to drop partial CA key %s: %w", keyPath, err)
+		}
+		log.Printf("Dropped the partial write of CA key %s", keyPath)
+	}
+	return nil
+}
+
+// writeKey writes a CA private key, sealed with kek or as plaintext PKCS#8 when kek is nil.
+// Only the reference of an external key is written.
+func writeKey(key crypto.Signer, keyPath string, kek []byte) error {
+	keyPEM, err := encodeKey(key, kek)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(keyPath, keyPEM, 0600); err != nil {
+		return fmt.Errorf("failed to write CA key: %w", err)
+	}
+	return nil
+}
+
+// encodeKey returns the PEM of a CA private key as writeKey stores it
+func encodeKey(key crypto.Signer, kek []byte) ([]byte, error) {
+	if external, ok := key.(ExternalSigner); ok {
+		return encodeKeyRef(external), nil
+	}
+	if kek != nil {
+		sealed, err := utils.EncryptPrivateKeyPEM(key, kek)
+		if err != nil {
+			return nil, fmt.Errorf("failed to seal CA key: %w", err)
+		}
+		return sealed, nil
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal CA key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it into place
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	// the data must be on disk before the rename makes it visible
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,287 @@
+package models
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"ca-server/utils"
+)
+
+// newTestRootCA creates a self-signed root CA
+func newTestRootCA(t *testing.T, name string) *CA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse CA certificate: %v", err)
+	}
+	ca, err := NewCA(key, cert, nil)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	return ca
+}
+
+// TestFileCAStoreRecoversPair loads a store whose issuing CA was being replaced when the process died
+func TestFileCAStoreRecoversPair(t *testing.T) {
+	cases := []struct {
+		name string
+		// interrupt leaves the files of next as a crash at that point of writePair would
+		interrupt func(t *testing.T, certPath, keyPath string, certPEM, keyPEM []byte)
+		next      bool
+	}{
+		{"key written", func(t *testing.T, certPath, keyPath string, certPEM, keyPEM []byte) {
+			writeTestFile(t, keyPath+pendingSuffix, keyPEM)
+		}, false},
+		{"both written", func(t *testing.T, certPath, keyPath string, certPEM, keyPEM []byte) {
+			writeTestFile(t, keyPath+pendingSuffix, keyPEM)
+			writeTestFile(t, certPath+pendingSuffix, certPEM)
+		}, true},
+		{"key renamed", func(t *testing.T, certPath, keyPath string, certPEM, keyPEM []byte) {
+			writeTestFile(t, keyPath, keyPEM)
+			writeTestFile(t, certPath+pendingSuffix, certPEM)
+		}, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			certPath, keyPath, caDir := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"), filepath.Join(dir, "cas")
+			store, err := NewFileCAStore(certPath, keyPath, caDir, nil, true)
+			if err != nil {
+				t.Fatalf("Failed to open CA store: %v", err)
+			}
+			current, next := newTestRootCA(t, "Current CA"), newTestRootCA(t, "Next CA")
+			if err := store.Save(current, true); err != nil {
+				t.Fatalf("Failed to save CA: %v", err)
+			}
+
+			keyPEM, err := encodeKey(next.Signer, nil)
+			if err != nil {
+				t.Fatalf("Failed to encode key: %v", err)
+			}
+			tc.interrupt(t, certPath, keyPath, utils.EncodeCertsPEM(next.Cert), keyPEM)
+
+			reopened, err := NewFileCAStore(certPath, keyPath, caDir, nil, false)
+			if err != nil {
+				t.Fatalf("Failed to reopen CA store: %v", err)
+			}
+			want := current
+			if tc.next {
+				want = next
+			}
+			if issuing, _ := reopened.Get(); issuing.ID() != want.ID() {
+				t.Errorf("Expected issuing CA %s, got %s", want.Cert.Subject.CommonName, issuing.Cert.Subject.CommonName)
+			}
+			for _, path := range []string{certPath + pendingSuffix, keyPath + pendingSuffix} {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("Expected %s to be gone after recovery, got %v", path, err)
+				}
+			}
+		})
+	}
+}
+
+// TestFileCAStoreCreate has concurrent requests create the first CA, exactly one of them wins
+func TestFileCAStoreCreate(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileCAStore(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"), filepath.Join(dir, "cas"), nil, true)
+	if err != nil {
+		t.Fatalf("Failed to open CA store: %v", err)
+	}
+
+	cas := make([]*CA, 8)
+	errs := make([]error, len(cas))
+	for i := range cas {
+		cas[i] = newTestRootCA(t, fmt.Sprintf("CA %d", i))
+	}
+	var wg sync.WaitGroup
+	for i := range cas {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = store.Create(cas[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var created *CA
+	for i, err := range errs {
+		switch {
+		case err == nil && created != nil:
+			t.Errorf("Expected a single CA to be created, got %s and %s", created.Cert.Subject.CommonName, cas[i].Cert.Subject.CommonName)
+		case err == nil:
+			created = cas[i]
+		case !errors.Is(err, ErrCAExists):
+			t.Errorf("Expected ErrCAExists for a losing request, got %v", err)
+		}
+	}
+	if created == nil {
+		t.Fatal("Expected one CA to be created")
+	}
+	if issuing, _ := store.Get(); issuing != created || len(store.List()) != 1 {
+		t.Errorf("Expected only the created CA in the store, got %d CAs", len(store.List()))
+	}
+}
+
+// TestFileCAStoreSealing walks a store with sealed keys through unseal and seal
+func TestFileCAStoreSealing(t *testing.T) {
+	kek := []byte("correct horse battery staple")
+	dir := t.TempDir()
+	certPath, keyPath, caDir := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"), filepath.Join(dir, "cas")
+
+	// keys written in plaintext are sealed in place once the KEK is known
+	plain, err := NewFileCAStore(certPath, keyPath, caDir, nil, true)
+	if err != nil {
+		t.Fatalf("Failed to open CA store: %v", err)
+	}
+	root, other := newTestRootCA(t, "Root CA"), newTestRootCA(t, "Other CA")
+	if err := plain.Save(root, true); err != nil {
+		t.Fatalf("Failed to save CA: %v", err)
+	}
+	if err := plain.Save(other, false); err != nil {
+		t.Fatalf("Failed to save CA: %v", err)
+	}
+	if err := plain.Seal(); !errors.Is(err, ErrNoKEK) {
+		t.Errorf("Expected ErrNoKEK sealing a plaintext store, got %v", err)
+	}
+	if _, err := NewFileCAStore(certPath, keyPath, caDir, kek, false); err != nil {
+		t.Fatalf("Failed to reopen CA store with the KEK: %v", err)
+	}
+	for _, path := range []string{keyPath, filepath.Join(caDir, root.ID()+".key"), filepath.Join(caDir, other.ID()+".key")} {
+		data, err := os.ReadFile(path)
+		if err != nil || !utils.IsSealedKeyPEM(data) {
+			t.Errorf("Expected %s to be sealed, got %v", path, err)
+		}
+	}
+
+	store, err := NewFileCAStore(certPath, keyPath, caDir, nil, false)
+	if err != nil {
+		t.Fatalf("Failed to reopen CA store without the KEK: %v", err)
+	}
+	steps := []struct {
+		name   string
+		do     func() error
+		err    error
+		sealed bool
+	}{
+		{"opened without the KEK", func() error { return nil }, nil, true},
+		{"save while sealed", func() error { return store.Save(newTestRootCA(t, "New CA"), false) }, ErrCASealed, true},
+		{"activate while sealed", func() error { return store.Activate(other.ID()) }, ErrCASealed, true},
+		{"wrong passphrase", func() error { return store.Unseal([]byte("wrong")) }, utils.ErrIncorrectPassphrase, true},
+		{"unseal", func() error { return store.Unseal(kek) }, nil, false},
+		{"unseal again", func() error { return store.Unseal(kek) }, ErrCANotSealed, false},
+		{"seal", store.Seal, nil, true},
+		{"seal again", store.Seal, nil, true},
+		{"unseal after seal", func() error { return store.Unseal(kek) }, nil, false},
+	}
+	for _, step := range steps {
+		if err := step.do(); !errors.Is(err, step.err) || (step.err == nil && err != nil) {
+			t.Fatalf("%s: expected %v, got %v", step.name, step.err, err)
+		}
+		if store.Sealed() != step.sealed {
+			t.Fatalf("%s: expected sealed %v", step.name, step.sealed)
+		}
+		// the CAs stay listed either way, only signing depends on the state
+		if len(store.List()) != 2 {
+			t.Fatalf("%s: expected both CAs listed, got %d", step.name, len(store.List()))
+		}
+		for _, ca := range store.List() {
+			_, err := ca.Signer.Sign(rand.Reader, make([]byte, 32), crypto.SHA256)
+			if step.sealed && !errors.Is(err, ErrCASealed) {
+				t.Errorf("%s: expected ErrCASealed signing with %s, got %v", step.name, ca.Cert.Subject.CommonName, err)
+			}
+			if !step.sealed && err != nil {
+				t.Errorf("%s: expected %s to sign, got %v", step.name, ca.Cert.Subject.CommonName, err)
+			}
+		}
+	}
+}
+
+// TestFileCAStoreUnsealWrongKEKKeepsPlaintext checks that a wrong passphrase seals nothing, even plaintext
+// keys loaded before the sealed key it fails to open
+func TestFileCAStoreUnsealWrongKEKKeepsPlaintext(t *testing.T) {
+	kek := []byte("correct horse battery staple")
+	dir := t.TempDir()
+	certPath, keyPath, caDir := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"), filepath.Join(dir, "cas")
+
+	plain, err := NewFileCAStore(certPath, keyPath, caDir, nil, true)
+	if err != nil {
+		t.Fatalf("Failed to open CA store: %v", err)
+	}
+	root, other := newTestRootCA(t, "Root CA"), newTestRootCA(t, "Other CA")
+	if err := plain.Save(root, true); err != nil {
+		t.Fatalf("Failed to save CA: %v", err)
+	}
+	if err := plain.Save(other, false); err != nil {
+		t.Fatalf("Failed to save CA: %v", err)
+	}
+	// the issuing key, read after those in the CA directory, is the only sealed one
+	sealed, err := utils.EncryptPrivateKeyPEM(root.Signer, kek)
+	if err != nil {
+		t.Fatalf("Failed to seal key: %v", err)
+	}
+	writeTestFile(t, keyPath, sealed)
+	plaintextPaths := []string{filepath.Join(caDir, root.ID()+".key"), filepath.Join(caDir, other.ID()+".key")}
+
+	store, err := NewFileCAStore(certPath, keyPath, caDir, nil, false)
+	if err != nil {
+		t.Fatalf("Failed to open CA store: %v", err)
+	}
+	if err := store.Unseal([]byte("wrong")); !errors.Is(err, utils.ErrIncorrectPassphrase) {
+		t.Fatalf("Expected ErrIncorrectPassphrase, got %v", err)
+	}
+	for _, path := range plaintextPaths {
+		if data, err := os.ReadFile(path); err != nil || utils.IsSealedKeyPEM(data) {
+			t.Errorf("Expected %s to stay in plaintext after a wrong passphrase, got %v", path, err)
+		}
+	}
+
+	if err := store.Unseal(kek); err != nil {
+		t.Fatalf("Failed to unseal: %v", err)
+	}
+	for _, path := range plaintextPaths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", path, err)
+		}
+		if _, err := utils.DecryptPrivateKeyPEM(data, kek); err != nil {
+			t.Errorf("Expected %s sealed under the KEK, got %v", path, err)
+		}
+	}
+}
+
+// writeTestFile writes data to path or fails the test
+func writeTestFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
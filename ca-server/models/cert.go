@@ -2,20 +2,36 @@ package models
 
 import (
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"time"
 )
 
 // Certificate represents an X.509 certificate
 type Certificate struct {
-	SerialNumber    string            `json:"serialNumber"`
-	Subject         string            `json:"subject"`
-	Issuer          string            `json:"issuer"`
-	NotBefore       time.Time         `json:"notBefore"`
-	NotAfter        time.Time         `json:"notAfter"`
-	IsCA            bool              `json:"isCA"`
-	SignatureAlg    string            `json:"signatureAlg"`
-	PublicKeyAlg    string            `json:"publicKeyAlg"`
+	SerialNumber   string     `json:"serialNumber"`
+	Subject        string     `json:"subject"`
+	Issuer         string     `json:"issuer"`
+	NotBefore      time.Time  `json:"notBefore"`
+	NotAfter       time.Time  `json:"notAfter"`
+	IsCA           bool       `json:"isCA"`
+	SignatureAlg   string     `json:"signatureAlg"`
+	PublicKeyAlg   string     `json:"publicKeyAlg"`
+	DNSNames       []string   `json:"dnsNames,omitempty"`
+	IPAddresses    []string   `json:"ipAddresses,omitempty"`
+	SubjectKeyID   string     `json:"subjectKeyId,omitempty"`
+	AuthorityKeyID string     `json:"authorityKeyId,omitempty"`
+	RevokedAt      *time.Time `json:"revokedAt,omitempty"`
+	RevocationCode int        `json:"revocationReason,omitempty"`
+	// RevokeAt schedules the revocation of a renewed certificate once its grace period ends
+	RevokeAt    *time.Time `json:"revokeAt,omitempty"`
+	Profile     string     `json:"profile,omitempty"`
+	RenewedFrom string     `json:"renewedFrom,omitempty"`
+	RenewedBy   string     `json:"renewedBy,omitempty"`
+	// IssuedBy names the caller that had the certificate issued, see middleware.GetPrincipal
+	IssuedBy string `json:"issuedBy,omitempty"`
+	// UserID is the user a client certificate authenticates as over mutual TLS, empty for none
+	UserID          string            `json:"userId,omitempty"`
 	RawCertificate  []byte            `json:"-"`
 	PemEncodedCert  string            `json:"pemEncodedCert,omitempty"`
 	X509Certificate *x509.Certificate `json:"-"`
@@ -33,6 +49,16 @@ func ParseCertificate(pemData []byte) (*Certificate, error) {
 		return nil, err
 	}
 
+	return NewCertificate(cert), nil
+}
+
+// NewCertificate creates a Certificate model from a parsed X.509 certificate
+func NewCertificate(cert *x509.Certificate) *Certificate {
+	ips := make([]string, 0, len(cert.IPAddresses))
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+
 	return &Certificate{
 		SerialNumber:    cert.SerialNumber.String(),
 		Subject:         cert.Subject.CommonName,
@@ -42,8 +68,17 @@ func ParseCertificate(pemData []byte) (*Certificate, error) {
 		IsCA:            cert.IsCA,
 		SignatureAlg:    cert.SignatureAlgorithm.String(),
 		PublicKeyAlg:    cert.PublicKeyAlgorithm.String(),
-		RawCertificate:  block.Bytes,
-		PemEncodedCert:  string(pemData),
+		DNSNames:        cert.DNSNames,
+		IPAddresses:     ips,
+		SubjectKeyID:    hex.EncodeToString(cert.SubjectKeyId),
+		AuthorityKeyID:  hex.EncodeToString(cert.AuthorityKeyId),
+		RawCertificate:  cert.Raw,
+		PemEncodedCert:  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
 		X509Certificate: cert,
-	}, nil
+	}
+}
+
+// IsRevoked reports whether the certificate has been revoked
+func (c *Certificate) IsRevoked() bool {
+	return c.RevokedAt != nil
 }
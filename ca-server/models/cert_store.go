@@ -0,0 +1,191 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrCertNotFound is returned for an unknown serial number
+	ErrCertNotFound error = &storeError{"certificate not found", ErrNotFound}
+	// ErrCertExists is returned when saving a serial number twice
+	ErrCertExists error = &storeError{"certificate already exists", ErrConflict}
+	// ErrAlreadyRevoked is returned when revoking a certificate twice
+	ErrAlreadyRevoked error = &storeError{"certificate already revoked", ErrConflict}
+)
+
+// CertStore defines the certificate inventory, certificates are indexed by serial number
+type CertStore interface {
+	SaveCert(ctx context.Context, cert *Certificate) error
+	GetCert(ctx context.Context, serial string) (*Certificate, error)
+	ListCerts(ctx context.Context, filter CertFilter) (*Page[Certificate], error)
+	RevokeCert(ctx context.Context, serial string, reason int, revokedAt time.Time) (*Certificate, error)
+	ListRevoked(ctx context.Context, authorityKeyID string) ([]*Certificate, error)
+	MarkRenewed(ctx context.Context, serial, renewedBy string, revokeAt *time.Time) (*Certificate, error)
+	ListRevocationsDue(ctx context.Context, now time.Time) ([]*Certificate, error)
+}
+
+// CertFilter narrows down and orders a certificate listing.
+// Zero values match everything, Limit 0 returns all matches after Cursor and Offset.
+type CertFilter struct {
+	Subject       string
+	Issuer        string
+	ExpiresAfter  time.Time
+	ExpiresBefore time.Time
+	IsCA          *bool
+	// Sort is notBefore, notAfter, subject or serial, prefixed with - for descending order, -notBefore by default
+	Sort string
+	// Cursor is the NextCursor of the previous page
+	Cursor string
+	Offset int
+	Limit  int
+}
+
+// Match reports whether cert satisfies the filter
+func (f CertFilter) Match(cert *Certificate) bool {
+	if f.Subject != "" && !strings.Contains(strings.ToLower(cert.Subject), strings.ToLower(f.Subject)) {
+		return false
+	}
+	if f.Issuer != "" && !strings.Contains(strings.ToLower(cert.Issuer), strings.ToLower(f.Issuer)) {
+		return false
+	}
+	if !f.ExpiresAfter.IsZero() && cert.NotAfter.Before(f.ExpiresAfter) {
+		return false
+	}
+	if !f.ExpiresBefore.IsZero() && cert.NotAfter.After(f.ExpiresBefore) {
+		return false
+	}
+	if f.IsCA != nil && cert.IsCA != *f.IsCA {
+		return false
+	}
+	return true
+}
+
+// certSorts are the keys certificates can be ordered by
+var certSorts = map[string]sortField[Certificate]{
+	"notBefore": {column: "not_before", at: func(c *Certificate) time.Time { return c.NotBefore }},
+	"notAfter":  {column: "not_after", at: func(c *Certificate) time.Time { return c.NotAfter }},
+	"subject":   {column: "subject", str: func(c *Certificate) string { return c.Subject }},
+	"serial":    {column: "serial", str: func(c *Certificate) string { return c.SerialNumber }},
+}
+
+// certListing validates the order and cursor of filter
+func certListing(filter CertFilter) (*listing[Certificate], error) {
+	return newListing(filter.Sort, filter.Cursor, certSorts, "-notBefore", func(c *Certificate) string { return c.SerialNumber }, "serial")
+}
+
+// SaveCert records an issued certificate
+func (s *MemoryStore) SaveCert(ctx context.Context, cert *Certificate) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.certs[cert.SerialNumber]; exists {
+		return ErrCertExists
+	}
+
+	s.certs[cert.SerialNumber] = cert
+	return nil
+}
+
+// GetCert retrieves a certificate by serial number
+func (s *MemoryStore) GetCert(ctx context.Context, serial string) (*Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	cert, exists := s.certs[serial]
+	if !exists {
+		return nil, ErrCertNotFound
+	}
+
+	return cert, nil
+}
+
+// ListCerts returns one page of the certificates matching filter, newest first unless it sorts otherwise
+func (s *MemoryStore) ListCerts(ctx context.Context, filter CertFilter) (*Page[Certificate], error) {
+	l, err := certListing(filter)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	certs := make([]*Certificate, 0)
+	for _, cert := range s.certs {
+		if filter.Match(cert) {
+			certs = append(certs, cert)
+		}
+	}
+
+	return l.page(certs, filter.Offset, filter.Limit), nil
+}
+
+// RevokeCert marks a certificate as revoked with an RFC 5280 reason code
+func (s *MemoryStore) RevokeCert(ctx context.Context, serial string, reason int, revokedAt time.Time) (*Certificate, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cert, exists := s.certs[serial]
+	if !exists {
+		return nil, ErrCertNotFound
+	}
+	if cert.IsRevoked() {
+		return nil, ErrAlreadyRevoked
+	}
+
+	cert.RevokedAt = &revokedAt
+	cert.RevocationCode = reason
+	cert.RevokeAt = nil
+	return cert, nil
+}
+
+// ListRevoked returns the revoked certificates issued by the CA with authorityKeyID
+func (s *MemoryStore) ListRevoked(ctx context.Context, authorityKeyID string) ([]*Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	certs := make([]*Certificate, 0)
+	for _, cert := range s.certs {
+		if cert.IsRevoked() && cert.AuthorityKeyID == authorityKeyID {
+			certs = append(certs, cert)
+		}
+	}
+
+	return certs, nil
+}
+
+// MarkRenewed links a certificate to its replacement and optionally schedules its revocation
+func (s *MemoryStore) MarkRenewed(ctx context.Context, serial, renewedBy string, revokeAt *time.Time) (*Certificate, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cert, exists := s.certs[serial]
+	if !exists {
+		return nil, ErrCertNotFound
+	}
+
+	cert.RenewedBy = renewedBy
+	if revokeAt != nil && !cert.IsRevoked() {
+		cert.RevokeAt = revokeAt
+	}
+	return cert, nil
+}
+
+// ListRevocationsDue returns the unrevoked certificates whose scheduled revocation is at or before now
+func (s *MemoryStore) ListRevocationsDue(ctx context.Context, now time.Time) ([]*Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	certs := make([]*Certificate, 0)
+	for _, cert := range s.certs {
+		if !cert.IsRevoked() && cert.RevokeAt != nil && !cert.RevokeAt.After(now) {
+			certs = append(certs, cert)
+		}
+	}
+
+	return certs, nil
+}
@@ -0,0 +1,183 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Page is one page of a listing
+type Page[T any] struct {
+	Items []*T `json:"items"`
+	// Total counts the matches of the filter on every page
+	Total int `json:"total"`
+	// NextCursor continues the listing after the last item, empty on the last page
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// sortField is a key a listing can be ordered by, a string or a time.
+// Times compare at microsecond precision, as the SQL store keeps them.
+type sortField[T any] struct {
+	column string
+	str    func(*T) string
+	at     func(*T) time.Time
+}
+
+// cursor is the position after the last item of a page, clients only see it base64 encoded
+type cursor struct {
+	Sort string `json:"s"`
+	Str  string `json:"v,omitempty"`
+	At   int64  `json:"t,omitempty"`
+	// ID breaks ties between equal keys
+	ID string `json:"k"`
+}
+
+// listing is the validated order and start position of a listing
+type listing[T any] struct {
+	spec     string
+	field    sortField[T]
+	desc     bool
+	id       func(*T) string
+	idColumn string
+	after    *cursor
+}
+
+// newListing parses a sort spec, a key of fields prefixed with - for descending order,
+// and the cursor of a previous page, which must come from the same order
+func newListing[T any](spec, encoded string, fields map[string]sortField[T], defaultSpec string, id func(*T) string, idColumn string) (*listing[T], error) {
+	if spec == "" {
+		spec = defaultSpec
+	}
+	name, desc := strings.CutPrefix(spec, "-")
+	field, ok := fields[name]
+	if !ok {
+		keys := make([]string, 0, len(fields))
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return nil, fmt.Errorf("%w: unknown sort key %q, use one of %s", ErrInvalidFilter, name, strings.Join(keys, ", "))
+	}
+	l := &listing[T]{spec: spec, field: field, desc: desc, id: id, idColumn: idColumn}
+
+	if encoded != "" {
+		data, err := base64.RawURLEncoding.DecodeString(encoded)
+		l.after = &cursor{}
+		if err == nil {
+			err = json.Unmarshal(data, l.after)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidFilter)
+		}
+		if l.after.Sort != spec {
+			return nil, fmt.Errorf("%w: cursor belongs to another sort order", ErrInvalidFilter)
+		}
+	}
+	return l, nil
+}
+
+// compareKey orders record against the key of c, ignoring the direction
+func (l *listing[T]) compareKey(record *T, c *cursor) int {
+	if l.field.at != nil {
+		a := l.field.at(record).UnixMicro()
+		switch {
+		case a < c.At:
+			return -1
+		case a > c.At:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(l.field.str(record), c.Str)
+}
+
+// cursorAt returns the position of record
+func (l *listing[T]) cursorAt(record *T) *cursor {
+	c := &cursor{Sort: l.spec, ID: l.id(record)}
+	if l.field.at != nil {
+		c.At = l.field.at(record).UnixMicro()
+	} else {
+		c.Str = l.field.str(record)
+	}
+	return c
+}
+
+// follows reports whether record comes after position c, ties on the key go by ascending ID
+func (l *listing[T]) follows(record *T, c *cursor) bool {
+	cmp := l.compareKey(record, c)
+	if l.desc {
+		cmp = -cmp
+	}
+	if cmp == 0 {
+		return l.id(record) > c.ID
+	}
+	return cmp > 0
+}
+
+// encode returns the cursor continuing after record
+func (l *listing[T]) encode(record *T) string {
+	data, _ := json.Marshal(l.cursorAt(record))
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// page orders the matching records and cuts out the page after the cursor and offset, for stores
+// that filter in Go. Total counts every match, wherever the cursor is.
+func (l *listing[T]) page(records []*T, offset, limit int) *Page[T] {
+	total := len(records)
+	if l.after != nil {
+		kept := records[:0:0]
+		for _, record := range records {
+			if l.follows(record, l.after) {
+				kept = append(kept, record)
+			}
+		}
+		records = kept
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return l.follows(records[j], l.cursorAt(records[i]))
+	})
+
+	if offset >= len(records) {
+		return &Page[T]{Items: []*T{}, Total: total}
+	}
+	return l.cut(records[offset:], limit, total)
+}
+
+// cut keeps the first limit records, the cursor is set when more follow
+func (l *listing[T]) cut(records []*T, limit, total int) *Page[T] {
+	p := &Page[T]{Items: records, Total: total}
+	if limit > 0 && len(records) > limit {
+		p.Items = records[:limit]
+		p.NextCursor = l.encode(p.Items[limit-1])
+	}
+	return p
+}
+
+// sqlAfter returns the condition selecting the rows after the cursor, empty without one
+func (l *listing[T]) sqlAfter() (string, []interface{}) {
+	if l.after == nil {
+		return "", nil
+	}
+	op := ">"
+	if l.desc {
+		op = "<"
+	}
+	var key interface{} = l.after.Str
+	if l.field.at != nil {
+		key = l.after.At
+	}
+	return fmt.Sprintf(`(%[1]s %[2]s ? OR (%[1]s = ? AND %[3]s > ?))`, l.field.column, op, l.idColumn),
+		[]interface{}{key, key, l.after.ID}
+}
+
+// sqlOrder returns the ORDER BY clause of the listing
+func (l *listing[T]) sqlOrder() string {
+	dir := "ASC"
+	if l.desc {
+		dir = "DESC"
+	}
+	return fmt.Sprintf(` ORDER BY %s %s, %s ASC`, l.field.column, dir, l.idColumn)
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// Profile is a named issuance template, selected per certificate request.
+// Key usages and extended key usages are referenced by name, e.g. "digitalSignature" and "serverAuth".
+type Profile struct {
+	Name             string   `json:"name"`
+	Description      string   `json:"description,omitempty"`
+	KeyUsages        []string `json:"keyUsages"`
+	ExtKeyUsages     []string `json:"extKeyUsages"`
+	DefaultValidDays int      `json:"defaultValidDays"`
+	MaxValidDays     int      `json:"maxValidDays"`
+	// Allowed SAN patterns, an empty list forbids that SAN type.
+	// DNS names and emails use shell patterns ("*.home.lab", "*@home.lab"), IPs use CIDR ranges.
+	AllowedDNSNames []string  `json:"allowedDNSNames"`
+	AllowedIPRanges []string  `json:"allowedIPRanges"`
+	AllowedEmails   []string  `json:"allowedEmails"`
+	RequireSAN      bool      `json:"requireSAN"`
+	CreatedAt       time.Time `json:"createdAt"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
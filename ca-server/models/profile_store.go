@@ -0,0 +1,97 @@
+package models
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrProfileNotFound is returned for an unknown profile name
+	ErrProfileNotFound error = &storeError{"profile not found", ErrNotFound}
+	// ErrProfileExists is returned when creating a profile under a name already in use
+	ErrProfileExists error = &storeError{"profile already exists", ErrConflict}
+)
+
+// ProfileStore defines the data access interface for issuance profiles, indexed by name
+type ProfileStore interface {
+	GetProfile(ctx context.Context, name string) (*Profile, error)
+	ListProfiles(ctx context.Context) ([]*Profile, error)
+	CreateProfile(ctx context.Context, profile *Profile) error
+	UpdateProfile(ctx context.Context, profile *Profile) error
+	DeleteProfile(ctx context.Context, name string) error
+}
+
+// GetProfile retrieves a profile by name
+func (s *MemoryStore) GetProfile(ctx context.Context, name string) (*Profile, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	profile, exists := s.profiles[name]
+	if !exists {
+		return nil, ErrProfileNotFound
+	}
+
+	return profile, nil
+}
+
+// ListProfiles returns all profiles sorted by name
+func (s *MemoryStore) ListProfiles(ctx context.Context) ([]*Profile, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	profiles := make([]*Profile, 0, len(s.profiles))
+	for _, profile := range s.profiles {
+		profiles = append(profiles, profile)
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Name < profiles[j].Name
+	})
+
+	return profiles, nil
+}
+
+// CreateProfile adds a new profile
+func (s *MemoryStore) CreateProfile(ctx context.Context, profile *Profile) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.profiles[profile.Name]; exists {
+		return ErrProfileExists
+	}
+
+	now := time.Now()
+	profile.CreatedAt = now
+	profile.UpdatedAt = now
+	s.profiles[profile.Name] = profile
+	return nil
+}
+
+// UpdateProfile replaces an existing profile
+func (s *MemoryStore) UpdateProfile(ctx context.Context, profile *Profile) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	existing, exists := s.profiles[profile.Name]
+	if !exists {
+		return ErrProfileNotFound
+	}
+
+	profile.CreatedAt = existing.CreatedAt
+	profile.UpdatedAt = time.Now()
+	s.profiles[profile.Name] = profile
+	return nil
+}
+
+// DeleteProfile removes a profile
+func (s *MemoryStore) DeleteProfile(ctx context.Context, name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.profiles[name]; !exists {
+		return ErrProfileNotFound
+	}
+
+	delete(s.profiles, name)
+	return nil
+}
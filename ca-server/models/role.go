@@ -0,0 +1,153 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Role grants a set of operations, admin grants every role
+type Role string
+
+// Built-in roles
+const (
+	RoleViewer  Role = "viewer"
+	RoleIssuer  Role = "issuer"
+	RoleRevoker Role = "revoker"
+	RoleAdmin   Role = "admin"
+)
+
+// ParseRole returns the role named s
+func ParseRole(s string) (Role, error) {
+	switch role := Role(strings.ToLower(strings.TrimSpace(s))); role {
+	case RoleViewer, RoleIssuer, RoleRevoker, RoleAdmin:
+		return role, nil
+	}
+	return "", fmt.Errorf("unknown role %q, use viewer, issuer, revoker or admin", s)
+}
+
+// Grants reports whether r allows what required allows.
+// Issuers and revokers can also view, admins can do everything.
+func (r Role) Grants(required Role) bool {
+	switch r {
+	case RoleAdmin:
+		return true
+	case RoleIssuer, RoleRevoker:
+		return required == r || required == RoleViewer
+	case RoleViewer:
+		return required == RoleViewer
+	}
+	return false
+}
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	// User is the matching user record, nil for callers without one
+	User *User `json:"user,omitempty"`
+	// Subject names the caller, e.g. the client certificate subject
+	Subject string `json:"subject"`
+	Roles   []Role `json:"roles"`
+	// Method is how the caller authenticated, e.g. mtls
+	Method string `json:"method"`
+}
+
+// HasRole reports whether one of the principal's roles, or a binding of its user, grants role.
+// Scoped bindings count here, Allows checks them against what an operation touches.
+func (p *Principal) HasRole(role Role) bool {
+	for _, r := range p.Roles {
+		if r.Grants(role) {
+			return true
+		}
+	}
+	if p.User != nil {
+		for _, binding := range p.User.Bindings {
+			if binding.Role.Grants(role) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Allows reports whether the principal holds role for scope, through an unscoped role or a matching binding
+func (p *Principal) Allows(role Role, scope AccessScope) bool {
+	for _, r := range p.Roles {
+		if r.Grants(role) {
+			return true
+		}
+	}
+	if p.User != nil {
+		for _, binding := range p.User.Bindings {
+			if binding.Allows(role, scope) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RoleBinding grants a role to a user within a scope. Each non-empty list limits the binding
+// to certificates from one of those profiles, signed by one of those CAs (by ID) or whose
+// names all fall under one of those domain suffixes.
+type RoleBinding struct {
+	Role     Role     `json:"role"`
+	Profiles []string `json:"profiles,omitempty"`
+	CAs      []string `json:"cas,omitempty"`
+	Domains  []string `json:"domains,omitempty"`
+}
+
+// AccessScope describes the certificate a scoped operation issues, renews or revokes
+type AccessScope struct {
+	Profile string
+	CAID    string
+	// Names are the DNS names, email addresses and URI hosts of the certificate, emails count by their domain
+	Names []string
+	// HasIPs is set when the certificate holds IP addresses, which no domain suffix covers
+	HasIPs bool
+}
+
+// Allows reports whether the binding grants role for scope
+func (b RoleBinding) Allows(role Role, scope AccessScope) bool {
+	if !b.Role.Grants(role) {
+		return false
+	}
+	if len(b.Profiles) > 0 && !containsString(b.Profiles, scope.Profile) {
+		return false
+	}
+	if len(b.CAs) > 0 && !containsString(b.CAs, scope.CAID) {
+		return false
+	}
+	if len(b.Domains) > 0 {
+		if scope.HasIPs {
+			return false
+		}
+		for _, name := range scope.Names {
+			if !underDomains(name, b.Domains) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// underDomains reports whether name, or the domain of an email address, is one of the suffixes or below one
+func underDomains(name string, suffixes []string) bool {
+	if _, domain, ok := strings.Cut(name, "@"); ok {
+		name = domain
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, suffix := range suffixes {
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
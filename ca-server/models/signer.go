@@ -0,0 +1,55 @@
+package models
+
+import (
+	"crypto"
+	"encoding/pem"
+	"fmt"
+)
+
+// keyRefPEMType is the PEM block type stored in place of a CA key that lives outside the CA store
+const keyRefPEMType = "CA KEY REFERENCE"
+
+// ExternalSigner is a CA key held by a signer backend, e.g. a PKCS#11 token or a remote KMS.
+// The key material never leaves the backend, the CA store only keeps the reference.
+type ExternalSigner interface {
+	crypto.Signer
+	// Backend names the SignerBackend that opens the reference again
+	Backend() string
+	// KeyRef identifies the key within its backend
+	KeyRef() string
+}
+
+// SignerBackend opens CA keys by the reference an ExternalSigner handed out
+type SignerBackend interface {
+	Name() string
+	Open(ref string) (crypto.Signer, error)
+}
+
+// encodeKeyRef encodes the reference of an external key for the key file
+func encodeKeyRef(signer ExternalSigner) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type: keyRefPEMType,
+		Headers: map[string]string{
+			"Backend": signer.Backend(),
+			"Ref":     signer.KeyRef(),
+		},
+	})
+}
+
+// decodeKeyRef returns the backend and reference stored in a key file, ok is false for key material
+func decodeKeyRef(data []byte) (backend, ref string, ok bool) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != keyRefPEMType {
+		return "", "", false
+	}
+	return block.Headers["Backend"], block.Headers["Ref"], true
+}
+
+// openKeyRef opens an external key with the backend it was created by
+func openKeyRef(backends map[string]SignerBackend, backend, ref string) (crypto.Signer, error) {
+	b, ok := backends[backend]
+	if !ok {
+		return nil, fmt.Errorf("key is held by the %q signer backend, which is not configured", backend)
+	}
+	return b.Open(ref)
+}
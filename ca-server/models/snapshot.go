@@ -0,0 +1,143 @@
+package models
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+)
+
+// StoreSnapshot is the whole content of a store, taken at one point in time
+type StoreSnapshot struct {
+	Users    []*User         `json:"users"`
+	Certs    []*CertRecord   `json:"certs"`
+	Profiles []*Profile      `json:"profiles"`
+	APIKeys  []*APIKeyRecord `json:"apiKeys"`
+	// ACME is missing from snapshots taken before ACME state was stored, restoring one clears it
+	ACME *ACMESnapshot `json:"acme,omitempty"`
+}
+
+// ACMESnapshot is the ACME server state of a store
+type ACMESnapshot struct {
+	Accounts       []*ACMEAccount       `json:"accounts"`
+	Orders         []*ACMEOrder         `json:"orders"`
+	Authorizations []*ACMEAuthorization `json:"authorizations"`
+	Challenges     []*ACMEChallenge     `json:"challenges"`
+}
+
+func newACMESnapshot() *ACMESnapshot {
+	return &ACMESnapshot{
+		Accounts:       make([]*ACMEAccount, 0),
+		Orders:         make([]*ACMEOrder, 0),
+		Authorizations: make([]*ACMEAuthorization, 0),
+		Challenges:     make([]*ACMEChallenge, 0),
+	}
+}
+
+// CertRecord is a certificate along with its DER encoding, which the API representation leaves out
+type CertRecord struct {
+	*Certificate
+	Raw []byte `json:"raw,omitempty"`
+}
+
+// NewCertRecord wraps cert for storage
+func NewCertRecord(cert *Certificate) *CertRecord {
+	return &CertRecord{Certificate: cert, Raw: cert.RawCertificate}
+}
+
+// Cert returns the certificate with its raw and parsed forms restored
+func (r *CertRecord) Cert() (*Certificate, error) {
+	cert := *r.Certificate
+	if len(r.Raw) > 0 {
+		parsed, err := x509.ParseCertificate(r.Raw)
+		if err != nil {
+			return nil, fmt.Errorf("certificate %s: %w", cert.SerialNumber, err)
+		}
+		cert.RawCertificate = r.Raw
+		cert.X509Certificate = parsed
+	}
+	return &cert, nil
+}
+
+// APIKeyRecord is an API key along with the hash of its secret, which the API representation leaves out
+type APIKeyRecord struct {
+	*APIKey
+	Hash []byte `json:"hash"`
+}
+
+// NewAPIKeyRecord wraps key for storage
+func NewAPIKeyRecord(key *APIKey) *APIKeyRecord {
+	return &APIKeyRecord{APIKey: key, Hash: key.Hash}
+}
+
+// Key returns the API key with its hash restored
+func (r *APIKeyRecord) Key() *APIKey {
+	key := *r.APIKey
+	key.Hash = r.Hash
+	return &key
+}
+
+// Snapshot copies every record of the store
+func (s *MemoryStore) Snapshot(ctx context.Context) (*StoreSnapshot, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	snap := &StoreSnapshot{
+		Users:    make([]*User, 0, len(s.users)),
+		Certs:    make([]*CertRecord, 0, len(s.certs)),
+		Profiles: make([]*Profile, 0, len(s.profiles)),
+		APIKeys:  make([]*APIKeyRecord, 0, len(s.apiKeys)),
+	}
+	// records are copied, the store keeps changing them in place
+	for _, user := range s.users {
+		copied := *user
+		snap.Users = append(snap.Users, &copied)
+	}
+	for _, cert := range s.certs {
+		copied := *cert
+		snap.Certs = append(snap.Certs, NewCertRecord(&copied))
+	}
+	for _, profile := range s.profiles {
+		copied := *profile
+		snap.Profiles = append(snap.Profiles, &copied)
+	}
+	for _, key := range s.apiKeys {
+		copied := *key
+		snap.APIKeys = append(snap.APIKeys, NewAPIKeyRecord(&copied))
+	}
+	snap.ACME = s.MemoryACMEStore.snapshot()
+	return snap, nil
+}
+
+// Restore replaces every record of the store with those of snap
+func (s *MemoryStore) Restore(ctx context.Context, snap *StoreSnapshot) error {
+	users := make(map[string]*User, len(snap.Users))
+	for _, user := range snap.Users {
+		users[user.ID] = user
+	}
+	certs := make(map[string]*Certificate, len(snap.Certs))
+	for _, record := range snap.Certs {
+		cert, err := record.Cert()
+		if err != nil {
+			return err
+		}
+		certs[cert.SerialNumber] = cert
+	}
+	profiles := make(map[string]*Profile, len(snap.Profiles))
+	for _, profile := range snap.Profiles {
+		profiles[profile.Name] = profile
+	}
+	apiKeys := make(map[string]*APIKey, len(snap.APIKeys))
+	for _, record := range snap.APIKeys {
+		apiKeys[record.ID] = record.Key()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.users = users
+	s.certs = certs
+	s.profiles = profiles
+	s.apiKeys = apiKeys
+	s.MemoryACMEStore.restore(snap.ACME)
+	return nil
+}
@@ -0,0 +1,122 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// sqliteMigrations builds the schema step by step, the version of a migration is its index plus one.
+// Released migrations are never edited, changes go into a new one appended at the end.
+var sqliteMigrations = []string{
+	// 1: users, certificates, profiles, API keys and the audit log
+	`CREATE TABLE users (
+		id         TEXT PRIMARY KEY,
+		name       TEXT NOT NULL,
+		email      TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		data       TEXT NOT NULL
+	);
+	CREATE TABLE certs (
+		serial           TEXT PRIMARY KEY,
+		subject          TEXT NOT NULL,
+		issuer           TEXT NOT NULL,
+		not_before       INTEGER NOT NULL,
+		not_after        INTEGER NOT NULL,
+		is_ca            INTEGER NOT NULL,
+		authority_key_id TEXT NOT NULL,
+		revoked_at       INTEGER,
+		revoke_at        INTEGER,
+		raw              BLOB,
+		data             TEXT NOT NULL
+	);
+	CREATE INDEX certs_not_before ON certs (not_before);
+	CREATE INDEX certs_not_after ON certs (not_after);
+	CREATE INDEX certs_revoked ON certs (authority_key_id, revoked_at);
+	CREATE INDEX certs_revoke_at ON certs (revoke_at) WHERE revoke_at IS NOT NULL;
+	CREATE TABLE profiles (
+		name TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	);
+	CREATE TABLE api_keys (
+		id         TEXT PRIMARY KEY,
+		user_id    TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		hash       BLOB NOT NULL,
+		data       TEXT NOT NULL
+	);
+	CREATE INDEX api_keys_user ON api_keys (user_id, created_at);
+	CREATE TABLE audit_log (
+		seq    INTEGER PRIMARY KEY,
+		time   INTEGER NOT NULL,
+		action TEXT NOT NULL,
+		actor  TEXT NOT NULL,
+		data   TEXT NOT NULL
+	);`,
+	// 2: indexes for the user and certificate sort keys and the email lookup
+	`CREATE INDEX users_name ON users (name, id);
+	CREATE INDEX users_email ON users (lower(email));
+	CREATE INDEX users_created_at ON users (created_at, id);
+	CREATE INDEX certs_subject ON certs (subject, serial);`,
+	// 3: emails are unique ignoring case, it fails on a database holding duplicates, which need to be resolved first
+	`DROP INDEX users_email;
+	CREATE UNIQUE INDEX users_email ON users (lower(email)) WHERE email != '';`,
+	// 4: ACME accounts, orders, authorizations and challenges
+	`CREATE TABLE acme_accounts (
+		id         TEXT PRIMARY KEY,
+		thumbprint TEXT NOT NULL UNIQUE,
+		data       TEXT NOT NULL
+	);
+	CREATE TABLE acme_orders (
+		id         TEXT PRIMARY KEY,
+		account_id TEXT NOT NULL,
+		data       TEXT NOT NULL
+	);
+	CREATE INDEX acme_orders_account ON acme_orders (account_id);
+	CREATE TABLE acme_authorizations (
+		id   TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	);
+	CREATE TABLE acme_challenges (
+		id   TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	);`,
+}
+
+// migrateSQLite applies the migrations newer than the schema version of db, each in its own transaction
+func migrateSQLite(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	var version int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("database schema version %d is newer than this server supports (%d)", version, len(sqliteMigrations))
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %w", i+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, i+1, time.Now().Unix()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d failed: %w", i+1, err)
+		}
+	}
+	return nil
+}
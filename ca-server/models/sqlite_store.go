@@ -0,0 +1,912 @@
+package models
+
+import (
+	"context"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	// pure Go SQLite driver, registered as "sqlite"
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore is a Store kept in a SQLite database, which also holds the audit log.
+// Each row keeps the fields that are searched on in columns and the whole record as JSON.
+// Records returned are copies, changes are saved through the store methods.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// sqlQuerier is implemented by *sql.DB and *sql.Tx
+type sqlQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// NewSQLiteStore opens or creates the database at path and migrates it to the latest schema
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	// SQLite takes one writer at a time, a single connection queues them instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// Close closes the database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// inTx runs fn in a transaction, committed when fn succeeds
+func (s *SQLiteStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetUser retrieves a user by ID
+func (s *SQLiteStore) GetUser(ctx context.Context, id string) (*User, error) {
+	return getUser(ctx, s.db, id)
+}
+
+// ListUsers returns one page of the users matching filter
+func (s *SQLiteStore) ListUsers(ctx context.Context, filter UserFilter) (*Page[User], error) {
+	l, err := userListing(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var where []string
+	var args []interface{}
+	if filter.Name != "" {
+		where = append(where, `instr(lower(name), lower(?)) > 0`)
+		args = append(args, filter.Name)
+	}
+	if filter.Email != "" {
+		where = append(where, `lower(email) = lower(?)`)
+		args = append(args, filter.Email)
+	}
+	if filter.Role != "" {
+		where = append(where, `(EXISTS (SELECT 1 FROM json_each(data, '$.roles') WHERE value = ?)
+			OR EXISTS (SELECT 1 FROM json_each(data, '$.bindings') WHERE json_extract(value, '$.role') = ?))`)
+		args = append(args, filter.Role, filter.Role)
+	}
+
+	total, err := countRows(ctx, s.db, "users", where, args)
+	if err != nil {
+		return nil, err
+	}
+	query, args := pageQuery(`SELECT data FROM users`, where, args, l, 0, filter.Limit)
+	users, err := queryJSON[User](ctx, s.db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return l.cut(users, filter.Limit, total), nil
+}
+
+// CreateUser adds a new user
+func (s *SQLiteStore) CreateUser(ctx context.Context, user *User) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if user.ID == "" {
+			user.ID = uuid.NewString()
+		} else if _, err := getUser(ctx, tx, user.ID); err == nil {
+			return ErrUserExists
+		}
+		if err := sqlEmailTaken(ctx, tx, user); err != nil {
+			return err
+		}
+		user.created()
+		return insertUser(ctx, tx, user)
+	})
+}
+
+// UpdateUser updates an existing user
+func (s *SQLiteStore) UpdateUser(ctx context.Context, user *User) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		existing, err := getUser(ctx, tx, user.ID)
+		if err != nil {
+			return err
+		}
+		if err := sqlEmailTaken(ctx, tx, user); err != nil {
+			return err
+		}
+		if err := user.replaces(existing); err != nil {
+			return err
+		}
+		data, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE users SET name = ?, email = ?, created_at = ?, data = ? WHERE id = ?`,
+			user.Name, user.Email, user.CreatedAt.UnixMicro(), data, user.ID)
+		return err
+	})
+}
+
+// DeleteUser removes a user
+func (s *SQLiteStore) DeleteUser(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, id)
+	return expectRow(result, err, ErrUserNotFound)
+}
+
+// sqlEmailTaken fails with ErrEmailTaken when another user has the email of user,
+// the unique index on the lower case email backs it up
+func sqlEmailTaken(ctx context.Context, q sqlQuerier, user *User) error {
+	if user.Email == "" {
+		return nil
+	}
+	var taken bool
+	err := q.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE lower(email) = lower(?) AND email != '' AND id != ?)`,
+		user.Email, user.ID).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrEmailTaken
+	}
+	return nil
+}
+
+func insertUser(ctx context.Context, q sqlQuerier, user *User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, `INSERT INTO users (id, name, email, created_at, data) VALUES (?, ?, ?, ?, ?)`,
+		user.ID, user.Name, user.Email, user.CreatedAt.UnixMicro(), data)
+	return err
+}
+
+func getUser(ctx context.Context, q sqlQuerier, id string) (*User, error) {
+	user := &User{}
+	err := scanJSON(q.QueryRowContext(ctx, `SELECT data FROM users WHERE id = ?`, id), user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// SaveCert records an issued certificate
+func (s *SQLiteStore) SaveCert(ctx context.Context, cert *Certificate) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := getCert(ctx, tx, cert.SerialNumber); err == nil {
+			return ErrCertExists
+		}
+		return insertCert(ctx, tx, cert)
+	})
+}
+
+// GetCert retrieves a certificate by serial number
+func (s *SQLiteStore) GetCert(ctx context.Context, serial string) (*Certificate, error) {
+	return getCert(ctx, s.db, serial)
+}
+
+// ListCerts returns one page of the certificates matching filter, newest first unless it sorts otherwise
+func (s *SQLiteStore) ListCerts(ctx context.Context, filter CertFilter) (*Page[Certificate], error) {
+	l, err := certListing(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var where []string
+	var args []interface{}
+	if filter.Subject != "" {
+		where = append(where, `instr(lower(subject), lower(?)) > 0`)
+		args = append(args, filter.Subject)
+	}
+	if filter.Issuer != "" {
+		where = append(where, `instr(lower(issuer), lower(?)) > 0`)
+		args = append(args, filter.Issuer)
+	}
+	if !filter.ExpiresAfter.IsZero() {
+		where = append(where, `not_after >= ?`)
+		args = append(args, filter.ExpiresAfter.UnixMicro())
+	}
+	if !filter.ExpiresBefore.IsZero() {
+		where = append(where, `not_after <= ?`)
+		args = append(args, filter.ExpiresBefore.UnixMicro())
+	}
+	if filter.IsCA != nil {
+		where = append(where, `is_ca = ?`)
+		args = append(args, *filter.IsCA)
+	}
+
+	total, err := countRows(ctx, s.db, "certs", where, args)
+	if err != nil {
+		return nil, err
+	}
+	query, args := pageQuery(`SELECT raw, data FROM certs`, where, args, l, filter.Offset, filter.Limit)
+	certs, err := queryCerts(ctx, s.db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return l.cut(certs, filter.Limit, total), nil
+}
+
+// countRows counts the rows of table matching every condition of where
+func countRows(ctx context.Context, q sqlQuerier, table string, where []string, args []interface{}) (int, error) {
+	query := `SELECT COUNT(*) FROM ` + table
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	var total int
+	err := q.QueryRowContext(ctx, query, args...).Scan(&total)
+	return total, err
+}
+
+// pageQuery completes a select with the conditions of where, the cursor and order of l and the page bounds.
+// It asks for one row more than limit, which tells whether another page follows.
+func pageQuery[T any](query string, where []string, args []interface{}, l *listing[T], offset, limit int) (string, []interface{}) {
+	if cond, condArgs := l.sqlAfter(); cond != "" {
+		where = append(where, cond)
+		args = append(args, condArgs...)
+	}
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	// a negative limit means no limit
+	rows := -1
+	if limit > 0 {
+		rows = limit + 1
+	}
+	return query + l.sqlOrder() + ` LIMIT ? OFFSET ?`, append(args, rows, offset)
+}
+
+// RevokeCert marks a certificate as revoked with an RFC 5280 reason code
+func (s *SQLiteStore) RevokeCert(ctx context.Context, serial string, reason int, revokedAt time.Time) (*Certificate, error) {
+	var cert *Certificate
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if cert, err = getCert(ctx, tx, serial); err != nil {
+			return err
+		}
+		if cert.IsRevoked() {
+			return ErrAlreadyRevoked
+		}
+
+		cert.RevokedAt = &revokedAt
+		cert.RevocationCode = reason
+		cert.RevokeAt = nil
+		return updateCert(ctx, tx, cert)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// ListRevoked returns the revoked certificates issued by the CA with authorityKeyID
+func (s *SQLiteStore) ListRevoked(ctx context.Context, authorityKeyID string) ([]*Certificate, error) {
+	return queryCerts(ctx, s.db, `SELECT raw, data FROM certs WHERE authority_key_id = ? AND revoked_at IS NOT NULL`, authorityKeyID)
+}
+
+// MarkRenewed links a certificate to its replacement and optionally schedules its revocation
+func (s *SQLiteStore) MarkRenewed(ctx context.Context, serial, renewedBy string, revokeAt *time.Time) (*Certificate, error) {
+	var cert *Certificate
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if cert, err = getCert(ctx, tx, serial); err != nil {
+			return err
+		}
+
+		cert.RenewedBy = renewedBy
+		if revokeAt != nil && !cert.IsRevoked() {
+			cert.RevokeAt = revokeAt
+		}
+		return updateCert(ctx, tx, cert)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// ListRevocationsDue returns the unrevoked certificates whose scheduled revocation is at or before now
+func (s *SQLiteStore) ListRevocationsDue(ctx context.Context, now time.Time) ([]*Certificate, error) {
+	return queryCerts(ctx, s.db, `SELECT raw, data FROM certs WHERE revoked_at IS NULL AND revoke_at IS NOT NULL AND revoke_at <= ?`, now.UnixMicro())
+}
+
+func getCert(ctx context.Context, q sqlQuerier, serial string) (*Certificate, error) {
+	certs, err := queryCerts(ctx, q, `SELECT raw, data FROM certs WHERE serial = ?`, serial)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, ErrCertNotFound
+	}
+	return certs[0], nil
+}
+
+func insertCert(ctx context.Context, q sqlQuerier, cert *Certificate) error {
+	data, err := json.Marshal(cert)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, `INSERT INTO certs (serial, subject, issuer, not_before, not_after, is_ca, authority_key_id, revoked_at, revoke_at, raw, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		cert.SerialNumber, cert.Subject, cert.Issuer, cert.NotBefore.UnixMicro(), cert.NotAfter.UnixMicro(),
+		cert.IsCA, cert.AuthorityKeyID, nullTime(cert.RevokedAt), nullTime(cert.RevokeAt), cert.RawCertificate, data)
+	return err
+}
+
+// updateCert writes the revocation state and the record of an existing certificate
+func updateCert(ctx context.Context, tx *sql.Tx, cert *Certificate) error {
+	data, err := json.Marshal(cert)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE certs SET revoked_at = ?, revoke_at = ?, data = ? WHERE serial = ?`,
+		nullTime(cert.RevokedAt), nullTime(cert.RevokeAt), data, cert.SerialNumber)
+	return err
+}
+
+// queryCerts reads the certificates selected by a query returning raw and data
+func queryCerts(ctx context.Context, q sqlQuerier, query string, args ...interface{}) ([]*Certificate, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	certs := make([]*Certificate, 0)
+	for rows.Next() {
+		var raw, data []byte
+		if err := rows.Scan(&raw, &data); err != nil {
+			return nil, err
+		}
+		cert := &Certificate{}
+		if err := json.Unmarshal(data, cert); err != nil {
+			return nil, err
+		}
+		if len(raw) > 0 {
+			cert.RawCertificate = raw
+			if cert.X509Certificate, err = x509.ParseCertificate(raw); err != nil {
+				return nil, fmt.Errorf("certificate %s: %w", cert.SerialNumber, err)
+			}
+		}
+		certs = append(certs, cert)
+	}
+	return certs, rows.Err()
+}
+
+// GetProfile retrieves a profile by name
+func (s *SQLiteStore) GetProfile(ctx context.Context, name string) (*Profile, error) {
+	return getProfile(ctx, s.db, name)
+}
+
+// ListProfiles returns all profiles sorted by name
+func (s *SQLiteStore) ListProfiles(ctx context.Context) ([]*Profile, error) {
+	return queryJSON[Profile](ctx, s.db, `SELECT data FROM profiles ORDER BY name`)
+}
+
+// CreateProfile adds a new profile
+func (s *SQLiteStore) CreateProfile(ctx context.Context, profile *Profile) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := getProfile(ctx, tx, profile.Name); err == nil {
+			return ErrProfileExists
+		}
+
+		now := time.Now()
+		profile.CreatedAt = now
+		profile.UpdatedAt = now
+		return insertProfile(ctx, tx, profile)
+	})
+}
+
+// UpdateProfile replaces an existing profile
+func (s *SQLiteStore) UpdateProfile(ctx context.Context, profile *Profile) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		existing, err := getProfile(ctx, tx, profile.Name)
+		if err != nil {
+			return err
+		}
+
+		profile.CreatedAt = existing.CreatedAt
+		profile.UpdatedAt = time.Now()
+		data, err := json.Marshal(profile)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE profiles SET data = ? WHERE name = ?`, data, profile.Name)
+		return err
+	})
+}
+
+// DeleteProfile removes a profile
+func (s *SQLiteStore) DeleteProfile(ctx context.Context, name string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM profiles WHERE name = ?`, name)
+	return expectRow(result, err, ErrProfileNotFound)
+}
+
+func insertProfile(ctx context.Context, q sqlQuerier, profile *Profile) error {
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, `INSERT INTO profiles (name, data) VALUES (?, ?)`, profile.Name, data)
+	return err
+}
+
+func getProfile(ctx context.Context, q sqlQuerier, name string) (*Profile, error) {
+	profile := &Profile{}
+	err := scanJSON(q.QueryRowContext(ctx, `SELECT data FROM profiles WHERE name = ?`, name), profile)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrProfileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// GetAPIKey retrieves an API key by ID
+func (s *SQLiteStore) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	return getAPIKey(ctx, s.db, id)
+}
+
+// ListAPIKeys returns the API keys of a user, oldest first
+func (s *SQLiteStore) ListAPIKeys(ctx context.Context, userID string) ([]*APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT hash, data FROM api_keys WHERE user_id = ? ORDER BY created_at, id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]*APIKey, 0)
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// CreateAPIKey adds a new API key
+func (s *SQLiteStore) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := getAPIKey(ctx, tx, key.ID); err == nil {
+			return ErrAPIKeyExists
+		}
+		return insertAPIKey(ctx, tx, key)
+	})
+}
+
+// RevokeAPIKey marks an API key revoked
+func (s *SQLiteStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) (*APIKey, error) {
+	var key *APIKey
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if key, err = getAPIKey(ctx, tx, id); err != nil {
+			return err
+		}
+		if key.RevokedAt != nil {
+			return nil
+		}
+		key.RevokedAt = &at
+		return updateAPIKey(ctx, tx, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// TouchAPIKey records the last use of an API key
+func (s *SQLiteStore) TouchAPIKey(ctx context.Context, id string, at time.Time) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		key, err := getAPIKey(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		key.LastUsedAt = &at
+		return updateAPIKey(ctx, tx, key)
+	})
+}
+
+func insertAPIKey(ctx context.Context, q sqlQuerier, key *APIKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, `INSERT INTO api_keys (id, user_id, created_at, hash, data) VALUES (?, ?, ?, ?, ?)`,
+		key.ID, key.UserID, key.CreatedAt.UnixMicro(), key.Hash, data)
+	return err
+}
+
+func getAPIKey(ctx context.Context, q sqlQuerier, id string) (*APIKey, error) {
+	key, err := scanAPIKey(q.QueryRowContext(ctx, `SELECT hash, data FROM api_keys WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAPIKeyNotFound
+	}
+	return key, err
+}
+
+func updateAPIKey(ctx context.Context, tx *sql.Tx, key *APIKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE api_keys SET data = ? WHERE id = ?`, data, key.ID)
+	return err
+}
+
+// scanAPIKey reads a row of hash and data, the hash is not part of the JSON
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	var hash, data []byte
+	if err := row.Scan(&hash, &data); err != nil {
+		return nil, err
+	}
+	key := &APIKey{}
+	if err := json.Unmarshal(data, key); err != nil {
+		return nil, err
+	}
+	key.Hash = hash
+	return key, nil
+}
+
+// Inserts of the ACME objects, the columns are followed by the JSON of the whole object
+const (
+	sqlInsertACMEAccount       = `INSERT INTO acme_accounts (id, thumbprint, data) VALUES (?, ?, ?)`
+	sqlInsertACMEOrder         = `INSERT INTO acme_orders (id, account_id, data) VALUES (?, ?, ?)`
+	sqlInsertACMEAuthorization = `INSERT INTO acme_authorizations (id, data) VALUES (?, ?)`
+	sqlInsertACMEChallenge     = `INSERT INTO acme_challenges (id, data) VALUES (?, ?)`
+)
+
+// CreateAccount adds a new ACME account, a key already registered fails
+func (s *SQLiteStore) CreateAccount(account *ACMEAccount) error {
+	return insertACME(context.Background(), s.db, sqlInsertACMEAccount,
+		account, account.ID, account.KeyThumbprint)
+}
+
+// GetAccount retrieves an ACME account by ID
+func (s *SQLiteStore) GetAccount(id string) (*ACMEAccount, error) {
+	return getACME[ACMEAccount](s.db, `SELECT data FROM acme_accounts WHERE id = ?`, id, ErrACMEAccountNotFound)
+}
+
+// GetAccountByThumbprint retrieves an ACME account by the thumbprint of its key
+func (s *SQLiteStore) GetAccountByThumbprint(thumbprint string) (*ACMEAccount, error) {
+	return getACME[ACMEAccount](s.db, `SELECT data FROM acme_accounts WHERE thumbprint = ?`, thumbprint, ErrACMEAccountNotFound)
+}
+
+// UpdateAccount updates an existing ACME account
+func (s *SQLiteStore) UpdateAccount(account *ACMEAccount) error {
+	return updateACME(s.db, `UPDATE acme_accounts SET data = ? WHERE id = ?`, account, account.ID, ErrACMEAccountNotFound)
+}
+
+// CreateOrder adds a new ACME order
+func (s *SQLiteStore) CreateOrder(order *ACMEOrder) error {
+	return insertACME(context.Background(), s.db, sqlInsertACMEOrder,
+		order, order.ID, order.AccountID)
+}
+
+// GetOrder retrieves an ACME order by ID
+func (s *SQLiteStore) GetOrder(id string) (*ACMEOrder, error) {
+	return getACME[ACMEOrder](s.db, `SELECT data FROM acme_orders WHERE id = ?`, id, ErrACMEOrderNotFound)
+}
+
+// ListOrders returns the orders of an ACME account
+func (s *SQLiteStore) ListOrders(accountID string) ([]*ACMEOrder, error) {
+	return queryJSON[ACMEOrder](context.Background(), s.db, `SELECT data FROM acme_orders WHERE account_id = ? ORDER BY rowid`, accountID)
+}
+
+// UpdateOrder updates an existing ACME order
+func (s *SQLiteStore) UpdateOrder(order *ACMEOrder) error {
+	return updateACME(s.db, `UPDATE acme_orders SET data = ? WHERE id = ?`, order, order.ID, ErrACMEOrderNotFound)
+}
+
+// TransitionOrder moves an ACME order from one status to another in one transaction
+func (s *SQLiteStore) TransitionOrder(id, from, to string) error {
+	ctx := context.Background()
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		order, err := getACME[ACMEOrder](tx, `SELECT data FROM acme_orders WHERE id = ?`, id, ErrACMEOrderNotFound)
+		if err != nil {
+			return err
+		}
+		if order.Status != from {
+			return ErrACMEOrderChanged
+		}
+		order.Status = to
+		return updateACME(tx, `UPDATE acme_orders SET data = ? WHERE id = ?`, order, id, ErrACMEOrderNotFound)
+	})
+}
+
+// CreateAuthorization adds a new ACME authorization
+func (s *SQLiteStore) CreateAuthorization(authz *ACMEAuthorization) error {
+	return insertACME(context.Background(), s.db, sqlInsertACMEAuthorization, authz, authz.ID)
+}
+
+// GetAuthorization retrieves an ACME authorization by ID
+func (s *SQLiteStore) GetAuthorization(id string) (*ACMEAuthorization, error) {
+	return getACME[ACMEAuthorization](s.db, `SELECT data FROM acme_authorizations WHERE id = ?`, id, ErrACMEAuthorizationNotFound)
+}
+
+// UpdateAuthorization updates an existing ACME authorization
+func (s *SQLiteStore) UpdateAuthorization(authz *ACMEAuthorization) error {
+	return updateACME(s.db, `UPDATE acme_authorizations SET data = ? WHERE id = ?`, authz, authz.ID, ErrACMEAuthorizationNotFound)
+}
+
+// CreateChallenge adds a new ACME challenge
+func (s *SQLiteStore) CreateChallenge(challenge *ACMEChallenge) error {
+	return insertACME(context.Background(), s.db, sqlInsertACMEChallenge, challenge, challenge.ID)
+}
+
+// GetChallenge retrieves an ACME challenge by ID
+func (s *SQLiteStore) GetChallenge(id string) (*ACMEChallenge, error) {
+	return getACME[ACMEChallenge](s.db, `SELECT data FROM acme_challenges WHERE id = ?`, id, ErrACMEChallengeNotFound)
+}
+
+// UpdateChallenge updates an existing ACME challenge
+func (s *SQLiteStore) UpdateChallenge(challenge *ACMEChallenge) error {
+	return updateACME(s.db, `UPDATE acme_challenges SET data = ? WHERE id = ?`, challenge, challenge.ID, ErrACMEChallengeNotFound)
+}
+
+// insertACME inserts the ACME object v, query takes the columns in args followed by the JSON of v
+func insertACME(ctx context.Context, q sqlQuerier, query string, v interface{}, args ...interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, query, append(args, data)...)
+	return err
+}
+
+// getACME decodes the ACME object selected by query, notFound is the error for a missing one
+func getACME[T any](q sqlQuerier, query, key string, notFound error) (*T, error) {
+	record := new(T)
+	err := scanJSON(q.QueryRowContext(context.Background(), query, key), record)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// updateACME replaces the JSON of the ACME object with ID id, notFound is the error for a missing one
+func updateACME(q sqlQuerier, query string, v interface{}, id string, notFound error) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	result, err := q.ExecContext(context.Background(), query, data, id)
+	return expectRow(result, err, notFound)
+}
+
+// Snapshot reads every record in one transaction
+func (s *SQLiteStore) Snapshot(ctx context.Context) (*StoreSnapshot, error) {
+	snap := &StoreSnapshot{
+		Certs:   make([]*CertRecord, 0),
+		APIKeys: make([]*APIKeyRecord, 0),
+	}
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if snap.Users, err = queryJSON[User](ctx, tx, `SELECT data FROM users ORDER BY id`); err != nil {
+			return err
+		}
+		certs, err := queryCerts(ctx, tx, `SELECT raw, data FROM certs ORDER BY serial`)
+		if err != nil {
+			return err
+		}
+		for _, cert := range certs {
+			snap.Certs = append(snap.Certs, NewCertRecord(cert))
+		}
+		if snap.Profiles, err = queryJSON[Profile](ctx, tx, `SELECT data FROM profiles ORDER BY name`); err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, `SELECT hash, data FROM api_keys ORDER BY id`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			key, err := scanAPIKey(rows)
+			if err != nil {
+				return err
+			}
+			snap.APIKeys = append(snap.APIKeys, NewAPIKeyRecord(key))
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		snap.ACME, err = sqlACMESnapshot(ctx, tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// Restore replaces every record but the audit log in one transaction
+func (s *SQLiteStore) Restore(ctx context.Context, snap *StoreSnapshot) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		for _, table := range []string{"users", "certs", "profiles", "api_keys", "acme_accounts", "acme_orders", "acme_authorizations", "acme_challenges"} {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM `+table); err != nil {
+				return err
+			}
+		}
+		for _, user := range snap.Users {
+			if err := insertUser(ctx, tx, user); err != nil {
+				return fmt.Errorf("user %s: %w", user.ID, err)
+			}
+		}
+		for _, record := range snap.Certs {
+			cert, err := record.Cert()
+			if err != nil {
+				return err
+			}
+			if err := insertCert(ctx, tx, cert); err != nil {
+				return fmt.Errorf("certificate %s: %w", cert.SerialNumber, err)
+			}
+		}
+		for _, profile := range snap.Profiles {
+			if err := insertProfile(ctx, tx, profile); err != nil {
+				return fmt.Errorf("profile %s: %w", profile.Name, err)
+			}
+		}
+		for _, record := range snap.APIKeys {
+			if err := insertAPIKey(ctx, tx, record.Key()); err != nil {
+				return fmt.Errorf("API key %s: %w", record.ID, err)
+			}
+		}
+		if snap.ACME != nil {
+			return sqlRestoreACME(ctx, tx, snap.ACME)
+		}
+		return nil
+	})
+}
+
+// sqlACMESnapshot reads every ACME object
+func sqlACMESnapshot(ctx context.Context, q sqlQuerier) (*ACMESnapshot, error) {
+	snap := &ACMESnapshot{}
+	var err error
+	if snap.Accounts, err = queryJSON[ACMEAccount](ctx, q, `SELECT data FROM acme_accounts ORDER BY id`); err != nil {
+		return nil, err
+	}
+	if snap.Orders, err = queryJSON[ACMEOrder](ctx, q, `SELECT data FROM acme_orders ORDER BY id`); err != nil {
+		return nil, err
+	}
+	if snap.Authorizations, err = queryJSON[ACMEAuthorization](ctx, q, `SELECT data FROM acme_authorizations ORDER BY id`); err != nil {
+		return nil, err
+	}
+	if snap.Challenges, err = queryJSON[ACMEChallenge](ctx, q, `SELECT data FROM acme_challenges ORDER BY id`); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// sqlRestoreACME inserts every ACME object of snap
+func sqlRestoreACME(ctx context.Context, q sqlQuerier, snap *ACMESnapshot) error {
+	for _, account := range snap.Accounts {
+		if err := insertACME(ctx, q, sqlInsertACMEAccount, account, account.ID, account.KeyThumbprint); err != nil {
+			return fmt.Errorf("ACME account %s: %w", account.ID, err)
+		}
+	}
+	for _, order := range snap.Orders {
+		if err := insertACME(ctx, q, sqlInsertACMEOrder, order, order.ID, order.AccountID); err != nil {
+			return fmt.Errorf("ACME order %s: %w", order.ID, err)
+		}
+	}
+	for _, authz := range snap.Authorizations {
+		if err := insertACME(ctx, q, sqlInsertACMEAuthorization, authz, authz.ID); err != nil {
+			return fmt.Errorf("ACME authorization %s: %w", authz.ID, err)
+		}
+	}
+	for _, challenge := range snap.Challenges {
+		if err := insertACME(ctx, q, sqlInsertACMEChallenge, challenge, challenge.ID); err != nil {
+			return fmt.Errorf("ACME challenge %s: %w", challenge.ID, err)
+		}
+	}
+	return nil
+}
+
+// AppendAudit inserts an audit record, a sequence number already in use fails
+func (s *SQLiteStore) AppendAudit(rec *AuditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO audit_log (seq, time, action, actor, data) VALUES (?, ?, ?, ?, ?)`,
+		rec.Seq, rec.Time.UnixMicro(), rec.Action, rec.Actor, data)
+	if err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+	return nil
+}
+
+// ScanAudit reads the audit records in sequence order
+func (s *SQLiteStore) ScanAudit(fn func(rec *AuditRecord) error) error {
+	rows, err := s.db.Query(`SELECT data FROM audit_log ORDER BY seq`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rec AuditRecord
+		if err := scanJSON(rows, &rec); err != nil {
+			return fmt.Errorf("audit record is not valid: %w", err)
+		}
+		if err := fn(&rec); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// queryJSON decodes the data column of every row selected by query
+func queryJSON[T any](ctx context.Context, q sqlQuerier, query string, args ...interface{}) ([]*T, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]*T, 0)
+	for rows.Next() {
+		record := new(T)
+		if err := scanJSON(rows, record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// scanJSON decodes the single data column of a row into v
+func scanJSON(row interface{ Scan(...interface{}) error }, v interface{}) error {
+	var data []byte
+	if err := row.Scan(&data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// expectRow turns the result of an update or delete that matched no row into the notFound error
+func expectRow(result sql.Result, err error, notFound error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound
+	}
+	return nil
+}
+
+// nullTime stores an optional time as microseconds since the epoch
+func nullTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UnixMicro()
+}
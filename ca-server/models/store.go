@@ -1,82 +1,219 @@
 package models
 
 import (
+	"context"
 	"errors"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Store backends, see config.Config.StoreBackend
+const (
+	StoreMemory = "memory"
+	StoreSQLite = "sqlite"
+	StoreBolt   = "bolt"
+)
+
+// Kinds of store errors, every store error matches one of them with errors.Is
+var (
+	// ErrNotFound is matched by the errors for a missing user, certificate, profile or API key
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is matched by the errors for a write that clashes with a stored record
+	ErrConflict = errors.New("conflict")
+	// ErrInvalidFilter is matched by the errors for an unknown sort key or a malformed cursor
+	ErrInvalidFilter = errors.New("invalid filter")
+	// ErrVersionMismatch is matched by the errors for a conditional write to a record changed since it was read
+	ErrVersionMismatch = errors.New("version mismatch")
+)
+
+// storeError is a store error with its own message, matching its kind
+type storeError struct {
+	msg  string
+	kind error
+}
+
+func (e *storeError) Error() string {
+	return e.msg
+}
+
+func (e *storeError) Unwrap() error {
+	return e.kind
+}
+
+var (
+	// ErrUserNotFound is returned for an unknown user ID
+	ErrUserNotFound error = &storeError{"user not found", ErrNotFound}
+	// ErrUserExists is returned when creating a user under an ID already in use
+	ErrUserExists error = &storeError{"user already exists", ErrConflict}
+	// ErrEmailTaken is returned when a user would get the email of another user
+	ErrEmailTaken error = &storeError{"email already in use", ErrConflict}
+	// ErrUserChanged is returned when updating a user from a version that is no longer current
+	ErrUserChanged error = &storeError{"user was changed by another update", ErrVersionMismatch}
 )
 
 // Store defines the data access interface
 type Store interface {
-	GetUser(id string) (*User, error)
-	ListUsers() ([]*User, error)
-	CreateUser(user *User) error
-	UpdateUser(user *User) error
-	DeleteUser(id string) error
+	UserStore
+	CertStore
+	ProfileStore
+	APIKeyStore
+	ACMEStore
+	// Snapshot copies the whole content of the store at one point in time
+	Snapshot(ctx context.Context) (*StoreSnapshot, error)
+	// Restore replaces the whole content of the store with snap
+	Restore(ctx context.Context, snap *StoreSnapshot) error
+}
+
+// UserStore defines the data access interface for users
+type UserStore interface {
+	GetUser(ctx context.Context, id string) (*User, error)
+	ListUsers(ctx context.Context, filter UserFilter) (*Page[User], error)
+	// CreateUser adds user, setting its timestamps and version 1 and a new UUID when it has no ID.
+	// Emails are unique ignoring case, a taken one fails with ErrEmailTaken.
+	CreateUser(ctx context.Context, user *User) error
+	// UpdateUser replaces a user, keeping CreatedAt and bumping UpdatedAt and Version.
+	// Unless user.Version is 0 it must match the stored version, or ErrUserChanged is returned.
+	UpdateUser(ctx context.Context, user *User) error
+	DeleteUser(ctx context.Context, id string) error
+}
+
+// UserFilter narrows down and orders a user listing.
+// Zero values match everything, Limit 0 returns all matches after Cursor.
+type UserFilter struct {
+	// Name matches the users whose name contains it, ignoring case
+	Name string
+	// Email matches the users with this email, ignoring case
+	Email string
+	// Role matches the users holding it, directly or through a binding
+	Role Role
+	// Sort is id, name, email or createdAt, prefixed with - for descending order, id by default
+	Sort string
+	// Cursor is the NextCursor of the previous page
+	Cursor string
+	Limit  int
+}
+
+// Match reports whether user satisfies the filter
+func (f UserFilter) Match(user *User) bool {
+	if f.Name != "" && !strings.Contains(strings.ToLower(user.Name), strings.ToLower(f.Name)) {
+		return false
+	}
+	if f.Email != "" && !strings.EqualFold(user.Email, f.Email) {
+		return false
+	}
+	if f.Role != "" && !user.holds(f.Role) {
+		return false
+	}
+	return true
+}
+
+// userSorts are the keys users can be ordered by
+var userSorts = map[string]sortField[User]{
+	"id":        {column: "id", str: func(u *User) string { return u.ID }},
+	"name":      {column: "name", str: func(u *User) string { return u.Name }},
+	"email":     {column: "email", str: func(u *User) string { return u.Email }},
+	"createdAt": {column: "created_at", at: func(u *User) time.Time { return u.CreatedAt }},
+}
+
+// userListing validates the order and cursor of filter
+func userListing(filter UserFilter) (*listing[User], error) {
+	return newListing(filter.Sort, filter.Cursor, userSorts, "id", func(u *User) string { return u.ID }, "id")
 }
 
 // MemoryStore provides an in-memory implementation of Store
 type MemoryStore struct {
-	users  map[string]*User
-	mutex  sync.RWMutex
-	nextID int
+	users    map[string]*User
+	certs    map[string]*Certificate
+	profiles map[string]*Profile
+	apiKeys  map[string]*APIKey
+	mutex    sync.RWMutex
+	*MemoryACMEStore
 }
 
 // NewMemoryStore creates a new in-memory store
 func NewMemoryStore() *MemoryStore {
 	return &MemoryStore{
-		users:  make(map[string]*User),
-		nextID: 1,
+		users:    make(map[string]*User),
+		certs:    make(map[string]*Certificate),
+		profiles: make(map[string]*Profile),
+		apiKeys:  make(map[string]*APIKey),
+
+		MemoryACMEStore: NewMemoryACMEStore(),
 	}
 }
 
 // GetUser retrieves a user by ID
-func (s *MemoryStore) GetUser(id string) (*User, error) {
+func (s *MemoryStore) GetUser(ctx context.Context, id string) (*User, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	user, exists := s.users[id]
 	if !exists {
-		return nil, errors.New("user not found")
+		return nil, ErrUserNotFound
 	}
 
 	return user, nil
 }
 
-// ListUsers returns all users
-func (s *MemoryStore) ListUsers() ([]*User, error) {
+// ListUsers returns one page of the users matching filter
+func (s *MemoryStore) ListUsers(ctx context.Context, filter UserFilter) (*Page[User], error) {
+	l, err := userListing(filter)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	users := make([]*User, 0, len(s.users))
 	for _, user := range s.users {
-		users = append(users, user)
+		if filter.Match(user) {
+			users = append(users, user)
+		}
 	}
 
-	return users, nil
+	return l.page(users, 0, filter.Limit), nil
 }
 
 // CreateUser adds a new user
-func (s *MemoryStore) CreateUser(user *User) error {
+func (s *MemoryStore) CreateUser(ctx context.Context, user *User) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	// Generate ID if not provided
 	if user.ID == "" {
-		user.ID = generateID(s.nextID)
-		s.nextID++
+		user.ID = uuid.NewString()
+	} else if _, exists := s.users[user.ID]; exists {
+		return ErrUserExists
+	}
+	if s.emailTaken(user) {
+		return ErrEmailTaken
 	}
 
+	user.created()
 	s.users[user.ID] = user
 	return nil
 }
 
 // UpdateUser updates an existing user
-func (s *MemoryStore) UpdateUser(user *User) error {
+func (s *MemoryStore) UpdateUser(ctx context.Context, user *User) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	if _, exists := s.users[user.ID]; !exists {
-		return errors.New("user not found")
+	existing, exists := s.users[user.ID]
+	if !exists {
+		return ErrUserNotFound
+	}
+	if s.emailTaken(user) {
+		return ErrEmailTaken
+	}
+	if err := user.replaces(existing); err != nil {
+		return err
 	}
 
 	s.users[user.ID] = user
@@ -84,19 +221,24 @@ func (s *MemoryStore) UpdateUser(user *User) error {
 }
 
 // DeleteUser removes a user
-func (s *MemoryStore) DeleteUser(id string) error {
+func (s *MemoryStore) DeleteUser(ctx context.Context, id string) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	if _, exists := s.users[id]; !exists {
-		return errors.New("user not found")
+		return ErrUserNotFound
 	}
 
 	delete(s.users, id)
 	return nil
 }
 
-// Helper to generate a string ID
-func generateID(id int) string {
-	return string(rune('0' + id))
+// emailTaken reports whether another user has the email of user
+func (s *MemoryStore) emailTaken(user *User) bool {
+	for _, other := range s.users {
+		if other.ID != user.ID && other.sameEmail(user.Email) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,735 @@
+package models
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store { return NewMemoryStore() })
+}
+
+func TestSQLiteStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store { return newTestSQLiteStore(t) })
+}
+
+func TestBoltStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store { return newTestBoltStore(t) })
+}
+
+func TestFileAuditStore(t *testing.T) {
+	testAuditStore(t, NewFileAuditStore(filepath.Join(t.TempDir(), "audit.log")))
+}
+
+func TestSQLiteAuditStore(t *testing.T) {
+	testAuditStore(t, newTestSQLiteStore(t))
+}
+
+func TestBoltAuditStore(t *testing.T) {
+	testAuditStore(t, newTestBoltStore(t))
+}
+
+// TestStoreSnapshot restores the snapshot of each backend into every other one
+func TestStoreSnapshot(t *testing.T) {
+	ctx := context.Background()
+	backends := map[string]func(t *testing.T) Store{
+		"memory": func(t *testing.T) Store { return NewMemoryStore() },
+		"sqlite": func(t *testing.T) Store { return newTestSQLiteStore(t) },
+		"bolt":   func(t *testing.T) Store { return newTestBoltStore(t) },
+	}
+	for from, newSource := range backends {
+		for to, newTarget := range backends {
+			t.Run(from+" to "+to, func(t *testing.T) {
+				source := newSource(t)
+				now := time.Now().Truncate(time.Second)
+				cert := testCert(t, 7, "web.home.lab", now, now.Add(time.Hour), false)
+				key, token, _ := NewAPIKey("3", "ci", nil)
+				for _, err := range []error{
+					source.CreateUser(ctx, NewUser("", "Alice", "alice@home.lab")),
+					source.CreateUser(ctx, NewUser("3", "Bob", "bob@home.lab")),
+					source.SaveCert(ctx, cert),
+					source.CreateProfile(ctx, &Profile{Name: "server"}),
+					source.CreateAPIKey(ctx, key),
+					source.CreateAccount(&ACMEAccount{ID: "acct", KeyThumbprint: "thumb"}),
+					source.CreateOrder(&ACMEOrder{ID: "order", AccountID: "acct"}),
+				} {
+					if err != nil {
+						t.Fatalf("Failed to fill store: %v", err)
+					}
+				}
+				if _, err := source.RevokeCert(ctx, "7", 1, now); err != nil {
+					t.Fatalf("Failed to revoke: %v", err)
+				}
+				snap, err := source.Snapshot(ctx)
+				if err != nil {
+					t.Fatalf("Failed to take snapshot: %v", err)
+				}
+
+				target := newTarget(t)
+				if err := target.CreateUser(ctx, NewUser("stale", "Stale", "stale@home.lab")); err != nil {
+					t.Fatalf("Failed to create user: %v", err)
+				}
+				if err := target.CreateOrder(&ACMEOrder{ID: "stale", AccountID: "acct"}); err != nil {
+					t.Fatalf("Failed to create order: %v", err)
+				}
+				if err := target.Restore(ctx, snap); err != nil {
+					t.Fatalf("Failed to restore: %v", err)
+				}
+
+				if _, err := target.GetUser(ctx, "stale"); err == nil {
+					t.Error("Expected the restore to replace existing records")
+				}
+				if users, _ := target.ListUsers(ctx, UserFilter{}); len(users.Items) != 2 {
+					t.Errorf("Expected 2 users, got %d", len(users.Items))
+				}
+				// restored emails stay taken
+				if err := target.CreateUser(ctx, NewUser("", "Alice", "alice@home.lab")); !errors.Is(err, ErrEmailTaken) {
+					t.Errorf("Expected the restored email to be taken, got %v", err)
+				}
+				if revoked, _ := target.ListRevoked(ctx, cert.AuthorityKeyID); len(revoked) != 1 || revoked[0].X509Certificate == nil {
+					t.Errorf("Expected the revoked certificate with its DER, got %v", serials(revoked))
+				}
+				if _, err := target.GetProfile(ctx, "server"); err != nil {
+					t.Errorf("Expected the profile, got %v", err)
+				}
+				if _, err := target.GetAccountByThumbprint("thumb"); err != nil {
+					t.Errorf("Expected the ACME account, got %v", err)
+				}
+				if orders, _ := target.ListOrders("acct"); len(orders) != 1 || orders[0].ID != "order" {
+					t.Errorf("Expected the ACME order alone, got %d", len(orders))
+				}
+				id, secret, _ := ParseAPIKeyToken(token)
+				if restored, err := target.GetAPIKey(ctx, id); err != nil || !restored.Matches(secret) {
+					t.Errorf("Expected the API key to still match its token, got %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestSQLiteStoreReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "ca.db")
+	store, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	alice := NewUser("", "Alice", "alice@home.lab")
+	if err := store.CreateUser(ctx, alice); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	store.Close()
+
+	// reopening keeps the data and does not migrate twice
+	store, err = NewSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	if user, err := store.GetUser(ctx, alice.ID); err != nil || user.Name != "Alice" {
+		t.Errorf("Expected the user to survive a restart, got %v, %v", user, err)
+	}
+	var version int
+	if err := store.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil || version != len(sqliteMigrations) {
+		t.Errorf("Expected schema version %d, got %d, %v", len(sqliteMigrations), version, err)
+	}
+
+	if _, err := store.db.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, 0)`, len(sqliteMigrations)+1); err != nil {
+		t.Fatalf("Failed to bump schema version: %v", err)
+	}
+	if newer, err := NewSQLiteStore(path); err == nil {
+		newer.Close()
+		t.Error("Expected a database from a newer server to be refused")
+	}
+}
+
+func newTestSQLiteStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "ca.db"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func newTestBoltStore(t *testing.T) *BoltStore {
+	t.Helper()
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "ca.bolt"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// testStore runs the behaviour every Store implementation shares against fresh stores from newStore
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	ctx := context.Background()
+
+	t.Run("Users", func(t *testing.T) {
+		store := newStore(t)
+
+		// users without ID get a fresh UUID
+		seen := make(map[string]bool)
+		for i := 0; i < 12; i++ {
+			user := NewUser("", "user", fmt.Sprintf("user%d@home.lab", i))
+			if err := store.CreateUser(ctx, user); err != nil {
+				t.Fatalf("Failed to create user: %v", err)
+			}
+			if _, err := uuid.Parse(user.ID); err != nil || seen[user.ID] {
+				t.Fatalf("Expected a new UUID, got %q", user.ID)
+			}
+			seen[user.ID] = true
+		}
+
+		alice := NewUser("alice", "Alice", "alice@home.lab")
+		alice.Roles = []Role{RoleIssuer}
+		alice.Bindings = []RoleBinding{{Role: RoleIssuer, Domains: []string{"home.lab"}}}
+		if err := store.CreateUser(ctx, alice); err != nil {
+			t.Fatalf("Failed to create alice: %v", err)
+		}
+		if err := store.CreateUser(ctx, NewUser("alice", "Other", "other@home.lab")); !errors.Is(err, ErrUserExists) || !errors.Is(err, ErrConflict) {
+			t.Errorf("Expected ErrUserExists for a duplicate ID, got %v", err)
+		}
+
+		// emails are unique ignoring case, on create and on update
+		if err := store.CreateUser(ctx, NewUser("", "Alice again", "ALICE@home.lab")); !errors.Is(err, ErrEmailTaken) || !errors.Is(err, ErrConflict) {
+			t.Errorf("Expected ErrEmailTaken for a duplicate email, got %v", err)
+		}
+		if err := store.UpdateUser(ctx, NewUser("alice", "Alice", "User3@home.lab")); !errors.Is(err, ErrEmailTaken) {
+			t.Errorf("Expected ErrEmailTaken updating to the email of another user, got %v", err)
+		}
+		pending := NewUser("", "Pending", "")
+		pending.Status = UserPending
+		noEmail := NewUser("", "No email", "")
+		noEmail.Status = ""
+		for _, user := range []*User{pending, noEmail} {
+			if err := store.CreateUser(ctx, user); err != nil {
+				t.Fatalf("Expected users without email not to clash, got %v", err)
+			}
+		}
+		if got, _ := store.GetUser(ctx, pending.ID); got.Status != UserPending || got.Active() {
+			t.Errorf("Expected the status to be kept, got %q", got.Status)
+		}
+		if got, _ := store.GetUser(ctx, noEmail.ID); got.Status != UserActive {
+			t.Errorf("Expected users to start active, got %q", got.Status)
+		}
+		for _, user := range []*User{pending, noEmail} {
+			if err := store.DeleteUser(ctx, user.ID); err != nil {
+				t.Fatalf("Failed to delete user: %v", err)
+			}
+		}
+
+		got, err := store.GetUser(ctx, "alice")
+		if err != nil {
+			t.Fatalf("Failed to get alice: %v", err)
+		}
+		if got.Name != "Alice" || len(got.Roles) != 1 || len(got.Bindings) != 1 || got.Bindings[0].Domains[0] != "home.lab" {
+			t.Errorf("Unexpected user %+v", got)
+		}
+
+		if got.Version != 1 || got.CreatedAt.IsZero() || !got.UpdatedAt.Equal(got.CreatedAt) {
+			t.Errorf("Expected the store to stamp version 1 and the timestamps, got %+v", got)
+		}
+		created := got.CreatedAt
+
+		// a replacement without timestamps keeps CreatedAt, bumps UpdatedAt and the version
+		update := NewUser("alice", "Alice Liddell", "alice@home.lab")
+		update.CreatedAt = time.Time{}
+		update.Roles = got.Roles
+		update.Bindings = got.Bindings
+		update.Version = 1
+		if err := store.UpdateUser(ctx, update); err != nil {
+			t.Fatalf("Failed to update alice: %v", err)
+		}
+		got, _ = store.GetUser(ctx, "alice")
+		if got.Name != "Alice Liddell" || got.Version != 2 || !got.CreatedAt.Equal(created) || got.UpdatedAt.Before(created) {
+			t.Errorf("Expected the update to be saved as version 2, got %+v", got)
+		}
+
+		// an update from version 1 lost the race against the one above
+		stale := NewUser("alice", "Stale", "alice@home.lab")
+		stale.Version = 1
+		if err := store.UpdateUser(ctx, stale); !errors.Is(err, ErrUserChanged) || !errors.Is(err, ErrVersionMismatch) {
+			t.Errorf("Expected ErrUserChanged for a stale version, got %v", err)
+		}
+		if got, _ := store.GetUser(ctx, "alice"); got.Name != "Alice Liddell" {
+			t.Errorf("Expected the stale update to be refused, got %q", got.Name)
+		}
+		if err := store.UpdateUser(ctx, NewUser("nobody", "", "")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound updating a missing user, got %v", err)
+		}
+
+		users, err := store.ListUsers(ctx, UserFilter{})
+		if err != nil || len(users.Items) != 13 || users.Total != 13 || users.NextCursor != "" {
+			t.Fatalf("Expected 13 users on one page, got %+v, %v", users, err)
+		}
+		for i := 1; i < len(users.Items); i++ {
+			if users.Items[i-1].ID >= users.Items[i].ID {
+				t.Fatalf("Expected users sorted by ID, got %q before %q", users.Items[i-1].ID, users.Items[i].ID)
+			}
+		}
+
+		filters := map[string]struct {
+			filter UserFilter
+			want   []string
+		}{
+			"name":    {UserFilter{Name: "liddell"}, []string{"alice"}},
+			"email":   {UserFilter{Email: "ALICE@home.lab"}, []string{"alice"}},
+			"role":    {UserFilter{Role: RoleIssuer}, []string{"alice"}},
+			"no role": {UserFilter{Role: RoleAdmin}, nil},
+		}
+		for name, tc := range filters {
+			page, err := store.ListUsers(ctx, tc.filter)
+			if err != nil || len(page.Items) != len(tc.want) || page.Total != len(tc.want) {
+				t.Errorf("%s: expected %v, got %+v, %v", name, tc.want, page, err)
+				continue
+			}
+			for i, user := range page.Items {
+				if user.ID != tc.want[i] {
+					t.Errorf("%s: expected %v, got user %q", name, tc.want, user.ID)
+				}
+			}
+		}
+
+		// paging by cursor visits every user once, in order, whatever the sort
+		for _, sort := range []string{"id", "-name", "createdAt"} {
+			var visited []string
+			filter := UserFilter{Sort: sort, Limit: 5}
+			for {
+				page, err := store.ListUsers(ctx, filter)
+				if err != nil {
+					t.Fatalf("%s: failed to list: %v", sort, err)
+				}
+				if page.Total != 13 {
+					t.Errorf("%s: expected a total of 13, got %d", sort, page.Total)
+				}
+				for _, user := range page.Items {
+					visited = append(visited, user.ID)
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				filter.Cursor = page.NextCursor
+			}
+			all, _ := store.ListUsers(ctx, UserFilter{Sort: sort})
+			if len(visited) != len(all.Items) {
+				t.Fatalf("%s: expected 13 users across pages, got %v", sort, visited)
+			}
+			for i, user := range all.Items {
+				if visited[i] != user.ID {
+					t.Errorf("%s: expected %q at %d, got %q", sort, user.ID, i, visited[i])
+				}
+			}
+		}
+		first, _ := store.ListUsers(ctx, UserFilter{Limit: 1})
+		if _, err := store.ListUsers(ctx, UserFilter{Sort: "name", Cursor: first.NextCursor}); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("Expected a cursor of another order to be refused, got %v", err)
+		}
+		if _, err := store.ListUsers(ctx, UserFilter{Cursor: "garbage"}); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("Expected a malformed cursor to be refused, got %v", err)
+		}
+		if _, err := store.ListUsers(ctx, UserFilter{Sort: "password"}); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("Expected an unknown sort key to be refused, got %v", err)
+		}
+
+		if err := store.DeleteUser(ctx, "alice"); err != nil {
+			t.Fatalf("Failed to delete alice: %v", err)
+		}
+		if _, err := store.GetUser(ctx, "alice"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected alice to be gone, got %v", err)
+		}
+		if err := store.DeleteUser(ctx, "alice"); err == nil {
+			t.Error("Expected deleting a missing user to fail")
+		}
+	})
+
+	t.Run("Certs", func(t *testing.T) {
+		store := newStore(t)
+		now := time.Now().Truncate(time.Second)
+
+		web := testCert(t, 1, "web.home.lab", now.Add(-2*time.Hour), now.Add(30*24*time.Hour), false)
+		web.Profile = "server"
+		api := testCert(t, 2, "api.home.lab", now.Add(-time.Hour), now.Add(10*24*time.Hour), false)
+		ca := testCert(t, 3, "Home Lab CA", now.Add(-3*time.Hour), now.Add(365*24*time.Hour), true)
+		for _, cert := range []*Certificate{web, api, ca} {
+			if err := store.SaveCert(ctx, cert); err != nil {
+				t.Fatalf("Failed to save %s: %v", cert.Subject, err)
+			}
+		}
+		if err := store.SaveCert(ctx, web); !errors.Is(err, ErrConflict) {
+			t.Errorf("Expected ErrConflict saving a serial twice, got %v", err)
+		}
+
+		got, err := store.GetCert(ctx, "1")
+		if err != nil {
+			t.Fatalf("Failed to get certificate: %v", err)
+		}
+		if got.Subject != "web.home.lab" || got.Profile != "server" || !got.NotAfter.Equal(web.NotAfter) {
+			t.Errorf("Unexpected certificate %+v", got)
+		}
+		if got.X509Certificate == nil || len(got.RawCertificate) == 0 {
+			t.Error("Expected the parsed certificate to be kept")
+		}
+		if _, err := store.GetCert(ctx, "99"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound for a missing certificate, got %v", err)
+		}
+
+		// newest first, with the total before paging
+		page, err := store.ListCerts(ctx, CertFilter{Limit: 2})
+		if err != nil || page.Total != 3 || len(page.Items) != 2 || page.Items[0].SerialNumber != "2" || page.Items[1].SerialNumber != "1" {
+			t.Fatalf("Unexpected first page %+v, %v", page, err)
+		}
+		if page, _ := store.ListCerts(ctx, CertFilter{Offset: 2}); len(page.Items) != 1 || page.Items[0].SerialNumber != "3" {
+			t.Errorf("Unexpected second page %v", serials(page.Items))
+		}
+		if page, _ := store.ListCerts(ctx, CertFilter{Offset: 5}); len(page.Items) != 0 {
+			t.Errorf("Expected an empty page past the end, got %v", serials(page.Items))
+		}
+		next, err := store.ListCerts(ctx, CertFilter{Cursor: page.NextCursor, Limit: 2})
+		if err != nil || len(next.Items) != 1 || next.Items[0].SerialNumber != "3" || next.NextCursor != "" || next.Total != 3 {
+			t.Errorf("Unexpected page after the cursor %+v, %v", next, err)
+		}
+		sorts := map[string][]string{
+			"notAfter": {"2", "1", "3"},
+			"-subject": {"1", "2", "3"},
+			"serial":   {"1", "2", "3"},
+		}
+		for sort, want := range sorts {
+			page, err := store.ListCerts(ctx, CertFilter{Sort: sort})
+			if err != nil || len(page.Items) != 3 {
+				t.Errorf("%s: unexpected listing %+v, %v", sort, page, err)
+				continue
+			}
+			for i, cert := range page.Items {
+				if cert.SerialNumber != want[i] {
+					t.Errorf("%s: expected %v, got %v", sort, want, serials(page.Items))
+					break
+				}
+			}
+		}
+		if _, err := store.ListCerts(ctx, CertFilter{Sort: "serial", Cursor: page.NextCursor}); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("Expected a cursor of another order to be refused, got %v", err)
+		}
+
+		isCA := false
+		filters := map[string]struct {
+			filter CertFilter
+			want   int
+		}{
+			"subject":        {CertFilter{Subject: "HOME.LAB"}, 2},
+			"issuer":         {CertFilter{Issuer: "api"}, 1},
+			"expires after":  {CertFilter{ExpiresAfter: now.Add(20 * 24 * time.Hour)}, 2},
+			"expires before": {CertFilter{ExpiresBefore: now.Add(20 * 24 * time.Hour)}, 1},
+			"not CA":         {CertFilter{IsCA: &isCA}, 2},
+		}
+		for name, tc := range filters {
+			if page, err := store.ListCerts(ctx, tc.filter); err != nil || page.Total != tc.want || len(page.Items) != tc.want {
+				t.Errorf("%s: expected %d matches, got %+v, %v", name, tc.want, page, err)
+			}
+		}
+
+		// renewal schedules the revocation of the old certificate
+		due := now.Add(time.Hour)
+		renewed, err := store.MarkRenewed(ctx, "1", "2", &due)
+		if err != nil || renewed.RenewedBy != "2" || renewed.RevokeAt == nil {
+			t.Fatalf("Failed to mark renewed: %+v, %v", renewed, err)
+		}
+		if certs, _ := store.ListRevocationsDue(ctx, now); len(certs) != 0 {
+			t.Errorf("Expected no revocation due yet, got %v", serials(certs))
+		}
+		if certs, _ := store.ListRevocationsDue(ctx, due); len(certs) != 1 || certs[0].SerialNumber != "1" {
+			t.Errorf("Expected certificate 1 due, got %v", serials(certs))
+		}
+
+		revoked, err := store.RevokeCert(ctx, "1", 4, now)
+		if err != nil || !revoked.IsRevoked() || revoked.RevocationCode != 4 || revoked.RevokeAt != nil {
+			t.Fatalf("Failed to revoke: %+v, %v", revoked, err)
+		}
+		if _, err := store.RevokeCert(ctx, "1", 1, now); !errors.Is(err, ErrAlreadyRevoked) {
+			t.Errorf("Expected ErrAlreadyRevoked, got %v", err)
+		}
+		if _, err := store.RevokeCert(ctx, "99", 1, now); err == nil {
+			t.Error("Expected revoking a missing certificate to fail")
+		}
+		if got, _ := store.GetCert(ctx, "1"); !got.IsRevoked() || !got.RevokedAt.Equal(now) || got.RenewedBy != "2" {
+			t.Errorf("Expected the revocation to be saved, got %+v", got)
+		}
+		if certs, _ := store.ListRevocationsDue(ctx, due); len(certs) != 0 {
+			t.Errorf("Expected a revoked certificate not to be due, got %v", serials(certs))
+		}
+		if certs, _ := store.ListRevoked(ctx, web.AuthorityKeyID); len(certs) != 1 || certs[0].SerialNumber != "1" {
+			t.Errorf("Expected certificate 1 on the CRL, got %v", serials(certs))
+		}
+		if certs, _ := store.ListRevoked(ctx, "00"); len(certs) != 0 {
+			t.Errorf("Expected no revocations of another CA, got %v", serials(certs))
+		}
+	})
+
+	t.Run("Profiles", func(t *testing.T) {
+		store := newStore(t)
+
+		profile := &Profile{Name: "server", ExtKeyUsages: []string{"serverAuth"}, MaxValidDays: 90}
+		if err := store.CreateProfile(ctx, profile); err != nil {
+			t.Fatalf("Failed to create profile: %v", err)
+		}
+		if profile.CreatedAt.IsZero() {
+			t.Error("Expected CreatedAt to be set")
+		}
+		if err := store.CreateProfile(ctx, &Profile{Name: "server"}); !errors.Is(err, ErrProfileExists) {
+			t.Errorf("Expected ErrProfileExists, got %v", err)
+		}
+		if err := store.CreateProfile(ctx, &Profile{Name: "client"}); err != nil {
+			t.Fatalf("Failed to create profile: %v", err)
+		}
+
+		update := &Profile{Name: "server", MaxValidDays: 30}
+		if err := store.UpdateProfile(ctx, update); err != nil {
+			t.Fatalf("Failed to update profile: %v", err)
+		}
+		got, err := store.GetProfile(ctx, "server")
+		if err != nil || got.MaxValidDays != 30 || !got.CreatedAt.Equal(profile.CreatedAt) {
+			t.Errorf("Expected the update to keep CreatedAt, got %+v, %v", got, err)
+		}
+		if err := store.UpdateProfile(ctx, &Profile{Name: "missing"}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound updating a missing profile, got %v", err)
+		}
+
+		profiles, err := store.ListProfiles(ctx)
+		if err != nil || len(profiles) != 2 || profiles[0].Name != "client" {
+			t.Errorf("Expected profiles sorted by name, got %d, %v", len(profiles), err)
+		}
+
+		if err := store.DeleteProfile(ctx, "server"); err != nil {
+			t.Fatalf("Failed to delete profile: %v", err)
+		}
+		if err := store.DeleteProfile(ctx, "server"); err == nil {
+			t.Error("Expected deleting a missing profile to fail")
+		}
+	})
+
+	t.Run("APIKeys", func(t *testing.T) {
+		store := newStore(t)
+
+		first, token, err := NewAPIKey("alice", "ci", nil)
+		if err != nil {
+			t.Fatalf("Failed to create key: %v", err)
+		}
+		second, _, _ := NewAPIKey("alice", "laptop", nil)
+		second.CreatedAt = first.CreatedAt.Add(time.Second)
+		other, _, _ := NewAPIKey("bob", "ci", nil)
+		for _, key := range []*APIKey{first, second, other} {
+			if err := store.CreateAPIKey(ctx, key); err != nil {
+				t.Fatalf("Failed to save key: %v", err)
+			}
+		}
+		if err := store.CreateAPIKey(ctx, first); !errors.Is(err, ErrConflict) {
+			t.Errorf("Expected ErrConflict saving a key ID twice, got %v", err)
+		}
+
+		id, secret, err := ParseAPIKeyToken(token)
+		if err != nil {
+			t.Fatalf("Failed to parse token: %v", err)
+		}
+		got, err := store.GetAPIKey(ctx, id)
+		if err != nil || !got.Matches(secret) {
+			t.Errorf("Expected the stored key to match its token, got %v", err)
+		}
+
+		keys, err := store.ListAPIKeys(ctx, "alice")
+		if err != nil || len(keys) != 2 || keys[0].ID != first.ID {
+			t.Errorf("Expected the keys of alice oldest first, got %d, %v", len(keys), err)
+		}
+
+		used := time.Now().Truncate(time.Second)
+		if err := store.TouchAPIKey(ctx, first.ID, used); err != nil {
+			t.Fatalf("Failed to touch key: %v", err)
+		}
+		revokedAt := used.Add(time.Minute)
+		if _, err := store.RevokeAPIKey(ctx, first.ID, revokedAt); err != nil {
+			t.Fatalf("Failed to revoke key: %v", err)
+		}
+		key, err := store.RevokeAPIKey(ctx, first.ID, revokedAt.Add(time.Hour))
+		if err != nil || !key.RevokedAt.Equal(revokedAt) {
+			t.Errorf("Expected a second revocation to keep the first time, got %+v, %v", key, err)
+		}
+		if got, _ := store.GetAPIKey(ctx, first.ID); !got.LastUsedAt.Equal(used) || got.Active(time.Now()) {
+			t.Errorf("Expected a used and revoked key, got %+v", got)
+		}
+		if err := store.TouchAPIKey(ctx, "missing", used); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound touching a missing key, got %v", err)
+		}
+	})
+
+	t.Run("ACME", func(t *testing.T) {
+		store := newStore(t)
+		account := &ACMEAccount{ID: "acct", Status: ACMEStatusValid, KeyThumbprint: "thumb", Key: []byte(`{"kty":"EC"}`)}
+		order := &ACMEOrder{ID: "order", AccountID: "acct", Status: ACMEStatusPending, AuthorizationIDs: []string{"authz"}}
+		authz := &ACMEAuthorization{ID: "authz", AccountID: "acct", Status: ACMEStatusPending, ChallengeIDs: []string{"chall"}}
+		challenge := &ACMEChallenge{ID: "chall", AuthorizationID: "authz", Type: "http-01", Status: ACMEStatusPending}
+		for _, err := range []error{
+			store.CreateAccount(account),
+			store.CreateOrder(order),
+			store.CreateOrder(&ACMEOrder{ID: "other", AccountID: "someone"}),
+			store.CreateAuthorization(authz),
+			store.CreateChallenge(challenge),
+		} {
+			if err != nil {
+				t.Fatalf("Failed to create ACME object: %v", err)
+			}
+		}
+
+		if got, err := store.GetAccountByThumbprint("thumb"); err != nil || got.ID != "acct" || string(got.Key) != `{"kty":"EC"}` {
+			t.Errorf("Expected the account by its thumbprint, got %+v, %v", got, err)
+		}
+		if orders, err := store.ListOrders("acct"); err != nil || len(orders) != 1 || orders[0].ID != "order" {
+			t.Errorf("Expected the one order of the account, got %d, %v", len(orders), err)
+		}
+
+		order.Status = ACMEStatusReady
+		authz.Status = ACMEStatusValid
+		challenge.Status = ACMEStatusValid
+		account.Contact = []string{"mailto:ops@home.lab"}
+		for _, err := range []error{
+			store.UpdateOrder(order),
+			store.UpdateAuthorization(authz),
+			store.UpdateChallenge(challenge),
+			store.UpdateAccount(account),
+		} {
+			if err != nil {
+				t.Fatalf("Failed to update ACME object: %v", err)
+			}
+		}
+		if got, _ := store.GetOrder("order"); got.Status != ACMEStatusReady {
+			t.Errorf("Expected the order to be ready, got %q", got.Status)
+		}
+		if got, _ := store.GetAuthorization("authz"); got.Status != ACMEStatusValid {
+			t.Errorf("Expected the authorization to be valid, got %q", got.Status)
+		}
+		if got, _ := store.GetChallenge("chall"); got.Status != ACMEStatusValid {
+			t.Errorf("Expected the challenge to be valid, got %q", got.Status)
+		}
+		if got, _ := store.GetAccount("acct"); len(got.Contact) != 1 {
+			t.Errorf("Expected the account contact, got %+v", got)
+		}
+
+		for name, err := range map[string]error{
+			"account":       store.UpdateAccount(&ACMEAccount{ID: "missing"}),
+			"order":         store.UpdateOrder(&ACMEOrder{ID: "missing"}),
+			"authorization": store.UpdateAuthorization(&ACMEAuthorization{ID: "missing"}),
+			"challenge":     store.UpdateChallenge(&ACMEChallenge{ID: "missing"}),
+		} {
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound updating a missing %s, got %v", name, err)
+			}
+		}
+		if _, err := store.GetOrder("missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound for a missing order, got %v", err)
+		}
+
+		// the order is ready, only the first transition out of ready succeeds
+		if err := store.TransitionOrder("order", ACMEStatusReady, ACMEStatusProcessing); err != nil {
+			t.Fatalf("Failed to move the order to processing: %v", err)
+		}
+		if err := store.TransitionOrder("order", ACMEStatusReady, ACMEStatusProcessing); !errors.Is(err, ErrACMEOrderChanged) {
+			t.Errorf("Expected ErrACMEOrderChanged for an order no longer ready, got %v", err)
+		}
+		if got, _ := store.GetOrder("order"); got.Status != ACMEStatusProcessing || len(got.AuthorizationIDs) != 1 {
+			t.Errorf("Expected the order to be processing and otherwise unchanged, got %+v", got)
+		}
+		if err := store.TransitionOrder("missing", ACMEStatusReady, ACMEStatusProcessing); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound moving a missing order, got %v", err)
+		}
+	})
+}
+
+// testAuditStore checks that records read back in order and unchanged
+func testAuditStore(t *testing.T, store AuditStore) {
+	scan := func() []*AuditRecord {
+		records := make([]*AuditRecord, 0)
+		if err := store.ScanAudit(func(rec *AuditRecord) error {
+			records = append(records, rec)
+			return nil
+		}); err != nil {
+			t.Fatalf("Failed to scan: %v", err)
+		}
+		return records
+	}
+	if records := scan(); len(records) != 0 {
+		t.Fatalf("Expected an empty log, got %d records", len(records))
+	}
+
+	now := time.Now().UTC()
+	for seq := int64(1); seq <= 3; seq++ {
+		err := store.AppendAudit(&AuditRecord{
+			Seq:    seq,
+			Time:   now,
+			Action: "cert.issue",
+			Actor:  "alice",
+			Params: map[string]interface{}{"commonName": "web.home.lab"},
+			Result: AuditSuccess,
+			Hash:   "h" + string(rune('0'+seq)),
+		})
+		if err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+
+	records := scan()
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %d", len(records))
+	}
+	for i, rec := range records {
+		if rec.Seq != int64(i+1) || rec.Params["commonName"] != "web.home.lab" || !rec.Time.Equal(now) {
+			t.Errorf("Unexpected record %d: %+v", i, rec)
+		}
+	}
+}
+
+// testCert creates a self-signed certificate record, all sharing one authority key ID
+func testCert(t *testing.T, serial int64, cn string, notBefore, notAfter time.Time, isCA bool) *Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		AuthorityKeyId:        []byte{0xca},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return NewCertificate(cert)
+}
+
+func serials(certs []*Certificate) []string {
+	list := make([]string, 0, len(certs))
+	for _, cert := range certs {
+		list = append(list, cert.SerialNumber)
+	}
+	return list
+}
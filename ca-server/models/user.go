@@ -1,24 +1,117 @@
 package models
 
-import "time"
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// UserStatus is the lifecycle state of a user, only active users authenticate
+type UserStatus string
+
+// User statuses, a pending user is provisioned but not activated yet
+const (
+	UserPending  UserStatus = "pending"
+	UserActive   UserStatus = "active"
+	UserDisabled UserStatus = "disabled"
+)
+
+// ParseUserStatus returns the status named s
+func ParseUserStatus(s string) (UserStatus, error) {
+	switch status := UserStatus(strings.ToLower(strings.TrimSpace(s))); status {
+	case UserPending, UserActive, UserDisabled:
+		return status, nil
+	}
+	return "", fmt.Errorf("unknown status %q, use pending, active or disabled", s)
+}
+
+// CanBecome reports whether a user may move from s to next.
+// Pending users are activated or disabled, active and disabled users switch between both, none returns to pending.
+func (s UserStatus) CanBecome(next UserStatus) bool {
+	return s == next || next != UserPending
+}
 
 // User represents user data model
 type User struct {
-	ID        string    `json:"id"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	// ID is a UUID assigned by the store
+	ID     string     `json:"id"`
+	Name   string     `json:"name"`
+	Email  string     `json:"email"`
+	Status UserStatus `json:"status"`
+	Roles  []Role     `json:"roles,omitempty"`
+	// Bindings grant roles limited to some profiles, CAs or domain suffixes
+	Bindings  []RoleBinding `json:"bindings,omitempty"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	// Version counts the writes of the user, the store bumps it on every update
+	Version int64 `json:"version"`
 }
 
-// NewUser creates a new user with default values
+// NewUser creates a new active user with default values
 func NewUser(id, name, email string) *User {
 	now := time.Now()
 	return &User{
 		ID:        id,
 		Name:      name,
 		Email:     email,
+		Status:    UserActive,
 		CreatedAt: now,
 		UpdatedAt: now,
 	}
 }
+
+// CurrentStatus returns the status of the user, users stored before statuses existed have none and are active
+func (u *User) CurrentStatus() UserStatus {
+	if u.Status == "" {
+		return UserActive
+	}
+	return u.Status
+}
+
+// Active reports whether the user may authenticate
+func (u *User) Active() bool {
+	return u.CurrentStatus() == UserActive
+}
+
+// created stamps a user the store is about to add, active unless it has a status
+func (u *User) created() {
+	if u.Status == "" {
+		u.Status = UserActive
+	}
+	now := time.Now()
+	u.CreatedAt = now
+	u.UpdatedAt = now
+	u.Version = 1
+}
+
+// replaces stamps u as the next version of existing. A non-zero Version on u must be the
+// version of existing, a user read before the last update is refused with ErrUserChanged.
+func (u *User) replaces(existing *User) error {
+	if u.Version != 0 && u.Version != existing.Version {
+		return ErrUserChanged
+	}
+	u.CreatedAt = existing.CreatedAt
+	u.UpdatedAt = time.Now()
+	u.Version = existing.Version + 1
+	return nil
+}
+
+// sameEmail reports whether u has the non-empty email, ignoring case
+func (u *User) sameEmail(email string) bool {
+	return email != "" && strings.EqualFold(u.Email, email)
+}
+
+// holds reports whether the user has role, directly or through a binding
+func (u *User) holds(role Role) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	for _, binding := range u.Bindings {
+		if binding.Role == role {
+			return true
+		}
+	}
+	return false
+}
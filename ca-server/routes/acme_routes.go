@@ -0,0 +1,53 @@
+package routes
+
+import (
+	"fmt"
+
+	"ca-server/config"
+	"ca-server/controllers"
+	"ca-server/middleware"
+	"ca-server/models"
+	"ca-server/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetupACMERoutes registers the RFC 8555 ACME server under /acme, keeping accounts and orders in store.
+// Anyone who can prove control of a name may order a certificate for it, so ACME_ALLOWED_DOMAINS must limit the names.
+func SetupACMERoutes(router *gin.Engine, cfg *config.Config, store models.ACMEStore, issuer *services.Issuer, keyPolicy *services.KeyPolicy) error {
+	if len(cfg.ACMEAllowedDomains) == 0 {
+		return fmt.Errorf("ACME_ENABLED requires ACME_ALLOWED_DOMAINS")
+	}
+	validators := map[string]services.ChallengeValidator{
+		services.ChallengeHTTP01: services.NewHTTP01Validator(cfg.ACMEHTTP01Port),
+		services.ChallengeDNS01:  services.NewDNS01Validator(cfg.ACMEDNSResolver),
+	}
+	policy := services.CSRPolicy{
+		AllowedDomains: cfg.ACMEAllowedDomains,
+		MinRSABits:     cfg.CSRMinRSABits,
+		Keys:           keyPolicy,
+	}
+
+	acmeService := services.NewACMEService(store, issuer, policy, validators, cfg.ACMECertValidDays)
+	setupACMERoutes(router, controllers.NewACMEController(acmeService, cfg.PublicURL))
+	return nil
+}
+
+// setupACMERoutes registers the ACME handlers, split out so tests can stub the validators
+func setupACMERoutes(router *gin.Engine, acmeController *controllers.ACMEController) {
+	acmeGroup := router.Group("/acme")
+	{
+		acmeGroup.GET("/directory", acmeController.Directory)
+		acmeGroup.HEAD("/new-nonce", acmeController.NewNonce)
+		acmeGroup.GET("/new-nonce", acmeController.NewNonce)
+		acmeGroup.POST("/new-account", acmeController.NewAccount)
+		acmeGroup.POST("/acct/:id", acmeController.Account)
+		acmeGroup.POST("/acct/:id/orders", acmeController.AccountOrders)
+		acmeGroup.POST("/new-order", acmeController.NewOrder)
+		acmeGroup.POST("/order/:id", acmeController.Order)
+		acmeGroup.POST("/order/:id/finalize", middleware.AuditAction("acme.finalize"), acmeController.Finalize)
+		acmeGroup.POST("/authz/:id", acmeController.Authorization)
+		acmeGroup.POST("/chall/:id", acmeController.Challenge)
+		acmeGroup.POST("/cert/:id", acmeController.Certificate)
+	}
+}
@@ -0,0 +1,353 @@
+package routes
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ca-server/config"
+	"ca-server/controllers"
+	"ca-server/models"
+	"ca-server/services"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/acme"
+)
+
+// stubTXTResolver serves TXT records from a map instead of DNS
+type stubTXTResolver struct {
+	mutex   sync.Mutex
+	records map[string][]string
+}
+
+func (r *stubTXTResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if records, ok := r.records[name]; ok {
+		return records, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (r *stubTXTResolver) set(name, value string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.records[name] = append(r.records[name], value)
+}
+
+// acmeTestEnv is an ACME server backed by a throwaway CA and stub challenge targets
+type acmeTestEnv struct {
+	server *httptest.Server
+	caCert *x509.Certificate
+	// http01 maps challenge tokens to the key authorization the stub web server answers with
+	http01   sync.Map
+	resolver *stubTXTResolver
+}
+
+func newACMETestEnv(t *testing.T) *acmeTestEnv {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	env := &acmeTestEnv{resolver: &stubTXTResolver{records: make(map[string][]string)}}
+
+	// every http-01 request lands on this server, whatever domain it was meant for
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.URL.Path, "/.well-known/acme-challenge/")
+		keyAuth, ok := env.http01.Load(token)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(keyAuth.(string)))
+	}))
+	t.Cleanup(target.Close)
+
+	http01 := services.NewHTTP01Validator(80)
+	http01.Client.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, target.Listener.Addr().String())
+		},
+	}
+	validators := map[string]services.ChallengeValidator{
+		services.ChallengeHTTP01: http01,
+		services.ChallengeDNS01:  &services.DNS01Validator{Resolver: env.resolver},
+	}
+
+	caStore, caCert := newTestCA(t)
+	env.caCert = caCert
+
+	// the public URL is only known once the server listens, so routes are set up after
+	router := gin.New()
+	env.server = httptest.NewServer(router)
+	t.Cleanup(env.server.Close)
+
+	issuer := services.NewIssuer(models.NewMemoryStore(), caStore, env.server.URL)
+	policy := services.CSRPolicy{AllowedDomains: []string{"example.com"}, MinRSABits: 2048}
+	acmeService := services.NewACMEService(models.NewMemoryACMEStore(), issuer, policy, validators, 90)
+	setupACMERoutes(router, controllers.NewACMEController(acmeService, env.server.URL))
+
+	return env
+}
+
+// newTestCA creates a self-signed ECDSA CA in a temporary directory
+func newTestCA(t *testing.T) (models.CAStore, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour * 365),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse CA certificate: %v", err)
+	}
+
+	dir := t.TempDir()
+	caStore, err := models.NewFileCAStore(filepath.Join(dir, "caCert.pem"), filepath.Join(dir, "caKey.pem"), filepath.Join(dir, "cas"), nil, true)
+	if err != nil {
+		t.Fatalf("Failed to create CA store: %v", err)
+	}
+	ca, err := models.NewCA(key, cert, nil)
+	if err != nil {
+		t.Fatalf("Invalid CA: %v", err)
+	}
+	if err := caStore.Save(ca, true); err != nil {
+		t.Fatalf("Failed to save CA: %v", err)
+	}
+	return caStore, cert
+}
+
+// newClient registers a fresh ACME account
+func (env *acmeTestEnv) newClient(ctx context.Context, t *testing.T) *acme.Client {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate account key: %v", err)
+	}
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: env.server.URL + "/acme/directory",
+		RetryBackoff: func(int, *http.Request, *http.Response) time.Duration { return 50 * time.Millisecond },
+	}
+	if _, err := client.Register(ctx, &acme.Account{Contact: []string{"mailto:ops@example.com"}}, acme.AcceptTOS); err != nil {
+		t.Fatalf("Failed to register account: %v", err)
+	}
+	return client
+}
+
+// solve fulfils the challenge of the given type on every authorization of the order
+func (env *acmeTestEnv) solve(ctx context.Context, t *testing.T, client *acme.Client, order *acme.Order, typ string) {
+	t.Helper()
+
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			t.Fatalf("Failed to get authorization: %v", err)
+		}
+
+		var challenge *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == typ {
+				challenge = c
+			}
+		}
+		if challenge == nil {
+			t.Fatalf("Authorization for %s offers no %s challenge", authz.Identifier.Value, typ)
+		}
+
+		switch typ {
+		case services.ChallengeHTTP01:
+			keyAuth, err := client.HTTP01ChallengeResponse(challenge.Token)
+			if err != nil {
+				t.Fatalf("Failed to compute key authorization: %v", err)
+			}
+			env.http01.Store(challenge.Token, keyAuth)
+		case services.ChallengeDNS01:
+			record, err := client.DNS01ChallengeRecord(challenge.Token)
+			if err != nil {
+				t.Fatalf("Failed to compute TXT record: %v", err)
+			}
+			env.resolver.set("_acme-challenge."+authz.Identifier.Value, record)
+		}
+
+		if _, err := client.Accept(ctx, challenge); err != nil {
+			t.Fatalf("Failed to accept challenge: %v", err)
+		}
+	}
+}
+
+// issue finalizes a ready order with a fresh key and returns the certificate chain
+func (env *acmeTestEnv) issue(ctx context.Context, t *testing.T, client *acme.Client, order *acme.Order, names ...string) []*x509.Certificate {
+	t.Helper()
+
+	order, err := client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		t.Fatalf("Order did not become ready: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate certificate key: %v", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: names}, key)
+	if err != nil {
+		t.Fatalf("Failed to create CSR: %v", err)
+	}
+	ders, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		t.Fatalf("Failed to finalize order: %v", err)
+	}
+
+	chain := make([]*x509.Certificate, 0, len(ders))
+	for _, der := range ders {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatalf("Failed to parse issued certificate: %v", err)
+		}
+		chain = append(chain, cert)
+	}
+	return chain
+}
+
+func TestACMEHTTP01Issuance(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	env := newACMETestEnv(t)
+	client := env.newClient(ctx, t)
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs("www.example.com", "api.example.com"))
+	if err != nil {
+		t.Fatalf("Failed to create order: %v", err)
+	}
+	env.solve(ctx, t, client, order, services.ChallengeHTTP01)
+	chain := env.issue(ctx, t, client, order, "www.example.com", "api.example.com")
+
+	if len(chain) != 2 {
+		t.Fatalf("Expected leaf and CA certificate, got %d certificates", len(chain))
+	}
+	leaf := chain[0]
+	if err := leaf.CheckSignatureFrom(env.caCert); err != nil {
+		t.Fatalf("Certificate is not signed by the CA: %v", err)
+	}
+	if err := leaf.VerifyHostname("api.example.com"); err != nil {
+		t.Fatalf("Certificate does not cover api.example.com: %v", err)
+	}
+	if validity := leaf.NotAfter.Sub(leaf.NotBefore); validity > 91*24*time.Hour {
+		t.Fatalf("Expected a 90 day certificate, got %s", validity)
+	}
+}
+
+func TestACMEDNS01WildcardIssuance(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	env := newACMETestEnv(t)
+	client := env.newClient(ctx, t)
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs("*.example.com"))
+	if err != nil {
+		t.Fatalf("Failed to create order: %v", err)
+	}
+	env.solve(ctx, t, client, order, services.ChallengeDNS01)
+	chain := env.issue(ctx, t, client, order, "*.example.com")
+
+	if err := chain[0].VerifyHostname("anything.example.com"); err != nil {
+		t.Fatalf("Certificate does not cover the wildcard: %v", err)
+	}
+}
+
+func TestACMEFailedChallengeInvalidatesOrder(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	env := newACMETestEnv(t)
+	client := env.newClient(ctx, t)
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs("www.example.com"))
+	if err != nil {
+		t.Fatalf("Failed to create order: %v", err)
+	}
+	authz, err := client.GetAuthorization(ctx, order.AuthzURLs[0])
+	if err != nil {
+		t.Fatalf("Failed to get authorization: %v", err)
+	}
+	for _, c := range authz.Challenges {
+		if c.Type == services.ChallengeHTTP01 {
+			// nothing is served for the token, so validation fails
+			if _, err := client.Accept(ctx, c); err != nil {
+				t.Fatalf("Failed to accept challenge: %v", err)
+			}
+		}
+	}
+
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err == nil {
+		t.Fatalf("Expected the authorization to become invalid")
+	}
+	order, err = client.GetOrder(ctx, order.URI)
+	if err != nil {
+		t.Fatalf("Failed to get order: %v", err)
+	}
+	if order.Status != acme.StatusInvalid {
+		t.Fatalf("Expected order status invalid, got %s", order.Status)
+	}
+}
+
+func TestACMERejectsNamesOutsidePolicy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	env := newACMETestEnv(t)
+	client := env.newClient(ctx, t)
+
+	_, err := client.AuthorizeOrder(ctx, acme.DomainIDs("www.example.org"))
+	var acmeErr *acme.Error
+	if !errors.As(err, &acmeErr) || acmeErr.ProblemType != "urn:ietf:params:acme:error:rejectedIdentifier" {
+		t.Fatalf("Expected rejectedIdentifier, got %v", err)
+	}
+}
+
+func TestACMERequiresAllowedDomains(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	caStore, _ := newTestCA(t)
+	issuer := services.NewIssuer(models.NewMemoryStore(), caStore, "http://localhost")
+
+	cfg := &config.Config{ACMEEnabled: true}
+	if err := SetupACMERoutes(gin.New(), cfg, models.NewMemoryACMEStore(), issuer, nil); err == nil {
+		t.Error("Expected ACME without ACME_ALLOWED_DOMAINS to be refused")
+	}
+	cfg.ACMEAllowedDomains = []string{"example.com"}
+	if err := SetupACMERoutes(gin.New(), cfg, models.NewMemoryACMEStore(), issuer, nil); err != nil {
+		t.Errorf("Failed to set up ACME routes: %v", err)
+	}
+}
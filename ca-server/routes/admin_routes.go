@@ -0,0 +1,30 @@
+package routes
+
+import (
+	"ca-server/config"
+	"ca-server/controllers"
+	"ca-server/middleware"
+	"ca-server/models"
+	"ca-server/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetupAdminRoutes registers the admin routes, all of them require the admin token
+func SetupAdminRoutes(router *gin.Engine, cfg *config.Config, store models.Store, caStore models.CAStore, auditLog *services.AuditLog) {
+	sealController := controllers.NewSealController(caStore)
+	auditController := controllers.NewAuditController(auditLog)
+	backupController := controllers.NewBackupController(store, caStore)
+
+	adminGroup := router.Group("/api/admin")
+	adminGroup.Use(middleware.AdminRequired(cfg.AdminToken))
+	{
+		adminGroup.GET("/ca/seal", sealController.SealStatus)
+		adminGroup.POST("/ca/seal", middleware.AuditAction("ca.seal"), sealController.Seal)
+		adminGroup.POST("/ca/unseal", middleware.AuditAction("ca.unseal"), sealController.Unseal)
+		adminGroup.GET("/audit", auditController.ListRecords)
+		adminGroup.GET("/audit/verify", auditController.VerifyChain)
+		adminGroup.GET("/snapshot", middleware.AuditAction("backup.snapshot"), backupController.Snapshot)
+		adminGroup.POST("/restore", middleware.AuditAction("backup.restore"), backupController.Restore)
+	}
+}
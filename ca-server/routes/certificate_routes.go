@@ -1,22 +1,88 @@
 package routes
 
 import (
+	"fmt"
+	"time"
+
+	"ca-server/config"
 	"ca-server/controllers"
+	"ca-server/middleware"
 	"ca-server/models"
+	"ca-server/services"
 
 	"github.com/gin-gonic/gin"
 )
 
 // SetupCertRoutes registers all cert-related routes
-func SetupCertRoutes(router *gin.Engine, store models.Store) {
-	certController := controllers.NewCertController()
+func SetupCertRoutes(router *gin.Engine, cfg *config.Config, store models.Store, caStore models.CAStore, issuer *services.Issuer, keyPolicy *services.KeyPolicy, keyBackend services.KeyBackend, crlService *services.CRLService, ocspService *services.OCSPService, revoker *services.RevocationService) error {
+	watcher, err := newExpiryWatcher(cfg, store)
+	if err != nil {
+		return err
+	}
+	watcher.Start(time.Duration(cfg.ExpiryCheckMinutes) * time.Minute)
+
+	certController := controllers.NewCertController(cfg, store, store, store, issuer, keyPolicy, revoker)
+	caController := controllers.NewCAController(caStore, issuer, keyPolicy, keyBackend)
+	crlController := controllers.NewCRLController(crlService)
+	expiryController := controllers.NewExpiryController(watcher)
+	ocspController := controllers.NewOCSPController(ocspService)
 
-	// Public user API endpoints
+	// Revocation information is published outside the API prefix
+	router.GET("/crl", crlController.GetCRL)
+	router.GET("/crl/:id", crlController.GetCRL)
+	router.POST("/ocsp", ocspController.Post)
+	router.GET("/ocsp/*request", ocspController.Get)
+
+	// Signing endpoints answer 503 while the CA keys are sealed
+	unsealed := middleware.Unsealed(caStore)
+	viewerRole := requireRole(cfg, models.RoleViewer)
+	issuerRole := requireRole(cfg, models.RoleIssuer)
+	revokerRole := requireRole(cfg, models.RoleRevoker)
+	adminRole := requireRole(cfg, models.RoleAdmin)
+	audit := middleware.AuditAction
+
+	// Reading the inventory takes the viewer role, which every other role grants.
+	// Issuing and revoking are further limited by the scope of the caller's role bindings.
 	certGroup := router.Group("/api/certs")
+	certGroup.Use(viewerRole)
 	{
-		certGroup.POST("", certController.CreateKey)
-		certGroup.POST("/ca", certController.CreateCA)
-		certGroup.POST("/server", certController.CreateServerCert)
-		certGroup.POST("/client", certController.CreateClientCert)
+		certGroup.GET("", certController.ListCerts)
+		certGroup.GET("/expiring", expiryController.ListExpiring)
+		certGroup.GET("/:serial", certController.GetCert)
+		certGroup.POST("", audit("key.generate"), certController.CreateKey)
+		certGroup.GET("/ca", caController.ListCAs)
+		certGroup.GET("/ca/:id", caController.GetCA)
+		certGroup.POST("/ca", audit("ca.create"), adminRole, unsealed, caController.CreateCA)
+		certGroup.POST("/ca/intermediate", audit("ca.create"), adminRole, unsealed, caController.CreateIntermediate)
+		certGroup.POST("/ca/:id/activate", audit("ca.activate"), adminRole, unsealed, caController.ActivateCA)
+		// Every leaf kind is a profile, /server and /client preselect the built-in ones
+		certGroup.POST("/issue", audit("cert.issue"), issuerRole, unsealed, certController.IssueCert(""))
+		certGroup.POST("/server", audit("cert.issue"), issuerRole, unsealed, certController.IssueCert("server"))
+		certGroup.POST("/client", audit("cert.issue"), issuerRole, unsealed, certController.IssueCert("client"))
+		certGroup.POST("/sign", audit("cert.sign"), issuerRole, unsealed, certController.SignCSR)
+		certGroup.POST("/:serial/revoke", audit("cert.revoke"), revokerRole, unsealed, certController.RevokeCert)
+		certGroup.POST("/:serial/renew", audit("cert.renew"), issuerRole, unsealed, certController.RenewCert)
+	}
+
+	return nil
+}
+
+// newExpiryWatcher creates the expiry watcher with the log sink and the webhook and SMTP sinks that are configured
+func newExpiryWatcher(cfg *config.Config, store models.CertStore) (*services.ExpiryWatcher, error) {
+	if cfg.ExpiryCheckMinutes <= 0 {
+		return nil, fmt.Errorf("EXPIRY_CHECK_MINUTES must be positive")
+	}
+
+	notifiers := []services.Notifier{services.LogNotifier{}}
+	if cfg.ExpiryWebhookURL != "" {
+		notifiers = append(notifiers, services.NewWebhookNotifier(cfg.ExpiryWebhookURL))
+	}
+	if cfg.ExpirySMTPAddr != "" {
+		smtpNotifier, err := services.NewSMTPNotifier(cfg.ExpirySMTPAddr, cfg.ExpirySMTPFrom, cfg.ExpirySMTPTo, cfg.ExpirySMTPUsername, cfg.ExpirySMTPPassword)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, smtpNotifier)
 	}
+	return services.NewExpiryWatcher(store, cfg.ExpiryThresholdDays, notifiers...)
 }
@@ -0,0 +1,694 @@
+package routes
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ca-server/config"
+	"ca-server/models"
+	"ca-server/services"
+	"ca-server/utils"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ocsp"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// newAPIKeyUser creates a user with bindings and returns an API key token for it
+func newAPIKeyUser(t *testing.T, store models.Store, id string, bindings ...models.RoleBinding) string {
+	t.Helper()
+	user := models.NewUser(id, id, id+"@home.lab")
+	user.Bindings = bindings
+	if err := store.CreateUser(context.Background(), user); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	key, token, err := models.NewAPIKey(id, "test", nil)
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	if err := store.CreateAPIKey(context.Background(), key); err != nil {
+		t.Fatalf("Failed to store API key: %v", err)
+	}
+	return token
+}
+
+func TestCertRoutesRoleBindings(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	t.Setenv("ACME_ENABLED", "false")
+	cfg := config.New()
+
+	store := models.NewMemoryStore()
+	caStore, _ := newTestCA(t)
+	auditLog, err := services.OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer auditLog.Close()
+	router := gin.New()
+	if err := SetupRoutes(router, cfg, store, caStore, services.FileKeyBackend{}, auditLog); err != nil {
+		t.Fatalf("Failed to set up routes: %v", err)
+	}
+
+	teamA := newAPIKeyUser(t, store, "team-a", models.RoleBinding{
+		Role: models.RoleIssuer, Profiles: []string{"server"}, Domains: []string{"team-a.home.lab"},
+	})
+	teamB := newAPIKeyUser(t, store, "team-b", models.RoleBinding{
+		Role: models.RoleRevoker, Domains: []string{"team-b.home.lab"},
+	})
+
+	send := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// roles are enforced by default, with nothing but the admin token and API keys configured
+	if w := send(http.MethodGet, "/api/certs", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an anonymous listing, got %d", w.Code)
+	}
+	if w := send(http.MethodGet, "/api/certs", teamA, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected issuers to view the inventory, got %d", w.Code)
+	}
+	if w := send(http.MethodPost, "/api/certs/ca", teamA, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a CA created by an issuer, got %d", w.Code)
+	}
+
+	cases := []struct {
+		name, target, body string
+		code               int
+	}{
+		{"own suffix", "/api/certs/server", `{"commonName": "web.team-a.home.lab", "dnsNames": ["web.team-a.home.lab", "api.team-a.home.lab"]}`, http.StatusOK},
+		{"other suffix", "/api/certs/server", `{"commonName": "web", "dnsNames": ["web.team-a.home.lab", "web.team-b.home.lab"]}`, http.StatusForbidden},
+		{"common name outside", "/api/certs/server", `{"commonName": "evil.example.com", "dnsNames": ["web.team-a.home.lab"]}`, http.StatusForbidden},
+		{"common name not a domain", "/api/certs/server", `{"commonName": "5f0c2a4e-8d1b-4c7a-9e3f-2b6d8a1c4e7f", "dnsNames": ["web.team-a.home.lab"]}`, http.StatusForbidden},
+		{"IP address", "/api/certs/server", `{"commonName": "web", "dnsNames": ["web.team-a.home.lab"], "ipAddresses": ["10.0.0.1"]}`, http.StatusForbidden},
+		{"other profile", "/api/certs/client", `{"commonName": "bot", "dnsNames": ["bot.team-a.home.lab"]}`, http.StatusForbidden},
+	}
+	var serial string
+	for _, tc := range cases {
+		w := send(http.MethodPost, tc.target, teamA, tc.body)
+		if w.Code != tc.code {
+			t.Errorf("%s: expected %d, got %d: %s", tc.name, tc.code, w.Code, w.Body.String())
+			continue
+		}
+		if w.Code == http.StatusOK {
+			var resp struct {
+				CertPEM []byte `json:"certPEM"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if block, _ := pem.Decode(resp.CertPEM); block != nil {
+				if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+					serial = cert.SerialNumber.String()
+				}
+			}
+		}
+	}
+	if serial == "" {
+		t.Fatal("No certificate was issued")
+	}
+
+	// renewing with revokeOld revokes the original, which an issuer alone may not do
+	if w := send(http.MethodPost, "/api/certs/"+serial+"/renew", teamA, `{"revokeOld": true}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a renewal revoking the original by an issuer, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := send(http.MethodPost, "/api/certs/"+serial+"/renew", teamA, `{"revokeOld": true, "graceHours": 1}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a renewal scheduling the revocation by an issuer, got %d: %s", w.Code, w.Body.String())
+	}
+	if old, _ := store.GetCert(context.Background(), serial); old.RenewedBy != "" || old.RevokeAt != nil {
+		t.Errorf("Expected a refused renewal to leave the original alone, got %+v", old)
+	}
+
+	// team-b may only revoke under its own suffix, the admin token revokes anything
+	if w := send(http.MethodPost, "/api/certs/"+serial+"/revoke", teamB, `{"reason": 1}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a revocation outside the binding, got %d", w.Code)
+	}
+	if w := send(http.MethodPost, "/api/certs/"+serial+"/revoke", teamA, `{"reason": 1}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a revocation by an issuer, got %d", w.Code)
+	}
+	if w := send(http.MethodPost, "/api/certs/"+serial+"/revoke", "admin-secret", `{"reason": 1}`); w.Code != http.StatusOK {
+		t.Errorf("Expected the admin to revoke, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// role bindings are managed by admins only
+	if w := send(http.MethodPut, "/api/users/team-a", teamA, `{"roles": ["admin"]}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a user granting itself admin, got %d", w.Code)
+	}
+
+	// every issuance attempt is audited with its caller and result, rejected requests too
+	issued, err := auditLog.Query(models.AuditFilter{Action: "cert.issue"})
+	if err != nil {
+		t.Fatalf("Failed to query audit log: %v", err)
+	}
+	if len(issued) != len(cases) {
+		t.Fatalf("Expected %d cert.issue records, got %d", len(cases), len(issued))
+	}
+	if first := issued[len(issued)-1]; first.Actor != "team-a" || first.Result != models.AuditSuccess || first.Details["serialNumber"] != serial {
+		t.Errorf("Unexpected record of the first issuance: %+v", first)
+	}
+	if denied, _ := auditLog.Query(models.AuditFilter{Action: "auth.failure"}); len(denied) != 1 || denied[0].Actor != "anonymous" {
+		t.Errorf("Expected the anonymous listing as the only auth failure, got %d", len(denied))
+	}
+	if denied, _ := auditLog.Query(models.AuditFilter{Action: "ca.", Result: models.AuditDenied}); len(denied) != 1 {
+		t.Errorf("Expected the CA creation by an issuer to be recorded as denied, got %d", len(denied))
+	}
+	if _, err := auditLog.Verify(); err != nil {
+		t.Errorf("Audit chain does not verify: %v", err)
+	}
+}
+
+func TestCertRoutesClientCertUser(t *testing.T) {
+	store, send := newUserRoutesEnv(t)
+	carol := newAPIKeyUser(t, store, "carol", models.RoleBinding{Role: models.RoleIssuer, Profiles: []string{"user"}, Domains: []string{"home.lab"}})
+	newAPIKeyUser(t, store, "dave")
+	if err := store.CreateProfile(context.Background(), &models.Profile{
+		Name:             "user",
+		KeyUsages:        []string{"digitalSignature"},
+		ExtKeyUsages:     []string{"clientAuth"},
+		DefaultValidDays: 30,
+		MaxValidDays:     30,
+		// common names are checked as DNS names
+		AllowedDNSNames: []string{"*"},
+		AllowedEmails:   []string{"*@home.lab"},
+	}); err != nil {
+		t.Fatalf("Failed to create profile: %v", err)
+	}
+
+	cases := []struct {
+		name, token, body string
+		code              int
+		user              string
+	}{
+		{"own ID", carol, `{"profile": "user", "commonName": "carol"}`, http.StatusOK, "carol"},
+		{"own email", carol, `{"profile": "user", "commonName": "laptop.home.lab", "emailAddresses": ["carol@home.lab"]}`, http.StatusOK, "carol"},
+		{"no user", carol, `{"profile": "user", "commonName": "bot.home.lab"}`, http.StatusOK, ""},
+		{"common name outside the binding", carol, `{"profile": "user", "commonName": "build-bot"}`, http.StatusForbidden, ""},
+		{"other ID", carol, `{"profile": "user", "commonName": "dave"}`, http.StatusForbidden, ""},
+		{"other email", carol, `{"profile": "user", "commonName": "laptop", "emailAddresses": ["DAVE@home.lab"]}`, http.StatusForbidden, ""},
+		{"two users", "admin-secret", `{"profile": "user", "commonName": "carol", "emailAddresses": ["dave@home.lab"]}`, http.StatusBadRequest, ""},
+		{"admin for another user", "admin-secret", `{"profile": "user", "commonName": "dave"}`, http.StatusOK, "dave"},
+	}
+	for _, tc := range cases {
+		w := send(http.MethodPost, "/api/certs/issue", tc.body, "Authorization", "Bearer "+tc.token)
+		if w.Code != tc.code {
+			t.Errorf("%s: expected %d, got %d: %s", tc.name, tc.code, w.Code, w.Body.String())
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var resp struct {
+			CertPEM []byte `json:"certPEM"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		block, _ := pem.Decode(resp.CertPEM)
+		if block == nil {
+			t.Fatalf("%s: no certificate in the response", tc.name)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf("%s: failed to parse certificate: %v", tc.name, err)
+		}
+		record, err := store.GetCert(context.Background(), cert.SerialNumber.String())
+		if err != nil {
+			t.Fatalf("%s: certificate was not recorded: %v", tc.name, err)
+		}
+		if record.UserID != tc.user {
+			t.Errorf("%s: expected the certificate to be bound to %q, got %q", tc.name, tc.user, record.UserID)
+		}
+		if want := map[bool]string{true: "admin", false: "carol"}[tc.token == "admin-secret"]; record.IssuedBy != want {
+			t.Errorf("%s: expected the certificate to be issued by %q, got %q", tc.name, want, record.IssuedBy)
+		}
+	}
+}
+
+func TestCertRoutesSignCSRPolicy(t *testing.T) {
+	t.Setenv("CSR_ALLOWED_DOMAINS", "home.lab")
+	t.Setenv("CSR_ALLOW_IP_ADDRESSES", "false")
+	_, send := newUserRoutesEnv(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	newCSR := func(tmpl *x509.CertificateRequest) string {
+		der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+		if err != nil {
+			t.Fatalf("Failed to create CSR: %v", err)
+		}
+		return strings.ReplaceAll(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), "\n", `\n`)
+	}
+
+	// the profile path runs the same CSR policy as the path without a profile
+	cases := []struct {
+		name string
+		csr  *x509.CertificateRequest
+		code int
+	}{
+		{"allowed", &x509.CertificateRequest{Subject: pkix.Name{CommonName: "www.home.lab"}, DNSNames: []string{"www.home.lab"}}, http.StatusOK},
+		{"IP SAN", &x509.CertificateRequest{DNSNames: []string{"www.home.lab"}, IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}}, http.StatusBadRequest},
+		{"common name outside domains", &x509.CertificateRequest{Subject: pkix.Name{CommonName: "www.example.org"}, DNSNames: []string{"www.home.lab"}}, http.StatusBadRequest},
+		{"IP common name", &x509.CertificateRequest{Subject: pkix.Name{CommonName: "10.0.0.1"}, DNSNames: []string{"www.home.lab"}}, http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		for _, profile := range []string{"", "server"} {
+			body := `{"csr": "` + newCSR(tc.csr) + `", "profile": "` + profile + `"}`
+			if w := send(http.MethodPost, "/api/certs/sign", body); w.Code != tc.code {
+				t.Errorf("%s with profile %q: expected %d, got %d: %s", tc.name, profile, tc.code, w.Code, w.Body.String())
+			}
+		}
+	}
+
+	// attributes outside the whitelist never reach the certificate
+	csr := newCSR(&x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "www.home.lab", Organization: []string{"Home"}, SerialNumber: "42", StreetAddress: []string{"Main Street 1"}},
+		DNSNames: []string{"www.home.lab"},
+	})
+	w := send(http.MethodPost, "/api/certs/sign", `{"csr": "`+csr+`", "profile": "server"}`)
+	var resp struct {
+		CertPEM []byte `json:"certPEM"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	block, _ := pem.Decode(resp.CertPEM)
+	if block == nil {
+		t.Fatalf("Failed to sign CSR: %d %s", w.Code, w.Body.String())
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	if subject := cert.Subject; subject.CommonName != "www.home.lab" || len(subject.Organization) != 1 || subject.SerialNumber != "" || len(subject.StreetAddress) != 0 {
+		t.Errorf("Expected only whitelisted subject attributes, got %v", subject)
+	}
+}
+
+func TestCertRoutesCreateCARecordsSaved(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	cfg := config.New()
+
+	// a file where the CA directory belongs makes every save fail
+	dir := t.TempDir()
+	casDir := filepath.Join(dir, "cas")
+	if err := os.WriteFile(casDir, nil, 0600); err != nil {
+		t.Fatalf("Failed to block the CA directory: %v", err)
+	}
+	caStore, err := models.NewFileCAStore(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"), casDir, nil, true)
+	if err != nil {
+		t.Fatalf("Failed to create CA store: %v", err)
+	}
+	store := models.NewMemoryStore()
+	auditLog, err := services.OpenAuditLog(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer auditLog.Close()
+	router := gin.New()
+	if err := SetupRoutes(router, cfg, store, caStore, services.FileKeyBackend{}, auditLog); err != nil {
+		t.Fatalf("Failed to set up routes: %v", err)
+	}
+
+	inventory := func() int {
+		isCA := true
+		certs, err := store.ListCerts(context.Background(), models.CertFilter{IsCA: &isCA})
+		if err != nil {
+			t.Fatalf("Failed to list certificates: %v", err)
+		}
+		return certs.Total
+	}
+	create := func(query string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/certs/ca"+query, nil)
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := create("?persist=true"); code != http.StatusInternalServerError {
+		t.Fatalf("Expected the save to fail, got %d", code)
+	}
+	if n := inventory(); n != 0 {
+		t.Errorf("Expected a CA that was not saved to stay out of the inventory, got %d", n)
+	}
+	// a CA handed to the caller is recorded
+	if code := create(""); code != http.StatusOK {
+		t.Fatalf("Expected a CA for the caller, got %d", code)
+	}
+	if n := inventory(); n != 1 {
+		t.Errorf("Expected the CA handed out in the inventory, got %d", n)
+	}
+
+	// neither does an intermediate CA that was not saved
+	root, _ := newTestCA(t)
+	router = gin.New()
+	if err := SetupRoutes(router, cfg, store, failingSaveCAStore{root}, services.FileKeyBackend{}, auditLog); err != nil {
+		t.Fatalf("Failed to set up routes: %v", err)
+	}
+	if code := create("/intermediate"); code != http.StatusInternalServerError {
+		t.Fatalf("Expected the save of the intermediate CA to fail, got %d", code)
+	}
+	if n := inventory(); n != 1 {
+		t.Errorf("Expected an intermediate CA that was not saved to stay out of the inventory, got %d", n-1)
+	}
+}
+
+// failingSaveCAStore fails every save to the CA store it wraps
+type failingSaveCAStore struct {
+	models.CAStore
+}
+
+func (s failingSaveCAStore) Save(*models.CA, bool) error {
+	return errors.New("disk full")
+}
+
+func TestCertRoutesExport(t *testing.T) {
+	store, send := newUserRoutesEnv(t)
+	const request = `"commonName": "web.home.lab", "dnsNames": ["web.home.lab"]`
+
+	// checkPEM expects the leaf, the CA and the key, in that order
+	checkPEM := func(t *testing.T, data []byte) {
+		var types []string
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			types = append(types, block.Type)
+		}
+		if strings.Join(types, ",") != "CERTIFICATE,CERTIFICATE,PRIVATE KEY" {
+			t.Errorf("Expected leaf, CA and key, got %v", types)
+		}
+	}
+	checkP12 := func(password string) func(t *testing.T, data []byte) {
+		return func(t *testing.T, data []byte) {
+			key, cert, caCerts, err := pkcs12.DecodeChain(data, password)
+			if err != nil {
+				t.Fatalf("Failed to decode PKCS#12: %v", err)
+			}
+			signer, ok := key.(crypto.Signer)
+			if !ok || !utils.PublicKeysEqual(signer.Public(), cert.PublicKey) {
+				t.Error("Expected the key of the certificate")
+			}
+			if cert.Subject.CommonName != "web.home.lab" || len(caCerts) != 1 || caCerts[0].Subject.CommonName != "Test CA" {
+				t.Errorf("Expected the leaf with its CA, got %s and %d CA certificates", cert.Subject.CommonName, len(caCerts))
+			}
+			if _, _, _, err := pkcs12.DecodeChain(data, "wrong"); err == nil {
+				t.Error("Expected a wrong password to be refused")
+			}
+		}
+	}
+	checkArchive := func(t *testing.T, files map[string][]byte) {
+		if len(files) != 3 || files["cert.pem"] == nil || files["ca.pem"] == nil || files["key.pem"] == nil {
+			t.Errorf("Expected cert.pem, ca.pem and key.pem, got %d files", len(files))
+		}
+	}
+
+	cases := []struct {
+		name        string
+		query       string
+		body        string
+		accept      string
+		code        int
+		contentType string
+		check       func(t *testing.T, data []byte)
+	}{
+		{"json by default", "", `{` + request + `}`, "", http.StatusOK, "application/json", func(t *testing.T, data []byte) {
+			var resp struct {
+				CertPEM, ChainPEM, KeyPEM []byte
+			}
+			if err := json.Unmarshal(data, &resp); err != nil || resp.CertPEM == nil || resp.ChainPEM == nil || resp.KeyPEM == nil {
+				t.Errorf("Expected certPEM, chainPEM and keyPEM, got %s", data)
+			}
+		}},
+		{"pem", "?format=pem", `{` + request + `}`, "", http.StatusOK, "application/x-pem-file", checkPEM},
+		{"pem by Accept", "", `{` + request + `}`, "text/html, application/x-pem-file", http.StatusOK, "application/x-pem-file", checkPEM},
+		{"p12", "", `{` + request + `, "format": "p12", "password": "changeit"}`, "", http.StatusOK, "application/x-pkcs12", checkP12("changeit")},
+		{"p12 by Accept", "", `{` + request + `, "password": "changeit"}`, "application/x-pkcs12", http.StatusOK, "application/x-pkcs12", checkP12("changeit")},
+		{"legacy p12", "?format=p12&p12Encryption=legacy", `{` + request + `, "password": "changeit"}`, "", http.StatusOK, "application/x-pkcs12", checkP12("changeit")},
+		{"tar", "?format=tar", `{` + request + `}`, "", http.StatusOK, "application/x-tar", func(t *testing.T, data []byte) {
+			files := make(map[string][]byte)
+			tr := tar.NewReader(bytes.NewReader(data))
+			for hdr, err := tr.Next(); err == nil; hdr, err = tr.Next() {
+				files[hdr.Name], _ = io.ReadAll(tr)
+				if hdr.Name == "key.pem" && hdr.Mode != 0600 {
+					t.Errorf("Expected key.pem readable by its owner only, got %o", hdr.Mode)
+				}
+			}
+			checkArchive(t, files)
+		}},
+		{"zip", "?format=zip", `{` + request + `}`, "", http.StatusOK, "application/zip", func(t *testing.T, data []byte) {
+			zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Fatalf("Failed to read zip: %v", err)
+			}
+			files := make(map[string][]byte)
+			for _, f := range zr.File {
+				r, _ := f.Open()
+				files[f.Name], _ = io.ReadAll(r)
+				r.Close()
+			}
+			checkArchive(t, files)
+		}},
+		{"p12 without password", "?format=p12", `{` + request + `}`, "", http.StatusBadRequest, "", nil},
+		// the generated key would be lost
+		{"der", "", `{` + request + `, "format": "der"}`, "", http.StatusBadRequest, "", nil},
+		{"trust store", "?format=truststore", `{` + request + `, "password": "changeit"}`, "", http.StatusBadRequest, "", nil},
+		{"unknown format", "?format=jks", `{` + request + `}`, "", http.StatusBadRequest, "", nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			before, _ := store.ListCerts(context.Background(), models.CertFilter{})
+			headers := []string{}
+			if tc.accept != "" {
+				headers = append(headers, "Accept", tc.accept)
+			}
+			w := send(http.MethodPost, "/api/certs/server"+tc.query, tc.body, headers...)
+			if w.Code != tc.code {
+				t.Fatalf("Expected %d, got %d: %s", tc.code, w.Code, w.Body.String())
+			}
+			if tc.check == nil {
+				// the format is checked before anything is issued
+				if after, _ := store.ListCerts(context.Background(), models.CertFilter{}); after.Total != before.Total {
+					t.Errorf("Expected nothing issued for a refused format, got %d new certificates", after.Total-before.Total)
+				}
+				return
+			}
+			if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, tc.contentType) {
+				t.Errorf("Expected content type %s, got %s", tc.contentType, contentType)
+			}
+			tc.check(t, w.Body.Bytes())
+		})
+	}
+
+	// the key of a CSR stays with the caller, there is nothing to bundle
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{"web.home.lab"}}, key)
+	if err != nil {
+		t.Fatalf("Failed to create CSR: %v", err)
+	}
+	csr := strings.ReplaceAll(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), "\n", `\n`)
+	if w := send(http.MethodPost, "/api/certs/sign", `{"csr": "`+csr+`", "format": "p12", "password": "changeit"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a PKCS#12 of a CSR, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := send(http.MethodPost, "/api/certs/sign", `{"csr": "`+csr+`", "format": "pem"}`); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "PRIVATE KEY") {
+		t.Errorf("Expected a PEM bundle without a key for a CSR, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := send(http.MethodPost, "/api/certs/sign", `{"csr": "`+csr+`", "format": "der"}`); w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/pkix-cert" {
+		t.Errorf("Expected the DER leaf for a CSR, got %d: %s", w.Code, w.Body.String())
+	} else if cert, err := x509.ParseCertificate(w.Body.Bytes()); err != nil || !utils.PublicKeysEqual(cert.PublicKey, key.Public()) {
+		t.Errorf("Expected the DER leaf of the CSR key, got %v", err)
+	}
+	if w := send(http.MethodPost, "/api/certs/sign?format=truststore", `{"csr": "`+csr+`", "password": "changeit"}`); w.Code != http.StatusOK {
+		t.Errorf("Expected a trust store for a CSR, got %d: %s", w.Code, w.Body.String())
+	} else if certs, err := pkcs12.DecodeTrustStore(w.Body.Bytes(), "changeit"); err != nil || len(certs) != 1 || certs[0].Subject.CommonName != "Test CA" {
+		t.Errorf("Expected a trust store holding the CA, got %d certificates, %v", len(certs), err)
+	}
+}
+
+func TestCertRoutesRenew(t *testing.T) {
+	store, send := newUserRoutesEnv(t)
+	ctx := context.Background()
+
+	// issue returns a fresh server certificate from the API
+	issue := func(t *testing.T) *x509.Certificate {
+		t.Helper()
+		w := send(http.MethodPost, "/api/certs/server", `{"commonName": "web.home.lab", "dnsNames": ["web.home.lab", "api.home.lab"]}`)
+		var resp struct {
+			CertPEM []byte `json:"certPEM"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		block, _ := pem.Decode(resp.CertPEM)
+		if block == nil {
+			t.Fatalf("Failed to issue: %d %s", w.Code, w.Body.String())
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf("Failed to parse certificate: %v", err)
+		}
+		return cert
+	}
+
+	cases := []struct {
+		name  string
+		body  string
+		code  int
+		rekey bool
+		// revoked tells whether the original is revoked right away, revokeAt when it is scheduled
+		revoked  bool
+		revokeAt time.Duration
+	}{
+		{"same key", `{}`, http.StatusOK, false, false, 0},
+		{"rekey", `{"rekey": true, "key": {"algorithm": "ecdsa", "curve": "P384"}}`, http.StatusOK, true, false, 0},
+		{"revoke right away", `{"revokeOld": true}`, http.StatusOK, false, true, 0},
+		{"revoke after grace", `{"revokeOld": true, "graceHours": 24}`, http.StatusOK, false, false, 24 * time.Hour},
+		{"grace without revokeOld", `{"graceHours": 24}`, http.StatusBadRequest, false, false, 0},
+		{"negative grace", `{"revokeOld": true, "graceHours": -1}`, http.StatusBadRequest, false, false, 0},
+		{"key without rekey", `{"key": {"algorithm": "ed25519"}}`, http.StatusBadRequest, false, false, 0},
+		{"unknown profile", `{"profile": "nope"}`, http.StatusBadRequest, false, false, 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			original := issue(t)
+			serial := original.SerialNumber.String()
+			w := send(http.MethodPost, "/api/certs/"+serial+"/renew", tc.body)
+			if w.Code != tc.code {
+				t.Fatalf("Expected %d, got %d: %s", tc.code, w.Code, w.Body.String())
+			}
+			old, err := store.GetCert(ctx, serial)
+			if err != nil {
+				t.Fatalf("Failed to get the original: %v", err)
+			}
+			if tc.code != http.StatusOK {
+				if old.RenewedBy != "" || old.IsRevoked() {
+					t.Errorf("Expected a refused renewal to leave the original alone, got %+v", old)
+				}
+				return
+			}
+
+			var resp struct {
+				CertPEM      []byte `json:"certPEM"`
+				KeyPEM       []byte `json:"keyPEM"`
+				SerialNumber string `json:"serialNumber"`
+				RenewedFrom  string `json:"renewedFrom"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			block, _ := pem.Decode(resp.CertPEM)
+			if block == nil {
+				t.Fatal("Expected the renewed certificate")
+			}
+			renewed, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				t.Fatalf("Failed to parse certificate: %v", err)
+			}
+			if resp.RenewedFrom != serial || resp.SerialNumber != renewed.SerialNumber.String() || old.RenewedBy != resp.SerialNumber {
+				t.Errorf("Expected %s linked to %s, got %s from %s, renewed by %s", resp.SerialNumber, serial, resp.SerialNumber, resp.RenewedFrom, old.RenewedBy)
+			}
+			if renewed.Subject.CommonName != original.Subject.CommonName || strings.Join(renewed.DNSNames, ",") != strings.Join(original.DNSNames, ",") {
+				t.Errorf("Expected the subject and SANs of the original, got %s %v", renewed.Subject.CommonName, renewed.DNSNames)
+			}
+			if record, err := store.GetCert(ctx, resp.SerialNumber); err != nil || record.RenewedFrom != serial || record.Profile != "server" {
+				t.Errorf("Expected the renewal recorded with its origin and profile, got %+v, %v", record, err)
+			}
+			if sameKey := utils.PublicKeysEqual(renewed.PublicKey, original.PublicKey); sameKey == tc.rekey || (resp.KeyPEM != nil) != tc.rekey {
+				t.Errorf("Expected rekey %v, got the same key %v and a key in the response %v", tc.rekey, sameKey, resp.KeyPEM != nil)
+			}
+			if old.IsRevoked() != tc.revoked || (tc.revoked && old.RevocationCode != services.ReasonSuperseded) {
+				t.Errorf("Expected the original revoked %v as superseded, got %+v", tc.revoked, old)
+			}
+			switch {
+			case tc.revokeAt == 0 && old.RevokeAt != nil:
+				t.Errorf("Expected no scheduled revocation, got %v", old.RevokeAt)
+			case tc.revokeAt != 0 && (old.RevokeAt == nil || time.Until(*old.RevokeAt) < tc.revokeAt-time.Minute || time.Until(*old.RevokeAt) > tc.revokeAt):
+				t.Errorf("Expected the revocation scheduled in %v, got %v", tc.revokeAt, old.RevokeAt)
+			}
+
+			// a certificate is renewed once
+			if w := send(http.MethodPost, "/api/certs/"+serial+"/renew", `{}`); w.Code != http.StatusConflict {
+				t.Errorf("Expected 409 renewing twice, got %d", w.Code)
+			}
+		})
+	}
+
+	revoked := issue(t).SerialNumber.String()
+	if w := send(http.MethodPost, "/api/certs/"+revoked+"/revoke", `{"reason": 1}`); w.Code != http.StatusOK {
+		t.Fatalf("Failed to revoke: %d %s", w.Code, w.Body.String())
+	}
+	if w := send(http.MethodPost, "/api/certs/"+revoked+"/renew", `{}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 renewing a revoked certificate, got %d", w.Code)
+	}
+	if w := send(http.MethodPost, "/api/certs/12345/renew", `{}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 renewing an unknown certificate, got %d", w.Code)
+	}
+}
+
+func TestCertRoutesOCSPCacheControl(t *testing.T) {
+	_, send := newUserRoutesEnv(t)
+	w := send(http.MethodPost, "/api/certs/server", `{"commonName": "web.home.lab", "dnsNames": ["web.home.lab"]}`)
+	var resp struct {
+		CertPEM  []byte `json:"certPEM"`
+		ChainPEM []byte `json:"chainPEM"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to issue: %d %s", w.Code, w.Body.String())
+	}
+	leaf, err := models.ParseCertificate(resp.CertPEM)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	chain, err := utils.ParseCertsPEM(resp.ChainPEM)
+	if err != nil {
+		t.Fatalf("Failed to parse chain: %v", err)
+	}
+	certs := []*x509.Certificate{leaf.X509Certificate, chain[len(chain)-1]}
+	request := func(issuer *x509.Certificate) string {
+		req, err := ocsp.CreateRequest(certs[0], issuer, nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		return base64.StdEncoding.EncodeToString(req)
+	}
+
+	// only signed responses may be kept by HTTP caches
+	cases := []struct {
+		name      string
+		request   string
+		cacheable bool
+	}{
+		{"good", request(certs[1]), true},
+		{"unknown CA", request(certs[0]), false},
+		{"malformed", base64.StdEncoding.EncodeToString([]byte("not a request")), false},
+	}
+	for _, tc := range cases {
+		w := send(http.MethodGet, "/ocsp/"+tc.request, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", tc.name, w.Code)
+		}
+		if cacheable := w.Header().Get("Cache-Control") != ""; cacheable != tc.cacheable {
+			t.Errorf("%s: expected cacheable %v, got Cache-Control %q", tc.name, tc.cacheable, w.Header().Get("Cache-Control"))
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package routes
+
+import (
+	"context"
+
+	"ca-server/config"
+	"ca-server/controllers"
+	"ca-server/middleware"
+	"ca-server/models"
+	"ca-server/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetupProfileRoutes seeds the built-in issuance profiles and registers the profile routes
+func SetupProfileRoutes(router *gin.Engine, cfg *config.Config, store models.ProfileStore) error {
+	if err := services.SeedProfiles(context.Background(), store, cfg.MaxCertValidDays); err != nil {
+		return err
+	}
+
+	profileController := controllers.NewProfileController(store, cfg.MaxCertValidDays)
+
+	profileGroup := router.Group("/api/profiles")
+	profileGroup.Use(requireRole(cfg, models.RoleViewer))
+	{
+		profileGroup.GET("", profileController.ListProfiles)
+		profileGroup.GET("/:name", profileController.GetProfile)
+	}
+
+	// Changing profiles changes what the CA will sign, so it requires authentication and the admin role
+	protectedGroup := router.Group("/api/profiles")
+	protectedGroup.Use(middleware.AuthRequired(), requireRole(cfg, models.RoleAdmin))
+	{
+		protectedGroup.POST("", middleware.AuditAction("profile.create"), profileController.CreateProfile)
+		protectedGroup.PUT("/:name", middleware.AuditAction("profile.update"), profileController.UpdateProfile)
+		protectedGroup.DELETE("/:name", middleware.AuditAction("profile.delete"), profileController.DeleteProfile)
+	}
+
+	return nil
+}
@@ -1,13 +1,44 @@
 package routes
 
 import (
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"ca-server/config"
+	"ca-server/middleware"
 	"ca-server/models"
+	"ca-server/services"
+	"ca-server/utils"
 
 	"github.com/gin-gonic/gin"
 )
 
 // SetupRoutes configures all API routes
-func SetupRoutes(r *gin.Engine, store models.Store) {
+func SetupRoutes(r *gin.Engine, cfg *config.Config, store models.Store, caStore models.CAStore, keyBackend services.KeyBackend, auditLog *services.AuditLog) error {
+	// Audited operations and every rejected request are recorded, so this runs before authentication
+	r.Use(middleware.Audit(auditLog))
+
+	// Verified client certificates authenticate the request, roles are checked per route
+	certRoleRules, err := middleware.ParseCertRoleRules(cfg.MTLSRoleRules)
+	if err != nil {
+		return err
+	}
+	rulesCA, err := loadRoleRulesCA(cfg, caStore, certRoleRules)
+	if err != nil {
+		return err
+	}
+	r.Use(middleware.ClientCertAuth(store, caStore, certRoleRules, rulesCA))
+
+	// Otherwise bearer tokens do: the admin token, API keys and JWTs when configured
+	authenticator, err := newAuthenticator(cfg, store)
+	if err != nil {
+		return err
+	}
+	r.Use(middleware.TokenAuth(authenticator))
+
 	// Public routes
 	r.GET("/", HomeHandler)
 	r.GET("/health", HealthCheckHandler)
@@ -16,11 +47,94 @@ func SetupRoutes(r *gin.Engine, store models.Store) {
 	api := r.Group("/api")
 	{
 		api.GET("/ping", PingHandler)
+		api.GET("/whoami", WhoAmIHandler)
+	}
+
+	// The issuer and key policy are shared by every endpoint that signs certificates
+	issuer := services.NewIssuer(store, caStore, cfg.PublicURL)
+	keyPolicy, err := services.NewKeyPolicy(cfg.KeyAllowedSpecs, cfg.KeyDefaultSpec)
+	if err != nil {
+		return err
+	}
+
+	// Revocation is shared by the certificate routes and the user routes, disabling a user revokes its client certificates
+	crlService := services.NewCRLService(store, caStore, time.Duration(cfg.CRLValidityHours)*time.Hour)
+	ocspService, err := services.NewOCSPService(store, caStore, time.Duration(cfg.OCSPNextUpdateMinutes)*time.Minute, cfg.OCSPSignerCertPath, cfg.OCSPSignerKeyPath)
+	if err != nil {
+		return err
+	}
+	// Renewed certificates are revoked by a background sweep once their grace period ends
+	revoker := services.NewRevocationService(store, crlService, ocspService, auditLog)
+	revoker.Start(time.Minute)
+
+	verifier, err := services.NewUserVerifier(store, []byte(cfg.UserVerificationSecret), time.Duration(cfg.UserVerificationHours)*time.Hour)
+	if err != nil {
+		return err
 	}
 
 	// Setup feature-specific routes
-	SetupUserRoutes(r, store)
-	SetupCertRoutes(r, store)
+	SetupUserRoutes(r, cfg, store, services.NewUserLifecycle(store, revoker), verifier)
+	SetupAdminRoutes(r, cfg, store, caStore, auditLog)
+	if err := SetupProfileRoutes(r, cfg, store); err != nil {
+		return err
+	}
+	if cfg.ACMEEnabled {
+		if err := SetupACMERoutes(r, cfg, store, issuer, keyPolicy); err != nil {
+			return err
+		}
+	}
+	return SetupCertRoutes(r, cfg, store, caStore, issuer, keyPolicy, keyBackend, crlService, ocspService, revoker)
+}
+
+// newAuthenticator creates the bearer token authenticator, JWTs are accepted once a key source is configured
+func newAuthenticator(cfg *config.Config, store models.Store) (*services.Authenticator, error) {
+	var verifier *services.JWTVerifier
+	if cfg.JWTHMACSecret != "" || cfg.JWTJWKSURL != "" || cfg.JWTJWKSFile != "" {
+		var err error
+		verifier, err = services.NewJWTVerifier(services.JWTOptions{
+			HMACSecret: cfg.JWTHMACSecret,
+			JWKSURL:    cfg.JWTJWKSURL,
+			JWKSFile:   cfg.JWTJWKSFile,
+			Issuer:     cfg.JWTIssuer,
+			Audience:   cfg.JWTAudience,
+			Leeway:     time.Duration(cfg.JWTLeewaySeconds) * time.Second,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return services.NewAuthenticator(store, verifier, cfg.AdminToken), nil
+}
+
+// loadRoleRulesCA reads the CA whose client certificates the role rules apply to, it must not be one of
+// the CAs this server manages, where issuers choose the names the rules match
+func loadRoleRulesCA(cfg *config.Config, caStore models.CAStore, rules []middleware.CertRoleRule) (*x509.Certificate, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	if cfg.MTLSRoleRulesCACertPath == "" {
+		return nil, fmt.Errorf("MTLS_ROLE_RULES needs MTLS_ROLE_RULES_CA_CERT_PATH, the CA of the client certificates the rules apply to")
+	}
+	data, err := os.ReadFile(cfg.MTLSRoleRulesCACertPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the role rules CA: %w", err)
+	}
+	certs, err := utils.ParseCertsPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the role rules CA %s: %w", cfg.MTLSRoleRulesCACertPath, err)
+	}
+	if _, err := caStore.GetByID(hex.EncodeToString(certs[0].SubjectKeyId)); err == nil {
+		return nil, fmt.Errorf("the role rules CA %s is managed by this server, use a CA that only issues client certificates", cfg.MTLSRoleRulesCACertPath)
+	}
+	return certs[0], nil
+}
+
+// requireRole checks the principal's roles unless INSECURE_SKIP_AUTH turned them off
+func requireRole(cfg *config.Config, role models.Role) gin.HandlerFunc {
+	if !cfg.AuthRequired {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return middleware.RoleRequired(role)
 }
 
 // HomeHandler returns welcome message
@@ -43,3 +157,15 @@ func PingHandler(c *gin.Context) {
 		"message": "pong",
 	})
 }
+
+// WhoAmIHandler returns the principal of the request, 401 when it is not authenticated
+func WhoAmIHandler(c *gin.Context) {
+	principal, ok := middleware.GetPrincipal(c)
+	if !ok {
+		c.JSON(401, gin.H{
+			"error": "Unauthorized: not authenticated",
+		})
+		return
+	}
+	c.JSON(200, principal)
+}
@@ -1,30 +1,46 @@
 package routes
 
 import (
+	"ca-server/config"
 	"ca-server/controllers"
 	"ca-server/middleware"
 	"ca-server/models"
+	"ca-server/services"
 
 	"github.com/gin-gonic/gin"
 )
 
 // SetupUserRoutes registers all user-related routes
-func SetupUserRoutes(router *gin.Engine, store models.Store) {
-	userController := controllers.NewUserController(store)
+func SetupUserRoutes(router *gin.Engine, cfg *config.Config, store models.Store, lifecycle *services.UserLifecycle, verifier *services.UserVerifier) {
+	userController := controllers.NewUserController(store, lifecycle, verifier)
+	apiKeyController := controllers.NewAPIKeyController(store)
 
-	// Public user API endpoints
+	// Reading users takes the viewer role when roles are enforced
 	userGroup := router.Group("/api/users")
+	userGroup.Use(requireRole(cfg, models.RoleViewer))
 	{
 		userGroup.GET("", userController.ListUsers)
 		userGroup.GET("/:id", userController.GetUser)
 	}
 
+	// Pending users verify their email with the token sent to it, they have no credentials yet
+	router.POST("/api/users/verify", middleware.AuditAction("user.verify"), userController.VerifyUser)
+
 	// Protected user API endpoints - require authentication
 	protectedGroup := router.Group("/api/users")
 	protectedGroup.Use(middleware.AuthRequired())
 	{
-		protectedGroup.POST("", userController.CreateUser)
-		protectedGroup.PUT("/:id", userController.UpdateUser)
-		protectedGroup.DELETE("/:id", userController.DeleteUser)
+		// Users carry roles, so changing them always takes an admin, even with INSECURE_SKIP_AUTH
+		adminRole := middleware.RoleRequired(models.RoleAdmin)
+		protectedGroup.POST("", middleware.AuditAction("user.create"), adminRole, userController.CreateUser)
+		protectedGroup.PUT("/:id", middleware.AuditAction("user.update"), adminRole, userController.UpdateUser)
+		protectedGroup.PATCH("/:id", middleware.AuditAction("user.update"), adminRole, userController.PatchUser)
+		protectedGroup.DELETE("/:id", middleware.AuditAction("user.delete"), adminRole, userController.DeleteUser)
+		protectedGroup.POST("/:id/verification", middleware.AuditAction("user.verification"), adminRole, userController.IssueVerification)
+
+		// API keys, managed by their user or an admin
+		protectedGroup.POST("/:id/api-keys", middleware.AuditAction("apikey.create"), apiKeyController.CreateAPIKey)
+		protectedGroup.GET("/:id/api-keys", apiKeyController.ListAPIKeys)
+		protectedGroup.DELETE("/:id/api-keys/:keyId", middleware.AuditAction("apikey.revoke"), apiKeyController.RevokeAPIKey)
 	}
 }
@@ -0,0 +1,400 @@
+package routes
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ca-server/config"
+	"ca-server/models"
+	"ca-server/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// userRequest sends a request with the admin token, headers are name and value pairs
+type userRequest func(method, target, body string, headers ...string) *httptest.ResponseRecorder
+
+// newUserRoutesEnv sets up every route on a memory store, requests carry the admin token
+func newUserRoutesEnv(t *testing.T) (*models.MemoryStore, userRequest) {
+	t.Helper()
+	store := models.NewMemoryStore()
+	return store, newRoutesEnv(t, store)
+}
+
+// newRoutesEnv sets up every route on store, requests carry the admin token
+func newRoutesEnv(t *testing.T, store models.Store) userRequest {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	t.Setenv("ACME_ENABLED", "false")
+	cfg := config.New()
+
+	caStore, _ := newTestCA(t)
+	auditLog, err := services.OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	t.Cleanup(func() { auditLog.Close() })
+	router := gin.New()
+	if err := SetupRoutes(router, cfg, store, caStore, services.FileKeyBackend{}, auditLog); err != nil {
+		t.Fatalf("Failed to set up routes: %v", err)
+	}
+
+	return func(method, target, body string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+}
+
+// decodeUser decodes the user in a response
+func decodeUser(t *testing.T, w *httptest.ResponseRecorder) *models.User {
+	t.Helper()
+	user := &models.User{}
+	if err := json.Unmarshal(w.Body.Bytes(), user); err != nil {
+		t.Fatalf("Failed to decode user: %v", err)
+	}
+	return user
+}
+
+func TestUserRoutesVersioning(t *testing.T) {
+	store, send := newUserRoutesEnv(t)
+	w := send(http.MethodPost, "/api/users", `{"name": "Alice", "email": "alice@home.lab"}`)
+	if w.Code != http.StatusCreated || w.Header().Get("ETag") != `"1"` {
+		t.Fatalf("Expected 201 with ETag \"1\", got %d %q: %s", w.Code, w.Header().Get("ETag"), w.Body.String())
+	}
+	created := decodeUser(t, w)
+	if created.CreatedAt.IsZero() {
+		t.Error("Expected the store to set created_at")
+	}
+	alice := "/api/users/" + created.ID
+
+	if w := send(http.MethodGet, alice, "", "If-None-Match", `"1"`); w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for a current If-None-Match, got %d", w.Code)
+	}
+
+	// two clients read version 1, the second PUT finds it changed
+	w = send(http.MethodPut, alice, `{"name": "Alice Liddell", "email": "alice@home.lab"}`, "If-Match", `"1"`)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"2"` {
+		t.Fatalf("Expected 200 with ETag \"2\", got %d %q: %s", w.Code, w.Header().Get("ETag"), w.Body.String())
+	}
+	if updated := decodeUser(t, w); !updated.CreatedAt.Equal(created.CreatedAt) || !updated.UpdatedAt.After(created.UpdatedAt) {
+		t.Errorf("Expected the update to keep created_at and bump updated_at, got %+v", updated)
+	}
+	if w := send(http.MethodPut, alice, `{"name": "Other", "email": "alice@home.lab"}`, "If-Match", `"1"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a stale If-Match, got %d", w.Code)
+	}
+	if w := send(http.MethodPut, alice, `{"name": "Other", "email": "alice@home.lab", "version": 1}`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a stale version in the body, got %d", w.Code)
+	}
+
+	// merge patch: members absent from the patch stay, null removes them
+	w = send(http.MethodPatch, alice, `{"roles": ["viewer"]}`, "Content-Type", "application/merge-patch+json")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the patch to apply, got %d: %s", w.Code, w.Body.String())
+	}
+	if patched := decodeUser(t, w); patched.Name != "Alice Liddell" || len(patched.Roles) != 1 || patched.Version != 3 {
+		t.Errorf("Unexpected patched user %+v", patched)
+	}
+	w = send(http.MethodPatch, alice, `{"roles": null}`, "Content-Type", "application/merge-patch+json", "If-Match", `"3"`)
+	if w.Code != http.StatusOK || len(decodeUser(t, w).Roles) != 0 {
+		t.Errorf("Expected null to remove the roles, got %d: %s", w.Code, w.Body.String())
+	}
+
+	cases := []struct {
+		name, body, contentType, ifMatch string
+		code                             int
+	}{
+		{"stale If-Match", `{"name": "Other"}`, "application/merge-patch+json", `"3"`, http.StatusPreconditionFailed},
+		{"changed id", `{"id": "bob"}`, "application/merge-patch+json", "", http.StatusBadRequest},
+		{"unknown role", `{"roles": ["owner"]}`, "application/merge-patch+json", "", http.StatusBadRequest},
+		{"wrong type", `{"name": 42}`, "application/merge-patch+json", "", http.StatusBadRequest},
+		{"JSON Patch", `[{"op": "remove", "path": "/roles"}]`, "application/json-patch+json", "", http.StatusUnsupportedMediaType},
+	}
+	for _, tc := range cases {
+		headers := []string{"Content-Type", tc.contentType}
+		if tc.ifMatch != "" {
+			headers = append(headers, "If-Match", tc.ifMatch)
+		}
+		if w := send(http.MethodPatch, alice, tc.body, headers...); w.Code != tc.code {
+			t.Errorf("%s: expected %d, got %d: %s", tc.name, tc.code, w.Code, w.Body.String())
+		}
+	}
+	if w := send(http.MethodPatch, "/api/users/nobody", `{"name": "Nobody"}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 patching a missing user, got %d", w.Code)
+	}
+
+	if got, _ := store.GetUser(context.Background(), created.ID); got.Name != "Alice Liddell" || got.Version != 4 {
+		t.Errorf("Expected the refused requests to leave version 4, got %+v", got)
+	}
+}
+
+func TestUserRoutesLifecycle(t *testing.T) {
+	_, send := newUserRoutesEnv(t)
+
+	cases := []struct {
+		name, body string
+		code       int
+	}{
+		{"empty name", `{"name": " ", "email": "bob@home.lab"}`, http.StatusBadRequest},
+		{"invalid email", `{"name": "Bob", "email": "Bob <bob@home.lab>"}`, http.StatusBadRequest},
+		{"client ID", `{"id": "bob", "name": "Bob", "email": "bob@home.lab"}`, http.StatusBadRequest},
+		{"unknown member", `{"name": "Bob", "email": "bob@home.lab", "admin": true}`, http.StatusBadRequest},
+		{"unknown status", `{"name": "Bob", "email": "bob@home.lab", "status": "locked"}`, http.StatusBadRequest},
+		{"created disabled", `{"name": "Bob", "email": "bob@home.lab", "status": "disabled"}`, http.StatusBadRequest},
+		{"pending", `{"name": "Bob", "email": "bob@home.lab", "status": "Pending"}`, http.StatusCreated},
+		{"duplicate email", `{"name": "Robert", "email": "BOB@home.lab"}`, http.StatusConflict},
+	}
+	var bob *models.User
+	for _, tc := range cases {
+		w := send(http.MethodPost, "/api/users", tc.body)
+		if w.Code != tc.code {
+			t.Fatalf("%s: expected %d, got %d: %s", tc.name, tc.code, w.Code, w.Body.String())
+		}
+		if w.Code == http.StatusCreated {
+			bob = decodeUser(t, w)
+		}
+	}
+	if bob.Status != models.UserPending {
+		t.Fatalf("Expected bob to be pending, got %q", bob.Status)
+	}
+	target := "/api/users/" + bob.ID
+	patch := func(body string) *httptest.ResponseRecorder {
+		return send(http.MethodPatch, target, body, "Content-Type", "application/merge-patch+json")
+	}
+
+	w := send(http.MethodPost, target+"/api-keys", `{"name": "ci"}`)
+	var key struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &key); err != nil || key.Token == "" {
+		t.Fatalf("Failed to create API key: %d %s", w.Code, w.Body.String())
+	}
+	listCerts := func() int {
+		return send(http.MethodGet, "/api/certs", "", "Authorization", "Bearer "+key.Token).Code
+	}
+	if code := listCerts(); code != http.StatusUnauthorized {
+		t.Errorf("Expected the key of a pending user to be refused, got %d", code)
+	}
+	if w := patch(`{"status": "active", "roles": ["viewer"]}`); w.Code != http.StatusOK {
+		t.Fatalf("Failed to activate bob: %d %s", w.Code, w.Body.String())
+	}
+	if code := listCerts(); code != http.StatusOK {
+		t.Errorf("Expected the key of an active user to work, got %d", code)
+	}
+	if w := patch(`{"status": "pending"}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 moving an active user back to pending, got %d", w.Code)
+	}
+
+	// client certificates with bob's ID as common name are bob's, others stay valid
+	issue := func(commonName string) string {
+		w := send(http.MethodPost, "/api/certs/client", `{"commonName": "`+commonName+`"}`)
+		var resp struct {
+			CertPEM []byte `json:"certPEM"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		block, _ := pem.Decode(resp.CertPEM)
+		if block == nil {
+			t.Fatalf("Failed to issue client certificate: %d %s", w.Code, w.Body.String())
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf("Failed to parse client certificate: %v", err)
+		}
+		return cert.SerialNumber.String()
+	}
+	bobCert, otherCert := issue(bob.ID), issue("carol")
+
+	if w := patch(`{"status": "disabled"}`); w.Code != http.StatusOK {
+		t.Fatalf("Failed to disable bob: %d %s", w.Code, w.Body.String())
+	}
+	revoked := func(serial string) bool {
+		var cert models.Certificate
+		json.Unmarshal(send(http.MethodGet, "/api/certs/"+serial, "").Body.Bytes(), &cert)
+		return cert.IsRevoked()
+	}
+	if !revoked(bobCert) || revoked(otherCert) {
+		t.Errorf("Expected only bob's client certificate to be revoked, got %v and %v", revoked(bobCert), revoked(otherCert))
+	}
+	if code := listCerts(); code != http.StatusUnauthorized {
+		t.Errorf("Expected the key of a disabled user to be refused, got %d", code)
+	}
+
+	// enabling bob again leaves the revoked credentials revoked
+	if w := patch(`{"status": "active"}`); w.Code != http.StatusOK {
+		t.Fatalf("Failed to enable bob: %d %s", w.Code, w.Body.String())
+	}
+	if code := listCerts(); code != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked key to stay revoked, got %d", code)
+	}
+}
+
+func TestUserRoutesDeleteRevokes(t *testing.T) {
+	store, send := newUserRoutesEnv(t)
+	w := send(http.MethodPost, "/api/users", `{"name": "Dave", "email": "dave@home.lab", "roles": ["viewer"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to create dave: %d %s", w.Code, w.Body.String())
+	}
+	dave := decodeUser(t, w)
+
+	w = send(http.MethodPost, "/api/users/"+dave.ID+"/api-keys", `{"name": "ci"}`)
+	var key struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &key); err != nil || key.Token == "" {
+		t.Fatalf("Failed to create API key: %d %s", w.Code, w.Body.String())
+	}
+	w = send(http.MethodPost, "/api/certs/client", `{"commonName": "`+dave.ID+`"}`)
+	if w.Code != http.StatusOK && w.Code != http.StatusCreated {
+		t.Fatalf("Failed to issue client certificate: %d %s", w.Code, w.Body.String())
+	}
+
+	if w := send(http.MethodDelete, "/api/users/"+dave.ID, ""); w.Code != http.StatusOK {
+		t.Fatalf("Failed to delete dave: %d %s", w.Code, w.Body.String())
+	}
+	if w := send(http.MethodGet, "/api/certs", "", "Authorization", "Bearer "+key.Token); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the key of a deleted user to be refused, got %d", w.Code)
+	}
+	isCA := false
+	certs, err := store.ListCerts(context.Background(), models.CertFilter{IsCA: &isCA})
+	if err != nil {
+		t.Fatalf("Failed to list certificates: %v", err)
+	}
+	for _, cert := range certs.Items {
+		if cert.UserID == dave.ID && !cert.IsRevoked() {
+			t.Errorf("Expected the client certificate %s of a deleted user to be revoked", cert.SerialNumber)
+		}
+	}
+	if len(certs.Items) == 0 {
+		t.Error("Expected the client certificate in the inventory")
+	}
+	if w := send(http.MethodDelete, "/api/users/"+dave.ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 deleting a deleted user, got %d", w.Code)
+	}
+}
+
+// crlFailingStore fails to list revoked certificates, so no CRL can be published
+type crlFailingStore struct {
+	*models.MemoryStore
+}
+
+func (s crlFailingStore) ListRevoked(context.Context, string) ([]*models.Certificate, error) {
+	return nil, errors.New("database is locked")
+}
+
+func TestUserRoutesDisableCRLFailure(t *testing.T) {
+	store := crlFailingStore{models.NewMemoryStore()}
+	send := newRoutesEnv(t, store)
+	w := send(http.MethodPost, "/api/users", `{"name": "Erin", "email": "erin@home.lab", "roles": ["viewer"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to create erin: %d %s", w.Code, w.Body.String())
+	}
+	erin := decodeUser(t, w)
+	if w := send(http.MethodPost, "/api/certs/client", `{"commonName": "`+erin.ID+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("Failed to issue client certificate: %d %s", w.Code, w.Body.String())
+	}
+
+	// the certificate is revoked and the user disabled, only the CRL is not published
+	w = send(http.MethodPatch, "/api/users/"+erin.ID, `{"status": "disabled"}`, "Content-Type", "application/merge-patch+json")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 with a warning, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		models.User
+		Warning string `json:"warning"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Status != models.UserDisabled || !strings.Contains(resp.Warning, "CRL") {
+		t.Errorf("Expected the disabled user with a CRL warning, got %s", w.Body.String())
+	}
+	if w.Header().Get("ETag") == "" {
+		t.Error("Expected the ETag of the updated user")
+	}
+	isCA := false
+	certs, err := store.ListCerts(context.Background(), models.CertFilter{IsCA: &isCA})
+	if err != nil || len(certs.Items) != 1 || !certs.Items[0].IsRevoked() {
+		t.Errorf("Expected the client certificate revoked, got %+v, %v", certs, err)
+	}
+}
+
+func TestUserRoutesVerification(t *testing.T) {
+	_, send := newUserRoutesEnv(t)
+	create := func(body string) (*models.User, string) {
+		w := send(http.MethodPost, "/api/users", body)
+		var resp struct {
+			models.User
+			VerificationToken string `json:"verificationToken"`
+		}
+		if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &resp) != nil {
+			t.Fatalf("Failed to create user: %d %s", w.Code, w.Body.String())
+		}
+		return &resp.User, resp.VerificationToken
+	}
+	verify := func(token string) int {
+		// verifying takes no credentials
+		return send(http.MethodPost, "/api/users/verify", `{"token": "`+token+`"}`, "Authorization", "").Code
+	}
+
+	if _, token := create(`{"name": "Active", "email": "active@home.lab"}`); token != "" {
+		t.Errorf("Expected no verification token for an active user, got %q", token)
+	}
+	erin, token := create(`{"name": "Erin", "email": "erin@home.lab", "status": "pending"}`)
+	if token == "" {
+		t.Fatal("Expected a verification token for a pending user")
+	}
+	frank, frankToken := create(`{"name": "Frank", "email": "frank@home.lab", "status": "pending"}`)
+
+	// frank's email changes, the token sent to the old address no longer counts
+	if w := send(http.MethodPatch, "/api/users/"+frank.ID, `{"email": "frank@other.lab"}`, "Content-Type", "application/merge-patch+json"); w.Code != http.StatusOK {
+		t.Fatalf("Failed to change frank's email: %d %s", w.Code, w.Body.String())
+	}
+	cases := []struct {
+		name, token string
+		code        int
+	}{
+		{"malformed", "nonsense", http.StatusBadRequest},
+		{"forged", token + "A", http.StatusBadRequest},
+		{"other user", strings.Replace(token, erin.ID, frank.ID, 1), http.StatusBadRequest},
+		{"changed version and expiry", strings.Replace(token, ".", ".1", 2), http.StatusBadRequest},
+		{"email changed", frankToken, http.StatusBadRequest},
+		{"valid", token, http.StatusOK},
+		{"used", token, http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		if code := verify(tc.token); code != tc.code {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.code, code)
+		}
+	}
+	if w := send(http.MethodGet, "/api/users/"+erin.ID, ""); decodeUser(t, w).Status != models.UserActive {
+		t.Errorf("Expected erin to be active after verifying, got %s", w.Body.String())
+	}
+
+	// a new token for frank's new address, none for erin who is active now
+	w := send(http.MethodPost, "/api/users/"+frank.ID+"/verification", "")
+	var resp struct {
+		VerificationToken string `json:"verificationToken"`
+	}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &resp) != nil || verify(resp.VerificationToken) != http.StatusOK {
+		t.Errorf("Expected a new token to verify frank, got %d %s", w.Code, w.Body.String())
+	}
+	if w := send(http.MethodPost, "/api/users/"+erin.ID+"/verification", ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a token of an active user, got %d", w.Code)
+	}
+	if w := send(http.MethodPost, "/api/users/"+erin.ID+"/verification", "", "Authorization", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 asking for a token without credentials, got %d", w.Code)
+	}
+}
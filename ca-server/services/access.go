@@ -0,0 +1,80 @@
+package services
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"ca-server/models"
+)
+
+// ErrForbidden is returned when the caller's role bindings do not cover a certificate
+var ErrForbidden = errors.New("not permitted by your role bindings")
+
+// ErrOtherUser is returned when a caller without the admin role asks for a client certificate of another user
+var ErrOtherUser = errors.New("only admins can issue client certificates for another user")
+
+// ErrAmbiguousUser is returned for a client certificate naming more than one user
+var ErrAmbiguousUser = errors.New("certificate names more than one user")
+
+// CertScope describes cert, from profile and signed by caID, for checking role bindings.
+// The common name counts as a name, so domain bindings only cover a common name under their domains,
+// unless it is self, the ID of the caller when the certificate is bound to the caller.
+func CertScope(profile, caID string, cert *x509.Certificate, self string) models.AccessScope {
+	scope := models.AccessScope{
+		Profile: profile,
+		CAID:    caID,
+		HasIPs:  len(cert.IPAddresses) > 0,
+	}
+	scope.Names = append(scope.Names, cert.DNSNames...)
+	scope.Names = append(scope.Names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		scope.Names = append(scope.Names, uri.Hostname())
+	}
+	if cn := cert.Subject.CommonName; cn != "" && (self == "" || cn != self) {
+		scope.Names = append(scope.Names, cn)
+	}
+	return scope
+}
+
+// CertUser returns the user a client certificate template names, nil when it names none.
+// A certificate for clientAuth names the user whose email is one of its email SANs, or whose ID is its common name.
+// The user is recorded with the certificate, only then does the certificate authenticate as it.
+func CertUser(ctx context.Context, users models.UserStore, cert *x509.Certificate) (*models.User, error) {
+	if !hasExtKeyUsage(cert, x509.ExtKeyUsageClientAuth) {
+		return nil, nil
+	}
+
+	var named *models.User
+	name := func(user *models.User) error {
+		if named != nil && named.ID != user.ID {
+			return fmt.Errorf("%w: %s and %s", ErrAmbiguousUser, named.ID, user.ID)
+		}
+		named = user
+		return nil
+	}
+	for _, email := range cert.EmailAddresses {
+		page, err := users.ListUsers(ctx, models.UserFilter{Email: email, Limit: 1})
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Items) > 0 {
+			if err := name(page.Items[0]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if cn := cert.Subject.CommonName; cn != "" {
+		user, err := users.GetUser(ctx, cn)
+		if err != nil && !errors.Is(err, models.ErrNotFound) {
+			return nil, err
+		}
+		if user != nil {
+			if err := name(user); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return named, nil
+}
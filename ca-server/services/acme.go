@@ -0,0 +1,530 @@
+package services
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"ca-server/models"
+	"ca-server/utils"
+)
+
+const (
+	acmeOrderLifetime   = 7 * 24 * time.Hour
+	acmeAuthzLifetime   = 30 * 24 * time.Hour
+	acmeValidateTimeout = 30 * time.Second
+	acmeMaxIdentifiers  = 100
+)
+
+// ACME challenge types
+const (
+	ChallengeHTTP01 = "http-01"
+	ChallengeDNS01  = "dns-01"
+)
+
+// ACMEError is a problem reported to ACME clients (RFC 8555 section 6.7)
+type ACMEError struct {
+	Type   string
+	Detail string
+	Status int
+}
+
+// Error implements the error interface
+func (e *ACMEError) Error() string {
+	return e.Type + ": " + e.Detail
+}
+
+// Problem converts the error to a problem document
+func (e *ACMEError) Problem() *models.ACMEProblem {
+	return &models.ACMEProblem{
+		Type:   "urn:ietf:params:acme:error:" + e.Type,
+		Detail: e.Detail,
+		Status: e.Status,
+	}
+}
+
+// NewACMEError creates an ACME problem of the given type, e.g. "malformed" or "badNonce"
+func NewACMEError(typ string, status int, format string, args ...any) *ACMEError {
+	return &ACMEError{Type: typ, Detail: fmt.Sprintf(format, args...), Status: status}
+}
+
+// ACMEService implements the RFC 8555 order workflow on top of the Issuer
+type ACMEService struct {
+	store      models.ACMEStore
+	issuer     *Issuer
+	policy     CSRPolicy
+	validators map[string]ChallengeValidator
+	validDays  int
+	nonces     *NonceStore
+}
+
+// NewACMEService creates an ACME service. validators maps challenge types to the
+// validator used for them, only the types present are offered to clients.
+func NewACMEService(store models.ACMEStore, issuer *Issuer, policy CSRPolicy, validators map[string]ChallengeValidator, validDays int) *ACMEService {
+	return &ACMEService{
+		store:      store,
+		issuer:     issuer,
+		policy:     policy,
+		validators: validators,
+		validDays:  validDays,
+		nonces:     NewNonceStore(),
+	}
+}
+
+// Nonces returns the anti-replay nonce store
+func (s *ACMEService) Nonces() *NonceStore {
+	return s.nonces
+}
+
+// NewAccount registers the key, or returns the existing account for it.
+// The boolean result reports whether a new account was created.
+func (s *ACMEService) NewAccount(key json.RawMessage, contact []string, termsOfServiceAgreed, onlyReturnExisting bool) (*models.ACMEAccount, bool, error) {
+	thumbprint, err := JWKThumbprint(key)
+	if err != nil {
+		return nil, false, NewACMEError("badPublicKey", http.StatusBadRequest, "%v", err)
+	}
+
+	if account, err := s.store.GetAccountByThumbprint(thumbprint); err == nil {
+		return account, false, nil
+	}
+	if onlyReturnExisting {
+		return nil, false, NewACMEError("accountDoesNotExist", http.StatusBadRequest, "no account exists for this key")
+	}
+	if err := validateContact(contact); err != nil {
+		return nil, false, err
+	}
+
+	account := &models.ACMEAccount{
+		ID:                   utils.NewRandomID(),
+		Status:               models.ACMEStatusValid,
+		Contact:              contact,
+		TermsOfServiceAgreed: termsOfServiceAgreed,
+		Key:                  key,
+		KeyThumbprint:        thumbprint,
+		CreatedAt:            time.Now(),
+	}
+	if err := s.store.CreateAccount(account); err != nil {
+		return nil, false, err
+	}
+	return account, true, nil
+}
+
+// Account returns a valid account by ID
+func (s *ACMEService) Account(id string) (*models.ACMEAccount, error) {
+	account, err := s.store.GetAccount(id)
+	if err != nil {
+		return nil, NewACMEError("accountDoesNotExist", http.StatusBadRequest, "account %s does not exist", id)
+	}
+	if account.Status != models.ACMEStatusValid {
+		return nil, NewACMEError("unauthorized", http.StatusUnauthorized, "account is %s", account.Status)
+	}
+	return account, nil
+}
+
+// UpdateAccount replaces the contacts of an account or deactivates it
+func (s *ACMEService) UpdateAccount(account *models.ACMEAccount, contact []string, status string) (*models.ACMEAccount, error) {
+	if contact != nil {
+		if err := validateContact(contact); err != nil {
+			return nil, err
+		}
+		account.Contact = contact
+	}
+	switch status {
+	case "":
+	case models.ACMEStatusDeactivated:
+		account.Status = status
+	default:
+		return nil, NewACMEError("malformed", http.StatusBadRequest, "account status can only be set to deactivated")
+	}
+
+	if err := s.store.UpdateAccount(account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// NewOrder creates an order and one pending authorization per identifier
+func (s *ACMEService) NewOrder(account *models.ACMEAccount, identifiers []models.ACMEIdentifier, notBefore, notAfter time.Time) (*models.ACMEOrder, error) {
+	if len(identifiers) == 0 || len(identifiers) > acmeMaxIdentifiers {
+		return nil, NewACMEError("malformed", http.StatusBadRequest, "an order needs between 1 and %d identifiers", acmeMaxIdentifiers)
+	}
+	if !notBefore.IsZero() && !notAfter.IsZero() && !notAfter.After(notBefore) {
+		return nil, NewACMEError("malformed", http.StatusBadRequest, "notAfter must be after notBefore")
+	}
+	if !notAfter.IsZero() && notAfter.Sub(maxTime(notBefore, time.Now())) > time.Duration(s.validDays)*24*time.Hour {
+		return nil, NewACMEError("malformed", http.StatusBadRequest, "certificates may be valid for at most %d days", s.validDays)
+	}
+
+	seen := make(map[string]bool)
+	normalized := make([]models.ACMEIdentifier, 0, len(identifiers))
+	for _, identifier := range identifiers {
+		if identifier.Type != "dns" {
+			return nil, NewACMEError("unsupportedIdentifier", http.StatusBadRequest, "identifier type %q is not supported", identifier.Type)
+		}
+		value := strings.ToLower(strings.TrimSuffix(identifier.Value, "."))
+		if !utils.IsValidDNSName(value) {
+			return nil, NewACMEError("rejectedIdentifier", http.StatusBadRequest, "%q is not a valid DNS name", identifier.Value)
+		}
+		if !utils.DomainAllowed(value, s.policy.AllowedDomains) {
+			return nil, NewACMEError("rejectedIdentifier", http.StatusBadRequest, "%q is not allowed by policy", identifier.Value)
+		}
+		if !seen[value] {
+			seen[value] = true
+			normalized = append(normalized, models.ACMEIdentifier{Type: "dns", Value: value})
+		}
+	}
+
+	order := &models.ACMEOrder{
+		ID:          utils.NewRandomID(),
+		AccountID:   account.ID,
+		Status:      models.ACMEStatusPending,
+		Expires:     time.Now().Add(acmeOrderLifetime),
+		Identifiers: normalized,
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+	}
+	for _, identifier := range normalized {
+		authz, err := s.newAuthorization(account, identifier)
+		if err != nil {
+			return nil, err
+		}
+		order.AuthorizationIDs = append(order.AuthorizationIDs, authz.ID)
+	}
+
+	if err := s.store.CreateOrder(order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// newAuthorization creates an authorization with the challenges that can prove the identifier
+func (s *ACMEService) newAuthorization(account *models.ACMEAccount, identifier models.ACMEIdentifier) (*models.ACMEAuthorization, error) {
+	authz := &models.ACMEAuthorization{
+		ID:         utils.NewRandomID(),
+		AccountID:  account.ID,
+		Status:     models.ACMEStatusPending,
+		Expires:    time.Now().Add(acmeAuthzLifetime),
+		Identifier: identifier,
+	}
+
+	// wildcard names are authorized on the base domain and only through DNS
+	types := []string{ChallengeHTTP01, ChallengeDNS01}
+	if strings.HasPrefix(identifier.Value, "*.") {
+		authz.Identifier.Value = strings.TrimPrefix(identifier.Value, "*.")
+		authz.Wildcard = true
+		types = []string{ChallengeDNS01}
+	}
+
+	for _, typ := range types {
+		if _, ok := s.validators[typ]; !ok {
+			continue
+		}
+		challenge := &models.ACMEChallenge{
+			ID:              utils.NewRandomID(),
+			AuthorizationID: authz.ID,
+			Type:            typ,
+			Token:           utils.NewRandomID(),
+			Status:          models.ACMEStatusPending,
+		}
+		if err := s.store.CreateChallenge(challenge); err != nil {
+			return nil, err
+		}
+		authz.ChallengeIDs = append(authz.ChallengeIDs, challenge.ID)
+	}
+	if len(authz.ChallengeIDs) == 0 {
+		return nil, NewACMEError("rejectedIdentifier", http.StatusBadRequest, "no challenge type can validate %q", identifier.Value)
+	}
+
+	if err := s.store.CreateAuthorization(authz); err != nil {
+		return nil, err
+	}
+	return authz, nil
+}
+
+// Order returns an order owned by account with an up to date status
+func (s *ACMEService) Order(account *models.ACMEAccount, id string) (*models.ACMEOrder, error) {
+	order, err := s.store.GetOrder(id)
+	if err != nil || order.AccountID != account.ID {
+		return nil, NewACMEError("malformed", http.StatusNotFound, "order %s does not exist", id)
+	}
+
+	if err := s.refreshOrder(order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// Orders returns all orders of account
+func (s *ACMEService) Orders(account *models.ACMEAccount) ([]*models.ACMEOrder, error) {
+	return s.store.ListOrders(account.ID)
+}
+
+// refreshOrder derives the order status from its authorizations
+func (s *ACMEService) refreshOrder(order *models.ACMEOrder) error {
+	if order.Status != models.ACMEStatusPending && order.Status != models.ACMEStatusReady {
+		return nil
+	}
+
+	status := models.ACMEStatusReady
+	if time.Now().After(order.Expires) {
+		status = models.ACMEStatusInvalid
+	}
+	for _, id := range order.AuthorizationIDs {
+		if status == models.ACMEStatusInvalid {
+			break
+		}
+		authz, err := s.authorization(id)
+		if err != nil {
+			return err
+		}
+		switch authz.Status {
+		case models.ACMEStatusValid:
+		case models.ACMEStatusPending:
+			status = models.ACMEStatusPending
+		default:
+			status = models.ACMEStatusInvalid
+		}
+	}
+
+	if status != order.Status {
+		order.Status = status
+		return s.store.UpdateOrder(order)
+	}
+	return nil
+}
+
+// Authorization returns an authorization owned by account along with its challenges
+func (s *ACMEService) Authorization(account *models.ACMEAccount, id string) (*models.ACMEAuthorization, []*models.ACMEChallenge, error) {
+	authz, err := s.authorization(id)
+	if err != nil || authz.AccountID != account.ID {
+		return nil, nil, NewACMEError("malformed", http.StatusNotFound, "authorization %s does not exist", id)
+	}
+
+	challenges := make([]*models.ACMEChallenge, 0, len(authz.ChallengeIDs))
+	for _, challengeID := range authz.ChallengeIDs {
+		challenge, err := s.store.GetChallenge(challengeID)
+		if err != nil {
+			return nil, nil, err
+		}
+		challenges = append(challenges, challenge)
+	}
+	return authz, challenges, nil
+}
+
+// DeactivateAuthorization lets a client give up an authorization
+func (s *ACMEService) DeactivateAuthorization(account *models.ACMEAccount, id string) error {
+	authz, _, err := s.Authorization(account, id)
+	if err != nil {
+		return err
+	}
+	if authz.Status != models.ACMEStatusPending && authz.Status != models.ACMEStatusValid {
+		return NewACMEError("malformed", http.StatusBadRequest, "authorization is %s", authz.Status)
+	}
+
+	authz.Status = models.ACMEStatusDeactivated
+	return s.store.UpdateAuthorization(authz)
+}
+
+// authorization loads an authorization and expires it when its lifetime has passed
+func (s *ACMEService) authorization(id string) (*models.ACMEAuthorization, error) {
+	authz, err := s.store.GetAuthorization(id)
+	if err != nil {
+		return nil, err
+	}
+
+	expirable := authz.Status == models.ACMEStatusPending || authz.Status == models.ACMEStatusValid
+	if expirable && time.Now().After(authz.Expires) {
+		authz.Status = models.ACMEStatusExpired
+		if err := s.store.UpdateAuthorization(authz); err != nil {
+			return nil, err
+		}
+	}
+	return authz, nil
+}
+
+// Challenge returns a challenge owned by account together with its authorization
+func (s *ACMEService) Challenge(account *models.ACMEAccount, id string) (*models.ACMEChallenge, *models.ACMEAuthorization, error) {
+	challenge, err := s.store.GetChallenge(id)
+	if err != nil {
+		return nil, nil, NewACMEError("malformed", http.StatusNotFound, "challenge %s does not exist", id)
+	}
+	authz, err := s.authorization(challenge.AuthorizationID)
+	if err != nil || authz.AccountID != account.ID {
+		return nil, nil, NewACMEError("malformed", http.StatusNotFound, "challenge %s does not exist", id)
+	}
+	return challenge, authz, nil
+}
+
+// RespondChallenge starts validating a pending challenge in the background.
+// Clients poll the challenge or authorization for the outcome.
+func (s *ACMEService) RespondChallenge(account *models.ACMEAccount, id string) (*models.ACMEChallenge, *models.ACMEAuthorization, error) {
+	challenge, authz, err := s.Challenge(account, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if challenge.Status != models.ACMEStatusPending {
+		return challenge, authz, nil
+	}
+	if authz.Status != models.ACMEStatusPending {
+		return nil, nil, NewACMEError("malformed", http.StatusBadRequest, "authorization is %s", authz.Status)
+	}
+
+	challenge.Status = models.ACMEStatusProcessing
+	if err := s.store.UpdateChallenge(challenge); err != nil {
+		return nil, nil, err
+	}
+
+	go s.validate(*challenge, *authz, KeyAuthorization(challenge.Token, account.KeyThumbprint))
+	return challenge, authz, nil
+}
+
+// validate runs the challenge validator and records the outcome
+func (s *ACMEService) validate(challenge models.ACMEChallenge, authz models.ACMEAuthorization, keyAuthorization string) {
+	ctx, cancel := context.WithTimeout(context.Background(), acmeValidateTimeout)
+	defer cancel()
+
+	err := s.validators[challenge.Type].Validate(ctx, authz.Identifier.Value, challenge.Token, keyAuthorization)
+	if err != nil {
+		log.Printf("ACME %s validation of %s failed: %v", challenge.Type, authz.Identifier.Value, err)
+		challenge.Status = models.ACMEStatusInvalid
+		challenge.Error = NewACMEError("incorrectResponse", http.StatusForbidden, "%v", err).Problem()
+		authz.Status = models.ACMEStatusInvalid
+	} else {
+		now := time.Now()
+		challenge.Status = models.ACMEStatusValid
+		challenge.Validated = &now
+		authz.Status = models.ACMEStatusValid
+	}
+
+	if err := s.store.UpdateChallenge(&challenge); err != nil {
+		log.Printf("Failed to update ACME challenge %s: %v", challenge.ID, err)
+	}
+	if err := s.store.UpdateAuthorization(&authz); err != nil {
+		log.Printf("Failed to update ACME authorization %s: %v", authz.ID, err)
+	}
+}
+
+// Finalize issues the certificate of a ready order from the client's CSR
+func (s *ACMEService) Finalize(ctx context.Context, account *models.ACMEAccount, orderID string, csrDER []byte) (*models.ACMEOrder, error) {
+	order, err := s.Order(account, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if order.Status != models.ACMEStatusReady {
+		return nil, NewACMEError("orderNotReady", http.StatusForbidden, "order is %s", order.Status)
+	}
+
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, NewACMEError("badCSR", http.StatusBadRequest, "failed to parse csr: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, NewACMEError("badCSR", http.StatusBadRequest, "invalid csr signature: %v", err)
+	}
+	if err := s.policy.CheckPublicKey(csr.PublicKey); err != nil {
+		return nil, NewACMEError("badCSR", http.StatusBadRequest, "%v", err)
+	}
+	if len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return nil, NewACMEError("badCSR", http.StatusBadRequest, "csr may only contain DNS names")
+	}
+
+	// the CSR must ask for exactly the identifiers of the order
+	names := make([]string, 0, len(order.Identifiers))
+	for _, identifier := range order.Identifiers {
+		names = append(names, identifier.Value)
+	}
+	requested := make([]string, 0, len(csr.DNSNames)+1)
+	for _, name := range csr.DNSNames {
+		requested = append(requested, strings.ToLower(name))
+	}
+	if cn := strings.ToLower(csr.Subject.CommonName); cn != "" && !slices.Contains(requested, cn) {
+		requested = append(requested, cn)
+	}
+	slices.Sort(names)
+	slices.Sort(requested)
+	if !slices.Equal(names, slices.Compact(requested)) {
+		return nil, NewACMEError("badCSR", http.StatusBadRequest, "csr names do not match the order identifiers")
+	}
+
+	commonName := strings.ToLower(csr.Subject.CommonName)
+	if commonName == "" {
+		commonName = order.Identifiers[0].Value
+	}
+	notBefore := maxTime(order.NotBefore, time.Now())
+	notAfter := order.NotAfter
+	if notAfter.IsZero() {
+		notAfter = notBefore.Add(time.Duration(s.validDays) * 24 * time.Hour)
+	}
+
+	// only one of concurrent finalize requests gets to move the order on and issue
+	err = s.store.TransitionOrder(order.ID, models.ACMEStatusReady, models.ACMEStatusProcessing)
+	if errors.Is(err, models.ErrACMEOrderChanged) {
+		return nil, NewACMEError("orderNotReady", http.StatusForbidden, "order is already being finalized")
+	}
+	if err != nil {
+		return nil, err
+	}
+	order.Status = models.ACMEStatusProcessing
+
+	cert, chain, err := s.issuer.Sign(ctx, "", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:    names,
+	}, csr.PublicKey)
+	if err != nil {
+		// nothing was issued, the client may finalize again
+		if err := s.store.TransitionOrder(order.ID, models.ACMEStatusProcessing, models.ACMEStatusReady); err != nil {
+			log.Printf("Failed to reset ACME order %s: %v", order.ID, err)
+		}
+	}
+	if errors.Is(err, models.ErrCANotLoaded) || errors.Is(err, models.ErrCASealed) {
+		return nil, NewACMEError("serverInternal", http.StatusServiceUnavailable, "issuing CA is not available")
+	}
+	if errors.Is(err, ErrCAConstraint) {
+		return nil, NewACMEError("rejectedIdentifier", http.StatusBadRequest, "%v", err)
+	}
+	if err != nil {
+		return nil, NewACMEError("serverInternal", http.StatusInternalServerError, "%v", err)
+	}
+
+	order.Status = models.ACMEStatusValid
+	order.CertSerial = cert.SerialNumber.String()
+	order.CertChainPEM = utils.EncodeCertsPEM(append([]*x509.Certificate{cert}, chain...)...)
+	if err := s.store.UpdateOrder(order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// KeyAuthorization builds the key authorization of a challenge token (RFC 8555 section 8.1)
+func KeyAuthorization(token, thumbprint string) string {
+	return token + "." + thumbprint
+}
+
+// validateContact accepts mailto: contacts only
+func validateContact(contact []string) error {
+	for _, c := range contact {
+		if !strings.HasPrefix(c, "mailto:") || strings.Contains(c, ",") {
+			return NewACMEError("invalidContact", http.StatusBadRequest, "unsupported contact %q, use a single mailto: address", c)
+		}
+	}
+	return nil
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // registers SHA-384 and SHA-512 for ES384 and ES512
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// JWS is a flattened JSON web signature as sent by ACME clients (RFC 8555 section 6.2)
+type JWS struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// JWSHeader is the protected header of an ACME request
+type JWSHeader struct {
+	Alg   string          `json:"alg"`
+	Nonce string          `json:"nonce"`
+	URL   string          `json:"url"`
+	KID   string          `json:"kid,omitempty"`
+	JWK   json.RawMessage `json:"jwk,omitempty"`
+}
+
+// jwk holds the members of RSA, EC and OKP public keys
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// ParseJWS decodes a request body into the JWS, its protected header and payload
+func ParseJWS(body []byte) (*JWS, *JWSHeader, []byte, error) {
+	var jws JWS
+	if err := json.Unmarshal(body, &jws); err != nil {
+		return nil, nil, nil, fmt.Errorf("request is not a flattened JWS: %w", err)
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid protected header encoding: %w", err)
+	}
+	var header JWSHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid protected header: %w", err)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid payload encoding: %w", err)
+	}
+
+	return &jws, &header, payload, nil
+}
+
+// VerifyJWS checks the signature of jws against the public key
+func VerifyJWS(jws *JWS, alg string, pub crypto.PublicKey) error {
+	sig, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	signingInput := []byte(jws.Protected + "." + jws.Payload)
+
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return fmt.Errorf("algorithm %s does not match RSA key", alg)
+		}
+		digest := sha256.Sum256(signingInput)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+	case *ecdsa.PublicKey:
+		hash, size, err := ecdsaParams(alg, key.Curve)
+		if err != nil {
+			return err
+		}
+		if len(sig) != 2*size {
+			return errors.New("invalid ECDSA signature length")
+		}
+		h := hash.New()
+		h.Write(signingInput)
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, h.Sum(nil), r, s) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			return fmt.Errorf("algorithm %s does not match Ed25519 key", alg)
+		}
+		if !ed25519.Verify(key, signingInput, sig) {
+			return errors.New("invalid EdDSA signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+}
+
+// ecdsaParams returns the hash and coordinate size of a JWS ECDSA algorithm
+func ecdsaParams(alg string, curve elliptic.Curve) (crypto.Hash, int, error) {
+	switch {
+	case alg == "ES256" && curve == elliptic.P256():
+		return crypto.SHA256, 32, nil
+	case alg == "ES384" && curve == elliptic.P384():
+		return crypto.SHA384, 48, nil
+	case alg == "ES512" && curve == elliptic.P521():
+		return crypto.SHA512, 66, nil
+	}
+	return 0, 0, fmt.Errorf("algorithm %s does not match ECDSA key", alg)
+}
+
+// minAccountRSABits is the smallest RSA modulus accepted for an ACME account key
+const minAccountRSABits = 2048
+
+// CheckAccountKey refuses account keys too weak to guard the certificates of an ACME account
+func CheckAccountKey(pub crypto.PublicKey) error {
+	if key, ok := pub.(*rsa.PublicKey); ok && key.N.BitLen() < minAccountRSABits {
+		return fmt.Errorf("RSA account keys must be at least %d bits", minAccountRSABits)
+	}
+	return nil
+}
+
+// ParseJWK decodes an RSA, EC or Ed25519 public JSON web key
+func ParseJWK(raw json.RawMessage) (crypto.PublicKey, error) {
+	var key jwk
+	if err := json.Unmarshal(raw, &key); err != nil {
+		return nil, fmt.Errorf("invalid JWK: %w", err)
+	}
+
+	switch key.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", key.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(key.X)
+		y, errY := base64.RawURLEncoding.DecodeString(key.Y)
+		if errX != nil || errY != nil {
+			return nil, errors.New("invalid EC coordinates")
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return pub, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if key.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", key.Kty)
+	}
+}
+
+// JWKThumbprint computes the RFC 7638 SHA-256 thumbprint of a JSON web key
+func JWKThumbprint(raw json.RawMessage) (string, error) {
+	var key jwk
+	if err := json.Unmarshal(raw, &key); err != nil {
+		return "", fmt.Errorf("invalid JWK: %w", err)
+	}
+
+	// required members only, in lexicographic order
+	var canonical string
+	switch key.Kty {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, key.E, key.N)
+	case "EC":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, key.Crv, key.X, key.Y)
+	case "OKP":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, key.Crv, key.X)
+	default:
+		return "", fmt.Errorf("unsupported key type %q", key.Kty)
+	}
+
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
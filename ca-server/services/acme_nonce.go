@@ -0,0 +1,66 @@
+package services
+
+import (
+	"sync"
+	"time"
+
+	"ca-server/utils"
+)
+
+// nonceLifetime bounds how long an issued nonce can be redeemed
+const nonceLifetime = time.Hour
+
+// maxNonces caps the outstanding nonces, issuing past it retires the oldest
+const maxNonces = 10000
+
+// NonceStore issues single-use anti-replay nonces for ACME requests.
+// Nonces are kept in a ring in issue order, so issuing is constant time and
+// the store never holds more than its capacity.
+type NonceStore struct {
+	mutex  sync.Mutex
+	nonces map[string]time.Time
+	ring   []string
+	next   int
+}
+
+// NewNonceStore creates an empty nonce store holding at most maxNonces
+func NewNonceStore() *NonceStore {
+	return newNonceStore(maxNonces)
+}
+
+// newNonceStore creates an empty nonce store holding at most capacity nonces
+func newNonceStore(capacity int) *NonceStore {
+	return &NonceStore{
+		nonces: make(map[string]time.Time, capacity),
+		ring:   make([]string, capacity),
+	}
+}
+
+// New issues a fresh nonce, retiring the oldest one if the store is full.
+// A client holding a retired nonce gets badNonce and retries with a new one.
+func (s *NonceStore) New() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// the slot holds the oldest nonce, consumed ones are no longer in the map
+	delete(s.nonces, s.ring[s.next])
+
+	nonce := utils.NewRandomID()
+	s.nonces[nonce] = time.Now().Add(nonceLifetime)
+	s.ring[s.next] = nonce
+	s.next = (s.next + 1) % len(s.ring)
+	return nonce
+}
+
+// Consume redeems a nonce, it reports false if the nonce is unknown, used, retired or expired
+func (s *NonceStore) Consume(nonce string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	expires, ok := s.nonces[nonce]
+	if !ok {
+		return false
+	}
+	delete(s.nonces, nonce)
+	return time.Now().Before(expires)
+}
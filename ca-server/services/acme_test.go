@@ -0,0 +1,187 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ca-server/models"
+)
+
+func TestACMEFinalizeIssuesOnce(t *testing.T) {
+	ctx := context.Background()
+	caStore := newSnapshotCAStore(t, nil)
+	if err := caStore.Save(newBackendCA(t, FileKeyBackend{}, "ecdsa-P256"), true); err != nil {
+		t.Fatalf("Failed to save CA: %v", err)
+	}
+	store := models.NewMemoryStore()
+	issuer := NewIssuer(store, caStore, "http://localhost")
+	service := NewACMEService(store, issuer, CSRPolicy{AllowedDomains: []string{"example.com"}}, nil, 90)
+
+	account := &models.ACMEAccount{ID: "acct", Status: models.ACMEStatusValid}
+	authz := &models.ACMEAuthorization{ID: "authz", AccountID: "acct", Status: models.ACMEStatusValid, Expires: time.Now().Add(time.Hour),
+		Identifier: models.ACMEIdentifier{Type: "dns", Value: "www.example.com"}}
+	order := &models.ACMEOrder{ID: "order", AccountID: "acct", Status: models.ACMEStatusReady, Expires: time.Now().Add(time.Hour),
+		Identifiers: []models.ACMEIdentifier{authz.Identifier}, AuthorizationIDs: []string{"authz"}}
+	for _, err := range []error{store.CreateAccount(account), store.CreateAuthorization(authz), store.CreateOrder(order)} {
+		if err != nil {
+			t.Fatalf("Failed to create ACME object: %v", err)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "www.example.com"},
+		DNSNames: []string{"www.example.com"},
+	}, key)
+	if err != nil {
+		t.Fatalf("Failed to create CSR: %v", err)
+	}
+
+	// concurrent finalize requests race for the ready order, one of them issues
+	var wg sync.WaitGroup
+	results := make(chan error, 8)
+	for i := 0; i < cap(results); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := service.Finalize(ctx, account, order.ID, csr)
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	issued := 0
+	for err := range results {
+		if err == nil {
+			issued++
+		} else if acmeErr, ok := err.(*ACMEError); !ok || acmeErr.Type != "orderNotReady" {
+			t.Errorf("Expected orderNotReady for a losing request, got %v", err)
+		}
+	}
+	if issued != 1 {
+		t.Errorf("Expected exactly one finalize to succeed, got %d", issued)
+	}
+	if certs, _ := store.ListCerts(ctx, models.CertFilter{}); certs.Total != 1 {
+		t.Errorf("Expected one certificate in the inventory, got %d", certs.Total)
+	}
+	if got, _ := store.GetOrder(order.ID); got.Status != models.ACMEStatusValid || got.CertSerial == "" {
+		t.Errorf("Expected a valid order with its certificate, got %q", got.Status)
+	}
+}
+
+func TestNonceStoreBounded(t *testing.T) {
+	nonces := newNonceStore(3)
+	first, second := nonces.New(), nonces.New()
+	if !nonces.Consume(second) {
+		t.Fatal("Expected a fresh nonce to be accepted")
+	}
+	if nonces.Consume(second) {
+		t.Error("Expected a used nonce to be refused")
+	}
+
+	// two more nonces fill the ring and retire the first one
+	third, fourth := nonces.New(), nonces.New()
+	if len(nonces.nonces) > 3 {
+		t.Errorf("Expected at most 3 outstanding nonces, got %d", len(nonces.nonces))
+	}
+	for _, tc := range []struct {
+		name  string
+		nonce string
+		valid bool
+	}{
+		{"retired", first, false},
+		{"unknown", "unknown", false},
+		{"third", third, true},
+		{"fourth", fourth, true},
+	} {
+		if got := nonces.Consume(tc.nonce); got != tc.valid {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.valid, got)
+		}
+	}
+
+	expired := nonces.New()
+	nonces.nonces[expired] = time.Now().Add(-time.Second)
+	if nonces.Consume(expired) {
+		t.Error("Expected an expired nonce to be refused")
+	}
+}
+
+func TestHTTP01ValidatorRedirects(t *testing.T) {
+	const keyAuth = "token.thumbprint"
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(keyAuth))
+	}))
+	t.Cleanup(other.Close)
+	_, otherPort, _ := net.SplitHostPort(other.Listener.Addr().String())
+
+	// the challenge server redirects /<target> wherever the token names
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.URL.Path, "/.well-known/acme-challenge/")
+		if token == "served" {
+			w.Write([]byte(keyAuth))
+			return
+		}
+		location, _ := url.PathUnescape(token)
+		http.Redirect(w, r, location, http.StatusFound)
+	}))
+	t.Cleanup(target.Close)
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+	targetPort, _ := strconv.Atoi(port)
+	validator := NewHTTP01Validator(targetPort)
+
+	cases := []struct {
+		name     string
+		location string
+		ok       bool
+	}{
+		{"same host", "/.well-known/acme-challenge/served", true},
+		{"other host", "http://localhost:" + port + "/.well-known/acme-challenge/served", false},
+		{"other port", "http://127.0.0.1:" + otherPort + "/", false},
+		{"other scheme", "ftp://127.0.0.1/", false},
+	}
+	for _, tc := range cases {
+		err := validator.Validate(context.Background(), "127.0.0.1", url.PathEscape(tc.location), keyAuth)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: expected ok %v, got %v", tc.name, tc.ok, err)
+		}
+	}
+}
+
+func TestCheckAccountKey(t *testing.T) {
+	rsa1024, _ := rsa.GenerateKey(rand.Reader, 1024)
+	rsa2048, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cases := []struct {
+		name string
+		pub  crypto.PublicKey
+		ok   bool
+	}{
+		{"RSA 1024", &rsa1024.PublicKey, false},
+		{"RSA 2048", &rsa2048.PublicKey, true},
+		{"P-256", &p256.PublicKey, true},
+	}
+	for _, tc := range cases {
+		if err := CheckAccountKey(tc.pub); (err == nil) != tc.ok {
+			t.Errorf("%s: expected ok %v, got %v", tc.name, tc.ok, err)
+		}
+	}
+}
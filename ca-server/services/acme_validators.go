@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChallengeValidator proves control over a domain for one ACME challenge type
+type ChallengeValidator interface {
+	Validate(ctx context.Context, domain, token, keyAuthorization string) error
+}
+
+// HTTP01Validator fetches the key authorization from the domain's well-known URL (RFC 8555 section 8.3)
+type HTTP01Validator struct {
+	// Client is used for the request, tests can point its transport at a stub target
+	Client *http.Client
+	// Port is the port the challenge is fetched from, 80 unless testing
+	Port int
+}
+
+// NewHTTP01Validator creates an http-01 validator fetching from port
+func NewHTTP01Validator(port int) *HTTP01Validator {
+	v := &HTTP01Validator{Port: port}
+	v.Client = &http.Client{Timeout: 10 * time.Second, CheckRedirect: v.checkRedirect}
+	return v
+}
+
+// checkRedirect follows redirects only to the validated host over http or https on ports 80 and 443,
+// or the configured port, so a challenge cannot point the server at other hosts or services
+func (v *HTTP01Validator) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if !strings.EqualFold(req.URL.Hostname(), via[0].URL.Hostname()) {
+		return fmt.Errorf("redirect to another host %q", req.URL.Hostname())
+	}
+	port := req.URL.Port()
+	switch {
+	case req.URL.Scheme == "http" && (port == "" || port == "80"):
+	case req.URL.Scheme == "https" && (port == "" || port == "443"):
+	case req.URL.Scheme == "http" && v.Port != 0 && port == strconv.Itoa(v.Port):
+	default:
+		return fmt.Errorf("redirect to %s://%s, only ports 80 and 443 are followed", req.URL.Scheme, req.URL.Host)
+	}
+	return nil
+}
+
+// Validate checks that the domain serves the expected key authorization
+func (v *HTTP01Validator) Validate(ctx context.Context, domain, token, keyAuthorization string) error {
+	host := domain
+	if v.Port != 0 && v.Port != 80 {
+		host = net.JoinHostPort(domain, strconv.Itoa(v.Port))
+	}
+	url := fmt.Sprintf("http://%s/.well-known/acme-challenge/%s", host, token)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 8*1024))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", url, err)
+	}
+	if strings.TrimSpace(string(body)) != keyAuthorization {
+		return fmt.Errorf("%s returned an unexpected key authorization", url)
+	}
+	return nil
+}
+
+// TXTResolver looks up TXT records, satisfied by *net.Resolver
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DNS01Validator looks for the key authorization digest in a TXT record (RFC 8555 section 8.4)
+type DNS01Validator struct {
+	Resolver TXTResolver
+}
+
+// NewDNS01Validator creates a dns-01 validator querying server, or the system resolver when empty
+func NewDNS01Validator(server string) *DNS01Validator {
+	if server == "" {
+		return &DNS01Validator{Resolver: net.DefaultResolver}
+	}
+
+	return &DNS01Validator{Resolver: &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}}
+}
+
+// Validate checks the _acme-challenge TXT record of the domain
+func (v *DNS01Validator) Validate(ctx context.Context, domain, token, keyAuthorization string) error {
+	name := "_acme-challenge." + strings.TrimPrefix(domain, "*.")
+	records, err := v.Resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to look up TXT records for %s: %w", name, err)
+	}
+
+	sum := sha256.Sum256([]byte(keyAuthorization))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	for _, record := range records {
+		if strings.TrimSpace(record) == expected {
+			return nil
+		}
+	}
+	return fmt.Errorf("no TXT record for %s matches the key authorization", name)
+}
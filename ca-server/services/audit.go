@@ -0,0 +1,221 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"ca-server/models"
+)
+
+// AuditLog is an append-only audit log of hash-chained records, kept in an AuditStore.
+// Editing, removing or reordering records breaks the chain, see VerifyAuditStore.
+type AuditLog struct {
+	store models.AuditStore
+	// closer is the store opened by OpenAuditLog, closed with the log
+	closer   io.Closer
+	mutex    sync.Mutex
+	seq      int64
+	lastHash string
+}
+
+// NewAuditLog continues the chain of the records in store
+func NewAuditLog(store models.AuditStore) (*AuditLog, error) {
+	l := &AuditLog{store: store}
+	err := store.ScanAudit(func(rec *models.AuditRecord) error {
+		l.seq = rec.Seq
+		l.lastHash = rec.Hash
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return l, nil
+}
+
+// OpenAuditLog opens or creates the audit log kept as JSON lines at path
+func OpenAuditLog(path string) (*AuditLog, error) {
+	store := models.NewFileAuditStore(path)
+	l, err := NewAuditLog(store)
+	if err != nil {
+		return nil, err
+	}
+	l.closer = store
+	return l, nil
+}
+
+// Record numbers, timestamps and chains rec, then appends it to the store
+func (l *AuditLog) Record(rec *models.AuditRecord) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	rec.Seq = l.seq + 1
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	rec.Time = rec.Time.UTC()
+	rec.PrevHash = l.lastHash
+	// params and details are hashed as they read back from the log, e.g. structs as JSON objects
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	*rec = models.AuditRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return err
+	}
+	hash, err := auditHash(rec)
+	if err != nil {
+		return err
+	}
+	rec.Hash = hash
+
+	if err := l.store.AppendAudit(rec); err != nil {
+		return err
+	}
+
+	l.seq = rec.Seq
+	l.lastHash = rec.Hash
+	return nil
+}
+
+// Query returns the records matching filter, newest first
+func (l *AuditLog) Query(filter models.AuditFilter) ([]*models.AuditRecord, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	records := make([]*models.AuditRecord, 0)
+	err := l.store.ScanAudit(func(rec *models.AuditRecord) error {
+		if auditMatches(rec, filter) {
+			records = append(records, rec)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// newest first, then cut to the limit
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	if filter.Limit > 0 && len(records) > filter.Limit {
+		records = records[:filter.Limit]
+	}
+	return records, nil
+}
+
+// Verify checks the chain of the log, see VerifyAuditStore
+func (l *AuditLog) Verify() (*AuditVerification, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return VerifyAuditStore(l.store)
+}
+
+// Close closes the log file opened by OpenAuditLog, stores passed to NewAuditLog are left open
+func (l *AuditLog) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// AuditVerification is the result of checking an audit log
+type AuditVerification struct {
+	Records int64 `json:"records"`
+	// Head is the hash of the last record, keep a copy elsewhere to also detect a truncated log
+	Head string `json:"head"`
+}
+
+// AuditChainError reports the first record that breaks the chain
+type AuditChainError struct {
+	Seq    int64
+	Reason string
+}
+
+// Error describes the broken record
+func (e *AuditChainError) Error() string {
+	return fmt.Sprintf("audit record %d: %s", e.Seq, e.Reason)
+}
+
+// VerifyAuditLog checks the audit log kept as JSON lines at path, see VerifyAuditStore
+func VerifyAuditLog(path string) (*AuditVerification, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return VerifyAuditStore(models.NewFileAuditStore(path))
+}
+
+// VerifyAuditStore recomputes the hash of every record in store and checks that the records are numbered
+// without gaps and each one points at the hash of the one before. It returns an *AuditChainError at the first break.
+func VerifyAuditStore(store models.AuditStore) (*AuditVerification, error) {
+	result := &AuditVerification{}
+	err := store.ScanAudit(func(rec *models.AuditRecord) error {
+		expected := result.Records + 1
+		switch {
+		case rec.Seq != expected:
+			return &AuditChainError{Seq: expected, Reason: fmt.Sprintf("found record %d instead", rec.Seq)}
+		case rec.PrevHash != result.Head:
+			return &AuditChainError{Seq: rec.Seq, Reason: "previous hash does not match, a record before it was changed or removed"}
+		}
+		hash, err := auditHash(rec)
+		if err != nil {
+			return err
+		}
+		if hash != rec.Hash {
+			return &AuditChainError{Seq: rec.Seq, Reason: "hash does not match its content, the record was changed"}
+		}
+		result.Records = rec.Seq
+		result.Head = rec.Hash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// auditHash computes the hash of rec with its hash field cleared
+func auditHash(rec *models.AuditRecord) (string, error) {
+	unhashed := *rec
+	unhashed.Hash = ""
+	data, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// auditMatches reports whether rec is selected by filter
+func auditMatches(rec *models.AuditRecord, filter models.AuditFilter) bool {
+	if filter.Action != "" {
+		if strings.HasSuffix(filter.Action, ".") {
+			if !strings.HasPrefix(rec.Action, filter.Action) {
+				return false
+			}
+		} else if rec.Action != filter.Action {
+			return false
+		}
+	}
+	if filter.Actor != "" && rec.Actor != filter.Actor {
+		return false
+	}
+	if filter.Result != "" && rec.Result != filter.Result {
+		return false
+	}
+	if !filter.Since.IsZero() && rec.Time.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && !rec.Time.Before(filter.Until) {
+		return false
+	}
+	return true
+}
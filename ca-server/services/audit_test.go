@@ -0,0 +1,101 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ca-server/models"
+)
+
+// writeAuditLog records n issuances to a fresh log and returns its path
+func writeAuditLog(t *testing.T, n int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer audit.Close()
+	for i := 0; i < n; i++ {
+		err := audit.Record(&models.AuditRecord{
+			Action:  "cert.issue",
+			Actor:   "alice",
+			Params:  map[string]interface{}{"commonName": "web.home.lab", "validDays": 30},
+			Result:  models.AuditSuccess,
+			Details: map[string]interface{}{"sans": []string{"web.home.lab"}},
+		})
+		if err != nil {
+			t.Fatalf("Failed to record: %v", err)
+		}
+	}
+	return path
+}
+
+func TestAuditLogChain(t *testing.T) {
+	path := writeAuditLog(t, 3)
+
+	// reopening continues the chain
+	audit, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen audit log: %v", err)
+	}
+	if err := audit.Record(&models.AuditRecord{Action: "cert.revoke", Actor: "bob", Result: models.AuditDenied}); err != nil {
+		t.Fatalf("Failed to record: %v", err)
+	}
+	audit.Close()
+
+	result, err := VerifyAuditLog(path)
+	if err != nil {
+		t.Fatalf("Expected an intact chain, got %v", err)
+	}
+	if result.Records != 4 {
+		t.Errorf("Expected 4 records, got %d", result.Records)
+	}
+
+	records, err := audit.Query(models.AuditFilter{Action: "cert.", Actor: "alice", Limit: 2})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(records) != 2 || records[0].Seq != 3 {
+		t.Errorf("Expected the two newest records of alice, got %d", len(records))
+	}
+}
+
+func TestAuditLogTampering(t *testing.T) {
+	lines := func(path string) []string {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read audit log: %v", err)
+		}
+		return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	tampered := map[string]struct {
+		edit func([]string) []string
+		seq  int64
+	}{
+		"edited": {func(l []string) []string {
+			l[1] = strings.Replace(l[1], `"actor":"alice"`, `"actor":"mallory"`, 1)
+			return l
+		}, 2},
+		"removed": {func(l []string) []string { return append(l[:1], l[2:]...) }, 2},
+		"reordered": {func(l []string) []string {
+			l[1], l[2] = l[2], l[1]
+			return l
+		}, 2},
+	}
+	for name, tc := range tampered {
+		path := writeAuditLog(t, 3)
+		if err := os.WriteFile(path, []byte(strings.Join(tc.edit(lines(path)), "\n")+"\n"), 0600); err != nil {
+			t.Fatalf("Failed to write audit log: %v", err)
+		}
+		_, err := VerifyAuditLog(path)
+		var chainErr *AuditChainError
+		if !errors.As(err, &chainErr) || chainErr.Seq != tc.seq {
+			t.Errorf("%s: expected a chain error at record %d, got %v", name, tc.seq, err)
+		}
+	}
+}
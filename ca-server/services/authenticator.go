@@ -0,0 +1,118 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"ca-server/models"
+)
+
+// Authenticator turns bearer tokens into principals. A token is the admin token,
+// an API key of a user, or a JWT accepted by the verifier.
+type Authenticator struct {
+	store      models.Store
+	verifier   *JWTVerifier
+	adminToken string
+}
+
+// NewAuthenticator creates an authenticator, verifier is nil when JWTs are not accepted
+func NewAuthenticator(store models.Store, verifier *JWTVerifier, adminToken string) *Authenticator {
+	return &Authenticator{
+		store:      store,
+		verifier:   verifier,
+		adminToken: adminToken,
+	}
+}
+
+// Authenticate returns the principal of token, errors wrap ErrInvalidToken
+func (a *Authenticator) Authenticate(ctx context.Context, token string) (*models.Principal, error) {
+	if a.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.adminToken)) == 1 {
+		return &models.Principal{Subject: "admin", Roles: []models.Role{models.RoleAdmin}, Method: "admin-token"}, nil
+	}
+	if strings.HasPrefix(token, models.APIKeyPrefix) {
+		return a.authenticateAPIKey(ctx, token)
+	}
+	if a.verifier == nil {
+		return nil, fmt.Errorf("%w: JWT verification is not configured", ErrInvalidToken)
+	}
+	return a.authenticateJWT(ctx, token)
+}
+
+// authenticateAPIKey checks an API key and returns its user with the user's roles
+func (a *Authenticator) authenticateAPIKey(ctx context.Context, token string) (*models.Principal, error) {
+	id, secret, err := models.ParseAPIKeyToken(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	key, err := a.store.GetAPIKey(ctx, id)
+	if err != nil || !key.Matches(secret) {
+		return nil, fmt.Errorf("%w: unknown API key", ErrInvalidToken)
+	}
+	now := time.Now()
+	if !key.Active(now) {
+		return nil, fmt.Errorf("%w: API key is revoked or expired", ErrInvalidToken)
+	}
+	user, err := a.store.GetUser(ctx, key.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: API key owner no longer exists", ErrInvalidToken)
+	}
+	if !user.Active() {
+		return nil, fmt.Errorf("%w: API key owner is %s", ErrInvalidToken, user.CurrentStatus())
+	}
+	if err := a.store.TouchAPIKey(ctx, key.ID, now); err != nil {
+		log.Printf("Failed to record use of API key %s: %v", key.ID, err)
+	}
+
+	return &models.Principal{
+		User:    user,
+		Subject: "apikey:" + key.ID,
+		Roles:   append([]models.Role(nil), user.Roles...),
+		Method:  "apikey",
+	}, nil
+}
+
+// authenticateJWT verifies a JWT and maps it to the user whose ID is its subject or whose
+// email is its email claim. The principal gets that user's roles plus the known roles in the roles claim,
+// tokens of pending or disabled users are refused.
+func (a *Authenticator) authenticateJWT(ctx context.Context, token string) (*models.Principal, error) {
+	claims, err := a.verifier.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	principal := &models.Principal{Subject: claims.Subject, Method: "jwt"}
+	if user := a.userForClaims(ctx, claims); user != nil {
+		if !user.Active() {
+			return nil, fmt.Errorf("%w: user is %s", ErrInvalidToken, user.CurrentStatus())
+		}
+		principal.User = user
+		principal.Roles = append(principal.Roles, user.Roles...)
+	}
+	for _, name := range claims.Roles {
+		if role, err := models.ParseRole(name); err == nil {
+			principal.Roles = append(principal.Roles, role)
+		}
+	}
+	return principal, nil
+}
+
+// userForClaims finds the user a JWT belongs to, nil when there is none
+func (a *Authenticator) userForClaims(ctx context.Context, claims *JWTClaims) *models.User {
+	if claims.Subject != "" {
+		if user, err := a.store.GetUser(ctx, claims.Subject); err == nil {
+			return user
+		}
+	}
+	if claims.Email == "" {
+		return nil
+	}
+	users, err := a.store.ListUsers(ctx, models.UserFilter{Email: claims.Email, Limit: 1})
+	if err != nil || len(users.Items) == 0 {
+		return nil
+	}
+	return users.Items[0]
+}
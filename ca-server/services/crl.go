@@ -0,0 +1,125 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"ca-server/models"
+)
+
+// CRLService builds and caches a certificate revocation list per CA
+type CRLService struct {
+	store    models.CertStore
+	caStore  models.CAStore
+	validity time.Duration
+
+	mutex  sync.Mutex
+	crls   map[string]*cachedCRL
+	number *big.Int
+}
+
+// cachedCRL is the last CRL published by a CA
+type cachedCRL struct {
+	der        []byte
+	issuer     *x509.Certificate
+	thisUpdate time.Time
+}
+
+// NewCRLService creates a CRL service, each CRL is valid for validity
+func NewCRLService(store models.CertStore, caStore models.CAStore, validity time.Duration) *CRLService {
+	return &CRLService{
+		store:    store,
+		caStore:  caStore,
+		validity: validity,
+		crls:     make(map[string]*cachedCRL),
+		number:   big.NewInt(0),
+	}
+}
+
+// Get returns the current DER encoded CRL of the CA with the given ID, or of the issuing CA when id is empty.
+// The CRL is rebuilt when the CA certificate changed or half of its validity has passed.
+func (s *CRLService) Get(ctx context.Context, caID string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ca, err := s.ca(caID)
+	if err != nil {
+		return nil, err
+	}
+
+	crl, ok := s.crls[ca.ID()]
+	if !ok || time.Since(crl.thisUpdate) > s.validity/2 || crl.issuer != ca.Cert {
+		if crl, err = s.regenerate(ctx, ca); err != nil {
+			return nil, err
+		}
+	}
+	return crl.der, nil
+}
+
+// Regenerate rebuilds the CRL of a CA, called whenever a certificate it issued is revoked
+func (s *CRLService) Regenerate(ctx context.Context, caID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ca, err := s.ca(caID)
+	if err != nil {
+		return err
+	}
+	_, err = s.regenerate(ctx, ca)
+	return err
+}
+
+func (s *CRLService) ca(id string) (*models.CA, error) {
+	if id == "" {
+		return s.caStore.Get()
+	}
+	return s.caStore.GetByID(id)
+}
+
+func (s *CRLService) regenerate(ctx context.Context, ca *models.CA) (*cachedCRL, error) {
+	revoked, err := s.store.ListRevoked(ctx, ca.ID())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list revoked certificates: %w", err)
+	}
+
+	entries := make([]x509.RevocationListEntry, 0, len(revoked))
+	for _, cert := range revoked {
+		serial, ok := new(big.Int).SetString(cert.SerialNumber, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial number %q", cert.SerialNumber)
+		}
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: *cert.RevokedAt,
+			ReasonCode:     cert.RevocationCode,
+		})
+	}
+
+	// CRL numbers must increase monotonically, also across restarts
+	now := time.Now()
+	number := big.NewInt(now.UnixNano())
+	if number.Cmp(s.number) <= 0 {
+		number = new(big.Int).Add(s.number, big.NewInt(1))
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		RevokedCertificateEntries: entries,
+		Number:                    number,
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(s.validity),
+		SignatureAlgorithm:        SignatureAlgorithm(ca.Signer.Public()),
+	}, ca.Cert, ca.Signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CRL: %w", err)
+	}
+
+	crl := &cachedCRL{der: der, issuer: ca.Cert, thisUpdate: now}
+	s.crls[ca.ID()] = crl
+	s.number = number
+	return crl, nil
+}
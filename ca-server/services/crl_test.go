@@ -0,0 +1,133 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+
+	"ca-server/models"
+)
+
+func TestCRLService(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		name string
+		spec string
+		// revoked maps the serials revoked under the CA to their reason code
+		revoked map[string]int
+	}{
+		{"ECDSA CA, nothing revoked", "ecdsa-P256", nil},
+		{"ECDSA CA", "ecdsa-P384", map[string]int{"11": 1, "12": 4}},
+		{"RSA CA", "rsa-2048", map[string]int{"21": 0}},
+		{"Ed25519 CA", "ed25519", map[string]int{"31": 5, "32": 9}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := models.NewMemoryStore()
+			caStore := newSnapshotCAStore(t, nil)
+			ca, other := newBackendCA(t, FileKeyBackend{}, tc.spec), newBackendCA(t, FileKeyBackend{}, "ecdsa-P256")
+			if err := caStore.Save(ca, true); err != nil {
+				t.Fatalf("Failed to save CA: %v", err)
+			}
+			if err := caStore.Save(other, false); err != nil {
+				t.Fatalf("Failed to save CA: %v", err)
+			}
+
+			now := time.Now().Truncate(time.Second)
+			saveCert := func(serial, caID string) {
+				if err := store.SaveCert(ctx, &models.Certificate{SerialNumber: serial, AuthorityKeyID: caID, NotBefore: now, NotAfter: now.Add(time.Hour)}); err != nil {
+					t.Fatalf("Failed to save certificate: %v", err)
+				}
+			}
+			for serial, reason := range tc.revoked {
+				saveCert(serial, ca.ID())
+				if _, err := store.RevokeCert(ctx, serial, reason, now); err != nil {
+					t.Fatalf("Failed to revoke %s: %v", serial, err)
+				}
+			}
+			// neither a valid certificate nor one revoked under another CA belongs on the CRL
+			saveCert("90", ca.ID())
+			saveCert("91", other.ID())
+			if _, err := store.RevokeCert(ctx, "91", 1, now); err != nil {
+				t.Fatalf("Failed to revoke: %v", err)
+			}
+
+			crlService := NewCRLService(store, caStore, time.Hour)
+			der, err := crlService.Get(ctx, "")
+			if err != nil {
+				t.Fatalf("Failed to get CRL: %v", err)
+			}
+			crl, err := x509.ParseRevocationList(der)
+			if err != nil {
+				t.Fatalf("Failed to parse CRL: %v", err)
+			}
+			if err := crl.CheckSignatureFrom(ca.Cert); err != nil {
+				t.Errorf("Expected the CRL signed by the CA: %v", err)
+			}
+			if got := crl.NextUpdate.Sub(crl.ThisUpdate); got != time.Hour {
+				t.Errorf("Expected the CRL valid for an hour, got %v", got)
+			}
+			if len(crl.RevokedCertificateEntries) != len(tc.revoked) {
+				t.Errorf("Expected %d revoked entries, got %d", len(tc.revoked), len(crl.RevokedCertificateEntries))
+			}
+			for _, entry := range crl.RevokedCertificateEntries {
+				reason, ok := tc.revoked[entry.SerialNumber.String()]
+				if !ok {
+					t.Errorf("Unexpected serial %s on the CRL", entry.SerialNumber)
+					continue
+				}
+				if entry.ReasonCode != reason || !entry.RevocationTime.Equal(now) {
+					t.Errorf("Serial %s: expected reason %d at %v, got %d at %v", entry.SerialNumber, reason, now, entry.ReasonCode, entry.RevocationTime)
+				}
+			}
+
+			// the published CRL is served until the next revocation
+			if cached, _ := crlService.Get(ctx, ca.ID()); !bytes.Equal(cached, der) {
+				t.Error("Expected the cached CRL to be served")
+			}
+			if err := crlService.Regenerate(ctx, ca.ID()); err != nil {
+				t.Fatalf("Failed to regenerate CRL: %v", err)
+			}
+			next, err := crlService.Get(ctx, ca.ID())
+			if err != nil {
+				t.Fatalf("Failed to get CRL: %v", err)
+			}
+			nextCRL, err := x509.ParseRevocationList(next)
+			if err != nil {
+				t.Fatalf("Failed to parse CRL: %v", err)
+			}
+			if nextCRL.Number.Cmp(crl.Number) <= 0 {
+				t.Errorf("Expected the CRL number to increase, got %v after %v", nextCRL.Number, crl.Number)
+			}
+		})
+	}
+}
+
+// TestIssuerCRLDistributionPoint checks issued certificates point at the CRL of their CA
+func TestIssuerCRLDistributionPoint(t *testing.T) {
+	caStore := newSnapshotCAStore(t, nil)
+	ca := newBackendCA(t, FileKeyBackend{}, "ecdsa-P256")
+	if err := caStore.Save(ca, true); err != nil {
+		t.Fatalf("Failed to save CA: %v", err)
+	}
+	issuer := NewIssuer(models.NewMemoryStore(), caStore, "https://ca.home.lab/")
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert, _, err := issuer.Sign(context.Background(), "", &x509.Certificate{
+		Subject:   pkix.Name{CommonName: "web.home.lab"},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(time.Hour),
+	}, &key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to issue: %v", err)
+	}
+	want := "https://ca.home.lab/crl/" + ca.ID()
+	if len(cert.CRLDistributionPoints) != 1 || cert.CRLDistributionPoints[0] != want {
+		t.Errorf("Expected CRL distribution point %s, got %v", want, cert.CRLDistributionPoints)
+	}
+}
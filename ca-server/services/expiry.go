@@ -0,0 +1,175 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"ca-server/models"
+)
+
+// ExpiryAlert is the alert state of a certificate inside the largest expiry threshold
+type ExpiryAlert struct {
+	ExpiryNotice
+	// Notified holds the lowest threshold delivered to each sink
+	Notified  map[string]int `json:"notified"`
+	LastError string         `json:"lastError,omitempty"`
+}
+
+// ExpiryWatcher scans the certificate inventory and notifies every sink once per threshold crossed.
+// Revoked and renewed certificates are left out, alert state lives in memory and restarts notify again.
+type ExpiryWatcher struct {
+	store      models.CertStore
+	thresholds []int
+	notifiers  []Notifier
+	// scanMutex serializes scans, mutex guards the alerts read by the API
+	scanMutex sync.Mutex
+	mutex     sync.RWMutex
+	alerts    map[string]*ExpiryAlert
+	lastScan  time.Time
+}
+
+// NewExpiryWatcher creates a watcher for thresholds given in days before expiry
+func NewExpiryWatcher(store models.CertStore, thresholdDays []int, notifiers ...Notifier) (*ExpiryWatcher, error) {
+	seen := make(map[int]bool)
+	thresholds := make([]int, 0, len(thresholdDays))
+	for _, n := range thresholdDays {
+		if n <= 0 {
+			return nil, fmt.Errorf("expiry thresholds must be positive, got %d", n)
+		}
+		if !seen[n] {
+			seen[n] = true
+			thresholds = append(thresholds, n)
+		}
+	}
+	if len(thresholds) == 0 {
+		return nil, fmt.Errorf("at least one expiry threshold is required")
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(thresholds)))
+
+	return &ExpiryWatcher{
+		store:      store,
+		thresholds: thresholds,
+		notifiers:  notifiers,
+		alerts:     make(map[string]*ExpiryAlert),
+	}, nil
+}
+
+// Thresholds returns the thresholds in days, largest first
+func (w *ExpiryWatcher) Thresholds() []int {
+	return w.thresholds
+}
+
+// Alerts returns the certificates inside a threshold, soonest to expire first, and when they were scanned
+func (w *ExpiryWatcher) Alerts() ([]*ExpiryAlert, time.Time) {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	alerts := make([]*ExpiryAlert, 0, len(w.alerts))
+	for _, alert := range w.alerts {
+		alerts = append(alerts, alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].NotAfter.Before(alerts[j].NotAfter)
+	})
+	return alerts, w.lastScan
+}
+
+// Scan checks the inventory at now and sends the notices that are due.
+// A failed delivery is retried, and reported in LastError, on every scan until it succeeds.
+func (w *ExpiryWatcher) Scan(ctx context.Context, now time.Time) error {
+	w.scanMutex.Lock()
+	defer w.scanMutex.Unlock()
+
+	page, err := w.store.ListCerts(ctx, models.CertFilter{
+		ExpiresAfter:  now,
+		ExpiresBefore: now.Add(days(w.thresholds[0])),
+	})
+	if err != nil {
+		return err
+	}
+
+	// alerts are replaced rather than updated so Alerts never sees a half-done scan
+	w.mutex.RLock()
+	previous := w.alerts
+	w.mutex.RUnlock()
+
+	alerts := make(map[string]*ExpiryAlert, len(page.Items))
+	for _, cert := range page.Items {
+		if cert.IsRevoked() || cert.RenewedBy != "" {
+			continue
+		}
+		remaining := cert.NotAfter.Sub(now)
+		threshold := 0
+		for _, t := range w.thresholds {
+			if remaining <= days(t) {
+				threshold = t
+			}
+		}
+
+		alert := &ExpiryAlert{
+			ExpiryNotice: ExpiryNotice{
+				SerialNumber:  cert.SerialNumber,
+				Subject:       cert.Subject,
+				DNSNames:      cert.DNSNames,
+				NotAfter:      cert.NotAfter,
+				DaysLeft:      int(math.Ceil(remaining.Hours() / 24)),
+				ThresholdDays: threshold,
+			},
+			Notified: make(map[string]int, len(w.notifiers)),
+		}
+		if prev, ok := previous[cert.SerialNumber]; ok {
+			for name, sent := range prev.Notified {
+				alert.Notified[name] = sent
+			}
+		}
+
+		for _, notifier := range w.notifiers {
+			if sent, ok := alert.Notified[notifier.Name()]; ok && sent <= threshold {
+				continue
+			}
+			if err := notifier.Notify(ctx, alert.ExpiryNotice); err != nil {
+				alert.LastError = fmt.Sprintf("%s: %v", notifier.Name(), err)
+				log.Printf("Failed to send expiry notice for %s through %s: %v", cert.SerialNumber, notifier.Name(), err)
+				continue
+			}
+			alert.Notified[notifier.Name()] = threshold
+		}
+		alerts[cert.SerialNumber] = alert
+	}
+
+	w.mutex.Lock()
+	w.alerts = alerts
+	w.lastScan = now
+	w.mutex.Unlock()
+	return nil
+}
+
+// Start scans right away and then every interval for the lifetime of the process
+func (w *ExpiryWatcher) Start(interval time.Duration) {
+	scan := func(now time.Time) {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		defer cancel()
+		if err := w.Scan(ctx, now); err != nil {
+			log.Printf("Expiry scan failed: %v", err)
+		}
+	}
+
+	go func() {
+		scan(time.Now())
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			scan(now)
+		}
+	}()
+}
+
+// days converts a number of days to a duration
+func days(n int) time.Duration {
+	return time.Duration(n) * 24 * time.Hour
+}
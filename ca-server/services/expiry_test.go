@@ -0,0 +1,210 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ca-server/models"
+)
+
+// recordingNotifier keeps the notices it was sent and fails while err is set
+type recordingNotifier struct {
+	name    string
+	err     error
+	notices []ExpiryNotice
+}
+
+func (r *recordingNotifier) Name() string {
+	return r.name
+}
+
+func (r *recordingNotifier) Notify(_ context.Context, n ExpiryNotice) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.notices = append(r.notices, n)
+	return nil
+}
+
+func (r *recordingNotifier) thresholds() []int {
+	sent := make([]int, 0, len(r.notices))
+	for _, n := range r.notices {
+		sent = append(sent, n.ThresholdDays)
+	}
+	return sent
+}
+
+func saveExpiringCert(t *testing.T, store *models.MemoryStore, serial string, notAfter time.Time) *models.Certificate {
+	t.Helper()
+
+	cert := &models.Certificate{SerialNumber: serial, Subject: serial + ".home.lab", NotAfter: notAfter}
+	if err := store.SaveCert(context.Background(), cert); err != nil {
+		t.Fatalf("Failed to save certificate: %v", err)
+	}
+	return cert
+}
+
+func TestExpiryWatcherNotifiesOncePerThreshold(t *testing.T) {
+	store := models.NewMemoryStore()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	saveExpiringCert(t, store, "app", start.Add(40*24*time.Hour))
+	saveExpiringCert(t, store, "late", start.Add(365*24*time.Hour))
+	revoked := saveExpiringCert(t, store, "revoked", start.Add(5*24*time.Hour))
+	if _, err := store.RevokeCert(context.Background(), revoked.SerialNumber, 1, start); err != nil {
+		t.Fatalf("Failed to revoke: %v", err)
+	}
+
+	sink := &recordingNotifier{name: "test"}
+	flaky := &recordingNotifier{name: "flaky", err: errors.New("unreachable")}
+	watcher, err := NewExpiryWatcher(store, []int{1, 30, 7, 30}, sink, flaky)
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+
+	// 40, 29, 28, 6.5, 5 and 0.5 days before expiry
+	for _, elapsed := range []float64{0, 11, 12, 33.5, 35, 39.5} {
+		if elapsed == 35 {
+			flaky.err = nil
+		}
+		now := start.Add(time.Duration(elapsed * float64(24*time.Hour)))
+		if err := watcher.Scan(context.Background(), now); err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+	}
+
+	if got := sink.thresholds(); len(got) != 3 || got[0] != 30 || got[1] != 7 || got[2] != 1 {
+		t.Fatalf("Expected notices at 30, 7 and 1 days, got %v", got)
+	}
+	// the failed sink catches up at the threshold current when it recovers
+	if got := flaky.thresholds(); len(got) != 2 || got[0] != 7 || got[1] != 1 {
+		t.Fatalf("Expected the recovered sink to get 7 and 1 days, got %v", got)
+	}
+
+	alerts, lastScan := watcher.Alerts()
+	if len(alerts) != 1 || alerts[0].SerialNumber != "app" || alerts[0].DaysLeft != 1 || alerts[0].Notified["test"] != 1 {
+		t.Fatalf("Unexpected alert state: %+v", alerts)
+	}
+	if alerts[0].LastError != "" || lastScan.IsZero() {
+		t.Fatalf("Expected a clean alert after delivery, got %+v at %v", alerts[0], lastScan)
+	}
+
+	// a renewed certificate no longer alerts
+	if _, err := store.MarkRenewed(context.Background(), "app", "next", nil); err != nil {
+		t.Fatalf("Failed to mark renewed: %v", err)
+	}
+	if err := watcher.Scan(context.Background(), start.Add(39*24*time.Hour+23*time.Hour)); err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if alerts, _ := watcher.Alerts(); len(alerts) != 0 {
+		t.Fatalf("Expected no alerts after renewal, got %+v", alerts)
+	}
+}
+
+func TestExpiryWatcherRejectsThresholds(t *testing.T) {
+	for _, thresholds := range [][]int{nil, {30, 0}, {-1}} {
+		if _, err := NewExpiryWatcher(models.NewMemoryStore(), thresholds); err == nil {
+			t.Fatalf("Expected an error for thresholds %v", thresholds)
+		}
+	}
+}
+
+func TestWebhookAndSMTPNotifiers(t *testing.T) {
+	notice := ExpiryNotice{SerialNumber: "42", Subject: "app.home.lab", NotAfter: time.Now().Add(24 * time.Hour), DaysLeft: 1, ThresholdDays: 1}
+
+	var received ExpiryNotice
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer hook.Close()
+	if err := NewWebhookNotifier(hook.URL).Notify(context.Background(), notice); err != nil {
+		t.Fatalf("Webhook failed: %v", err)
+	}
+	if received.SerialNumber != "42" || received.ThresholdDays != 1 {
+		t.Fatalf("Webhook received %+v", received)
+	}
+	if err := NewWebhookNotifier(hook.URL+"/missing\x00").Notify(context.Background(), notice); err == nil {
+		t.Fatal("Expected an error for an invalid webhook URL")
+	}
+
+	addr, mail := newStubSMTP(t)
+	smtpNotifier, err := NewSMTPNotifier(addr, "ca@home.lab", []string{"ops@home.lab"}, "", "")
+	if err != nil {
+		t.Fatalf("Failed to create SMTP notifier: %v", err)
+	}
+	if err := smtpNotifier.Notify(context.Background(), notice); err != nil {
+		t.Fatalf("SMTP delivery failed: %v", err)
+	}
+	if msg := <-mail; !strings.Contains(msg, "Subject: Certificate app.home.lab expires in 1 days") {
+		t.Fatalf("Unexpected mail:\n%s", msg)
+	}
+	if _, err := NewSMTPNotifier(addr, "ca@home.lab", nil, "", ""); err == nil {
+		t.Fatal("Expected an error without recipients")
+	}
+}
+
+// newStubSMTP accepts one mail on a local port and sends its data on the returned channel
+func newStubSMTP(t *testing.T) (string, <-chan string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	mail := make(chan string, 1)
+	var once sync.Once
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 stub ESMTP")
+		var data strings.Builder
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					once.Do(func() { mail <- data.String() })
+					reply("250 queued")
+					continue
+				}
+				data.WriteString(line)
+				continue
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 stub")
+			case cmd == "DATA":
+				inData = true
+				reply("354 go ahead")
+			case cmd == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return listener.Addr().String(), mail
+}
@@ -0,0 +1,225 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"ca-server/models"
+	"ca-server/utils"
+)
+
+// ErrCAConstraint is returned when a certificate would break the constraints of the CAs above it
+var ErrCAConstraint = errors.New("not permitted by the CA constraints")
+
+// Issuer signs certificates with the issuing CA and records them in the certificate inventory.
+// Every issuance path (API handlers, CSR signing, ACME) goes through it.
+type Issuer struct {
+	store   models.CertStore
+	caStore models.CAStore
+	crlURL  string
+	ocspURL string
+}
+
+// NewIssuer creates an issuer, publicURL is the base URL of the CRL and OCSP endpoints
+func NewIssuer(store models.CertStore, caStore models.CAStore, publicURL string) *Issuer {
+	publicURL = strings.TrimSuffix(publicURL, "/")
+	return &Issuer{
+		store:   store,
+		caStore: caStore,
+		crlURL:  publicURL + "/crl",
+		ocspURL: publicURL + "/ocsp",
+	}
+}
+
+// CA returns the CA with the given ID, or the issuing CA when id is empty
+func (i *Issuer) CA(id string) (*models.CA, error) {
+	if id == "" {
+		return i.caStore.Get()
+	}
+	return i.caStore.GetByID(id)
+}
+
+// IssueOptions pick the signing CA and what is recorded with a leaf certificate in the inventory
+type IssueOptions struct {
+	// CAID picks the signing CA, the issuing CA signs when it is empty
+	CAID        string
+	Profile     string
+	RenewedFrom string
+	// IssuedBy names the caller, UserID the user the certificate is bound to for mutual TLS
+	IssuedBy string
+	UserID   string
+	// Authorize, when set, vets the signing CA and the certificate before it is signed
+	Authorize func(ca *models.CA, tmpl *x509.Certificate) error
+}
+
+// Sign issues a leaf certificate for pub from tmpl and returns it with the chain of CAs up to the root.
+// caID picks the signing CA, the issuing CA signs when it is empty.
+// A serial number and revocation pointers are added and the lifetime is capped to the CA's.
+func (i *Issuer) Sign(ctx context.Context, caID string, tmpl *x509.Certificate, pub crypto.PublicKey) (*x509.Certificate, []*x509.Certificate, error) {
+	return i.Issue(ctx, IssueOptions{CAID: caID}, tmpl, pub)
+}
+
+// Issue is Sign with the profile, renewal, caller and bound user recorded alongside the certificate
+func (i *Issuer) Issue(ctx context.Context, opts IssueOptions, tmpl *x509.Certificate, pub crypto.PublicKey) (*x509.Certificate, []*x509.Certificate, error) {
+	ca, err := i.CA(opts.CAID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.Authorize != nil {
+		if err := opts.Authorize(ca, tmpl); err != nil {
+			return nil, nil, err
+		}
+	}
+	cert, chain, err := i.sign(ca, tmpl, pub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Record the certificate in the inventory before handing it out
+	record := models.NewCertificate(cert)
+	record.Profile = opts.Profile
+	record.RenewedFrom = opts.RenewedFrom
+	record.IssuedBy = opts.IssuedBy
+	record.UserID = opts.UserID
+	if err := i.store.SaveCert(ctx, record); err != nil {
+		return nil, nil, fmt.Errorf("failed to record certificate: %w", err)
+	}
+	return cert, chain, nil
+}
+
+// SignCA issues a subordinate CA certificate for pub with the CA identified by parentID.
+// An unset path length is derived from the parent, an explicit one and the name
+// constraints of tmpl must fit within those of the parent chain.
+// The certificate is not recorded, the caller calls Record once the CA is saved.
+func (i *Issuer) SignCA(parentID string, tmpl *x509.Certificate, pub crypto.PublicKey) (*x509.Certificate, []*x509.Certificate, error) {
+	parent, err := i.CA(parentID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if parentLen := parent.Cert.MaxPathLen; parentLen == 0 {
+		return nil, nil, fmt.Errorf("%w: CA %q has path length 0 and cannot issue subordinate CAs", ErrCAConstraint, parent.Cert.Subject.CommonName)
+	} else if parentLen > 0 {
+		if tmpl.MaxPathLen < 0 {
+			tmpl.MaxPathLen = parentLen - 1
+			tmpl.MaxPathLenZero = tmpl.MaxPathLen == 0
+		} else if tmpl.MaxPathLen >= parentLen {
+			return nil, nil, fmt.Errorf("%w: path length must be below %d", ErrCAConstraint, parentLen)
+		}
+	}
+
+	for _, ancestor := range parent.FullChain() {
+		if err := checkNameConstraints(tmpl, ancestor); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	tmpl.BasicConstraintsValid = true
+	tmpl.IsCA = true
+	tmpl.PermittedDNSDomainsCritical = len(tmpl.PermittedDNSDomains) > 0 || len(tmpl.ExcludedDNSDomains) > 0 ||
+		len(tmpl.PermittedIPRanges) > 0 || len(tmpl.ExcludedIPRanges) > 0
+
+	return i.sign(parent, tmpl, pub)
+}
+
+// sign creates the certificate and checks it chains up to the root
+func (i *Issuer) sign(ca *models.CA, tmpl *x509.Certificate, pub crypto.PublicKey) (*x509.Certificate, []*x509.Certificate, error) {
+	if tmpl.SerialNumber == nil {
+		tmpl.SerialNumber = utils.NewSerialNum()
+	}
+	if tmpl.NotAfter.After(ca.Cert.NotAfter) {
+		tmpl.NotAfter = ca.Cert.NotAfter
+	}
+	tmpl.SignatureAlgorithm = SignatureAlgorithm(ca.Signer.Public())
+	// key encipherment only applies to RSA subject keys
+	if _, ok := pub.(*rsa.PublicKey); !ok {
+		tmpl.KeyUsage &^= x509.KeyUsageKeyEncipherment
+	}
+	tmpl.CRLDistributionPoints = []string{i.crlURL + "/" + ca.ID()}
+	tmpl.OCSPServer = []string{i.ocspURL}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, pub, ca.Signer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Path length and name constraints of every CA in the chain apply to the new certificate
+	chain := ca.FullChain()
+	if err := verifyChain(cert, chain); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrCAConstraint, err)
+	}
+	return cert, chain, nil
+}
+
+// Record saves a certificate signed outside of Issue to the inventory, once it is certain to be handed out
+func (i *Issuer) Record(ctx context.Context, cert *x509.Certificate) error {
+	return i.store.SaveCert(ctx, models.NewCertificate(cert))
+}
+
+// verifyChain checks that cert chains up to the last certificate of chain at the time it becomes valid
+func verifyChain(cert *x509.Certificate, chain []*x509.Certificate) error {
+	roots := x509.NewCertPool()
+	roots.AddCert(chain[len(chain)-1])
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[:len(chain)-1] {
+		intermediates.AddCert(c)
+	}
+
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   cert.NotBefore,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// checkNameConstraints requires the permitted names of a subordinate CA to lie within those of an ancestor
+func checkNameConstraints(tmpl, ancestor *x509.Certificate) error {
+	if len(ancestor.PermittedDNSDomains) > 0 {
+		if len(tmpl.PermittedDNSDomains) == 0 {
+			return fmt.Errorf("%w: %q only permits DNS domains %v, the subordinate CA must be restricted too",
+				ErrCAConstraint, ancestor.Subject.CommonName, ancestor.PermittedDNSDomains)
+		}
+		for _, domain := range tmpl.PermittedDNSDomains {
+			if !utils.DomainAllowed(domain, ancestor.PermittedDNSDomains) {
+				return fmt.Errorf("%w: DNS domain %q is outside those permitted by %q", ErrCAConstraint, domain, ancestor.Subject.CommonName)
+			}
+		}
+	}
+
+	if len(ancestor.PermittedIPRanges) > 0 {
+		if len(tmpl.PermittedIPRanges) == 0 {
+			return fmt.Errorf("%w: %q only permits IP ranges, the subordinate CA must be restricted too", ErrCAConstraint, ancestor.Subject.CommonName)
+		}
+		for _, ipNet := range tmpl.PermittedIPRanges {
+			if !ipNetWithin(ipNet, ancestor.PermittedIPRanges) {
+				return fmt.Errorf("%w: IP range %s is outside those permitted by %q", ErrCAConstraint, ipNet, ancestor.Subject.CommonName)
+			}
+		}
+	}
+	return nil
+}
+
+// ipNetWithin reports whether ipNet is contained in one of ranges
+func ipNetWithin(ipNet *net.IPNet, ranges []*net.IPNet) bool {
+	ones, bits := ipNet.Mask.Size()
+	for _, r := range ranges {
+		rOnes, rBits := r.Mask.Size()
+		if bits == rBits && rOnes <= ones && r.Contains(ipNet.IP) {
+			return true
+		}
+	}
+	return false
+}
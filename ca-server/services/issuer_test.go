@@ -0,0 +1,172 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"ca-server/models"
+)
+
+// caTemplate builds a subordinate CA template as the CA endpoints do, pathLen -1 derives it from the parent
+func caTemplate(name string, pathLen int, domains []string, ipRanges ...string) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		Subject:             pkix.Name{CommonName: name},
+		NotBefore:           time.Now().Add(-time.Minute),
+		NotAfter:            time.Now().Add(time.Hour),
+		KeyUsage:            x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		MaxPathLen:          pathLen,
+		MaxPathLenZero:      pathLen == 0,
+		PermittedDNSDomains: domains,
+	}
+	for _, r := range ipRanges {
+		_, ipNet, _ := net.ParseCIDR(r)
+		tmpl.PermittedIPRanges = append(tmpl.PermittedIPRanges, ipNet)
+	}
+	return tmpl
+}
+
+func TestIssuerSignCA(t *testing.T) {
+	caStore := newSnapshotCAStore(t, nil)
+	root := newBackendCA(t, FileKeyBackend{}, "ecdsa-P256")
+	if err := caStore.Save(root, true); err != nil {
+		t.Fatalf("Failed to save CA: %v", err)
+	}
+	issuer := NewIssuer(models.NewMemoryStore(), caStore, "http://localhost")
+	signCA := func(parent *models.CA, tmpl *x509.Certificate) (*models.CA, error) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		cert, chain, err := issuer.SignCA(parent.ID(), tmpl, &key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		ca, err := models.NewCA(key, cert, chain)
+		if err != nil {
+			t.Fatalf("Failed to create CA: %v", err)
+		}
+		if err := caStore.Save(ca, false); err != nil {
+			t.Fatalf("Failed to save CA: %v", err)
+		}
+		return ca, nil
+	}
+
+	constrained, err := signCA(root, caTemplate("Constrained CA", 1, []string{"home.lab"}, "10.0.0.0/8"))
+	if err != nil {
+		t.Fatalf("Failed to sign the constrained CA: %v", err)
+	}
+	last, err := signCA(constrained, caTemplate("Last CA", -1, []string{"home.lab"}, "10.0.0.0/8"))
+	if err != nil {
+		t.Fatalf("Failed to sign the last CA: %v", err)
+	}
+	if !last.Cert.MaxPathLenZero || len(last.Chain) != 2 || !last.Chain[0].Equal(constrained.Cert) || !last.Chain[1].Equal(root.Cert) {
+		t.Fatalf("Expected path length 0 chained to the constrained CA and the root, got %d with %d parents", last.Cert.MaxPathLen, len(last.Chain))
+	}
+
+	cases := []struct {
+		name        string
+		parent      *models.CA
+		tmpl        *x509.Certificate
+		wantPathLen int
+		ok          bool
+	}{
+		{"unlimited under the root", root, caTemplate("CA", -1, nil), -1, true},
+		{"explicit under the root", root, caTemplate("CA", 3, nil), 3, true},
+		{"derived from the parent", constrained, caTemplate("CA", -1, []string{"home.lab"}, "10.0.0.0/8"), 0, true},
+		{"explicit below the parent", constrained, caTemplate("CA", 0, []string{"home.lab"}, "10.0.0.0/8"), 0, true},
+		{"narrower names", constrained, caTemplate("CA", -1, []string{"lab.home.lab"}, "10.1.0.0/16"), 0, true},
+		{"path length of the parent", constrained, caTemplate("CA", 1, []string{"home.lab"}, "10.0.0.0/8"), 0, false},
+		{"parent at path length 0", last, caTemplate("CA", -1, []string{"home.lab"}, "10.0.0.0/8"), 0, false},
+		{"unrestricted DNS names", constrained, caTemplate("CA", -1, nil, "10.0.0.0/8"), 0, false},
+		{"DNS domain outside the parent's", constrained, caTemplate("CA", -1, []string{"other.lab"}, "10.0.0.0/8"), 0, false},
+		{"unrestricted IP ranges", constrained, caTemplate("CA", -1, []string{"home.lab"}), 0, false},
+		{"IP range outside the parent's", constrained, caTemplate("CA", -1, []string{"home.lab"}, "192.168.0.0/16"), 0, false},
+		{"IP range wider than the parent's", constrained, caTemplate("CA", -1, []string{"home.lab"}, "0.0.0.0/0"), 0, false},
+	}
+	for _, tc := range cases {
+		ca, err := signCA(tc.parent, tc.tmpl)
+		if !tc.ok {
+			if !errors.Is(err, ErrCAConstraint) {
+				t.Errorf("%s: expected ErrCAConstraint, got %v", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected the CA to be signed, got %v", tc.name, err)
+			continue
+		}
+		if ca.Cert.MaxPathLen != tc.wantPathLen || ca.Cert.MaxPathLenZero != (tc.wantPathLen == 0) {
+			t.Errorf("%s: expected path length %d, got %d", tc.name, tc.wantPathLen, ca.Cert.MaxPathLen)
+		}
+	}
+}
+
+func TestIssuerNameConstraints(t *testing.T) {
+	ctx := context.Background()
+	caStore := newSnapshotCAStore(t, nil)
+	root := newBackendCA(t, FileKeyBackend{}, "ecdsa-P256")
+	if err := caStore.Save(root, false); err != nil {
+		t.Fatalf("Failed to save CA: %v", err)
+	}
+	issuer := NewIssuer(models.NewMemoryStore(), caStore, "http://localhost")
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caCert, chain, err := issuer.SignCA(root.ID(), caTemplate("Home CA", 0, []string{"home.lab"}, "10.0.0.0/8"), &caKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to sign CA: %v", err)
+	}
+	ca, err := models.NewCA(caKey, caCert, chain)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	if err := caStore.Save(ca, true); err != nil {
+		t.Fatalf("Failed to save CA: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		dnsNames []string
+		ips      []string
+		ok       bool
+	}{
+		{"permitted DNS name", []string{"web.home.lab"}, nil, true},
+		{"permitted IP", nil, []string{"10.0.0.5"}, true},
+		{"both permitted", []string{"home.lab"}, []string{"10.1.2.3"}, true},
+		{"DNS name outside", []string{"web.other.lab"}, nil, false},
+		{"one DNS name outside", []string{"web.home.lab", "home.lab.evil.com"}, nil, false},
+		{"IP outside", nil, []string{"192.168.1.1"}, false},
+	}
+	for _, tc := range cases {
+		tmpl := &x509.Certificate{
+			Subject:   pkix.Name{CommonName: tc.name},
+			DNSNames:  tc.dnsNames,
+			NotBefore: time.Now(),
+			NotAfter:  time.Now().Add(time.Hour),
+		}
+		for _, ip := range tc.ips {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, net.ParseIP(ip))
+		}
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		cert, leafChain, err := issuer.Sign(ctx, "", tmpl, &key.PublicKey)
+		if !tc.ok {
+			if !errors.Is(err, ErrCAConstraint) {
+				t.Errorf("%s: expected ErrCAConstraint, got %v", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected the certificate to be issued, got %v", tc.name, err)
+			continue
+		}
+		if len(leafChain) != 2 || !leafChain[0].Equal(caCert) || !leafChain[1].Equal(root.Cert) {
+			t.Errorf("%s: expected the chain up to the root, got %d certificates", tc.name, len(leafChain))
+		}
+		if cert.NotAfter.After(caCert.NotAfter) {
+			t.Errorf("%s: expected the lifetime capped to the CA's", tc.name)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidToken is returned for bearer tokens that fail verification
+var ErrInvalidToken = errors.New("invalid token")
+
+// JWTClaims are the registered claims checked by JWTVerifier and the identity claims mapped to users
+type JWTClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	Email     string   `json:"email"`
+	Roles     []string `json:"roles"`
+}
+
+// audience is the aud claim, a single string or an array of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("aud must be a string or an array of strings")
+	}
+	*a = list
+	return nil
+}
+
+// JWTOptions configure a JWTVerifier, at least one of HMACSecret, JWKSURL and JWKSFile is required
+type JWTOptions struct {
+	HMACSecret string
+	JWKSURL    string
+	// JWKSFile is a local JWKS document for offline use, it takes precedence over JWKSURL
+	JWKSFile string
+	// Issuer and Audience are required in every token when set
+	Issuer   string
+	Audience string
+	Leeway   time.Duration
+}
+
+// JWTVerifier checks compact JWS tokens. HS* tokens are verified with the HMAC secret,
+// RS*, PS*, ES* and EdDSA tokens with the JWKS key named by their kid, so no key serves two algorithm families.
+type JWTVerifier struct {
+	hmacSecret []byte
+	jwks       *jwkSet
+	issuer     string
+	audience   string
+	leeway     time.Duration
+	now        func() time.Time
+}
+
+// NewJWTVerifier creates a verifier, JWKS documents are loaded on first use
+func NewJWTVerifier(opts JWTOptions) (*JWTVerifier, error) {
+	if opts.HMACSecret == "" && opts.JWKSURL == "" && opts.JWKSFile == "" {
+		return nil, fmt.Errorf("JWT verification needs an HMAC secret or a JWKS")
+	}
+	if opts.HMACSecret != "" && len(opts.HMACSecret) < 32 {
+		return nil, fmt.Errorf("the JWT HMAC secret must be at least 32 bytes")
+	}
+
+	v := &JWTVerifier{
+		issuer:   opts.Issuer,
+		audience: opts.Audience,
+		leeway:   opts.Leeway,
+		now:      time.Now,
+	}
+	if opts.HMACSecret != "" {
+		v.hmacSecret = []byte(opts.HMACSecret)
+	}
+	if opts.JWKSFile != "" || opts.JWKSURL != "" {
+		v.jwks = &jwkSet{file: opts.JWKSFile, url: opts.JWKSURL, client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	return v, nil
+}
+
+// Verify checks the signature, expiry, not-before, issuer and audience of token and returns its claims
+func (v *JWTVerifier) Verify(token string) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a compact JWS", ErrInvalidToken)
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad header encoding", ErrInvalidToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("%w: bad header", ErrInvalidToken)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature encoding", ErrInvalidToken)
+	}
+	signingInput := []byte(parts[0] + "." + parts[1])
+
+	if strings.HasPrefix(header.Alg, "HS") {
+		if v.hmacSecret == nil {
+			return nil, fmt.Errorf("%w: HMAC tokens are not accepted", ErrInvalidToken)
+		}
+		err = verifyHMAC(header.Alg, v.hmacSecret, signingInput, sig)
+	} else {
+		if v.jwks == nil {
+			return nil, fmt.Errorf("%w: no JWKS configured for %s tokens", ErrInvalidToken, header.Alg)
+		}
+		var pub crypto.PublicKey
+		if pub, err = v.jwks.key(header.Kid); err == nil {
+			err = verifyJWTSignature(header.Alg, pub, signingInput, sig)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad payload encoding", ErrInvalidToken)
+	}
+	var claims JWTClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: bad claims: %v", ErrInvalidToken, err)
+	}
+	if err := v.checkClaims(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return &claims, nil
+}
+
+// checkClaims validates the time, issuer and audience claims, exp is required
+func (v *JWTVerifier) checkClaims(claims *JWTClaims) error {
+	now := v.now()
+	if claims.ExpiresAt == 0 {
+		return errors.New("exp claim is required")
+	}
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(v.leeway)) {
+		return errors.New("token has expired")
+	}
+	if claims.NotBefore != 0 && now.Add(v.leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return errors.New("token is not valid yet")
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if v.audience != "" {
+		for _, aud := range claims.Audience {
+			if aud == v.audience {
+				return nil
+			}
+		}
+		return fmt.Errorf("token is not meant for audience %q", v.audience)
+	}
+	return nil
+}
+
+// verifyHMAC checks an HS256, HS384 or HS512 signature
+func verifyHMAC(alg string, secret, signingInput, sig []byte) error {
+	hash, err := jwtHash(alg)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(hash.New, secret)
+	mac.Write(signingInput)
+	if !hmac.Equal(mac.Sum(nil), sig) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// verifyJWTSignature checks an RS*, PS*, ES* or EdDSA signature against pub
+func verifyJWTSignature(alg string, pub crypto.PublicKey, signingInput, sig []byte) error {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") && !strings.HasPrefix(alg, "PS") {
+			return fmt.Errorf("algorithm %s does not match RSA key", alg)
+		}
+		hash, err := jwtHash(alg)
+		if err != nil {
+			return err
+		}
+		h := hash.New()
+		h.Write(signingInput)
+		if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(key, hash, h.Sum(nil), sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		return rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), sig)
+	case *ecdsa.PublicKey:
+		hash, size, err := ecdsaParams(alg, key.Curve)
+		if err != nil {
+			return err
+		}
+		if len(sig) != 2*size {
+			return errors.New("invalid ECDSA signature length")
+		}
+		h := hash.New()
+		h.Write(signingInput)
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, h.Sum(nil), r, s) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			return fmt.Errorf("algorithm %s does not match Ed25519 key", alg)
+		}
+		if !ed25519.Verify(key, signingInput, sig) {
+			return errors.New("invalid EdDSA signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", pub)
+}
+
+// jwtHash returns the hash named by the digits of a JWS algorithm, e.g. RS384
+func jwtHash(alg string) (crypto.Hash, error) {
+	switch {
+	case strings.HasSuffix(alg, "256"):
+		return crypto.SHA256, nil
+	case strings.HasSuffix(alg, "384"):
+		return crypto.SHA384, nil
+	case strings.HasSuffix(alg, "512"):
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// jwkSet caches the keys of a JWKS document, read from a file or fetched from a URL.
+// An unknown kid triggers a reload, at most once a minute, so rotated keys are picked up.
+type jwkSet struct {
+	file   string
+	url    string
+	client *http.Client
+	mutex  sync.Mutex
+	keys   map[string]crypto.PublicKey
+	loaded time.Time
+}
+
+// key returns the public key with kid, or the only key when kid is empty
+func (s *jwkSet) key(kid string) (crypto.PublicKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pub, ok := s.lookup(kid)
+	if !ok && time.Since(s.loaded) > time.Minute {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+		pub, ok = s.lookup(kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("no JWKS key with kid %q", kid)
+	}
+	return pub, nil
+}
+
+func (s *jwkSet) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, pub := range s.keys {
+			return pub, true
+		}
+	}
+	pub, ok := s.keys[kid]
+	return pub, ok
+}
+
+// load reads the JWKS document, keys that are not for signatures or fail to parse are skipped
+func (s *jwkSet) load() error {
+	s.loaded = time.Now()
+
+	var data []byte
+	var err error
+	if s.file != "" {
+		data, err = os.ReadFile(s.file)
+	} else {
+		data, err = s.fetch()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load JWKS: %w", err)
+	}
+
+	var doc struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("invalid JWKS: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(doc.Keys))
+	for _, raw := range doc.Keys {
+		var meta struct {
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+		}
+		if json.Unmarshal(raw, &meta) != nil || (meta.Use != "" && meta.Use != "sig") {
+			continue
+		}
+		if pub, err := ParseJWK(raw); err == nil {
+			keys[meta.Kid] = pub
+		}
+	}
+	s.keys = keys
+	return nil
+}
+
+func (s *jwkSet) fetch() ([]byte, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS endpoint answered %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
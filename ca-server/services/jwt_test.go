@@ -0,0 +1,140 @@
+package services
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ca-server/models"
+)
+
+const testHMACSecret = "0123456789abcdef0123456789abcdef"
+
+// signJWT builds a compact JWS of claims with the given header, sign produces the signature
+func signJWT(t *testing.T, header, claims map[string]interface{}, sign func([]byte) []byte) string {
+	t.Helper()
+	headerJSON, _ := json.Marshal(header)
+	claimsJSON, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	return input + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(input)))
+}
+
+func hs256(input []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(testHMACSecret))
+	mac.Write(input)
+	return mac.Sum(nil)
+}
+
+func TestJWTVerifierHMAC(t *testing.T) {
+	verifier, err := NewJWTVerifier(JWTOptions{HMACSecret: testHMACSecret, Issuer: "https://idp.home.lab", Audience: "ca-server"})
+	if err != nil {
+		t.Fatalf("Failed to create verifier: %v", err)
+	}
+	hs := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	token := signJWT(t, hs, map[string]interface{}{"sub": "alice", "iss": "https://idp.home.lab", "aud": []string{"other", "ca-server"}, "exp": exp}, hs256)
+	claims, err := verifier.Verify(token)
+	if err != nil {
+		t.Fatalf("Expected a valid token, got %v", err)
+	}
+	if claims.Subject != "alice" {
+		t.Errorf("Expected subject alice, got %q", claims.Subject)
+	}
+
+	rejected := map[string]string{
+		"expired":       signJWT(t, hs, map[string]interface{}{"iss": "https://idp.home.lab", "aud": "ca-server", "exp": time.Now().Add(-time.Hour).Unix()}, hs256),
+		"no exp":        signJWT(t, hs, map[string]interface{}{"iss": "https://idp.home.lab", "aud": "ca-server"}, hs256),
+		"not yet valid": signJWT(t, hs, map[string]interface{}{"iss": "https://idp.home.lab", "aud": "ca-server", "exp": exp, "nbf": time.Now().Add(time.Hour).Unix()}, hs256),
+		"wrong issuer":  signJWT(t, hs, map[string]interface{}{"iss": "https://evil.example", "aud": "ca-server", "exp": exp}, hs256),
+		"wrong aud":     signJWT(t, hs, map[string]interface{}{"iss": "https://idp.home.lab", "aud": "other", "exp": exp}, hs256),
+		"bad signature": token[:len(token)-2] + "AA",
+		"alg none":      signJWT(t, map[string]interface{}{"alg": "none"}, map[string]interface{}{"iss": "https://idp.home.lab", "aud": "ca-server", "exp": exp}, func([]byte) []byte { return nil }),
+		"no JWKS":       signJWT(t, map[string]interface{}{"alg": "EdDSA"}, map[string]interface{}{"iss": "https://idp.home.lab", "aud": "ca-server", "exp": exp}, hs256),
+	}
+	for name, token := range rejected {
+		if _, err := verifier.Verify(token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: expected ErrInvalidToken, got %v", name, err)
+		}
+	}
+}
+
+func TestJWTVerifierJWKSFile(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "OKP", "crv": "Ed25519", "kid": "k1", "use": "sig", "x": base64.RawURLEncoding.EncodeToString(pub)},
+	}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0644); err != nil {
+		t.Fatalf("Failed to write JWKS: %v", err)
+	}
+
+	verifier, err := NewJWTVerifier(JWTOptions{JWKSFile: path})
+	if err != nil {
+		t.Fatalf("Failed to create verifier: %v", err)
+	}
+	claims := map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+	sign := func(input []byte) []byte { return ed25519.Sign(priv, input) }
+
+	if _, err := verifier.Verify(signJWT(t, map[string]interface{}{"alg": "EdDSA", "kid": "k1"}, claims, sign)); err != nil {
+		t.Fatalf("Expected a valid token, got %v", err)
+	}
+	if _, err := verifier.Verify(signJWT(t, map[string]interface{}{"alg": "EdDSA", "kid": "k2"}, claims, sign)); err == nil {
+		t.Error("Expected an unknown kid to be rejected")
+	}
+	// JWKS keys never verify HMAC tokens, so a public key cannot be used as a secret
+	if _, err := verifier.Verify(signJWT(t, map[string]interface{}{"alg": "HS256", "kid": "k1"}, claims, hs256)); err == nil {
+		t.Error("Expected an HMAC token to be rejected without a secret")
+	}
+}
+
+func TestAuthenticatorAPIKeys(t *testing.T) {
+	ctx := context.Background()
+	store := models.NewMemoryStore()
+	alice := models.NewUser("alice", "Alice", "alice@home.lab")
+	alice.Roles = []models.Role{models.RoleIssuer}
+	if err := store.CreateUser(ctx, alice); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	key, token, err := models.NewAPIKey("alice", "ci", nil)
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	if err := store.CreateAPIKey(ctx, key); err != nil {
+		t.Fatalf("Failed to store API key: %v", err)
+	}
+
+	auth := NewAuthenticator(store, nil, "")
+	principal, err := auth.Authenticate(ctx, token)
+	if err != nil {
+		t.Fatalf("Expected the API key to authenticate, got %v", err)
+	}
+	if principal.User != alice || !principal.HasRole(models.RoleIssuer) {
+		t.Fatalf("Expected alice with the issuer role, got %+v", principal)
+	}
+	if key.LastUsedAt == nil {
+		t.Error("Expected the last use to be recorded")
+	}
+
+	if _, err := auth.Authenticate(ctx, token[:len(token)-1]+"x"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected a wrong secret to be rejected, got %v", err)
+	}
+	if _, err := auth.Authenticate(ctx, "anything"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected a JWT to be rejected without a verifier, got %v", err)
+	}
+	if _, err := store.RevokeAPIKey(ctx, key.ID, time.Now()); err != nil {
+		t.Fatalf("Failed to revoke API key: %v", err)
+	}
+	if _, err := auth.Authenticate(ctx, token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected a revoked key to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package services
+
+import (
+	"crypto"
+	"fmt"
+
+	"ca-server/models"
+)
+
+// Signer backends selectable for CA keys
+const (
+	KeyBackendFile   = "file"
+	KeyBackendPKCS11 = "pkcs11"
+	KeyBackendRemote = "remote"
+)
+
+// KeyBackend creates CA keys and opens them again by reference.
+// Issuance only ever sees the crypto.Signer, so keys of external backends never leave them.
+type KeyBackend interface {
+	models.SignerBackend
+	// Generate creates a key pair of spec, label names it within the backend
+	Generate(spec KeySpec, label string) (crypto.Signer, error)
+}
+
+// FileKeyBackend generates CA keys in memory, the CA store writes them to disk
+type FileKeyBackend struct{}
+
+// Name returns "file"
+func (FileKeyBackend) Name() string {
+	return KeyBackendFile
+}
+
+// Generate creates an in-memory key pair
+func (FileKeyBackend) Generate(spec KeySpec, _ string) (crypto.Signer, error) {
+	return spec.Generate()
+}
+
+// Open is never needed, file keys are kept in the CA store itself
+func (FileKeyBackend) Open(string) (crypto.Signer, error) {
+	return nil, fmt.Errorf("file keys are not referenced")
+}
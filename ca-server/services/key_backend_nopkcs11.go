@@ -0,0 +1,10 @@
+//go:build !pkcs11
+
+package services
+
+import "fmt"
+
+// NewPKCS11Backend is unavailable in this build, PKCS#11 support needs cgo and the pkcs11 build tag
+func NewPKCS11Backend(module, tokenLabel, pin string) (KeyBackend, error) {
+	return nil, fmt.Errorf("built without PKCS#11 support, rebuild with -tags pkcs11")
+}
@@ -0,0 +1,322 @@
+//go:build pkcs11
+
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// curveOIDs maps the accepted curve names to their PKCS#11 EC parameters
+var curveOIDs = map[string]asn1.ObjectIdentifier{
+	"P256": {1, 2, 840, 10045, 3, 1, 7},
+	"P384": {1, 3, 132, 0, 34},
+	"P521": {1, 3, 132, 0, 35},
+}
+
+// digestInfoPrefixes are the DER DigestInfo headers CKM_RSA_PKCS expects in front of a digest
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// PKCS11KeyBackend keeps CA keys in a PKCS#11 token, e.g. an HSM or SoftHSM.
+// Keys are generated on the token as sensitive and non-extractable and referenced by their hex CKA_ID.
+type PKCS11KeyBackend struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	// a PKCS#11 session handles one operation at a time
+	mutex sync.Mutex
+}
+
+// NewPKCS11Backend loads the PKCS#11 module and logs in to the token labelled tokenLabel
+func NewPKCS11Backend(module, tokenLabel, pin string) (KeyBackend, error) {
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 module %s", module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("failed to initialize PKCS#11 module: %w", err)
+	}
+
+	slot, err := findSlot(ctx, tokenLabel)
+	if err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, err
+	}
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, fmt.Errorf("failed to open PKCS#11 session: %w", err)
+	}
+	if err := ctx.Login(session, pkcs11.CKU_USER, pin); err != nil {
+		ctx.CloseSession(session)
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, fmt.Errorf("failed to log in to token %q: %w", tokenLabel, err)
+	}
+
+	return &PKCS11KeyBackend{ctx: ctx, session: session}, nil
+}
+
+// findSlot returns the slot holding the token labelled label
+func findSlot(ctx *pkcs11.Ctx, label string) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list PKCS#11 slots: %w", err)
+	}
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err == nil && info.Label == label {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("no PKCS#11 token labelled %q", label)
+}
+
+// Name returns "pkcs11"
+func (b *PKCS11KeyBackend) Name() string {
+	return KeyBackendPKCS11
+}
+
+// Generate creates a key pair on the token, Ed25519 is not supported
+func (b *PKCS11KeyBackend) Generate(spec KeySpec, label string) (crypto.Signer, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	public := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	private := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+
+	var mechanism uint
+	switch spec.Algorithm {
+	case KeyAlgorithmRSA:
+		mechanism = pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN
+		public = append(public,
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, spec.Bits),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}))
+	case KeyAlgorithmECDSA:
+		params, err := asn1.Marshal(curveOIDs[spec.Curve])
+		if err != nil {
+			return nil, err
+		}
+		mechanism = pkcs11.CKM_EC_KEY_PAIR_GEN
+		public = append(public, pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params))
+	default:
+		return nil, fmt.Errorf("%s keys are not supported by the PKCS#11 backend", spec.Algorithm)
+	}
+
+	b.mutex.Lock()
+	_, _, err := b.ctx.GenerateKeyPair(b.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, public, private)
+	b.mutex.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key on token: %w", err)
+	}
+	return b.Open(hex.EncodeToString(id))
+}
+
+// Open finds the key pair with the hex CKA_ID ref on the token
+func (b *PKCS11KeyBackend) Open(ref string) (crypto.Signer, error) {
+	id, err := hex.DecodeString(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PKCS#11 key reference %q", ref)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	priv, err := b.findObject(pkcs11.CKO_PRIVATE_KEY, id)
+	if err != nil {
+		return nil, err
+	}
+	pubHandle, err := b.findObject(pkcs11.CKO_PUBLIC_KEY, id)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := b.publicKey(pubHandle)
+	if err != nil {
+		return nil, err
+	}
+	return &pkcs11Signer{backend: b, ref: ref, handle: priv, pub: pub}, nil
+}
+
+// findObject returns the single object of class with CKA_ID id, the caller holds the mutex
+func (b *PKCS11KeyBackend) findObject(class uint, id []byte) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	if err := b.ctx.FindObjectsInit(b.session, template); err != nil {
+		return 0, err
+	}
+	handles, _, err := b.ctx.FindObjects(b.session, 2)
+	if finalErr := b.ctx.FindObjectsFinal(b.session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(handles) != 1 {
+		return 0, fmt.Errorf("expected one PKCS#11 key with ID %x, found %d", id, len(handles))
+	}
+	return handles[0], nil
+}
+
+// publicKey reads an RSA or EC public key object, the caller holds the mutex
+func (b *PKCS11KeyBackend) publicKey(handle pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	attrs, err := b.ctx.GetAttributeValue(b.session, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch keyType := attributeUint(attrs[0].Value); keyType {
+	case pkcs11.CKK_RSA:
+		attrs, err := b.ctx.GetAttributeValue(b.session, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+		}, nil
+	case pkcs11.CKK_EC:
+		attrs, err := b.ctx.GetAttributeValue(b.session, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		// CKA_EC_POINT is the uncompressed point wrapped in an OCTET STRING,
+		// rebuild the SubjectPublicKeyInfo so x509 validates it
+		var point []byte
+		if _, err := asn1.Unmarshal(attrs[1].Value, &point); err != nil {
+			return nil, fmt.Errorf("invalid EC point: %w", err)
+		}
+		spki, err := asn1.Marshal(struct {
+			Algorithm pkix.AlgorithmIdentifier
+			PublicKey asn1.BitString
+		}{
+			Algorithm: pkix.AlgorithmIdentifier{
+				Algorithm:  asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1},
+				Parameters: asn1.RawValue{FullBytes: attrs[0].Value},
+			},
+			PublicKey: asn1.BitString{Bytes: point, BitLength: 8 * len(point)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParsePKIXPublicKey(spki)
+	default:
+		return nil, fmt.Errorf("unsupported PKCS#11 key type %d", keyType)
+	}
+}
+
+// attributeUint decodes a CK_ULONG attribute, which is stored in native byte order
+func attributeUint(b []byte) uint64 {
+	switch len(b) {
+	case 8:
+		return binary.NativeEndian.Uint64(b)
+	case 4:
+		return uint64(binary.NativeEndian.Uint32(b))
+	}
+	return 0
+}
+
+// pkcs11Signer signs with a private key object that never leaves the token
+type pkcs11Signer struct {
+	backend *PKCS11KeyBackend
+	ref     string
+	handle  pkcs11.ObjectHandle
+	pub     crypto.PublicKey
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *pkcs11Signer) Backend() string {
+	return KeyBackendPKCS11
+}
+
+func (s *pkcs11Signer) KeyRef() string {
+	return s.ref
+}
+
+// Sign signs digest on the token, RSA keys sign with PKCS #1 v1.5
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mechanism uint
+	input := digest
+	switch s.pub.(type) {
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return nil, fmt.Errorf("RSA-PSS is not supported by the PKCS#11 signer")
+		}
+		prefix, ok := digestInfoPrefixes[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash %v", opts.HashFunc())
+		}
+		mechanism = pkcs11.CKM_RSA_PKCS
+		input = append(append([]byte{}, prefix...), digest...)
+	case *ecdsa.PublicKey:
+		mechanism = pkcs11.CKM_ECDSA
+	}
+
+	s.backend.mutex.Lock()
+	defer s.backend.mutex.Unlock()
+
+	ctx, session := s.backend.ctx, s.backend.session
+	if err := ctx.SignInit(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, s.handle); err != nil {
+		return nil, err
+	}
+	sig, err := ctx.Sign(session, input)
+	if err != nil {
+		return nil, err
+	}
+
+	if mechanism != pkcs11.CKM_ECDSA {
+		return sig, nil
+	}
+	// CKM_ECDSA returns r || s, x509 expects the ASN.1 form
+	half := len(sig) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		R: new(big.Int).SetBytes(sig[:half]),
+		S: new(big.Int).SetBytes(sig[half:]),
+	})
+}
@@ -0,0 +1,54 @@
+//go:build pkcs11
+
+package services
+
+import (
+	"crypto/x509"
+	"os"
+	"testing"
+)
+
+// TestPKCS11BackendSoftHSM runs against an initialized SoftHSM token, e.g.
+//
+//	softhsm2-util --init-token --free --label ca-test --pin 1234 --so-pin 1234
+//	PKCS11_TEST_MODULE=/usr/lib/softhsm/libsofthsm2.so go test -tags pkcs11 ./services
+func TestPKCS11BackendSoftHSM(t *testing.T) {
+	module := os.Getenv("PKCS11_TEST_MODULE")
+	if module == "" {
+		t.Skip("PKCS11_TEST_MODULE is not set")
+	}
+	label, pin := os.Getenv("PKCS11_TEST_TOKEN"), os.Getenv("PKCS11_TEST_PIN")
+	if label == "" {
+		label, pin = "ca-test", "1234"
+	}
+
+	backend, err := NewPKCS11Backend(module, label, pin)
+	if err != nil {
+		t.Fatalf("Failed to open token: %v", err)
+	}
+
+	for _, spec := range []string{"ecdsa-P256", "ecdsa-P384", "rsa-2048"} {
+		t.Run(spec, func(t *testing.T) {
+			ca := newBackendCA(t, backend, spec)
+
+			signer, ok := ca.Signer.(interface{ KeyRef() string })
+			if !ok {
+				t.Fatal("PKCS#11 signer does not expose a key reference")
+			}
+			reopened, err := backend.Open(signer.KeyRef())
+			if err != nil {
+				t.Fatalf("Failed to reopen key: %v", err)
+			}
+			if _, err := x509.MarshalPKIXPublicKey(reopened.Public()); err != nil {
+				t.Fatalf("Reopened key has an invalid public key: %v", err)
+			}
+			if err := ca.Cert.CheckSignatureFrom(ca.Cert); err != nil {
+				t.Fatalf("Self-signature made on the token does not verify: %v", err)
+			}
+		})
+	}
+
+	if _, err := backend.Generate(KeySpec{Algorithm: KeyAlgorithmEd25519}, "unsupported"); err == nil {
+		t.Fatal("Expected ed25519 to be rejected")
+	}
+}
@@ -0,0 +1,155 @@
+package services
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RemoteKeyBackend keeps CA keys in a KMS-style signing service reached over HTTP.
+// The service implements three JSON endpoints, binary values are base64 encoded:
+//
+//	POST /keys             {"label", "spec"}               -> {"ref", "publicKey"}
+//	GET  /keys/:ref                                         -> {"ref", "publicKey"}
+//	POST /keys/:ref/sign   {"hash", "digest"}              -> {"signature"}
+//
+// publicKey is PKIX DER. hash is the Go name of the digest algorithm, e.g. SHA-256,
+// and empty for Ed25519 keys which sign the whole message passed as digest.
+type RemoteKeyBackend struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewRemoteKeyBackend creates a backend for the signing service at baseURL, token is sent as bearer token
+func NewRemoteKeyBackend(baseURL, token string) (*RemoteKeyBackend, error) {
+	if _, err := url.ParseRequestURI(baseURL); err != nil {
+		return nil, fmt.Errorf("invalid signing service URL: %w", err)
+	}
+	return &RemoteKeyBackend{
+		url:    strings.TrimSuffix(baseURL, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// remoteKey is the key description returned by the signing service
+type remoteKey struct {
+	Ref       string `json:"ref"`
+	PublicKey []byte `json:"publicKey"`
+}
+
+// Name returns "remote"
+func (b *RemoteKeyBackend) Name() string {
+	return KeyBackendRemote
+}
+
+// Generate asks the signing service for a new key pair
+func (b *RemoteKeyBackend) Generate(spec KeySpec, label string) (crypto.Signer, error) {
+	var key remoteKey
+	if err := b.call(http.MethodPost, "/keys", map[string]any{"label": label, "spec": spec}, &key); err != nil {
+		return nil, err
+	}
+	return b.signer(key)
+}
+
+// Open looks up an existing key by its reference
+func (b *RemoteKeyBackend) Open(ref string) (crypto.Signer, error) {
+	var key remoteKey
+	if err := b.call(http.MethodGet, "/keys/"+url.PathEscape(ref), nil, &key); err != nil {
+		return nil, err
+	}
+	return b.signer(key)
+}
+
+func (b *RemoteKeyBackend) signer(key remoteKey) (crypto.Signer, error) {
+	pub, err := x509.ParsePKIXPublicKey(key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("signing service returned an invalid public key: %w", err)
+	}
+	if _, err := KeySpecOf(pub); err != nil {
+		return nil, err
+	}
+	return &remoteSigner{backend: b, ref: key.Ref, pub: pub}, nil
+}
+
+// call sends a JSON request to the signing service and decodes the JSON response into out
+func (b *RemoteKeyBackend) call(method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, b.url+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("signing service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("signing service: %s %s: %s %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// remoteSigner signs with a key held by the signing service
+type remoteSigner struct {
+	backend *RemoteKeyBackend
+	ref     string
+	pub     crypto.PublicKey
+}
+
+func (s *remoteSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *remoteSigner) Backend() string {
+	return KeyBackendRemote
+}
+
+func (s *remoteSigner) KeyRef() string {
+	return s.ref
+}
+
+// Sign sends the digest to the signing service, RSA keys sign with PKCS #1 v1.5
+func (s *remoteSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, fmt.Errorf("RSA-PSS is not supported by the remote signer")
+	}
+
+	hash := ""
+	if opts.HashFunc() != 0 {
+		hash = opts.HashFunc().String()
+	}
+
+	var resp struct {
+		Signature []byte `json:"signature"`
+	}
+	req := map[string]any{"hash": hash, "digest": digest}
+	if err := s.backend.call(http.MethodPost, "/keys/"+url.PathEscape(s.ref)+"/sign", req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Signature, nil
+}
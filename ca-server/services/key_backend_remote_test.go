@@ -0,0 +1,249 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ca-server/models"
+	"ca-server/utils"
+)
+
+// stubKMS is a minimal signing service speaking the RemoteKeyBackend protocol, keys stay in its memory
+type stubKMS struct {
+	token string
+	mutex sync.Mutex
+	keys  map[string]crypto.Signer
+}
+
+func newStubKMS(t *testing.T, token string) *httptest.Server {
+	t.Helper()
+
+	kms := &stubKMS{token: token, keys: make(map[string]crypto.Signer)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /keys", kms.generate)
+	mux.HandleFunc("GET /keys/{ref}", kms.get)
+	mux.HandleFunc("POST /keys/{ref}/sign", kms.sign)
+
+	server := httptest.NewServer(kms.authenticate(mux))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (k *stubKMS) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+k.token {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (k *stubKMS) generate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Label string  `json:"label"`
+		Spec  KeySpec `json:"spec"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := req.Spec.Generate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ref := utils.NewRandomID()
+	k.mutex.Lock()
+	k.keys[ref] = key
+	k.mutex.Unlock()
+	k.writeKey(w, ref, key)
+}
+
+func (k *stubKMS) get(w http.ResponseWriter, r *http.Request) {
+	k.mutex.Lock()
+	key, ok := k.keys[r.PathValue("ref")]
+	k.mutex.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	k.writeKey(w, r.PathValue("ref"), key)
+}
+
+func (k *stubKMS) writeKey(w http.ResponseWriter, ref string, key crypto.Signer) {
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(remoteKey{Ref: ref, PublicKey: pub})
+}
+
+func (k *stubKMS) sign(w http.ResponseWriter, r *http.Request) {
+	k.mutex.Lock()
+	key, ok := k.keys[r.PathValue("ref")]
+	k.mutex.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req struct {
+		Hash   string `json:"hash"`
+		Digest []byte `json:"digest"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hashes := map[string]crypto.Hash{"": 0, "SHA-256": crypto.SHA256, "SHA-384": crypto.SHA384, "SHA-512": crypto.SHA512}
+	hash, ok := hashes[req.Hash]
+	if !ok {
+		http.Error(w, "unsupported hash", http.StatusBadRequest)
+		return
+	}
+
+	sig, err := key.Sign(rand.Reader, req.Digest, hash)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string][]byte{"signature": sig})
+}
+
+// newBackendCA creates a self-signed CA whose key is generated by backend
+func newBackendCA(t *testing.T, backend KeyBackend, spec string) *models.CA {
+	t.Helper()
+
+	keySpec, err := ParseKeySpec(spec)
+	if err != nil {
+		t.Fatalf("Invalid key spec: %v", err)
+	}
+	key, err := backend.Generate(keySpec, "Backend Test CA")
+	if err != nil {
+		t.Fatalf("Failed to generate backend key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Backend Test CA " + spec},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SignatureAlgorithm:    SignatureAlgorithm(key.Public()),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("Failed to self-sign with backend key: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse CA certificate: %v", err)
+	}
+	ca, err := models.NewCA(key, cert, nil)
+	if err != nil {
+		t.Fatalf("Invalid CA: %v", err)
+	}
+	return ca
+}
+
+func TestRemoteBackendSignsForStoredCA(t *testing.T) {
+	server := newStubKMS(t, "kms-token")
+	backend, err := NewRemoteKeyBackend(server.URL, "kms-token")
+	if err != nil {
+		t.Fatalf("Failed to create backend: %v", err)
+	}
+
+	for _, spec := range []string{"ecdsa-P384", "rsa-2048", "ed25519"} {
+		t.Run(spec, func(t *testing.T) {
+			dir := t.TempDir()
+			certPath, keyPath, caDir := filepath.Join(dir, "caCert.pem"), filepath.Join(dir, "caKey.pem"), filepath.Join(dir, "cas")
+
+			caStore, err := models.NewFileCAStore(certPath, keyPath, caDir, nil, true, backend)
+			if err != nil {
+				t.Fatalf("Failed to create CA store: %v", err)
+			}
+			if err := caStore.Save(newBackendCA(t, backend, spec), true); err != nil {
+				t.Fatalf("Failed to save CA: %v", err)
+			}
+
+			// only a reference to the key is written to disk
+			keyFile, err := os.ReadFile(keyPath)
+			if err != nil {
+				t.Fatalf("Failed to read key file: %v", err)
+			}
+			if strings.Contains(string(keyFile), "PRIVATE KEY") || !strings.Contains(string(keyFile), "Backend: remote") {
+				t.Fatalf("Key file holds more than a reference:\n%s", keyFile)
+			}
+
+			// a restarted store reopens the key through the backend
+			caStore, err = models.NewFileCAStore(certPath, keyPath, caDir, nil, false, backend)
+			if err != nil {
+				t.Fatalf("Failed to reload CA store: %v", err)
+			}
+
+			leafKey, err := KeySpec{Algorithm: KeyAlgorithmECDSA, Curve: "P256"}.Generate()
+			if err != nil {
+				t.Fatalf("Failed to generate leaf key: %v", err)
+			}
+			issuer := NewIssuer(models.NewMemoryStore(), caStore, "http://localhost")
+			cert, chain, err := issuer.Sign(context.Background(), "", &x509.Certificate{
+				Subject:     pkix.Name{CommonName: "app.home.lab"},
+				NotBefore:   time.Now(),
+				NotAfter:    time.Now().Add(time.Hour),
+				KeyUsage:    x509.KeyUsageDigitalSignature,
+				ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+				DNSNames:    []string{"app.home.lab"},
+			}, leafKey.Public())
+			if err != nil {
+				t.Fatalf("Failed to issue through remote CA key: %v", err)
+			}
+
+			roots := x509.NewCertPool()
+			roots.AddCert(chain[len(chain)-1])
+			if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: "app.home.lab"}); err != nil {
+				t.Fatalf("Issued certificate does not verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestRemoteBackendErrors(t *testing.T) {
+	server := newStubKMS(t, "kms-token")
+
+	backend, err := NewRemoteKeyBackend(server.URL, "wrong-token")
+	if err != nil {
+		t.Fatalf("Failed to create backend: %v", err)
+	}
+	if _, err := backend.Generate(KeySpec{Algorithm: KeyAlgorithmEd25519}, "denied"); err == nil {
+		t.Fatal("Expected an error for a rejected token")
+	}
+
+	backend, err = NewRemoteKeyBackend(server.URL, "kms-token")
+	if err != nil {
+		t.Fatalf("Failed to create backend: %v", err)
+	}
+	if _, err := backend.Open("missing"); err == nil {
+		t.Fatal("Expected an error for an unknown key reference")
+	}
+	if _, err := NewRemoteKeyBackend("not a url", ""); err == nil {
+		t.Fatal("Expected an error for an invalid URL")
+	}
+}
@@ -0,0 +1,224 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Key algorithms accepted in a KeySpec
+const (
+	KeyAlgorithmRSA     = "rsa"
+	KeyAlgorithmECDSA   = "ecdsa"
+	KeyAlgorithmEd25519 = "ed25519"
+)
+
+const (
+	defaultRSABits = 2048
+	minRSABits     = 2048
+	maxRSABits     = 8192
+)
+
+// curves maps the accepted curve names to their implementation
+var curves = map[string]elliptic.Curve{
+	"P256": elliptic.P256(),
+	"P384": elliptic.P384(),
+	"P521": elliptic.P521(),
+}
+
+// KeySpec selects the algorithm and size of a key pair, e.g. {"algorithm":"rsa","bits":3072},
+// {"algorithm":"ecdsa","curve":"P384"} or {"algorithm":"ed25519"}
+type KeySpec struct {
+	Algorithm string `json:"algorithm"`
+	Bits      int    `json:"bits,omitempty"`
+	Curve     string `json:"curve,omitempty"`
+}
+
+// ParseKeySpec parses the short form used in configuration: rsa-3072, ecdsa-P384 or ed25519
+func ParseKeySpec(s string) (KeySpec, error) {
+	algorithm, param, _ := strings.Cut(strings.TrimSpace(s), "-")
+	spec := KeySpec{Algorithm: algorithm}
+	switch strings.ToLower(algorithm) {
+	case KeyAlgorithmRSA:
+		if param != "" {
+			bits, err := strconv.Atoi(param)
+			if err != nil {
+				return KeySpec{}, fmt.Errorf("invalid RSA key size in %q", s)
+			}
+			spec.Bits = bits
+		}
+	case KeyAlgorithmECDSA:
+		spec.Curve = param
+	case KeyAlgorithmEd25519:
+		if param != "" {
+			return KeySpec{}, fmt.Errorf("ed25519 takes no parameter: %q", s)
+		}
+	}
+	return spec.normalize()
+}
+
+// normalize validates the spec and fills in the default size or curve
+func (k KeySpec) normalize() (KeySpec, error) {
+	k.Algorithm = strings.ToLower(strings.TrimSpace(k.Algorithm))
+	switch k.Algorithm {
+	case KeyAlgorithmRSA:
+		if k.Curve != "" {
+			return KeySpec{}, fmt.Errorf("curve does not apply to RSA keys")
+		}
+		if k.Bits == 0 {
+			k.Bits = defaultRSABits
+		}
+		if k.Bits < minRSABits || k.Bits > maxRSABits || k.Bits%8 != 0 {
+			return KeySpec{}, fmt.Errorf("RSA key size must be a multiple of 8 between %d and %d", minRSABits, maxRSABits)
+		}
+	case KeyAlgorithmECDSA:
+		if k.Bits != 0 {
+			return KeySpec{}, fmt.Errorf("bits does not apply to ECDSA keys, set curve")
+		}
+		k.Curve = strings.ToUpper(strings.ReplaceAll(k.Curve, "-", ""))
+		if k.Curve == "" {
+			k.Curve = "P256"
+		}
+		if _, ok := curves[k.Curve]; !ok {
+			return KeySpec{}, fmt.Errorf("unsupported curve %q, use P256, P384 or P521", k.Curve)
+		}
+	case KeyAlgorithmEd25519:
+		if k.Bits != 0 || k.Curve != "" {
+			return KeySpec{}, fmt.Errorf("ed25519 keys take neither bits nor curve")
+		}
+	default:
+		return KeySpec{}, fmt.Errorf("unsupported key algorithm %q, use rsa, ecdsa or ed25519", k.Algorithm)
+	}
+	return k, nil
+}
+
+// String returns the short form of the spec, as accepted by ParseKeySpec
+func (k KeySpec) String() string {
+	switch k.Algorithm {
+	case KeyAlgorithmRSA:
+		return fmt.Sprintf("%s-%d", k.Algorithm, k.Bits)
+	case KeyAlgorithmECDSA:
+		return k.Algorithm + "-" + k.Curve
+	}
+	return k.Algorithm
+}
+
+// Generate creates a new key pair of the spec, which must be normalized
+func (k KeySpec) Generate() (crypto.Signer, error) {
+	switch k.Algorithm {
+	case KeyAlgorithmRSA:
+		return rsa.GenerateKey(rand.Reader, k.Bits)
+	case KeyAlgorithmECDSA:
+		return ecdsa.GenerateKey(curves[k.Curve], rand.Reader)
+	case KeyAlgorithmEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+	return nil, fmt.Errorf("unsupported key algorithm %q", k.Algorithm)
+}
+
+// KeySpecOf describes an existing public key
+func KeySpecOf(pub crypto.PublicKey) (KeySpec, error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return KeySpec{Algorithm: KeyAlgorithmRSA, Bits: key.N.BitLen()}, nil
+	case *ecdsa.PublicKey:
+		for name, curve := range curves {
+			if key.Curve == curve {
+				return KeySpec{Algorithm: KeyAlgorithmECDSA, Curve: name}, nil
+			}
+		}
+		return KeySpec{}, fmt.Errorf("unsupported ECDSA curve")
+	case ed25519.PublicKey:
+		return KeySpec{Algorithm: KeyAlgorithmEd25519}, nil
+	}
+	return KeySpec{}, fmt.Errorf("unsupported public key type %T", pub)
+}
+
+// SignatureAlgorithm picks the signature algorithm for a signing key, matching the hash to the key strength
+func SignatureAlgorithm(pub crypto.PublicKey) x509.SignatureAlgorithm {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() >= 4096 {
+			return x509.SHA384WithRSA
+		}
+		return x509.SHA256WithRSA
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P384():
+			return x509.ECDSAWithSHA384
+		case elliptic.P521():
+			return x509.ECDSAWithSHA512
+		}
+		return x509.ECDSAWithSHA256
+	case ed25519.PublicKey:
+		return x509.PureEd25519
+	}
+	return x509.UnknownSignatureAlgorithm
+}
+
+// KeyPolicy is the allowlist of key specs the CA generates and certifies
+type KeyPolicy struct {
+	// Allowed holds the short form of every allowed spec, e.g. rsa-3072
+	Allowed []string
+	// Default is used when a request does not ask for a key spec
+	Default KeySpec
+}
+
+// NewKeyPolicy parses the allowlist and default spec from their short forms
+func NewKeyPolicy(allowed []string, defaultSpec string) (*KeyPolicy, error) {
+	p := &KeyPolicy{}
+	for _, s := range allowed {
+		spec, err := ParseKeySpec(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed key spec: %w", err)
+		}
+		p.Allowed = append(p.Allowed, spec.String())
+	}
+
+	spec, err := ParseKeySpec(defaultSpec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default key spec: %w", err)
+	}
+	if !slices.Contains(p.Allowed, spec.String()) {
+		return nil, fmt.Errorf("default key spec %s is not in the allowlist", spec)
+	}
+	p.Default = spec
+	return p, nil
+}
+
+// Resolve validates a requested spec against the allowlist, nil selects the default
+func (p *KeyPolicy) Resolve(spec *KeySpec) (KeySpec, error) {
+	if spec == nil || (spec.Algorithm == "" && spec.Bits == 0 && spec.Curve == "") {
+		return p.Default, nil
+	}
+
+	resolved, err := spec.normalize()
+	if err != nil {
+		return KeySpec{}, err
+	}
+	if !slices.Contains(p.Allowed, resolved.String()) {
+		return KeySpec{}, fmt.Errorf("key spec %s is not allowed, use one of %s", resolved, strings.Join(p.Allowed, ", "))
+	}
+	return resolved, nil
+}
+
+// CheckPublicKey rejects public keys, e.g. from a CSR, whose spec is not in the allowlist
+func (p *KeyPolicy) CheckPublicKey(pub crypto.PublicKey) error {
+	spec, err := KeySpecOf(pub)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(p.Allowed, spec.String()) {
+		return fmt.Errorf("key spec %s is not allowed, use one of %s", spec, strings.Join(p.Allowed, ", "))
+	}
+	return nil
+}
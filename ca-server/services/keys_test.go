@@ -0,0 +1,140 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"testing"
+)
+
+func TestParseKeySpec(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"rsa", "rsa-2048", true},
+		{"RSA-3072", "rsa-3072", true},
+		{"ecdsa", "ecdsa-P256", true},
+		{"ecdsa-p384", "ecdsa-P384", true},
+		{"ecdsa-P-521", "ecdsa-P521", true},
+		{" ed25519 ", "ed25519", true},
+		{"rsa-1024", "", false},
+		{"rsa-2049", "", false},
+		{"rsa-16384", "", false},
+		{"rsa-big", "", false},
+		{"ecdsa-P224", "", false},
+		{"ed25519-256", "", false},
+		{"dsa", "", false},
+		{"", "", false},
+	}
+	for _, tc := range cases {
+		spec, err := ParseKeySpec(tc.in)
+		if (err == nil) != tc.ok || (tc.ok && spec.String() != tc.want) {
+			t.Errorf("%q: expected %q (ok %v), got %q, %v", tc.in, tc.want, tc.ok, spec, err)
+		}
+	}
+}
+
+func TestKeyPolicy(t *testing.T) {
+	policy, err := NewKeyPolicy([]string{"rsa-3072", "ecdsa-P256", "ecdsa-P384", "ed25519"}, "ecdsa-P256")
+	if err != nil {
+		t.Fatalf("Failed to create key policy: %v", err)
+	}
+
+	resolveCases := []struct {
+		name string
+		spec *KeySpec
+		want string
+		ok   bool
+	}{
+		{"unset", nil, "ecdsa-P256", true},
+		{"empty", &KeySpec{}, "ecdsa-P256", true},
+		{"allowed RSA", &KeySpec{Algorithm: "rsa", Bits: 3072}, "rsa-3072", true},
+		{"allowed curve", &KeySpec{Algorithm: "ECDSA", Curve: "P384"}, "ecdsa-P384", true},
+		{"default curve", &KeySpec{Algorithm: "ecdsa"}, "ecdsa-P256", true},
+		{"ed25519", &KeySpec{Algorithm: "ed25519"}, "ed25519", true},
+		{"RSA size outside allowlist", &KeySpec{Algorithm: "rsa", Bits: 4096}, "", false},
+		{"default RSA size outside allowlist", &KeySpec{Algorithm: "rsa"}, "", false},
+		{"curve outside allowlist", &KeySpec{Algorithm: "ecdsa", Curve: "P521"}, "", false},
+		{"curve on RSA", &KeySpec{Algorithm: "rsa", Bits: 3072, Curve: "P256"}, "", false},
+		{"bits on ECDSA", &KeySpec{Algorithm: "ecdsa", Bits: 256}, "", false},
+		{"parameters on ed25519", &KeySpec{Algorithm: "ed25519", Bits: 256}, "", false},
+		{"unknown algorithm", &KeySpec{Algorithm: "dsa"}, "", false},
+	}
+	for _, tc := range resolveCases {
+		spec, err := policy.Resolve(tc.spec)
+		if (err == nil) != tc.ok || (tc.ok && spec.String() != tc.want) {
+			t.Errorf("%s: expected %q (ok %v), got %q, %v", tc.name, tc.want, tc.ok, spec, err)
+		}
+	}
+
+	rsa2048, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p224, _ := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	edPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	publicKeyCases := []struct {
+		name string
+		pub  crypto.PublicKey
+		ok   bool
+	}{
+		{"allowed curve", &p256.PublicKey, true},
+		{"ed25519", edPub, true},
+		{"RSA size outside allowlist", &rsa2048.PublicKey, false},
+		{"unsupported curve", &p224.PublicKey, false},
+		{"unsupported key type", "not a key", false},
+	}
+	for _, tc := range publicKeyCases {
+		if err := policy.CheckPublicKey(tc.pub); (err == nil) != tc.ok {
+			t.Errorf("%s: expected ok %v, got %v", tc.name, tc.ok, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		allowed []string
+		def     string
+	}{
+		{"default outside allowlist", []string{"rsa-3072"}, "ecdsa-P256"},
+		{"invalid allowed spec", []string{"rsa-1024"}, "rsa-1024"},
+		{"invalid default", []string{"ed25519"}, "ed448"},
+	} {
+		if _, err := NewKeyPolicy(tc.allowed, tc.def); err == nil {
+			t.Errorf("%s: expected the key policy to be refused", tc.name)
+		}
+	}
+}
+
+func TestKeySpecGenerate(t *testing.T) {
+	cases := []struct {
+		spec   string
+		sigAlg x509.SignatureAlgorithm
+	}{
+		{"rsa-2048", x509.SHA256WithRSA},
+		{"rsa-4096", x509.SHA384WithRSA},
+		{"ecdsa-P256", x509.ECDSAWithSHA256},
+		{"ecdsa-P384", x509.ECDSAWithSHA384},
+		{"ecdsa-P521", x509.ECDSAWithSHA512},
+		{"ed25519", x509.PureEd25519},
+	}
+	for _, tc := range cases {
+		spec, err := ParseKeySpec(tc.spec)
+		if err != nil {
+			t.Fatalf("%s: invalid key spec: %v", tc.spec, err)
+		}
+		key, err := spec.Generate()
+		if err != nil {
+			t.Fatalf("%s: failed to generate key: %v", tc.spec, err)
+		}
+		if got, err := KeySpecOf(key.Public()); err != nil || got != spec {
+			t.Errorf("%s: expected the generated key to match its spec, got %q, %v", tc.spec, got, err)
+		}
+		if got := SignatureAlgorithm(key.Public()); got != tc.sigAlg {
+			t.Errorf("%s: expected signature algorithm %v, got %v", tc.spec, tc.sigAlg, got)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// ExpiryNotice is sent when a certificate crosses an expiry threshold
+type ExpiryNotice struct {
+	SerialNumber string    `json:"serialNumber"`
+	Subject      string    `json:"subject"`
+	DNSNames     []string  `json:"dnsNames,omitempty"`
+	NotAfter     time.Time `json:"notAfter"`
+	DaysLeft     int       `json:"daysLeft"`
+	// ThresholdDays is the threshold that was crossed, e.g. 30, 7 or 1
+	ThresholdDays int `json:"thresholdDays"`
+}
+
+// Notifier delivers expiry notices to one sink
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, notice ExpiryNotice) error
+}
+
+// LogNotifier writes expiry notices to the server log
+type LogNotifier struct{}
+
+// Name returns "log"
+func (LogNotifier) Name() string {
+	return "log"
+}
+
+// Notify logs the notice
+func (LogNotifier) Notify(_ context.Context, n ExpiryNotice) error {
+	log.Printf("Certificate %s (%s) expires in %d days on %s", n.SerialNumber, n.Subject, n.DaysLeft, n.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// WebhookNotifier POSTs expiry notices as JSON to a URL
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookNotifier creates a webhook sink, any 2xx answer counts as delivered
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Name returns "webhook"
+func (w *WebhookNotifier) Name() string {
+	return "webhook"
+}
+
+// Notify posts the notice as JSON
+func (w *WebhookNotifier) Notify(ctx context.Context, n ExpiryNotice) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// SMTPNotifier mails expiry notices, authenticating only when a username is set
+type SMTPNotifier struct {
+	addr string
+	from string
+	to   []string
+	auth smtp.Auth
+}
+
+// NewSMTPNotifier creates a mail sink for the server at addr (host:port)
+func NewSMTPNotifier(addr, from string, to []string, username, password string) (*SMTPNotifier, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP address %q: %w", addr, err)
+	}
+	if len(to) == 0 {
+		return nil, fmt.Errorf("SMTP notifications need at least one recipient")
+	}
+
+	n := &SMTPNotifier{addr: addr, from: from, to: to}
+	if username != "" {
+		// net/smtp refuses plain auth without TLS except to localhost
+		n.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return n, nil
+}
+
+// Name returns "smtp"
+func (s *SMTPNotifier) Name() string {
+	return "smtp"
+}
+
+// Notify mails a plain text notice to every recipient
+func (s *SMTPNotifier) Notify(_ context.Context, n ExpiryNotice) error {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&msg, "Subject: Certificate %s expires in %d days\r\n", n.Subject, n.DaysLeft)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "Subject:       %s\r\n", n.Subject)
+	fmt.Fprintf(&msg, "Serial number: %s\r\n", n.SerialNumber)
+	if len(n.DNSNames) > 0 {
+		fmt.Fprintf(&msg, "DNS names:     %s\r\n", strings.Join(n.DNSNames, ", "))
+	}
+	fmt.Fprintf(&msg, "Expires:       %s\r\n", n.NotAfter.Format(time.RFC1123))
+	fmt.Fprintf(&msg, "\r\nRenew it with POST /api/certs/%s/renew\r\n", n.SerialNumber)
+
+	return smtp.SendMail(s.addr, s.auth, s.from, s.to, []byte(msg.String()))
+}
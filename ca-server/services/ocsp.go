@@ -0,0 +1,235 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"ca-server/models"
+	"ca-server/utils"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSPService answers RFC 6960 status requests for certificates issued by the managed CAs
+type OCSPService struct {
+	store      models.CertStore
+	caStore    models.CAStore
+	nextUpdate time.Duration
+
+	// delegated responder, when nil responses are signed by the CA itself
+	signer     crypto.Signer
+	signerCert *x509.Certificate
+
+	mutex sync.Mutex
+	cache map[string]cachedOCSPResponse
+	// generation counts invalidations, a response signed across one is not cached
+	generation uint64
+}
+
+// maxOCSPCacheEntries bounds the cached responses, the expired ones and then those expiring first are dropped
+const maxOCSPCacheEntries = 10000
+
+type cachedOCSPResponse struct {
+	der     []byte
+	issuer  *x509.Certificate
+	expires time.Time
+}
+
+// NewOCSPService creates an OCSP responder whose responses are valid for nextUpdate.
+// When signerCertPath and signerKeyPath are set, responses are signed by that delegated
+// OCSP signing certificate instead of the CA key.
+func NewOCSPService(store models.CertStore, caStore models.CAStore, nextUpdate time.Duration, signerCertPath, signerKeyPath string) (*OCSPService, error) {
+	s := &OCSPService{
+		store:      store,
+		caStore:    caStore,
+		nextUpdate: nextUpdate,
+		cache:      make(map[string]cachedOCSPResponse),
+	}
+
+	if signerCertPath == "" && signerKeyPath == "" {
+		return s, nil
+	}
+
+	signer, signerCert, err := loadKeyPair(signerCertPath, signerKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load OCSP signer: %w", err)
+	}
+	if !slices.Contains(signerCert.ExtKeyUsage, x509.ExtKeyUsageOCSPSigning) {
+		return nil, fmt.Errorf("OCSP signer %s lacks the OCSPSigning extended key usage", signerCertPath)
+	}
+	s.signer = signer
+	s.signerCert = signerCert
+	return s, nil
+}
+
+// Respond parses a DER encoded OCSP request and returns the DER encoded response
+func (s *OCSPService) Respond(ctx context.Context, reqDER []byte) ([]byte, error) {
+	req, err := ocsp.ParseRequest(reqDER)
+	if err != nil {
+		return ocsp.MalformedRequestErrorResponse, nil
+	}
+
+	ca := s.findCA(req)
+	if ca == nil {
+		return ocsp.UnauthorizedErrorResponse, nil
+	}
+	caCert := ca.Cert
+
+	serial := req.SerialNumber.String()
+
+	s.mutex.Lock()
+	cached, ok := s.cache[serial]
+	generation := s.generation
+	s.mutex.Unlock()
+	if ok && cached.issuer == caCert && time.Now().Before(cached.expires) {
+		return cached.der, nil
+	}
+
+	now := time.Now()
+	tmpl := ocsp.Response{
+		SerialNumber: req.SerialNumber,
+		Status:       ocsp.Unknown,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(s.nextUpdate),
+	}
+
+	cert, err := s.store.GetCert(ctx, serial)
+	known := err == nil && cert.AuthorityKeyID == ca.ID()
+	if known {
+		tmpl.Status = ocsp.Good
+		if cert.IsRevoked() {
+			tmpl.Status = ocsp.Revoked
+			tmpl.RevokedAt = *cert.RevokedAt
+			tmpl.RevocationReason = cert.RevocationCode
+		}
+	}
+
+	var signer crypto.Signer = ca.Signer
+	responderCert := caCert
+	if s.signer != nil && s.signerCert.CheckSignatureFrom(caCert) == nil {
+		signer = s.signer
+		responderCert = s.signerCert
+		tmpl.Certificate = s.signerCert
+	}
+
+	der, err := ocsp.CreateResponse(caCert, responderCert, tmpl, signer)
+	if errors.Is(err, models.ErrCASealed) {
+		return ocsp.TryLaterErrorResponse, nil
+	}
+	if err != nil {
+		return ocsp.InternalErrorErrorResponse, fmt.Errorf("failed to create OCSP response: %w", err)
+	}
+
+	// only certificates of the inventory are cached, anyone may ask about any serial
+	if known {
+		// refresh well before relying parties see the response expire
+		s.cacheResponse(serial, cachedOCSPResponse{der: der, issuer: caCert, expires: now.Add(s.nextUpdate / 2)}, generation)
+	}
+	return der, nil
+}
+
+// cacheResponse caches the response of serial unless a status change was invalidated since generation
+func (s *OCSPService) cacheResponse(serial string, resp cachedOCSPResponse, generation uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.generation != generation {
+		return
+	}
+	if _, ok := s.cache[serial]; !ok && len(s.cache) >= maxOCSPCacheEntries {
+		now := time.Now()
+		for key, cached := range s.cache {
+			if !now.Before(cached.expires) {
+				delete(s.cache, key)
+			}
+		}
+		for len(s.cache) >= maxOCSPCacheEntries {
+			first := ""
+			for key, cached := range s.cache {
+				if first == "" || cached.expires.Before(s.cache[first].expires) {
+					first = key
+				}
+			}
+			delete(s.cache, first)
+		}
+	}
+	s.cache[serial] = resp
+}
+
+// findCA returns the CA whose public key the request names as issuer
+func (s *OCSPService) findCA(req *ocsp.Request) *models.CA {
+	for _, ca := range s.caStore.List() {
+		keyHash, err := publicKeyHash(ca.Cert, req.HashAlgorithm)
+		if err == nil && bytes.Equal(keyHash, req.IssuerKeyHash) {
+			return ca
+		}
+	}
+	return nil
+}
+
+// MaxAge is how long HTTP caches may keep a response
+func (s *OCSPService) MaxAge() time.Duration {
+	return s.nextUpdate / 2
+}
+
+// Invalidate drops the cached response of a certificate, called when its status changes
+func (s *OCSPService) Invalidate(serial string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.cache, serial)
+	s.generation++
+}
+
+// publicKeyHash hashes the subject public key bit string of cert, as used in an OCSP CertID
+func publicKeyHash(cert *x509.Certificate, hash crypto.Hash) ([]byte, error) {
+	var spki struct {
+		Algorithm        asn1.RawValue
+		SubjectPublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, err
+	}
+	if !hash.Available() {
+		return nil, errors.New("unsupported hash algorithm")
+	}
+
+	h := hash.New()
+	h.Write(spki.SubjectPublicKey.RightAlign())
+	return h.Sum(nil), nil
+}
+
+// loadKeyPair reads a PEM certificate and private key from disk
+func loadKeyPair(certPath, keyPath string) (crypto.Signer, *x509.Certificate, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := models.ParseCertificate(certPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse certificate %s: %w", certPath, err)
+	}
+	signer, err := utils.ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse key %s: %w", keyPath, err)
+	}
+	if !utils.PublicKeysEqual(signer.Public(), cert.X509Certificate.PublicKey) {
+		return nil, nil, fmt.Errorf("key %s does not match certificate %s", keyPath, certPath)
+	}
+
+	return signer, cert.X509Certificate, nil
+}
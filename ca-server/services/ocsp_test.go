@@ -0,0 +1,207 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ca-server/models"
+	"ca-server/utils"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestOCSPService(t *testing.T) {
+	ctx := context.Background()
+	store := models.NewMemoryStore()
+	caStore := newSnapshotCAStore(t, nil)
+	ca := newBackendCA(t, FileKeyBackend{}, "ecdsa-P256")
+	if err := caStore.Save(ca, true); err != nil {
+		t.Fatalf("Failed to save CA: %v", err)
+	}
+	issuer := NewIssuer(store, caStore, "http://localhost")
+	issue := func(name string, ekus ...x509.ExtKeyUsage) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		cert, _, err := issuer.Sign(ctx, "", &x509.Certificate{
+			Subject:     pkix.Name{CommonName: name},
+			NotBefore:   time.Now().Add(-time.Minute),
+			NotAfter:    time.Now().Add(time.Hour),
+			ExtKeyUsage: ekus,
+		}, &key.PublicKey)
+		if err != nil {
+			t.Fatalf("Failed to issue %s: %v", name, err)
+		}
+		return cert, key
+	}
+
+	good, _ := issue("good.home.lab")
+	revoked, _ := issue("revoked.home.lab")
+	revokedAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	if _, err := store.RevokeCert(ctx, revoked.SerialNumber.String(), 1, revokedAt); err != nil {
+		t.Fatalf("Failed to revoke: %v", err)
+	}
+	// signed by the CA but never recorded in the inventory
+	unknown := *good
+	unknown.SerialNumber = utils.NewSerialNum()
+	foreign := newBackendCA(t, FileKeyBackend{}, "ecdsa-P256")
+
+	// a delegated responder certified by the CA
+	responderCert, responderKey := issue("OCSP Responder", x509.ExtKeyUsageOCSPSigning)
+	dir := t.TempDir()
+	keyDER, err := x509.MarshalPKCS8PrivateKey(responderKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	certPath, keyPath := filepath.Join(dir, "ocsp.pem"), filepath.Join(dir, "ocsp.key")
+	writeFile(t, certPath, utils.EncodeCertsPEM(responderCert))
+	writeFile(t, keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+
+	cases := []struct {
+		name      string
+		cert      *x509.Certificate
+		issuer    *x509.Certificate
+		delegated bool
+		status    int
+	}{
+		{"good", good, ca.Cert, false, ocsp.Good},
+		{"revoked", revoked, ca.Cert, false, ocsp.Revoked},
+		{"not in the inventory", &unknown, ca.Cert, false, ocsp.Unknown},
+		{"good, delegated", good, ca.Cert, true, ocsp.Good},
+		{"revoked, delegated", revoked, ca.Cert, true, ocsp.Revoked},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var signerCertPath, signerKeyPath string
+			if tc.delegated {
+				signerCertPath, signerKeyPath = certPath, keyPath
+			}
+			service, err := NewOCSPService(store, caStore, time.Hour, signerCertPath, signerKeyPath)
+			if err != nil {
+				t.Fatalf("Failed to create OCSP service: %v", err)
+			}
+			req, err := ocsp.CreateRequest(tc.cert, tc.issuer, nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			der, err := service.Respond(ctx, req)
+			if err != nil {
+				t.Fatalf("Failed to respond: %v", err)
+			}
+			resp, err := ocsp.ParseResponseForCert(der, tc.cert, tc.issuer)
+			if err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if resp.Status != tc.status {
+				t.Errorf("Expected status %d, got %d", tc.status, resp.Status)
+			}
+			if got := resp.NextUpdate.Sub(resp.ThisUpdate); got != time.Hour {
+				t.Errorf("Expected the response valid for an hour, got %v", got)
+			}
+			if tc.status == ocsp.Revoked && (resp.RevocationReason != 1 || !resp.RevokedAt.Equal(revokedAt)) {
+				t.Errorf("Expected reason 1 at %v, got %d at %v", revokedAt, resp.RevocationReason, resp.RevokedAt)
+			}
+			if delegated := resp.Certificate != nil && resp.Certificate.Equal(responderCert); delegated != tc.delegated {
+				t.Errorf("Expected a delegated responder %v, got certificate %v", tc.delegated, resp.Certificate)
+			}
+
+			// serials outside the inventory are answered afresh, anyone could fill the cache with them
+			if _, ok := service.cache[tc.cert.SerialNumber.String()]; ok != (tc.status != ocsp.Unknown) {
+				t.Errorf("Expected the response cached %v, got %v", tc.status != ocsp.Unknown, ok)
+			}
+			if cached, _ := service.Respond(ctx, req); tc.status != ocsp.Unknown && !bytes.Equal(cached, der) {
+				t.Error("Expected the cached response to be served")
+			}
+		})
+	}
+
+	service, err := NewOCSPService(store, caStore, time.Hour, "", "")
+	if err != nil {
+		t.Fatalf("Failed to create OCSP service: %v", err)
+	}
+	errorCases := []struct {
+		name string
+		req  func() []byte
+		want []byte
+	}{
+		{"malformed", func() []byte { return []byte("not a request") }, ocsp.MalformedRequestErrorResponse},
+		{"unknown CA", func() []byte {
+			req, _ := ocsp.CreateRequest(good, foreign.Cert, nil)
+			return req
+		}, ocsp.UnauthorizedErrorResponse},
+	}
+	for _, tc := range errorCases {
+		if der, err := service.Respond(ctx, tc.req()); err != nil || !bytes.Equal(der, tc.want) {
+			t.Errorf("%s: expected the error response %x, got %x, %v", tc.name, tc.want, der, err)
+		}
+	}
+
+	// a revocation shows as soon as the cached response is invalidated
+	req, _ := ocsp.CreateRequest(good, ca.Cert, nil)
+	if _, err := service.Respond(ctx, req); err != nil {
+		t.Fatalf("Failed to respond: %v", err)
+	}
+	if _, err := store.RevokeCert(ctx, good.SerialNumber.String(), 4, time.Now()); err != nil {
+		t.Fatalf("Failed to revoke: %v", err)
+	}
+	service.Invalidate(good.SerialNumber.String())
+	der, _ := service.Respond(ctx, req)
+	if resp, err := ocsp.ParseResponseForCert(der, good, ca.Cert); err != nil || resp.Status != ocsp.Revoked {
+		t.Errorf("Expected the invalidated response to report the revocation, got %+v, %v", resp, err)
+	}
+
+	// a full cache drops its expired responses first, then those expiring first
+	service.cache = make(map[string]cachedOCSPResponse)
+	for i := range maxOCSPCacheEntries {
+		expires := time.Now().Add(time.Duration(i+1) * time.Minute)
+		if i%2 == 0 {
+			expires = time.Now().Add(-time.Minute)
+		}
+		service.cache[fmt.Sprint(i)] = cachedOCSPResponse{expires: expires}
+	}
+	req, _ = ocsp.CreateRequest(revoked, ca.Cert, nil)
+	if _, err := service.Respond(ctx, req); err != nil {
+		t.Fatalf("Failed to respond: %v", err)
+	}
+	if _, ok := service.cache[revoked.SerialNumber.String()]; !ok || len(service.cache) != maxOCSPCacheEntries/2+1 {
+		t.Errorf("Expected the expired responses dropped for the new one, got %d cached", len(service.cache))
+	}
+	for i := range maxOCSPCacheEntries / 2 {
+		service.cache[fmt.Sprintf("fresh-%d", i)] = cachedOCSPResponse{expires: time.Now().Add(time.Duration(i+1) * time.Hour)}
+	}
+	service.Invalidate(revoked.SerialNumber.String())
+	if _, err := service.Respond(ctx, req); err != nil {
+		t.Fatalf("Failed to respond: %v", err)
+	}
+	if _, ok := service.cache["1"]; ok || len(service.cache) != maxOCSPCacheEntries {
+		t.Errorf("Expected the response expiring first dropped, got %d cached", len(service.cache))
+	}
+
+	if _, err := NewOCSPService(store, caStore, time.Hour, filepath.Join(dir, "missing.pem"), keyPath); err == nil {
+		t.Error("Expected a missing signer certificate to be refused")
+	}
+	serverCert, serverKey := issue("server.home.lab", x509.ExtKeyUsageServerAuth)
+	serverKeyDER, _ := x509.MarshalPKCS8PrivateKey(serverKey)
+	writeFile(t, certPath, utils.EncodeCertsPEM(serverCert))
+	writeFile(t, keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: serverKeyDER}))
+	if _, err := NewOCSPService(store, caStore, time.Hour, certPath, keyPath); err == nil {
+		t.Error("Expected a signer without the OCSPSigning usage to be refused")
+	}
+}
+
+// writeFile writes data to path or fails the test
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"ca-server/utils"
+)
+
+// ExtKeyUsages maps the names accepted in requests to their x509 values
+var ExtKeyUsages = map[string]x509.ExtKeyUsage{
+	"serverAuth":      x509.ExtKeyUsageServerAuth,
+	"clientAuth":      x509.ExtKeyUsageClientAuth,
+	"codeSigning":     x509.ExtKeyUsageCodeSigning,
+	"emailProtection": x509.ExtKeyUsageEmailProtection,
+	"ocspSigning":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// CSRPolicy restricts what a submitted CSR may ask for
+type CSRPolicy struct {
+	// AllowedDomains lists the DNS suffixes a SAN may use, empty allows any name
+	AllowedDomains      []string
+	AllowIPAddresses    bool
+	AllowedExtKeyUsages []string
+	MinRSABits          int
+	// Keys is the allowlist of key specs, nil accepts any supported key
+	Keys *KeyPolicy
+}
+
+// Check validates the key, common name and SANs of a CSR against the policy. Email SANs are
+// refused unless emails is set, for profiles that vet them against their own rules.
+func (p *CSRPolicy) Check(csr *x509.CertificateRequest, emails bool) error {
+	if err := p.CheckPublicKey(csr.PublicKey); err != nil {
+		return err
+	}
+
+	if csr.Subject.CommonName == "" && len(csr.DNSNames) == 0 && len(csr.IPAddresses) == 0 && len(csr.EmailAddresses) == 0 {
+		return fmt.Errorf("csr must carry a common name or at least one SAN")
+	}
+	if len(csr.URIs) > 0 {
+		return fmt.Errorf("URI SANs are not allowed by policy")
+	}
+	if len(csr.EmailAddresses) > 0 && !emails {
+		return fmt.Errorf("email SANs are not allowed by policy")
+	}
+
+	for _, name := range csr.DNSNames {
+		if err := p.checkDNSName(name); err != nil {
+			return err
+		}
+	}
+	if len(csr.IPAddresses) > 0 && !p.AllowIPAddresses {
+		return fmt.Errorf("IP address SANs are not allowed by policy")
+	}
+	return p.checkCommonName(csr)
+}
+
+// checkCommonName accepts an empty common name, an allowed DNS name, an IP address when those are
+// allowed, or one of the email SANs, which were checked along with the other SANs
+func (p *CSRPolicy) checkCommonName(csr *x509.CertificateRequest) error {
+	cn := csr.Subject.CommonName
+	switch {
+	case cn == "":
+		return nil
+	case net.ParseIP(cn) != nil:
+		if !p.AllowIPAddresses {
+			return fmt.Errorf("IP address common names are not allowed by policy")
+		}
+		return nil
+	case strings.Contains(cn, "@"):
+		for _, email := range csr.EmailAddresses {
+			if strings.EqualFold(cn, email) {
+				return nil
+			}
+		}
+		return fmt.Errorf("common name %q must also be an email SAN", cn)
+	}
+	if err := p.checkDNSName(cn); err != nil {
+		return fmt.Errorf("common name: %w", err)
+	}
+	return nil
+}
+
+// checkDNSName accepts valid DNS names within the allowed domains
+func (p *CSRPolicy) checkDNSName(name string) error {
+	if !utils.IsValidDNSName(strings.ToLower(name)) {
+		return fmt.Errorf("invalid DNS name: %q", name)
+	}
+	if !utils.DomainAllowed(name, p.AllowedDomains) {
+		return fmt.Errorf("DNS name %q is not allowed by policy", name)
+	}
+	return nil
+}
+
+// ExtKeyUsages returns the extended key usages named in requested, serverAuth when none,
+// refusing any the policy does not allow
+func (p *CSRPolicy) ExtKeyUsages(requested []string) ([]x509.ExtKeyUsage, error) {
+	if len(requested) == 0 {
+		requested = []string{"serverAuth"}
+	}
+	usages := make([]x509.ExtKeyUsage, 0, len(requested))
+	for _, name := range requested {
+		usage, ok := ExtKeyUsages[name]
+		if !ok || !slices.Contains(p.AllowedExtKeyUsages, name) {
+			return nil, fmt.Errorf("extended key usage %q is not allowed by policy", name)
+		}
+		usages = append(usages, usage)
+	}
+	return usages, nil
+}
+
+// CSRSubject returns the subject to certify for a CSR. Only the common name, organization,
+// organizational unit, locality, province and country are kept, other attributes of the
+// request, including extra names, are dropped.
+func CSRSubject(subject pkix.Name) pkix.Name {
+	return pkix.Name{
+		CommonName:         subject.CommonName,
+		Organization:       subject.Organization,
+		OrganizationalUnit: subject.OrganizationalUnit,
+		Locality:           subject.Locality,
+		Province:           subject.Province,
+		Country:            subject.Country,
+	}
+}
+
+// CheckPublicKey rejects key types and sizes the CA is not willing to certify
+func (p *CSRPolicy) CheckPublicKey(pub any) error {
+	if key, ok := pub.(*rsa.PublicKey); ok && key.N.BitLen() < p.MinRSABits {
+		return fmt.Errorf("RSA keys must be at least %d bits", p.MinRSABits)
+	}
+	if p.Keys == nil {
+		_, err := KeySpecOf(pub)
+		return err
+	}
+	return p.Keys.CheckPublicKey(pub)
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestCSRPolicyCheck(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	policy := CSRPolicy{AllowedDomains: []string{"example.com"}, MinRSABits: 2048}
+	withIPs := policy
+	withIPs.AllowIPAddresses = true
+
+	cases := []struct {
+		name   string
+		policy CSRPolicy
+		csr    x509.CertificateRequest
+		emails bool
+		ok     bool
+	}{
+		{"DNS name", policy, x509.CertificateRequest{DNSNames: []string{"www.example.com"}}, false, true},
+		{"common name in domain", policy, x509.CertificateRequest{Subject: pkix.Name{CommonName: "www.example.com"}}, false, true},
+		{"wildcard", policy, x509.CertificateRequest{DNSNames: []string{"*.example.com"}}, false, true},
+		{"nothing to certify", policy, x509.CertificateRequest{Subject: pkix.Name{Organization: []string{"Example"}}}, false, false},
+		{"DNS name outside domains", policy, x509.CertificateRequest{DNSNames: []string{"www.example.org"}}, false, false},
+		{"invalid DNS name", policy, x509.CertificateRequest{DNSNames: []string{"www_example.com"}}, false, false},
+		{"common name outside domains", policy, x509.CertificateRequest{Subject: pkix.Name{CommonName: "www.example.org"}, DNSNames: []string{"www.example.com"}}, false, false},
+		{"common name not a DNS name", policy, x509.CertificateRequest{Subject: pkix.Name{CommonName: "Example Corp"}, DNSNames: []string{"www.example.com"}}, false, false},
+		{"IP SAN refused", policy, x509.CertificateRequest{IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}}, false, false},
+		{"IP common name refused", policy, x509.CertificateRequest{Subject: pkix.Name{CommonName: "10.0.0.1"}}, false, false},
+		{"IP SAN allowed", withIPs, x509.CertificateRequest{IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}}, false, true},
+		{"IP common name allowed", withIPs, x509.CertificateRequest{Subject: pkix.Name{CommonName: "10.0.0.1"}}, false, true},
+		{"email SAN without profile", policy, x509.CertificateRequest{EmailAddresses: []string{"alice@example.com"}}, false, false},
+		{"email SAN with profile", policy, x509.CertificateRequest{EmailAddresses: []string{"alice@example.com"}}, true, true},
+		{"email common name in SANs", policy, x509.CertificateRequest{Subject: pkix.Name{CommonName: "Alice@example.com"}, EmailAddresses: []string{"alice@example.com"}}, true, true},
+		{"email common name not in SANs", policy, x509.CertificateRequest{Subject: pkix.Name{CommonName: "bob@example.com"}, EmailAddresses: []string{"alice@example.com"}}, true, false},
+		{"URI SAN", policy, x509.CertificateRequest{DNSNames: []string{"www.example.com"}, URIs: []*url.URL{{Scheme: "spiffe", Host: "example.com"}}}, true, false},
+		{"weak RSA key", policy, x509.CertificateRequest{DNSNames: []string{"www.example.com"}, PublicKey: &rsaKey.PublicKey}, false, false},
+	}
+	for _, tc := range cases {
+		if tc.csr.PublicKey == nil {
+			tc.csr.PublicKey = &ecKey.PublicKey
+		}
+		err := tc.policy.Check(&tc.csr, tc.emails)
+		if tc.ok && err != nil {
+			t.Errorf("%s: expected the CSR to pass, got %v", tc.name, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%s: expected the CSR to be refused", tc.name)
+		}
+	}
+}
+
+func TestCSRPolicyExtKeyUsages(t *testing.T) {
+	policy := CSRPolicy{AllowedExtKeyUsages: []string{"serverAuth", "clientAuth"}}
+	cases := []struct {
+		name      string
+		requested []string
+		want      []x509.ExtKeyUsage
+		ok        bool
+	}{
+		{"default", nil, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, true},
+		{"allowed", []string{"clientAuth", "serverAuth"}, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth}, true},
+		{"not allowed", []string{"codeSigning"}, nil, false},
+		{"unknown", []string{"anything"}, nil, false},
+	}
+	for _, tc := range cases {
+		got, err := policy.ExtKeyUsages(tc.requested)
+		if (err == nil) != tc.ok || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: expected %v (ok %v), got %v, %v", tc.name, tc.want, tc.ok, got, err)
+		}
+	}
+}
+
+func TestCSRSubject(t *testing.T) {
+	requested := pkix.Name{
+		CommonName:         "www.example.com",
+		Organization:       []string{"Example"},
+		OrganizationalUnit: []string{"Web"},
+		Locality:           []string{"Berlin"},
+		Province:           []string{"Berlin"},
+		Country:            []string{"DE"},
+		SerialNumber:       "42",
+		StreetAddress:      []string{"Main Street 1"},
+		PostalCode:         []string{"10115"},
+		ExtraNames:         []pkix.AttributeTypeAndValue{{Type: asn1.ObjectIdentifier{2, 5, 4, 3}, Value: "admin.example.com"}},
+	}
+	want := pkix.Name{
+		CommonName:         "www.example.com",
+		Organization:       []string{"Example"},
+		OrganizationalUnit: []string{"Web"},
+		Locality:           []string{"Berlin"},
+		Province:           []string{"Berlin"},
+		Country:            []string{"DE"},
+	}
+	if got := CSRSubject(requested); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected only the whitelisted attributes, got %+v", got)
+	}
+}
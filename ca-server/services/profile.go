@@ -0,0 +1,284 @@
+package services
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"ca-server/models"
+	"ca-server/utils"
+)
+
+// KeyUsages maps the key usage names accepted in profiles to their x509 values
+var KeyUsages = map[string]x509.KeyUsage{
+	"digitalSignature":  x509.KeyUsageDigitalSignature,
+	"contentCommitment": x509.KeyUsageContentCommitment,
+	"keyEncipherment":   x509.KeyUsageKeyEncipherment,
+	"dataEncipherment":  x509.KeyUsageDataEncipherment,
+	"keyAgreement":      x509.KeyUsageKeyAgreement,
+}
+
+// profileNamePattern restricts profile names to URL friendly slugs
+var profileNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// anyIP allows every IPv4 and IPv6 address
+var anyIP = []string{"0.0.0.0/0", "::/0"}
+
+// DefaultProfiles returns the built-in profiles, valid for at most maxValidDays
+func DefaultProfiles(maxValidDays int) []*models.Profile {
+	defaultValidDays := min(365, maxValidDays)
+	return []*models.Profile{
+		{
+			Name:             "server",
+			Description:      "TLS server",
+			KeyUsages:        []string{"digitalSignature", "keyEncipherment"},
+			ExtKeyUsages:     []string{"serverAuth"},
+			DefaultValidDays: defaultValidDays,
+			MaxValidDays:     maxValidDays,
+			AllowedDNSNames:  []string{"*"},
+			AllowedIPRanges:  anyIP,
+			RequireSAN:       true,
+		},
+		{
+			Name:             "client",
+			Description:      "TLS client",
+			KeyUsages:        []string{"digitalSignature", "keyEncipherment"},
+			ExtKeyUsages:     []string{"clientAuth"},
+			DefaultValidDays: defaultValidDays,
+			MaxValidDays:     maxValidDays,
+			AllowedDNSNames:  []string{"*"},
+			AllowedIPRanges:  anyIP,
+		},
+		{
+			Name:             "peer",
+			Description:      "TLS server and client, e.g. cluster members",
+			KeyUsages:        []string{"digitalSignature", "keyEncipherment"},
+			ExtKeyUsages:     []string{"serverAuth", "clientAuth"},
+			DefaultValidDays: defaultValidDays,
+			MaxValidDays:     maxValidDays,
+			AllowedDNSNames:  []string{"*"},
+			AllowedIPRanges:  anyIP,
+			RequireSAN:       true,
+		},
+		{
+			Name:             "code-signing",
+			Description:      "Code signing",
+			KeyUsages:        []string{"digitalSignature"},
+			ExtKeyUsages:     []string{"codeSigning"},
+			DefaultValidDays: defaultValidDays,
+			MaxValidDays:     maxValidDays,
+		},
+		{
+			Name:             "email",
+			Description:      "S/MIME email protection",
+			KeyUsages:        []string{"digitalSignature", "keyEncipherment"},
+			ExtKeyUsages:     []string{"emailProtection"},
+			DefaultValidDays: defaultValidDays,
+			MaxValidDays:     maxValidDays,
+			AllowedEmails:    []string{"*"},
+			RequireSAN:       true,
+		},
+	}
+}
+
+// SeedProfiles creates the built-in profiles that are missing from store
+func SeedProfiles(ctx context.Context, store models.ProfileStore, maxValidDays int) error {
+	for _, profile := range DefaultProfiles(maxValidDays) {
+		if _, err := store.GetProfile(ctx, profile.Name); err == nil {
+			continue
+		}
+		if err := store.CreateProfile(ctx, profile); err != nil {
+			return fmt.Errorf("failed to create profile %s: %w", profile.Name, err)
+		}
+		log.Printf("Created built-in profile %s", profile.Name)
+	}
+	return nil
+}
+
+// ValidateProfile checks names, usages, validity and SAN patterns of a profile.
+// maxValidDays is the server-wide ceiling for MaxValidDays.
+func ValidateProfile(p *models.Profile, maxValidDays int) error {
+	if !profileNamePattern.MatchString(p.Name) {
+		return fmt.Errorf("name must be lower case letters, digits and dashes")
+	}
+
+	for _, name := range p.KeyUsages {
+		if _, ok := KeyUsages[name]; !ok {
+			return fmt.Errorf("unknown key usage %q", name)
+		}
+	}
+	if len(p.ExtKeyUsages) == 0 {
+		return fmt.Errorf("at least one extended key usage is required")
+	}
+	for _, name := range p.ExtKeyUsages {
+		if _, ok := ExtKeyUsages[name]; !ok {
+			return fmt.Errorf("unknown extended key usage %q", name)
+		}
+	}
+
+	if p.DefaultValidDays <= 0 || p.MaxValidDays <= 0 {
+		return fmt.Errorf("defaultValidDays and maxValidDays must be positive")
+	}
+	if p.DefaultValidDays > p.MaxValidDays {
+		return fmt.Errorf("defaultValidDays must not exceed maxValidDays")
+	}
+	if p.MaxValidDays > maxValidDays {
+		return fmt.Errorf("maxValidDays must not exceed %d", maxValidDays)
+	}
+
+	for _, pattern := range p.AllowedDNSNames {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid DNS name pattern %q", pattern)
+		}
+	}
+	for _, cidr := range p.AllowedIPRanges {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid IP range %q", cidr)
+		}
+	}
+	for _, pattern := range p.AllowedEmails {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid email pattern %q", pattern)
+		}
+	}
+	if p.RequireSAN && len(p.AllowedDNSNames) == 0 && len(p.AllowedIPRanges) == 0 && len(p.AllowedEmails) == 0 {
+		return fmt.Errorf("requireSAN needs at least one allowed SAN type")
+	}
+	return nil
+}
+
+// ProfileRequest is what a caller asks a profile to certify
+type ProfileRequest struct {
+	Subject        pkix.Name
+	DNSNames       []string
+	IPAddresses    []net.IP
+	EmailAddresses []string
+	// ValidDays of 0 selects the profile default
+	ValidDays int
+}
+
+// ApplyProfile checks the request against the profile and builds the certificate template
+func ApplyProfile(p *models.Profile, req ProfileRequest) (*x509.Certificate, error) {
+	if req.Subject.CommonName == "" && len(req.DNSNames) == 0 && len(req.IPAddresses) == 0 && len(req.EmailAddresses) == 0 {
+		return nil, fmt.Errorf("a common name or at least one SAN is required")
+	}
+	if p.RequireSAN && len(req.DNSNames) == 0 && len(req.IPAddresses) == 0 && len(req.EmailAddresses) == 0 {
+		return nil, fmt.Errorf("profile %s requires at least one SAN", p.Name)
+	}
+
+	for _, name := range req.DNSNames {
+		if !utils.IsValidDNSName(strings.ToLower(name)) {
+			return nil, fmt.Errorf("invalid DNS name: %q", name)
+		}
+		if !matchAny(p.AllowedDNSNames, strings.ToLower(name)) {
+			return nil, fmt.Errorf("DNS name %q is not allowed by profile %s", name, p.Name)
+		}
+	}
+	for _, ip := range req.IPAddresses {
+		if !ipAllowed(p.AllowedIPRanges, ip) {
+			return nil, fmt.Errorf("IP address %s is not allowed by profile %s", ip, p.Name)
+		}
+	}
+	for _, email := range req.EmailAddresses {
+		if !strings.Contains(email, "@") {
+			return nil, fmt.Errorf("invalid email address: %q", email)
+		}
+		if !matchAny(p.AllowedEmails, strings.ToLower(email)) {
+			return nil, fmt.Errorf("email address %q is not allowed by profile %s", email, p.Name)
+		}
+	}
+
+	if err := checkProfileCommonName(p, req); err != nil {
+		return nil, err
+	}
+
+	validDays := req.ValidDays
+	if validDays < 0 {
+		return nil, fmt.Errorf("validDays must be positive")
+	}
+	if validDays == 0 {
+		validDays = p.DefaultValidDays
+	}
+	if validDays > p.MaxValidDays {
+		return nil, fmt.Errorf("validDays must not exceed %d for profile %s", p.MaxValidDays, p.Name)
+	}
+
+	var keyUsage x509.KeyUsage
+	for _, name := range p.KeyUsages {
+		keyUsage |= KeyUsages[name]
+	}
+	extKeyUsage := make([]x509.ExtKeyUsage, 0, len(p.ExtKeyUsages))
+	for _, name := range p.ExtKeyUsages {
+		extKeyUsage = append(extKeyUsage, ExtKeyUsages[name])
+	}
+
+	notBefore := time.Now()
+	return &x509.Certificate{
+		Subject:        req.Subject,
+		NotBefore:      notBefore,
+		NotAfter:       notBefore.Add(time.Duration(validDays) * 24 * time.Hour),
+		KeyUsage:       keyUsage,
+		ExtKeyUsage:    extKeyUsage,
+		DNSNames:       req.DNSNames,
+		IPAddresses:    req.IPAddresses,
+		EmailAddresses: req.EmailAddresses,
+	}, nil
+}
+
+// checkProfileCommonName applies the rules of CSRPolicy.checkCommonName to the profile: the common name is
+// empty, an allowed DNS name or IP address, or one of the email SANs. A profile allowing no SAN type, such
+// as code-signing, certifies no names, its common name is free text.
+func checkProfileCommonName(p *models.Profile, req ProfileRequest) error {
+	cn := req.Subject.CommonName
+	if cn == "" || len(p.AllowedDNSNames) == 0 && len(p.AllowedIPRanges) == 0 && len(p.AllowedEmails) == 0 {
+		return nil
+	}
+	if ip := net.ParseIP(cn); ip != nil {
+		if !ipAllowed(p.AllowedIPRanges, ip) {
+			return fmt.Errorf("common name %s is not an IP address allowed by profile %s", cn, p.Name)
+		}
+		return nil
+	}
+	if strings.Contains(cn, "@") {
+		for _, email := range req.EmailAddresses {
+			if strings.EqualFold(cn, email) {
+				return nil
+			}
+		}
+		return fmt.Errorf("common name %q must also be an email SAN", cn)
+	}
+	if !utils.IsValidDNSName(strings.ToLower(cn)) {
+		return fmt.Errorf("common name: invalid DNS name: %q", cn)
+	}
+	if !matchAny(p.AllowedDNSNames, strings.ToLower(cn)) {
+		return fmt.Errorf("common name %q is not a DNS name allowed by profile %s", cn, p.Name)
+	}
+	return nil
+}
+
+// matchAny reports whether value matches one of the shell patterns
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAllowed reports whether ip lies in one of the CIDR ranges
+func ipAllowed(ranges []string, ip net.IP) bool {
+	for _, cidr := range ranges {
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
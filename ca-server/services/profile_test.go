@@ -0,0 +1,143 @@
+package services
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"ca-server/models"
+)
+
+func TestApplyProfile(t *testing.T) {
+	profiles := make(map[string]*models.Profile)
+	for _, p := range DefaultProfiles(825) {
+		profiles[p.Name] = p
+	}
+	homeLab := &models.Profile{
+		Name:             "home-lab",
+		KeyUsages:        []string{"digitalSignature"},
+		ExtKeyUsages:     []string{"serverAuth"},
+		DefaultValidDays: 30,
+		MaxValidDays:     90,
+		AllowedDNSNames:  []string{"*.home.lab"},
+		AllowedIPRanges:  []string{"10.0.0.0/8"},
+		AllowedEmails:    []string{"*@home.lab"},
+	}
+
+	cases := []struct {
+		name      string
+		profile   *models.Profile
+		req       ProfileRequest
+		keyUsage  x509.KeyUsage
+		ekus      []x509.ExtKeyUsage
+		validDays int
+		ok        bool
+	}{
+		{"server", profiles["server"], ProfileRequest{DNSNames: []string{"web.home.lab"}},
+			x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, 365, true},
+		{"client by common name", profiles["client"], ProfileRequest{Subject: pkix.Name{CommonName: "alice"}, ValidDays: 7},
+			x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, 7, true},
+		{"peer", profiles["peer"], ProfileRequest{IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}},
+			x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}, 365, true},
+		{"code signing", profiles["code-signing"], ProfileRequest{Subject: pkix.Name{CommonName: "Release"}},
+			x509.KeyUsageDigitalSignature, []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}, 365, true},
+		{"email", profiles["email"], ProfileRequest{EmailAddresses: []string{"alice@home.lab"}},
+			x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment, []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection}, 365, true},
+		{"maximum validity", homeLab, ProfileRequest{DNSNames: []string{"Web.Home.Lab"}, ValidDays: 90},
+			x509.KeyUsageDigitalSignature, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, 90, true},
+		{"common name among the SANs", homeLab, ProfileRequest{Subject: pkix.Name{CommonName: "ops@home.lab"}, DNSNames: []string{"web.home.lab"}, EmailAddresses: []string{"Ops@home.lab"}},
+			x509.KeyUsageDigitalSignature, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, 30, true},
+		{"IP common name", homeLab, ProfileRequest{Subject: pkix.Name{CommonName: "10.0.0.1"}, IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}},
+			x509.KeyUsageDigitalSignature, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, 30, true},
+		{"all SAN types", homeLab, ProfileRequest{DNSNames: []string{"web.home.lab"}, IPAddresses: []net.IP{net.ParseIP("10.1.2.3")}, EmailAddresses: []string{"Ops@home.lab"}},
+			x509.KeyUsageDigitalSignature, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, 30, true},
+
+		{"nothing to certify", profiles["client"], ProfileRequest{Subject: pkix.Name{Organization: []string{"Home"}}}, 0, nil, 0, false},
+		{"SAN required", profiles["server"], ProfileRequest{Subject: pkix.Name{CommonName: "web.home.lab"}}, 0, nil, 0, false},
+		{"DNS name outside patterns", homeLab, ProfileRequest{DNSNames: []string{"web.other.lab"}}, 0, nil, 0, false},
+		{"invalid DNS name", homeLab, ProfileRequest{DNSNames: []string{"web_1.home.lab"}}, 0, nil, 0, false},
+		{"IP outside ranges", homeLab, ProfileRequest{IPAddresses: []net.IP{net.ParseIP("192.168.1.1")}}, 0, nil, 0, false},
+		{"email outside patterns", homeLab, ProfileRequest{EmailAddresses: []string{"alice@example.com"}}, 0, nil, 0, false},
+		{"invalid email", homeLab, ProfileRequest{EmailAddresses: []string{"home.lab"}}, 0, nil, 0, false},
+		{"SAN type not allowed", profiles["code-signing"], ProfileRequest{DNSNames: []string{"web.home.lab"}}, 0, nil, 0, false},
+		{"email on server profile", profiles["server"], ProfileRequest{DNSNames: []string{"web.home.lab"}, EmailAddresses: []string{"alice@home.lab"}}, 0, nil, 0, false},
+		{"common name outside patterns", homeLab, ProfileRequest{Subject: pkix.Name{CommonName: "bank.example.com"}, DNSNames: []string{"web.home.lab"}}, 0, nil, 0, false},
+		{"common name outside ranges", homeLab, ProfileRequest{Subject: pkix.Name{CommonName: "192.168.1.1"}, DNSNames: []string{"web.home.lab"}}, 0, nil, 0, false},
+		{"email common name without SAN", homeLab, ProfileRequest{Subject: pkix.Name{CommonName: "ops@home.lab"}, DNSNames: []string{"web.home.lab"}}, 0, nil, 0, false},
+		{"invalid common name", homeLab, ProfileRequest{Subject: pkix.Name{CommonName: "Web Server"}, DNSNames: []string{"web.home.lab"}}, 0, nil, 0, false},
+		{"validity above maximum", homeLab, ProfileRequest{DNSNames: []string{"web.home.lab"}, ValidDays: 91}, 0, nil, 0, false},
+		{"negative validity", homeLab, ProfileRequest{DNSNames: []string{"web.home.lab"}, ValidDays: -1}, 0, nil, 0, false},
+	}
+	for _, tc := range cases {
+		tmpl, err := ApplyProfile(tc.profile, tc.req)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("%s: expected the request to be refused", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected a template, got %v", tc.name, err)
+			continue
+		}
+		if tmpl.KeyUsage != tc.keyUsage || !reflect.DeepEqual(tmpl.ExtKeyUsage, tc.ekus) {
+			t.Errorf("%s: expected usages %v %v, got %v %v", tc.name, tc.keyUsage, tc.ekus, tmpl.KeyUsage, tmpl.ExtKeyUsage)
+		}
+		if got := tmpl.NotAfter.Sub(tmpl.NotBefore); got != time.Duration(tc.validDays)*24*time.Hour {
+			t.Errorf("%s: expected %d days of validity, got %v", tc.name, tc.validDays, got)
+		}
+		if !reflect.DeepEqual(tmpl.Subject, tc.req.Subject) || !reflect.DeepEqual(tmpl.DNSNames, tc.req.DNSNames) ||
+			!reflect.DeepEqual(tmpl.IPAddresses, tc.req.IPAddresses) || !reflect.DeepEqual(tmpl.EmailAddresses, tc.req.EmailAddresses) {
+			t.Errorf("%s: expected the subject and SANs of the request, got %+v", tc.name, tmpl)
+		}
+	}
+}
+
+func TestValidateProfile(t *testing.T) {
+	for _, p := range DefaultProfiles(825) {
+		if err := ValidateProfile(p, 825); err != nil {
+			t.Errorf("Built-in profile %s: %v", p.Name, err)
+		}
+	}
+
+	valid := models.Profile{
+		Name:             "iot",
+		KeyUsages:        []string{"digitalSignature"},
+		ExtKeyUsages:     []string{"clientAuth"},
+		DefaultValidDays: 30,
+		MaxValidDays:     90,
+		AllowedDNSNames:  []string{"*.iot.home.lab"},
+		AllowedIPRanges:  []string{"10.0.0.0/8"},
+		RequireSAN:       true,
+	}
+	cases := []struct {
+		name   string
+		modify func(p *models.Profile)
+		ok     bool
+	}{
+		{"valid", func(p *models.Profile) {}, true},
+		{"no key usages", func(p *models.Profile) { p.KeyUsages = nil }, true},
+		{"upper case name", func(p *models.Profile) { p.Name = "IoT" }, false},
+		{"name with slash", func(p *models.Profile) { p.Name = "iot/devices" }, false},
+		{"unknown key usage", func(p *models.Profile) { p.KeyUsages = []string{"certSign"} }, false},
+		{"no extended key usage", func(p *models.Profile) { p.ExtKeyUsages = nil }, false},
+		{"unknown extended key usage", func(p *models.Profile) { p.ExtKeyUsages = []string{"anything"} }, false},
+		{"no default validity", func(p *models.Profile) { p.DefaultValidDays = 0 }, false},
+		{"default above maximum", func(p *models.Profile) { p.DefaultValidDays = 91 }, false},
+		{"maximum above server ceiling", func(p *models.Profile) { p.MaxValidDays = 826 }, false},
+		{"invalid DNS pattern", func(p *models.Profile) { p.AllowedDNSNames = []string{"[a-"} }, false},
+		{"invalid IP range", func(p *models.Profile) { p.AllowedIPRanges = []string{"10.0.0.0"} }, false},
+		{"invalid email pattern", func(p *models.Profile) { p.AllowedEmails = []string{"[@home.lab"} }, false},
+		{"SAN required but none allowed", func(p *models.Profile) { p.AllowedDNSNames, p.AllowedIPRanges = nil, nil }, false},
+	}
+	for _, tc := range cases {
+		p := valid
+		tc.modify(&p)
+		if err := ValidateProfile(&p, 825); (err == nil) != tc.ok {
+			t.Errorf("%s: expected ok %v, got %v", tc.name, tc.ok, err)
+		}
+	}
+}
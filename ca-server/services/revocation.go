@@ -0,0 +1,159 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"ca-server/models"
+)
+
+// ReasonSuperseded is the RFC 5280 CRLReason of a certificate replaced by a renewal
+const ReasonSuperseded = 4
+
+// RevocationService revokes certificates and republishes the CRL and OCSP answers for them
+type RevocationService struct {
+	store       models.CertStore
+	crlService  *CRLService
+	ocspService *OCSPService
+	audit       models.AuditRecorder
+	// stale holds the IDs of the CAs whose CRL failed to publish, retried by Start
+	stale map[string]bool
+	mutex sync.Mutex
+}
+
+// NewRevocationService creates a revocation service, audit records the revocations made
+// in the background and may be nil
+func NewRevocationService(store models.CertStore, crlService *CRLService, ocspService *OCSPService, audit models.AuditRecorder) *RevocationService {
+	return &RevocationService{
+		store:       store,
+		crlService:  crlService,
+		ocspService: ocspService,
+		audit:       audit,
+		stale:       make(map[string]bool),
+	}
+}
+
+// Revoke marks a certificate as revoked and regenerates the CRL of its CA.
+// The revocation is recorded even when the CRL cannot be published, the error says so
+// and the publication is retried in the background, see Start.
+func (s *RevocationService) Revoke(ctx context.Context, serial string, reason int, revokedAt time.Time) (*models.Certificate, error) {
+	cert, err := s.store.RevokeCert(ctx, serial, reason, revokedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// the revocation is stored, a caller going away must not keep it off the CRL
+	s.ocspService.Invalidate(cert.SerialNumber)
+	if err := s.crlService.Regenerate(context.WithoutCancel(ctx), cert.AuthorityKeyID); err != nil && !errors.Is(err, models.ErrCANotFound) {
+		s.mutex.Lock()
+		s.stale[cert.AuthorityKeyID] = true
+		s.mutex.Unlock()
+		return cert, &CRLPublishError{Err: err}
+	}
+	return cert, nil
+}
+
+// RepublishStale retries the CRLs that failed to publish after a revocation, those failing
+// again are retried on the next call
+func (s *RevocationService) RepublishStale(ctx context.Context) {
+	s.mutex.Lock()
+	caIDs := make([]string, 0, len(s.stale))
+	for caID := range s.stale {
+		caIDs = append(caIDs, caID)
+	}
+	s.mutex.Unlock()
+
+	for _, caID := range caIDs {
+		err := s.crlService.Regenerate(ctx, caID)
+		if err != nil && !errors.Is(err, models.ErrCANotFound) {
+			log.Printf("Failed to republish the CRL of CA %s: %v", caID, err)
+			continue
+		}
+		s.mutex.Lock()
+		delete(s.stale, caID)
+		s.mutex.Unlock()
+		if err == nil {
+			log.Printf("Republished the CRL of CA %s", caID)
+		}
+	}
+}
+
+// CRLPublishError is returned by Revoke when the certificate is revoked but the CRL is stale
+type CRLPublishError struct {
+	Err error
+}
+
+// Error describes the failed publication
+func (e *CRLPublishError) Error() string {
+	return "failed to publish CRL: " + e.Err.Error()
+}
+
+// Unwrap returns the CRL error
+func (e *CRLPublishError) Unwrap() error {
+	return e.Err
+}
+
+// RevokeDue revokes the renewed certificates whose grace period has ended
+func (s *RevocationService) RevokeDue(ctx context.Context, now time.Time) {
+	certs, err := s.store.ListRevocationsDue(ctx, now)
+	if err != nil {
+		log.Printf("Failed to list scheduled revocations: %v", err)
+		return
+	}
+
+	for _, cert := range certs {
+		_, err := s.Revoke(ctx, cert.SerialNumber, ReasonSuperseded, now)
+		s.auditRevokeDue(cert, err)
+		var publishErr *CRLPublishError
+		switch {
+		case errors.As(err, &publishErr):
+			// revoked, the CRL is retried with the next tick
+			log.Printf("Revoked renewed certificate %s, %v", cert.SerialNumber, err)
+		case err != nil && !errors.Is(err, models.ErrAlreadyRevoked):
+			log.Printf("Failed to revoke renewed certificate %s: %v", cert.SerialNumber, err)
+		case err == nil:
+			log.Printf("Revoked renewed certificate %s after its grace period", cert.SerialNumber)
+		}
+	}
+}
+
+// Start checks for due revocations and retries stale CRLs every interval for the lifetime of the process
+func (s *RevocationService) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			s.RepublishStale(context.Background())
+			s.RevokeDue(context.Background(), now)
+		}
+	}()
+}
+
+// auditRevokeDue records a scheduled revocation, made by the system rather than a caller
+func (s *RevocationService) auditRevokeDue(cert *models.Certificate, err error) {
+	if s.audit == nil || errors.Is(err, models.ErrAlreadyRevoked) {
+		return
+	}
+	rec := &models.AuditRecord{
+		Action: "cert.revoke",
+		Actor:  "system",
+		Params: map[string]interface{}{"serial": cert.SerialNumber, "reason": ReasonSuperseded},
+		Result: models.AuditSuccess,
+		Details: map[string]interface{}{
+			"renewedBy": cert.RenewedBy,
+		},
+	}
+	var publishErr *CRLPublishError
+	if err != nil && !errors.As(err, &publishErr) {
+		rec.Result = models.AuditFailure
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if err := s.audit.Record(rec); err != nil {
+		log.Printf("Failed to write audit record for %s: %v", cert.SerialNumber, err)
+	}
+}
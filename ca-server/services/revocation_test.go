@@ -0,0 +1,166 @@
+package services
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	"ca-server/models"
+)
+
+// TestRevokeRetriesCRL revokes while the CA keys are sealed, the CRL follows once they are unsealed
+func TestRevokeRetriesCRL(t *testing.T) {
+	ctx := context.Background()
+	kek := []byte("correct horse battery staple")
+	store := models.NewMemoryStore()
+	caStore := newSnapshotCAStore(t, kek)
+	ca := newBackendCA(t, FileKeyBackend{}, "ecdsa-P256")
+	if err := caStore.Save(ca, true); err != nil {
+		t.Fatalf("Failed to save CA: %v", err)
+	}
+	now := time.Now()
+	if err := store.SaveCert(ctx, &models.Certificate{SerialNumber: "42", AuthorityKeyID: ca.ID(), NotBefore: now, NotAfter: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("Failed to save certificate: %v", err)
+	}
+	crlService := NewCRLService(store, caStore, time.Hour)
+	ocspService, err := NewOCSPService(store, caStore, time.Hour, "", "")
+	if err != nil {
+		t.Fatalf("Failed to create OCSP service: %v", err)
+	}
+	revoker := NewRevocationService(store, crlService, ocspService, nil)
+
+	if err := caStore.Seal(); err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+	cert, err := revoker.Revoke(ctx, "42", 1, now)
+	var publishErr *CRLPublishError
+	if !errors.As(err, &publishErr) || cert == nil || !cert.IsRevoked() {
+		t.Fatalf("Expected the certificate revoked with a CRL error, got %v, %+v", err, cert)
+	}
+
+	// still sealed, the CRL stays due
+	revoker.RepublishStale(ctx)
+	if len(revoker.stale) != 1 {
+		t.Fatalf("Expected the CRL to stay due while sealed, got %v", revoker.stale)
+	}
+
+	if err := caStore.Unseal(kek); err != nil {
+		t.Fatalf("Failed to unseal: %v", err)
+	}
+	revoker.RepublishStale(ctx)
+	if len(revoker.stale) != 0 {
+		t.Errorf("Expected the CRL to be published, still due: %v", revoker.stale)
+	}
+	published, ok := crlService.crls[ca.ID()]
+	if !ok {
+		t.Fatal("Expected a published CRL")
+	}
+	crl, err := x509.ParseRevocationList(published.der)
+	if err != nil {
+		t.Fatalf("Failed to parse CRL: %v", err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.String() != "42" {
+		t.Errorf("Expected the CRL to list serial 42, got %+v", crl.RevokedCertificateEntries)
+	}
+}
+
+// auditRecords collects the records of the revocations made in the background
+type auditRecords []*models.AuditRecord
+
+func (r *auditRecords) Record(rec *models.AuditRecord) error {
+	*r = append(*r, rec)
+	return nil
+}
+
+// TestRevokeDue revokes renewed certificates once their grace period has ended
+func TestRevokeDue(t *testing.T) {
+	ctx := context.Background()
+	store := models.NewMemoryStore()
+	caStore := newSnapshotCAStore(t, nil)
+	ca := newBackendCA(t, FileKeyBackend{}, "ecdsa-P256")
+	if err := caStore.Save(ca, true); err != nil {
+		t.Fatalf("Failed to save CA: %v", err)
+	}
+	crlService := NewCRLService(store, caStore, time.Hour)
+	ocspService, err := NewOCSPService(store, caStore, time.Hour, "", "")
+	if err != nil {
+		t.Fatalf("Failed to create OCSP service: %v", err)
+	}
+	var audit auditRecords
+	revoker := NewRevocationService(store, crlService, ocspService, &audit)
+
+	now := time.Now()
+	cases := []struct {
+		serial string
+		// revokeAt schedules the revocation relative to now, nil for none
+		revokeAt *time.Duration
+		// revoked is the reason the certificate was revoked with before, -1 for none
+		revoked    int
+		wantReason int
+	}{
+		{"1", ptr(-time.Minute), -1, ReasonSuperseded},
+		{"2", ptr(time.Duration(0)), -1, ReasonSuperseded},
+		{"3", ptr(time.Hour), -1, -1},
+		{"4", ptr(-time.Minute), 1, 1},
+		{"5", nil, -1, -1},
+	}
+	for _, tc := range cases {
+		if err := store.SaveCert(ctx, &models.Certificate{SerialNumber: tc.serial, AuthorityKeyID: ca.ID(), NotBefore: now, NotAfter: now.Add(24 * time.Hour)}); err != nil {
+			t.Fatalf("Failed to save certificate: %v", err)
+		}
+		if tc.revoked >= 0 {
+			if _, err := store.RevokeCert(ctx, tc.serial, tc.revoked, now.Add(-time.Hour)); err != nil {
+				t.Fatalf("Failed to revoke: %v", err)
+			}
+		}
+		if tc.revokeAt != nil {
+			at := now.Add(*tc.revokeAt)
+			if _, err := store.MarkRenewed(ctx, tc.serial, "renewed-"+tc.serial, &at); err != nil {
+				t.Fatalf("Failed to mark renewed: %v", err)
+			}
+		}
+	}
+
+	revoker.RevokeDue(ctx, now)
+	for _, tc := range cases {
+		cert, err := store.GetCert(ctx, tc.serial)
+		if err != nil {
+			t.Fatalf("Failed to get certificate: %v", err)
+		}
+		if tc.wantReason < 0 {
+			if cert.IsRevoked() {
+				t.Errorf("Serial %s: expected it to stay valid", tc.serial)
+			}
+			continue
+		}
+		if !cert.IsRevoked() || cert.RevocationCode != tc.wantReason {
+			t.Errorf("Serial %s: expected revoked with reason %d, got %v", tc.serial, tc.wantReason, cert.RevocationCode)
+		}
+	}
+	if len(audit) != 2 || audit[0].Actor != "system" || audit[0].Result != models.AuditSuccess {
+		t.Errorf("Expected the two due revocations audited as made by the system, got %d records", len(audit))
+	}
+	der, err := crlService.Get(ctx, ca.ID())
+	if err != nil {
+		t.Fatalf("Failed to get CRL: %v", err)
+	}
+	if crl, err := x509.ParseRevocationList(der); err != nil || len(crl.RevokedCertificateEntries) != 3 {
+		t.Errorf("Expected the CRL to list the three revoked certificates, got %v", err)
+	}
+
+	// the remaining one is revoked once its grace period ends
+	revoker.RevokeDue(ctx, now.Add(time.Hour))
+	if cert, _ := store.GetCert(ctx, "3"); !cert.IsRevoked() {
+		t.Error("Expected serial 3 to be revoked after its grace period")
+	}
+	if len(audit) != 3 {
+		t.Errorf("Expected one more audit record, got %d", len(audit))
+	}
+}
+
+// ptr returns a pointer to v
+func ptr[T any](v T) *T {
+	return &v
+}
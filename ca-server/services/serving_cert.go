@@ -0,0 +1,251 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ca-server/utils"
+)
+
+// Sources of the TLS serving certificate
+const (
+	ServingCertFile = "file"
+	ServingCertCA   = "ca"
+)
+
+// CertSource provides the TLS serving certificate of the server
+type CertSource interface {
+	// Load returns a new certificate, or nil when current is still the one to serve
+	Load(current *tls.Certificate) (*tls.Certificate, error)
+}
+
+// ServingCert hands the current serving certificate to tls.Config.GetCertificate.
+// Handshakes in flight keep the certificate they started with, so replacing it needs no restart.
+type ServingCert struct {
+	source CertSource
+	cert   atomic.Pointer[tls.Certificate]
+}
+
+// NewServingCert loads the first certificate from source
+func NewServingCert(source CertSource) (*ServingCert, error) {
+	s := &ServingCert{source: source}
+	cert, err := source.Load(nil)
+	if err != nil {
+		return nil, err
+	}
+	s.cert.Store(cert)
+	return s, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (s *ServingCert) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.cert.Load(), nil
+}
+
+// Refresh asks the source for a replacement, a failure keeps the current certificate
+func (s *ServingCert) Refresh() error {
+	cert, err := s.source.Load(s.cert.Load())
+	if err != nil {
+		return err
+	}
+	if cert != nil {
+		s.cert.Store(cert)
+		log.Printf("Serving certificate replaced, %s valid until %s", cert.Leaf.Subject.CommonName, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Start refreshes the certificate every interval for the lifetime of the process
+func (s *ServingCert) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.Refresh(); err != nil {
+				log.Printf("Failed to refresh serving certificate: %v", err)
+			}
+		}
+	}()
+}
+
+// FileCertSource reloads a PEM certificate and key pair whenever either file changes
+type FileCertSource struct {
+	certPath string
+	keyPath  string
+	mutex    sync.Mutex
+	modTime  time.Time
+	warned   time.Time
+}
+
+// NewFileCertSource creates a source for the key pair at certPath and keyPath
+func NewFileCertSource(certPath, keyPath string) *FileCertSource {
+	return &FileCertSource{certPath: certPath, keyPath: keyPath}
+}
+
+// Load reads the key pair when a file was modified since the last load.
+// A pair that does not match, e.g. while the files are being replaced, is retried on the next call.
+func (f *FileCertSource) Load(current *tls.Certificate) (*tls.Certificate, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	modTime, err := latestModTime(f.certPath, f.keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && modTime.Equal(f.modTime) {
+		if time.Until(current.Leaf.NotAfter) < 7*24*time.Hour && time.Since(f.warned) > 24*time.Hour {
+			f.warned = time.Now()
+			log.Printf("Serving certificate %s expires on %s, replace %s", current.Leaf.Subject.CommonName, current.Leaf.NotAfter.Format(time.RFC3339), f.certPath)
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.certPath, f.keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	f.modTime = modTime
+	return &cert, nil
+}
+
+// latestModTime returns the most recent modification time of paths
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// CACertSource issues the serving certificate from the managed CA and renews it once two thirds of its lifetime have passed.
+// While the CA cannot sign, e.g. when it is sealed or not created yet, a short-lived self-signed certificate stands in.
+type CACertSource struct {
+	issuer    *Issuer
+	keySpec   KeySpec
+	dnsNames  []string
+	ips       []net.IP
+	validDays int
+}
+
+// NewCACertSource creates a source issuing for names, which may be DNS names or IP addresses
+func NewCACertSource(issuer *Issuer, keySpec KeySpec, names []string, validDays int) (*CACertSource, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("the serving certificate needs at least one name")
+	}
+	if validDays <= 0 {
+		return nil, fmt.Errorf("serving certificate lifetime must be positive")
+	}
+
+	s := &CACertSource{issuer: issuer, keySpec: keySpec, validDays: validDays}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			s.ips = append(s.ips, ip)
+		} else if utils.IsValidDNSName(name) {
+			s.dnsNames = append(s.dnsNames, name)
+		} else {
+			return nil, fmt.Errorf("invalid serving certificate name %q", name)
+		}
+	}
+	return s, nil
+}
+
+// Load issues a certificate when there is none, the current one is self-signed or it is due for renewal
+func (c *CACertSource) Load(current *tls.Certificate) (*tls.Certificate, error) {
+	if current != nil && !isSelfSigned(current.Leaf) {
+		lifetime := current.Leaf.NotAfter.Sub(current.Leaf.NotBefore)
+		if time.Now().Before(current.Leaf.NotBefore.Add(lifetime * 2 / 3)) {
+			return nil, nil
+		}
+	}
+
+	key, err := c.keySpec.Generate()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: c.commonName()},
+		NotBefore:   now,
+		NotAfter:    now.Add(days(c.validDays)),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:    c.dnsNames,
+		IPAddresses: c.ips,
+	}
+
+	cert, chain, err := c.issuer.Issue(context.Background(), IssueOptions{Profile: "server"}, tmpl, key.Public())
+	if err != nil {
+		// keep serving the current certificate unless it is a stand-in about to expire
+		if current != nil && (!isSelfSigned(current.Leaf) || time.Until(current.Leaf.NotAfter) > 8*time.Hour) {
+			return nil, err
+		}
+		log.Printf("Cannot issue the serving certificate from the CA (%v), serving a self-signed one until it can", err)
+		return c.selfSigned(key)
+	}
+
+	tlsCert := &tls.Certificate{PrivateKey: key, Leaf: cert}
+	for _, chainCert := range append([]*x509.Certificate{cert}, chain...) {
+		tlsCert.Certificate = append(tlsCert.Certificate, chainCert.Raw)
+	}
+	return tlsCert, nil
+}
+
+// selfSigned creates the stand-in certificate for key, valid for a day
+func (c *CACertSource) selfSigned(key crypto.Signer) (*tls.Certificate, error) {
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:       utils.NewSerialNum(),
+		Subject:            pkix.Name{CommonName: c.commonName()},
+		NotBefore:          now.Add(-time.Minute),
+		NotAfter:           now.Add(24 * time.Hour),
+		KeyUsage:           x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:           c.dnsNames,
+		IPAddresses:        c.ips,
+		SignatureAlgorithm: SignatureAlgorithm(key.Public()),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// commonName is the first DNS name, or the first IP address without one
+func (c *CACertSource) commonName() string {
+	if len(c.dnsNames) > 0 {
+		return c.dnsNames[0]
+	}
+	return c.ips[0].String()
+}
+
+// isSelfSigned reports whether cert is the stand-in rather than one issued by the CA
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
@@ -0,0 +1,77 @@
+package services
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ca-server/models"
+)
+
+func TestCACertSourceRotates(t *testing.T) {
+	dir := t.TempDir()
+	caStore, err := models.NewFileCAStore(filepath.Join(dir, "caCert.pem"), filepath.Join(dir, "caKey.pem"), filepath.Join(dir, "cas"), nil, true)
+	if err != nil {
+		t.Fatalf("Failed to create CA store: %v", err)
+	}
+	issuer := NewIssuer(models.NewMemoryStore(), caStore, "http://localhost")
+	source, err := NewCACertSource(issuer, KeySpec{Algorithm: KeyAlgorithmECDSA, Curve: "P256"}, []string{"ca.home.lab", "127.0.0.1"}, 30)
+	if err != nil {
+		t.Fatalf("Failed to create source: %v", err)
+	}
+
+	// without a CA a self-signed certificate stands in
+	serving, err := NewServingCert(source)
+	if err != nil {
+		t.Fatalf("Failed to load serving certificate: %v", err)
+	}
+	standIn, _ := serving.GetCertificate(nil)
+	if !isSelfSigned(standIn.Leaf) {
+		t.Fatal("Expected a self-signed stand-in without a CA")
+	}
+	if err := serving.Refresh(); err == nil {
+		t.Fatal("Expected the refresh to fail while there is no CA")
+	}
+
+	ca := newBackendCA(t, FileKeyBackend{}, "ecdsa-P256")
+	if err := caStore.Save(ca, true); err != nil {
+		t.Fatalf("Failed to save CA: %v", err)
+	}
+	if err := serving.Refresh(); err != nil {
+		t.Fatalf("Failed to issue serving certificate: %v", err)
+	}
+	issued, _ := serving.GetCertificate(nil)
+	if isSelfSigned(issued.Leaf) || len(issued.Certificate) != 2 {
+		t.Fatalf("Expected a CA issued certificate with its chain, got %d certificates", len(issued.Certificate))
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	if _, err := issued.Leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "ca.home.lab"}); err != nil {
+		t.Fatalf("Serving certificate does not verify: %v", err)
+	}
+
+	// a fresh certificate is kept, one past two thirds of its lifetime is replaced
+	if err := serving.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if current, _ := serving.GetCertificate(nil); current != issued {
+		t.Fatal("Expected a fresh certificate to be kept")
+	}
+	aged := *issued.Leaf
+	aged.NotBefore = time.Now().Add(-21 * 24 * time.Hour)
+	aged.NotAfter = time.Now().Add(9 * 24 * time.Hour)
+	replacement, err := source.Load(&tls.Certificate{Certificate: issued.Certificate, Leaf: &aged})
+	if err != nil || replacement == nil {
+		t.Fatalf("Expected an aged certificate to be replaced, got %v", err)
+	}
+}
+
+func TestCACertSourceRejectsNames(t *testing.T) {
+	for _, names := range [][]string{nil, {"not a name"}} {
+		if _, err := NewCACertSource(nil, KeySpec{}, names, 30); err == nil {
+			t.Fatalf("Expected an error for names %v", names)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"ca-server/models"
+)
+
+// SnapshotVersion is the format written by WriteSnapshot, older servers refuse newer snapshots
+const SnapshotVersion = 1
+
+// ErrNotFresh is returned when restoring into an instance that already holds CAs, certificates or users
+var ErrNotFresh = errors.New("instance already holds CAs, certificates or users")
+
+// Snapshot is a backup of the whole CA state: the CAs with their keys as stored, the certificates
+// with their revocation state, from which CRLs and OCSP responses are rebuilt, users, profiles, API keys and ACME state.
+// The audit log is not part of it, it stays with the instance that recorded it.
+type Snapshot struct {
+	Version   int                `json:"version"`
+	CreatedAt time.Time          `json:"createdAt"`
+	CAs       []models.CAArchive `json:"cas"`
+	models.StoreSnapshot
+}
+
+// SnapshotSummary counts the records of a snapshot
+type SnapshotSummary struct {
+	CAs      int `json:"cas"`
+	Certs    int `json:"certs"`
+	Users    int `json:"users"`
+	Profiles int `json:"profiles"`
+	APIKeys  int `json:"apiKeys"`
+}
+
+// Summary counts the records of the snapshot
+func (s *Snapshot) Summary() SnapshotSummary {
+	return SnapshotSummary{
+		CAs:      len(s.CAs),
+		Certs:    len(s.Certs),
+		Users:    len(s.Users),
+		Profiles: len(s.Profiles),
+		APIKeys:  len(s.APIKeys),
+	}
+}
+
+// TakeSnapshot copies the CAs and the store, each of them consistent in itself
+func TakeSnapshot(ctx context.Context, store models.Store, caStore models.CAStore) (*Snapshot, error) {
+	cas, err := caStore.Export()
+	if err != nil {
+		return nil, fmt.Errorf("failed to export CAs: %w", err)
+	}
+	content, err := store.Snapshot(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy store: %w", err)
+	}
+	return &Snapshot{
+		Version:       SnapshotVersion,
+		CreatedAt:     time.Now().UTC(),
+		CAs:           cas,
+		StoreSnapshot: *content,
+	}, nil
+}
+
+// WriteSnapshot streams snap to w as gzip compressed JSON
+func WriteSnapshot(w io.Writer, snap *Snapshot) error {
+	gz := gzip.NewWriter(w)
+	if err := json.NewEncoder(gz).Encode(snap); err != nil {
+		gz.Close()
+		return err
+	}
+	return gz.Close()
+}
+
+// ReadSnapshot decodes a snapshot written by WriteSnapshot
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot is not gzip compressed: %w", err)
+	}
+	defer gz.Close()
+
+	var snap Snapshot
+	if err := json.NewDecoder(gz).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("snapshot is not valid: %w", err)
+	}
+	if snap.Version < 1 || snap.Version > SnapshotVersion {
+		return nil, fmt.Errorf("snapshot version %d is not supported, this server reads up to %d", snap.Version, SnapshotVersion)
+	}
+	return &snap, nil
+}
+
+// RestoreSnapshot imports the CAs of snap and replaces the content of store with it.
+// Unless force is set the instance must be fresh, holding no CAs, certificates or users yet.
+func RestoreSnapshot(ctx context.Context, snap *Snapshot, store models.Store, caStore models.CAStore, force bool) error {
+	if !force {
+		users, err := store.ListUsers(ctx, models.UserFilter{Limit: 1})
+		if err != nil {
+			return err
+		}
+		certs, err := store.ListCerts(ctx, models.CertFilter{Limit: 1})
+		if err != nil {
+			return err
+		}
+		if len(caStore.List()) > 0 || users.Total > 0 || certs.Total > 0 {
+			return ErrNotFresh
+		}
+	}
+
+	// CAs first, they fail on keys this instance cannot open
+	if err := caStore.Import(snap.CAs); err != nil {
+		return fmt.Errorf("failed to import CAs: %w", err)
+	}
+	if err := store.Restore(ctx, &snap.StoreSnapshot); err != nil {
+		return fmt.Errorf("failed to restore store: %w", err)
+	}
+	return nil
+}
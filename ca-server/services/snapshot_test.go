@@ -0,0 +1,128 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ca-server/models"
+)
+
+// newSnapshotCAStore creates an empty CA store in a fresh directory
+func newSnapshotCAStore(t *testing.T, kek []byte) *models.FileCAStore {
+	t.Helper()
+	dir := t.TempDir()
+	caStore, err := models.NewFileCAStore(filepath.Join(dir, "caCert.pem"), filepath.Join(dir, "caKey.pem"), filepath.Join(dir, "cas"), kek, true)
+	if err != nil {
+		t.Fatalf("Failed to create CA store: %v", err)
+	}
+	return caStore
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+	kek := []byte("correct horse battery staple")
+	store := models.NewMemoryStore()
+	caStore := newSnapshotCAStore(t, kek)
+	ca := newBackendCA(t, FileKeyBackend{}, "ecdsa-P256")
+	if err := caStore.Save(ca, true); err != nil {
+		t.Fatalf("Failed to save CA: %v", err)
+	}
+
+	issuer := NewIssuer(store, caStore, "http://localhost")
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		Subject:   pkix.Name{CommonName: "web.home.lab"},
+		DNSNames:  []string{"web.home.lab"},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(24 * time.Hour),
+	}
+	cert, _, err := issuer.Sign(ctx, "", tmpl, &key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to issue: %v", err)
+	}
+	if _, err := store.RevokeCert(ctx, cert.SerialNumber.String(), 1, time.Now()); err != nil {
+		t.Fatalf("Failed to revoke: %v", err)
+	}
+	if err := store.CreateUser(ctx, models.NewUser("", "Alice", "alice@home.lab")); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	snap, err := TakeSnapshot(ctx, store, caStore)
+	if err != nil {
+		t.Fatalf("Failed to take snapshot: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, snap); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	if strings.Contains(buf.String(), "PRIVATE KEY") {
+		t.Fatal("Expected the snapshot to be compressed")
+	}
+	data := buf.Bytes()
+
+	// a fresh instance with the same KEK takes it, on another store backend
+	fresh, err := models.NewSQLiteStore(filepath.Join(t.TempDir(), "ca.db"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer fresh.Close()
+	freshCAs := newSnapshotCAStore(t, kek)
+	read, err := ReadSnapshot(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+	if summary := read.Summary(); summary.CAs != 1 || summary.Certs != 1 || summary.Users != 1 {
+		t.Fatalf("Unexpected snapshot content %+v", summary)
+	}
+	if err := RestoreSnapshot(ctx, read, fresh, freshCAs, false); err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+
+	restoredCA, err := freshCAs.Get()
+	if err != nil || restoredCA.ID() != ca.ID() {
+		t.Fatalf("Expected the issuing CA to be restored, got %v", err)
+	}
+	if freshCAs.Sealed() {
+		t.Error("Expected the restored keys to open with the KEK")
+	}
+	crl, err := NewCRLService(fresh, freshCAs, time.Hour).Get(ctx, "")
+	if err != nil {
+		t.Fatalf("Failed to build CRL: %v", err)
+	}
+	list, err := x509.ParseRevocationList(crl)
+	if err != nil || len(list.RevokedCertificateEntries) != 1 || list.RevokedCertificateEntries[0].SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		t.Errorf("Expected the revoked certificate on the CRL of the restored CA, got %v", err)
+	}
+
+	// restoring again needs force
+	if err := RestoreSnapshot(ctx, read, fresh, freshCAs, false); !errors.Is(err, ErrNotFresh) {
+		t.Errorf("Expected ErrNotFresh, got %v", err)
+	}
+	if err := RestoreSnapshot(ctx, read, fresh, freshCAs, true); err != nil {
+		t.Errorf("Expected a forced restore to succeed, got %v", err)
+	}
+
+	// keys sealed with another KEK are refused before anything is written
+	other := models.NewMemoryStore()
+	otherCAs := newSnapshotCAStore(t, []byte("another passphrase entirely"))
+	if err := RestoreSnapshot(ctx, read, other, otherCAs, false); err == nil {
+		t.Error("Expected keys sealed with another KEK to be refused")
+	}
+	if len(otherCAs.List()) != 0 {
+		t.Error("Expected a refused restore to leave the CA store untouched")
+	}
+
+	if _, err := ReadSnapshot(strings.NewReader("not a snapshot")); err == nil {
+		t.Error("Expected garbage to be refused")
+	}
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"time"
+
+	"ca-server/models"
+)
+
+// ReasonPrivilegeWithdrawn is the RFC 5280 CRLReason of the client certificates of a disabled user
+const ReasonPrivilegeWithdrawn = 9
+
+// UserRevocations lists the credentials revoked when a user was disabled
+type UserRevocations struct {
+	APIKeys []string `json:"apiKeys"`
+	Certs   []string `json:"certs"`
+}
+
+// UserLifecycle carries out what a status change of a user means for its credentials
+type UserLifecycle struct {
+	store   models.Store
+	revoker *RevocationService
+}
+
+// NewUserLifecycle creates a user lifecycle revoking certificates through revoker
+func NewUserLifecycle(store models.Store, revoker *RevocationService) *UserLifecycle {
+	return &UserLifecycle{
+		store:   store,
+		revoker: revoker,
+	}
+}
+
+// Disabled revokes the API keys of a disabled user and the client certificates bound to it, see CertUser.
+// Revoked and expired credentials are skipped, so calling it again after a failure finishes the job.
+func (l *UserLifecycle) Disabled(ctx context.Context, user *models.User) (*UserRevocations, error) {
+	revoked := &UserRevocations{APIKeys: []string{}, Certs: []string{}}
+	now := time.Now()
+
+	keys, err := l.store.ListAPIKeys(ctx, user.ID)
+	if err != nil {
+		return revoked, err
+	}
+	for _, key := range keys {
+		if !key.Active(now) {
+			continue
+		}
+		if _, err := l.store.RevokeAPIKey(ctx, key.ID, now); err != nil {
+			return revoked, err
+		}
+		revoked.APIKeys = append(revoked.APIKeys, key.ID)
+	}
+
+	isCA := false
+	certs, err := l.store.ListCerts(ctx, models.CertFilter{IsCA: &isCA, ExpiresAfter: now})
+	if err != nil {
+		return revoked, err
+	}
+	var publishErr error
+	for _, cert := range certs.Items {
+		if cert.IsRevoked() || cert.UserID != user.ID {
+			continue
+		}
+		_, err := l.revoker.Revoke(ctx, cert.SerialNumber, ReasonPrivilegeWithdrawn, now)
+		var crlErr *CRLPublishError
+		switch {
+		case errors.As(err, &crlErr):
+			// revoked all the same, the CRL catches up with the next publication
+			publishErr = err
+		case errors.Is(err, models.ErrAlreadyRevoked):
+			continue
+		case err != nil:
+			return revoked, err
+		}
+		revoked.Certs = append(revoked.Certs, cert.SerialNumber)
+	}
+	return revoked, publishErr
+}
+
+// hasExtKeyUsage reports whether cert may be used for usage
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage || u == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
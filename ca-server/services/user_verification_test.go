@@ -0,0 +1,54 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"ca-server/models"
+)
+
+func TestUserVerifier(t *testing.T) {
+	ctx := context.Background()
+	store := models.NewMemoryStore()
+	verifier, err := NewUserVerifier(store, []byte("secret"), time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create verifier: %v", err)
+	}
+	user := &models.User{Name: "Grace", Email: "Grace@home.lab", Status: models.UserPending}
+	if err := store.CreateUser(ctx, user); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	now := time.Now()
+	token, expires, err := verifier.Token(user, now)
+	if err != nil || !expires.After(now) {
+		t.Fatalf("Failed to issue token: %v, expires %v", err, expires)
+	}
+	other, _ := NewUserVerifier(store, []byte("other"), time.Hour)
+
+	cases := []struct {
+		name     string
+		verifier *UserVerifier
+		at       time.Time
+		err      error
+	}{
+		{"expired", verifier, now.Add(time.Hour + time.Second), ErrInvalidVerification},
+		{"other secret", other, now, ErrInvalidVerification},
+		{"valid", verifier, now.Add(time.Minute), nil},
+		{"used", verifier, now.Add(time.Minute), ErrInvalidVerification},
+	}
+	for _, tc := range cases {
+		if _, err := tc.verifier.Verify(ctx, token, tc.at); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+
+	active, _ := store.GetUser(ctx, user.ID)
+	if active.Status != models.UserActive {
+		t.Errorf("Expected the user to be active, got %q", active.Status)
+	}
+	if _, _, err := verifier.Token(active, now); !errors.Is(err, ErrNotPending) {
+		t.Errorf("Expected ErrNotPending for an active user, got %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package utils
+
+import "strings"
+
+// IsValidDNSName reports whether name is a valid lower-case hostname,
+// optionally with a leading wildcard label
+func IsValidDNSName(name string) bool {
+	name = strings.TrimPrefix(name, "*.")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, ch := range label {
+			switch {
+			case ch >= 'a' && ch <= 'z', ch >= '0' && ch <= '9', ch == '-':
+			default:
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// DomainAllowed reports whether name equals or is a subdomain of one of domains.
+// An empty list allows any name.
+func DomainAllowed(name string, domains []string) bool {
+	if len(domains) == 0 {
+		return true
+	}
+
+	name = strings.ToLower(strings.TrimPrefix(name, "*."))
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
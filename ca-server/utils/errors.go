@@ -47,7 +47,22 @@ func NotFound(c *gin.Context, message string) {
 	RespondWithError(c, http.StatusNotFound, message, "")
 }
 
+// Conflict sends a 409 Conflict error
+func Conflict(c *gin.Context, message string) {
+	RespondWithError(c, http.StatusConflict, message, "")
+}
+
+// PreconditionFailed sends a 412 Precondition Failed error
+func PreconditionFailed(c *gin.Context, message string) {
+	RespondWithError(c, http.StatusPreconditionFailed, message, "")
+}
+
 // InternalServerError sends a 500 Internal Server Error
 func InternalServerError(c *gin.Context, err string) {
 	RespondWithError(c, http.StatusInternalServerError, "Internal server error", err)
 }
+
+// ServiceUnavailable sends a 503 Service Unavailable error
+func ServiceUnavailable(c *gin.Context, message, err string) {
+	RespondWithError(c, http.StatusServiceUnavailable, message, err)
+}
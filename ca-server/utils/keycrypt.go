@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// SealedKeyPEMType is the PEM block type of a private key encrypted with EncryptPrivateKeyPEM
+const SealedKeyPEMType = "SEALED PRIVATE KEY"
+
+// scrypt cost parameters, about 100ms per key on current hardware
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+// ErrIncorrectPassphrase is returned when a sealed key cannot be decrypted with the given passphrase
+var ErrIncorrectPassphrase = errors.New("incorrect key encryption passphrase")
+
+// EncryptPrivateKeyPEM encrypts the PKCS#8 form of key with AES-256-GCM under a key derived
+// from passphrase with scrypt. The salt and nonce are kept in the PEM headers.
+func EncryptPrivateKeyPEM(key crypto.Signer, passphrase []byte) ([]byte, error) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := sealedKeyAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type: SealedKeyPEMType,
+		Headers: map[string]string{
+			"Cipher": "AES-256-GCM",
+			"KDF":    fmt.Sprintf("scrypt N=%d r=%d p=%d", scryptN, scryptR, scryptP),
+			"Salt":   hex.EncodeToString(salt),
+			"Nonce":  hex.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, keyDER, []byte(SealedKeyPEMType)),
+	}), nil
+}
+
+// DecryptPrivateKeyPEM decrypts a key written by EncryptPrivateKeyPEM
+func DecryptPrivateKeyPEM(data, passphrase []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != SealedKeyPEMType {
+		return nil, errors.New("no sealed private key PEM block found")
+	}
+
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil || len(salt) == 0 {
+		return nil, errors.New("sealed key has an invalid salt")
+	}
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, errors.New("sealed key has an invalid nonce")
+	}
+	aead, err := sealedKeyAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("sealed key has an invalid nonce")
+	}
+
+	keyDER, err := aead.Open(nil, nonce, block.Bytes, []byte(SealedKeyPEMType))
+	if err != nil {
+		return nil, ErrIncorrectPassphrase
+	}
+	return ParsePrivateKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+}
+
+// IsSealedKeyPEM reports whether data holds a key encrypted with EncryptPrivateKeyPEM
+func IsSealedKeyPEM(data []byte) bool {
+	block, _ := pem.Decode(data)
+	return block != nil && block.Type == SealedKeyPEMType
+}
+
+// sealedKeyAEAD derives the AES-256-GCM cipher for a passphrase and salt
+func sealedKeyAEAD(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"testing"
+)
+
+func TestSealedKeyPEM(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	for _, key := range []crypto.Signer{ecKey, rsaKey, edKey} {
+		sealed, err := EncryptPrivateKeyPEM(key, passphrase)
+		if err != nil {
+			t.Fatalf("%T: failed to seal: %v", key, err)
+		}
+		if !IsSealedKeyPEM(sealed) {
+			t.Errorf("%T: expected a sealed key PEM", key)
+		}
+		opened, err := DecryptPrivateKeyPEM(sealed, passphrase)
+		if err != nil {
+			t.Fatalf("%T: failed to unseal: %v", key, err)
+		}
+		if !PublicKeysEqual(opened.Public(), key.Public()) {
+			t.Errorf("%T: expected the unsealed key to match", key)
+		}
+	}
+
+	sealed, err := EncryptPrivateKeyPEM(ecKey, passphrase)
+	if err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+	if again, _ := EncryptPrivateKeyPEM(ecKey, passphrase); bytes.Equal(again, sealed) {
+		t.Error("Expected a fresh salt and nonce for every seal")
+	}
+	// modify returns a copy of the sealed PEM changed by fn
+	modify := func(fn func(block *pem.Block)) []byte {
+		block, _ := pem.Decode(sealed)
+		headers := make(map[string]string)
+		for k, v := range block.Headers {
+			headers[k] = v
+		}
+		block = &pem.Block{Type: block.Type, Headers: headers, Bytes: bytes.Clone(block.Bytes)}
+		fn(block)
+		return pem.EncodeToMemory(block)
+	}
+
+	cases := []struct {
+		name       string
+		data       []byte
+		passphrase []byte
+		err        error
+	}{
+		{"wrong passphrase", sealed, []byte("wrong"), ErrIncorrectPassphrase},
+		{"empty passphrase", sealed, nil, ErrIncorrectPassphrase},
+		{"tampered ciphertext", modify(func(b *pem.Block) { b.Bytes[0] ^= 1 }), passphrase, ErrIncorrectPassphrase},
+		{"other salt", modify(func(b *pem.Block) { b.Headers["Salt"] = "00112233445566778899aabbccddeeff" }), passphrase, ErrIncorrectPassphrase},
+		{"relabelled block", modify(func(b *pem.Block) { b.Type = "PRIVATE KEY" }), passphrase, nil},
+		{"missing salt", modify(func(b *pem.Block) { delete(b.Headers, "Salt") }), passphrase, nil},
+		{"short nonce", modify(func(b *pem.Block) { b.Headers["Nonce"] = "0011" }), passphrase, nil},
+		{"not PEM", []byte("not a key"), passphrase, nil},
+	}
+	for _, tc := range cases {
+		key, err := DecryptPrivateKeyPEM(tc.data, tc.passphrase)
+		if err == nil || key != nil {
+			t.Errorf("%s: expected the key to stay sealed", tc.name)
+			continue
+		}
+		if tc.err != nil && !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+}